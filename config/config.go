@@ -1,10 +1,15 @@
 package config
 
 import (
+	"fmt"
 	"log"
+	"net"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/capactiyvirus/stripe-backend/models"
 	"github.com/joho/godotenv"
 )
 
@@ -13,17 +18,107 @@ type Config struct {
 	// Stripe configs
 	StripeSecretKey      string
 	StripePublishableKey string
-	StripeWebhookSecret  string
+	StripeWebhookSecret  string // Comma-separated to accept several secrets while rotating
+	StripeMode           string // STRIPE_MODE; StripeModeFake answers Stripe calls in memory instead of calling Stripe
+
+	// AutomaticPaymentMethods (ENABLE_AUTOMATIC_PAYMENT_METHODS) lets Stripe offer every payment method enabled
+	// in the dashboard, such as Apple Pay and Google Pay, instead of cards only
+	AutomaticPaymentMethods bool
+
+	// Webhook configs
+	WebhookEventRetention time.Duration // WEBHOOK_EVENT_RETENTION, how long raw webhook events are kept for replay; default 30d, zero stops keeping them
+	WebhookMaxBodyBytes   int64         // WEBHOOK_MAX_BODY_BYTES, largest webhook payload accepted; default DefaultWebhookMaxBodyBytes
 
 	// Server configs
-	Port        string
-	Environment string
+	Port                 string
+	Environment          string
+	ServerReadTimeout    time.Duration // SERVER_READ_TIMEOUT, default 15s
+	IdempotencyMaxBody   int64         // IDEMPOTENCY_MAX_BODY_BYTES, largest Idempotency-Key request body buffered; default DefaultIdempotencyMaxBodyBytes
+	ServerWriteTimeout   time.Duration // SERVER_WRITE_TIMEOUT, default 15s; raise it for large exports
+	ServerIdleTimeout    time.Duration // SERVER_IDLE_TIMEOUT, default 60s
+	ServerMaxHeaderBytes int           // SERVER_MAX_HEADER_BYTES, default 1 MB
+
+	// Database configs
+	DatabaseURL       string
+	StoreSnapshotPath string // In-memory store is loaded from and saved to this file when set
 
 	// Additional configs
 	CorsAllowedOrigins []string
 	LogLevel           string
+
+	// Admin configs
+	AdminAPIKeys []string // Admin routes require one of these in the X-API-Key header
+	AdminEmail   string   // ADMIN_EMAIL, where dispute notifications are sent; unset sends none
+
+	// Rate limit configs
+	RateLimitRPS   float64 // Requests per second allowed per client IP on /api; zero disables the limit
+	RateLimitBurst int     // Requests a client IP can make at once before being limited
+
+	// TrustedProxies are the networks (TRUSTED_PROXIES) whose X-Forwarded-For header is believed
+	// for the client IP; requests from anywhere else are keyed on their connection's address
+	TrustedProxies []*net.IPNet
+
+	// Tax configs
+	RequireTaxExemptionID bool
+
+	// Pricing configs
+	DefaultCurrency string // DEFAULT_CURRENCY, the currency of orders and payments that don't name one; default DefaultCurrency
+	VerifyPrices    bool   // VERIFY_PRICES; item prices must match their Stripe product's default price
+	MaxOrderAmount  int64  // MAX_ORDER_AMOUNT_CENTS, the largest order total in the currency's smallest unit; zero disables the cap
+
+	// Email configs
+	EmailOnOrderCreate  bool
+	EmailResendInterval time.Duration // EMAIL_RESEND_INTERVAL, the minimum time between resends of an order's emails; default 5m
+
+	// Tracking configs
+	TrackingTokenSecret string // Tracking lookups require a token signed with this secret when set
+
+	// Download configs
+	DownloadTokenSecret string        // Signs emailed download links; downloads are unavailable without it
+	DownloadLinkTTL     time.Duration // DOWNLOAD_LINK_TTL, how long emailed download links work; default 7d
+
+	// Refund configs
+	MaxRefundAge        time.Duration // Orders paid longer ago than this can't be refunded; zero disables the limit
+	RefundOverrideToken string        // Lets a refund past MaxRefundAge through when sent as X-Refund-Override-Token
+
+	// Hook configs
+	HookErrorsFatal bool // Order creation and fulfillment fail when a lifecycle hook returns an error
+
+	// Idempotency configs
+	IdempotencyTTL time.Duration // How long responses to Idempotency-Key requests are replayed
+
+	// Product configs
+	ProductCatalogPath string        // Products are served from, and edited in, this JSON file when set
+	ProductCacheTTL    time.Duration // PRODUCT_CACHE_TTL, how long Stripe products are cached; default 5m, zero disables the cache
+
+	// Readiness configs
+	ReadyCheckStripe bool // /ready also makes a Stripe API call to check the secret key
+
+	// Branding configs, used in customer emails
+	CompanyName     string // COMPANY_NAME, default DefaultCompanyName
+	SupportEmail    string // SUPPORT_EMAIL, default DefaultSupportEmail
+	TrackingBaseURL string // TRACKING_BASE_URL, the storefront page emailed tracking links open; default DefaultTrackingBaseURL
 }
 
+// StripeModeFake is the STRIPE_MODE that swaps Stripe for an in-memory fake, for demos and local testing
+const StripeModeFake = "fake"
+
+// DefaultCurrency is the DEFAULT_CURRENCY used when none is set
+const DefaultCurrency = "usd"
+
+// DefaultWebhookMaxBodyBytes is the WEBHOOK_MAX_BODY_BYTES used when none is set, 256 KB
+const DefaultWebhookMaxBodyBytes = 256 << 10
+
+// DefaultIdempotencyMaxBodyBytes is the IDEMPOTENCY_MAX_BODY_BYTES used when none is set, 1 MB
+const DefaultIdempotencyMaxBodyBytes = 1 << 20
+
+// Branding defaults for stores that don't set their own
+const (
+	DefaultCompanyName     = "PlannerPalette"
+	DefaultSupportEmail    = "support@yourdomain.com"
+	DefaultTrackingBaseURL = "https://yourdomain.com/track-order"
+)
+
 // Load initializes configuration from environment variables and .env file
 func Load() *Config {
 	// Load .env file if it exists
@@ -36,10 +131,58 @@ func Load() *Config {
 		LogLevel:    getEnv("LOG_LEVEL", "info"),
 	}
 
-	// Required Stripe keys
-	config.StripeSecretKey = mustGetEnv("STRIPE_SECRET_KEY")
+	// HTTP server limits
+	config.ServerReadTimeout = mustParseDuration("SERVER_READ_TIMEOUT", "15s")
+	config.ServerWriteTimeout = mustParseDuration("SERVER_WRITE_TIMEOUT", "15s")
+	config.ServerIdleTimeout = mustParseDuration("SERVER_IDLE_TIMEOUT", "60s")
+	maxHeaderBytes, err := strconv.Atoi(getEnv("SERVER_MAX_HEADER_BYTES", "1048576"))
+	if err != nil || maxHeaderBytes < 1 {
+		log.Fatalf("Invalid SERVER_MAX_HEADER_BYTES: %q", getEnv("SERVER_MAX_HEADER_BYTES", "1048576"))
+	}
+	config.ServerMaxHeaderBytes = maxHeaderBytes
+
+	config.DatabaseURL = getEnv("DATABASE_URL", "")
+	config.StoreSnapshotPath = getEnv("STORE_SNAPSHOT_PATH", "")
+
+	// Required Stripe keys, unless Stripe is faked
+	config.StripeMode = getEnv("STRIPE_MODE", "")
+	if config.StripeMode != "" && config.StripeMode != StripeModeFake {
+		log.Fatalf("Invalid STRIPE_MODE: %q", config.StripeMode)
+	}
+	if config.StripeMode == StripeModeFake && config.Environment == "production" {
+		log.Fatalf("STRIPE_MODE=fake can't be used with ENVIRONMENT=production")
+	}
+	if config.StripeMode == StripeModeFake {
+		config.StripeSecretKey = getEnv("STRIPE_SECRET_KEY", "")
+	} else {
+		config.StripeSecretKey = mustGetEnv("STRIPE_SECRET_KEY")
+	}
 	config.StripePublishableKey = getEnv("STRIPE_PUBLISHABLE_KEY", "")
 	config.StripeWebhookSecret = getEnv("STRIPE_WEBHOOK_SECRET", "")
+	if config.StripeMode != StripeModeFake && len(config.WebhookSecrets()) == 0 {
+		log.Fatalf("Required environment variable not set: STRIPE_WEBHOOK_SECRET")
+	}
+	config.AutomaticPaymentMethods = getEnv("ENABLE_AUTOMATIC_PAYMENT_METHODS", "false") == "true"
+
+	webhookEventRetention, err := parseAge(getEnv("WEBHOOK_EVENT_RETENTION", "30d"))
+	if err != nil {
+		log.Fatalf("Invalid WEBHOOK_EVENT_RETENTION: %v", err)
+	}
+	config.WebhookEventRetention = webhookEventRetention
+
+	webhookMaxBody := getEnv("WEBHOOK_MAX_BODY_BYTES", strconv.Itoa(DefaultWebhookMaxBodyBytes))
+	webhookMaxBodyBytes, err := strconv.ParseInt(webhookMaxBody, 10, 64)
+	if err != nil || webhookMaxBodyBytes < 1 {
+		log.Fatalf("Invalid WEBHOOK_MAX_BODY_BYTES: %q", webhookMaxBody)
+	}
+	config.WebhookMaxBodyBytes = webhookMaxBodyBytes
+
+	idempotencyMaxBody := getEnv("IDEMPOTENCY_MAX_BODY_BYTES", strconv.Itoa(DefaultIdempotencyMaxBodyBytes))
+	idempotencyMaxBodyBytes, err := strconv.ParseInt(idempotencyMaxBody, 10, 64)
+	if err != nil || idempotencyMaxBodyBytes < 1 {
+		log.Fatalf("Invalid IDEMPOTENCY_MAX_BODY_BYTES: %q", idempotencyMaxBody)
+	}
+	config.IdempotencyMaxBody = idempotencyMaxBodyBytes
 
 	// Parse CORS allowed origins
 	corsOrigins := getEnv("CORS_ALLOWED_ORIGINS", "")
@@ -49,9 +192,104 @@ func Load() *Config {
 		config.CorsAllowedOrigins = []string{"*"}
 	}
 
+	// Admin routes are locked until at least one key is configured
+	for _, key := range strings.Split(getEnv("ADMIN_API_KEYS", ""), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			config.AdminAPIKeys = append(config.AdminAPIKeys, key)
+		}
+	}
+	config.AdminEmail = getEnv("ADMIN_EMAIL", "")
+
+	// Per-IP rate limit on the API
+	rateLimitRPS, err := strconv.ParseFloat(getEnv("RATE_LIMIT_RPS", "10"), 64)
+	if err != nil || rateLimitRPS < 0 {
+		log.Fatalf("Invalid RATE_LIMIT_RPS: %q", getEnv("RATE_LIMIT_RPS", "10"))
+	}
+	rateLimitBurst, err := strconv.Atoi(getEnv("RATE_LIMIT_BURST", "20"))
+	if err != nil || rateLimitBurst < 1 {
+		log.Fatalf("Invalid RATE_LIMIT_BURST: %q", getEnv("RATE_LIMIT_BURST", "20"))
+	}
+	config.RateLimitRPS = rateLimitRPS
+	config.RateLimitBurst = rateLimitBurst
+
+	trustedProxies, err := parseNetworks(getEnv("TRUSTED_PROXIES", ""))
+	if err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+	config.TrustedProxies = trustedProxies
+
+	// Tax exemption claims must carry an exemption ID when required
+	config.RequireTaxExemptionID = getEnv("REQUIRE_TAX_EXEMPTION_ID", "false") == "true"
+
+	// Item prices come from Stripe rather than the client when verified
+	defaultCurrency, err := models.ValidateCurrency(getEnv("DEFAULT_CURRENCY", DefaultCurrency))
+	if err != nil {
+		log.Fatalf("Invalid DEFAULT_CURRENCY: %v", err)
+	}
+	config.DefaultCurrency = defaultCurrency
+	config.VerifyPrices = getEnv("VERIFY_PRICES", "false") == "true"
+
+	// Totals above the cap are almost certainly a client bug; the default is Stripe's own limit for USD
+	maxOrderAmount, err := strconv.ParseInt(getEnv("MAX_ORDER_AMOUNT_CENTS", "99999999"), 10, 64)
+	if err != nil || maxOrderAmount < 0 {
+		log.Fatalf("Invalid MAX_ORDER_AMOUNT_CENTS: %q", getEnv("MAX_ORDER_AMOUNT_CENTS", "99999999"))
+	}
+	config.MaxOrderAmount = maxOrderAmount
+
+	// Send the order confirmation at creation instead of only the payment confirmation
+	config.EmailOnOrderCreate = getEnv("EMAIL_ON_ORDER_CREATE", "false") == "true"
+	config.EmailResendInterval = mustParseDuration("EMAIL_RESEND_INTERVAL", "5m")
+
+	config.ProductCatalogPath = getEnv("PRODUCT_CATALOG_PATH", "")
+	config.ProductCacheTTL = mustParseDuration("PRODUCT_CACHE_TTL", "5m")
+
+	config.TrackingTokenSecret = getEnv("TRACKING_TOKEN_SECRET", "")
+
+	// Download links get their own key, so a leaked tracking key can't sign downloads
+	config.DownloadTokenSecret = getEnv("DOWNLOAD_TOKEN_SECRET", "")
+	downloadLinkTTL, err := parseAge(getEnv("DOWNLOAD_LINK_TTL", "7d"))
+	if err != nil || downloadLinkTTL <= 0 {
+		log.Fatalf("Invalid DOWNLOAD_LINK_TTL: %q", getEnv("DOWNLOAD_LINK_TTL", "7d"))
+	}
+	config.DownloadLinkTTL = downloadLinkTTL
+
+	// Refunds of old orders are blocked unless explicitly overridden
+	maxRefundAge, err := parseAge(getEnv("MAX_REFUND_AGE", "180d"))
+	if err != nil {
+		log.Fatalf("Invalid MAX_REFUND_AGE: %v", err)
+	}
+	config.MaxRefundAge = maxRefundAge
+	config.RefundOverrideToken = getEnv("REFUND_OVERRIDE_TOKEN", "")
+
+	config.HookErrorsFatal = getEnv("HOOK_ERRORS_FATAL", "false") == "true"
+
+	idempotencyTTL, err := parseAge(getEnv("IDEMPOTENCY_TTL", "24h"))
+	if err != nil {
+		log.Fatalf("Invalid IDEMPOTENCY_TTL: %v", err)
+	}
+	config.IdempotencyTTL = idempotencyTTL
+
+	config.ReadyCheckStripe = getEnv("READY_CHECK_STRIPE", "false") == "true"
+
+	config.CompanyName = getEnv("COMPANY_NAME", DefaultCompanyName)
+	config.SupportEmail = getEnv("SUPPORT_EMAIL", DefaultSupportEmail)
+	config.TrackingBaseURL = getEnv("TRACKING_BASE_URL", DefaultTrackingBaseURL)
+
 	return config
 }
 
+// WebhookSecrets returns the non-empty secrets in StripeWebhookSecret, so a stray comma can't make
+// an empty string a valid signing key
+func (c *Config) WebhookSecrets() []string {
+	var secrets []string
+	for _, secret := range strings.Split(c.StripeWebhookSecret, ",") {
+		if secret = strings.TrimSpace(secret); secret != "" {
+			secrets = append(secrets, secret)
+		}
+	}
+	return secrets
+}
+
 // getEnv gets an environment variable or returns a default value
 func getEnv(key, defaultValue string) string {
 	value := os.Getenv(key)
@@ -61,6 +299,66 @@ func getEnv(key, defaultValue string) string {
 	return value
 }
 
+// parseAge parses a duration such as "72h", also accepting whole days such as "180d". Ages can't be negative.
+func parseAge(value string) (time.Duration, error) {
+	var age time.Duration
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		age = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		if age, err = time.ParseDuration(value); err != nil {
+			return 0, err
+		}
+	}
+	if age < 0 {
+		return 0, fmt.Errorf("%q is negative", value)
+	}
+	return age, nil
+}
+
+// parseNetworks parses a comma-separated list of CIDR networks or single IP addresses
+func parseNetworks(value string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an IP address or CIDR network", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP address or CIDR network", entry)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// mustParseDuration parses an environment variable such as "30s" with time.ParseDuration, exiting if it's invalid
+func mustParseDuration(key, defaultValue string) time.Duration {
+	value := getEnv(key, defaultValue)
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		log.Fatalf("Invalid %s: %q", key, value)
+	}
+	return duration
+}
+
 // mustGetEnv gets an environment variable or panics if it's not set
 func mustGetEnv(key string) string {
 	value := os.Getenv(key)
@@ -68,4 +366,4 @@ func mustGetEnv(key string) string {
 		log.Fatalf("Required environment variable not set: %s", key)
 	}
 	return value
-}
\ No newline at end of file
+}
@@ -0,0 +1,33 @@
+-- db/init/02-payment-details.sql
+-- Adds the columns the Postgres store needs beyond the initial schema.
+-- Safe to run against an existing database.
+
+-- Payments can be partially captured across several charges
+ALTER TYPE payment_status ADD VALUE IF NOT EXISTS 'partially_paid';
+
+-- Stripe fees and captured charges
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS stripe_fee BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS net_amount BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS amount_captured BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS charge_ids TEXT[] NOT NULL DEFAULT '{}';
+
+-- Product thumbnails and item ordering
+ALTER TABLE order_items ADD COLUMN IF NOT EXISTS image_url TEXT;
+ALTER TABLE order_items ADD COLUMN IF NOT EXISTS position INTEGER NOT NULL DEFAULT 0;
+
+-- Event IDs are generated by the application (evt_...) and preserved on migration
+ALTER TABLE payment_events ALTER COLUMN id DROP DEFAULT;
+ALTER TABLE payment_events ALTER COLUMN id TYPE VARCHAR(64) USING id::text;
+ALTER TABLE payment_events ALTER COLUMN id SET DEFAULT uuid_generate_v4()::text;
+
+-- Let upserts keep the updated_at they were given (SET LOCAL app.preserve_timestamps = 'on'),
+-- so migrated orders keep their original timestamps
+CREATE OR REPLACE FUNCTION update_updated_at_column()
+RETURNS TRIGGER AS $$
+BEGIN
+    IF current_setting('app.preserve_timestamps', true) IS DISTINCT FROM 'on' THEN
+        NEW.updated_at = NOW();
+    END IF;
+    RETURN NEW;
+END;
+$$ language 'plpgsql';
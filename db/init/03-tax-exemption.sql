@@ -0,0 +1,6 @@
+-- db/init/03-tax-exemption.sql
+-- Tax exemption details for B2B customers, kept for audit.
+-- Safe to run against an existing database.
+
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS customer_tax_exempt BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS customer_tax_exemption_id VARCHAR(100);
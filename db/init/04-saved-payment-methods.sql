@@ -0,0 +1,6 @@
+-- db/init/04-saved-payment-methods.sql
+-- Payment methods saved with setup_future_usage for later off-session charges.
+-- Safe to run against an existing database.
+
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS stripe_customer_id VARCHAR(255);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS saved_payment_method_id VARCHAR(255);
@@ -0,0 +1,8 @@
+-- db/init/05-refunds.sql
+-- Stripe refunds, which may return only part of a payment.
+-- Safe to run against an existing database.
+
+ALTER TYPE payment_status ADD VALUE IF NOT EXISTS 'partially_refunded';
+
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS stripe_refund_id VARCHAR(255);
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS amount_refunded BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,8 @@
+-- db/init/06-processed-webhook-events.sql
+-- Stripe webhook events already handled, so retried deliveries are skipped.
+-- Safe to run against an existing database.
+
+CREATE TABLE IF NOT EXISTS processed_webhook_events (
+    event_id VARCHAR(255) PRIMARY KEY,
+    processed_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
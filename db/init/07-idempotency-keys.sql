@@ -0,0 +1,13 @@
+-- db/init/07-idempotency-keys.sql
+-- Responses replayed for repeated Idempotency-Key requests.
+-- Safe to run against an existing database.
+
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    key TEXT PRIMARY KEY,
+    status_code INTEGER NOT NULL,
+    content_type TEXT NOT NULL DEFAULT '',
+    body BYTEA NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expires_at ON idempotency_keys(expires_at);
@@ -0,0 +1,11 @@
+-- db/init/08-order-idempotency-keys.sql
+-- Orders created for CreateOrder Idempotency-Key headers, so a repeated key returns the same order.
+-- Safe to run against an existing database.
+
+CREATE TABLE IF NOT EXISTS order_idempotency_keys (
+    key TEXT PRIMARY KEY,
+    order_id VARCHAR(50) NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_order_idempotency_keys_expires_at ON order_idempotency_keys(expires_at);
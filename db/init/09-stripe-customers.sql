@@ -0,0 +1,9 @@
+-- db/init/09-stripe-customers.sql
+-- The Stripe customer each email's orders are charged to, so returning buyers reuse it.
+-- Safe to run against an existing database.
+
+CREATE TABLE IF NOT EXISTS stripe_customers (
+    email VARCHAR(255) PRIMARY KEY,
+    stripe_customer_id VARCHAR(255) NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
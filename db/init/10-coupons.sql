@@ -0,0 +1,16 @@
+-- db/init/10-coupons.sql
+-- Coupon codes and the discount they applied to each order.
+-- Safe to run against an existing database.
+
+CREATE TABLE IF NOT EXISTS coupons (
+    code VARCHAR(64) PRIMARY KEY,
+    percent_off BIGINT NOT NULL DEFAULT 0,
+    amount_off BIGINT NOT NULL DEFAULT 0,
+    expires_at TIMESTAMP WITH TIME ZONE,
+    max_uses INTEGER NOT NULL DEFAULT 0,
+    uses INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS coupon_code VARCHAR(64);
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS discount_amount BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,20 @@
+-- db/init/11-disputes.sql
+-- Chargebacks reported by Stripe's dispute webhooks, and a flag on the orders they were opened against.
+-- Safe to run against an existing database.
+
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS disputed BOOLEAN NOT NULL DEFAULT false;
+
+CREATE TABLE IF NOT EXISTS disputes (
+    id VARCHAR(255) PRIMARY KEY,
+    charge_id VARCHAR(255) NOT NULL DEFAULT '',
+    payment_intent_id VARCHAR(255) NOT NULL DEFAULT '',
+    order_id VARCHAR(255) REFERENCES orders(id) ON DELETE SET NULL,
+    reason VARCHAR(64) NOT NULL DEFAULT '',
+    amount BIGINT NOT NULL DEFAULT 0,
+    currency VARCHAR(3) NOT NULL DEFAULT 'usd',
+    status VARCHAR(32) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_disputes_created_at ON disputes(created_at);
@@ -0,0 +1,12 @@
+-- db/init/12-webhook-events.sql
+-- Raw Stripe webhook events, kept for WEBHOOK_EVENT_RETENTION so they can be replayed.
+-- Safe to run against an existing database.
+
+CREATE TABLE IF NOT EXISTS webhook_events (
+    event_id VARCHAR(255) PRIMARY KEY,
+    type VARCHAR(255) NOT NULL,
+    payload BYTEA NOT NULL,
+    received_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_events_received_at ON webhook_events(received_at);
@@ -0,0 +1,13 @@
+-- db/init/13-order-notes.sql
+-- Internal admin notes on orders.
+-- Safe to run against an existing database.
+
+CREATE TABLE IF NOT EXISTS order_notes (
+    id VARCHAR(64) PRIMARY KEY,
+    order_id VARCHAR(50) NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+    author VARCHAR(255) NOT NULL DEFAULT '',
+    body TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_order_notes_order_id ON order_notes(order_id, created_at);
@@ -0,0 +1,7 @@
+-- db/init/14-archived-orders.sql
+-- Archiving hides orders from listings and stats without deleting them.
+-- Safe to run against an existing database.
+
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS archived_at TIMESTAMP WITH TIME ZONE;
+
+CREATE INDEX IF NOT EXISTS idx_orders_unarchived_created_at ON orders(created_at) WHERE archived_at IS NULL;
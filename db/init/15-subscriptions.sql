@@ -0,0 +1,27 @@
+-- db/init/15-subscriptions.sql
+-- Recurring Stripe subscriptions and their lifecycle events, kept apart from one-time orders.
+-- Safe to run against an existing database.
+
+CREATE TABLE IF NOT EXISTS subscriptions (
+    stripe_subscription_id VARCHAR(255) PRIMARY KEY,
+    stripe_customer_id VARCHAR(255) NOT NULL DEFAULT '',
+    customer_email VARCHAR(255) NOT NULL DEFAULT '',
+    status VARCHAR(32) NOT NULL,
+    current_period_end TIMESTAMP WITH TIME ZONE,
+    canceled_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_subscriptions_customer_email ON subscriptions(customer_email);
+
+CREATE TABLE IF NOT EXISTS subscription_events (
+    id VARCHAR(64) PRIMARY KEY,
+    subscription_id VARCHAR(255) NOT NULL REFERENCES subscriptions(stripe_subscription_id) ON DELETE CASCADE,
+    event_type VARCHAR(100) NOT NULL,
+    status VARCHAR(32) NOT NULL,
+    data JSONB DEFAULT '{}',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_subscription_events_subscription_id ON subscription_events(subscription_id, created_at);
@@ -0,0 +1,5 @@
+-- db/init/16-idempotency-body-hash.sql
+-- Ties each stored idempotent response to the request body it was for.
+-- Safe to run against an existing database.
+
+ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS body_hash TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,5 @@
+-- db/init/17-subscription-last-event.sql
+-- Records when the last applied subscription event was created, so older events delivered late are ignored.
+-- Safe to run against an existing database.
+
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS last_event_at TIMESTAMP WITH TIME ZONE;
@@ -0,0 +1,7 @@
+-- db/init/18-coupon-currency.sql
+-- Records the currency an amount_off coupon is in, so it only applies to orders in that currency.
+-- Amount-off coupons created before this are assumed to be in usd; update any that aren't.
+-- Safe to run against an existing database.
+
+ALTER TABLE coupons ADD COLUMN IF NOT EXISTS currency VARCHAR(3);
+UPDATE coupons SET currency = 'usd' WHERE amount_off > 0 AND currency IS NULL;
@@ -0,0 +1,49 @@
+// handlers/archive.go
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/capactiyvirus/stripe-backend/models"
+	"github.com/go-chi/chi/v5"
+)
+
+// ArchiveOrder archives an order so the order listing, export, and stats leave it out unless asked
+// for include_archived=true (admin endpoint). The order itself can still be fetched by ID.
+// Archiving an order that's already archived keeps its original archive time.
+func (h *Handlers) ArchiveOrder(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	orderID := chi.URLParam(r, "orderID")
+
+	unlock := h.orderLocks.Lock(orderID)
+	defer unlock()
+
+	order, err := h.PaymentStore.GetOrder(ctx, orderID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Order not found")
+		return
+	}
+
+	archivedAt, alreadyArchived, err := h.PaymentStore.ArchiveOrder(ctx, orderID)
+	if err != nil {
+		h.Logger.Error("Failed to archive order", "order_id", orderID, "error", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to archive order")
+		return
+	}
+
+	if !alreadyArchived {
+		h.PaymentStore.AddPaymentEvent(ctx, models.PaymentEvent{
+			OrderID:   orderID,
+			EventType: "order_archived",
+			Status:    order.Payment.Status,
+			Data:      map[string]interface{}{"archived_at": archivedAt},
+		})
+		h.Logger.Info("Order archived", "order_id", orderID)
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"order_id":         orderID,
+		"archived_at":      archivedAt,
+		"already_archived": alreadyArchived,
+	})
+}
@@ -0,0 +1,71 @@
+// handlers/background.go
+package handlers
+
+import (
+	"context"
+	"sync"
+)
+
+// backgroundTasks tracks goroutines started outside the request that spawned them, such as
+// email sends, so shutdown can wait for them. The zero value is ready to use.
+type backgroundTasks struct {
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+	running  int
+	draining bool
+}
+
+// Go runs fn in a goroutine unless the tasks are being drained, in which case fn runs
+// before Go returns so its work isn't lost
+func (b *backgroundTasks) Go(fn func()) {
+	b.mu.Lock()
+	if b.draining {
+		b.mu.Unlock()
+		fn()
+		return
+	}
+	b.running++
+	b.wg.Add(1)
+	b.mu.Unlock()
+
+	go func() {
+		defer func() {
+			b.mu.Lock()
+			b.running--
+			b.mu.Unlock()
+			b.wg.Done()
+		}()
+		fn()
+	}()
+}
+
+// Drain waits until every running task has finished or ctx is done, returning how many tasks
+// finished and how many were still running
+func (b *backgroundTasks) Drain(ctx context.Context) (drained, abandoned int) {
+	b.mu.Lock()
+	b.draining = true
+	pending := b.running
+	b.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return pending, 0
+	case <-ctx.Done():
+		b.mu.Lock()
+		abandoned = b.running
+		b.mu.Unlock()
+		return pending - abandoned, abandoned
+	}
+}
+
+// RunInBackground runs fn in a goroutine that Shutdown waits for, so work started by a
+// request, such as sending its confirmation email, isn't cut off by a restart
+func (h *Handlers) RunInBackground(fn func()) {
+	h.background.Go(fn)
+}
@@ -0,0 +1,130 @@
+// handlers/catalog.go
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/capactiyvirus/stripe-backend/models"
+	"github.com/capactiyvirus/stripe-backend/store"
+	"github.com/go-chi/chi/v5"
+)
+
+// CreateProduct adds a product to the local catalog (admin endpoint)
+func (h *Handlers) CreateProduct(w http.ResponseWriter, r *http.Request) {
+	product, ok := h.decodeCatalogProduct(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.Catalog.CreateProduct(product); err != nil {
+		if errors.Is(err, store.ErrProductExists) {
+			respondWithError(w, http.StatusConflict, "Product ID already exists")
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Failed to create product: "+err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, product)
+}
+
+// UpdateProduct replaces a product in the local catalog (admin endpoint)
+func (h *Handlers) UpdateProduct(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	product, ok := h.decodeCatalogProduct(w, r)
+	if !ok {
+		return
+	}
+	if product.ID != id {
+		respondWithError(w, http.StatusBadRequest, "Product ID cannot be changed")
+		return
+	}
+
+	if _, err := h.Catalog.GetProduct(id); err != nil {
+		respondWithError(w, http.StatusNotFound, "Product not found")
+		return
+	}
+	if err := h.Catalog.UpdateProduct(product); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to update product: "+err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, product)
+}
+
+// DeleteProduct removes a product from the local catalog (admin endpoint)
+func (h *Handlers) DeleteProduct(w http.ResponseWriter, r *http.Request) {
+	if h.Catalog == nil {
+		respondWithError(w, http.StatusMethodNotAllowed, "Product catalog is read-only")
+		return
+	}
+
+	id := chi.URLParam(r, "id")
+	if _, err := h.Catalog.GetProduct(id); err != nil {
+		respondWithError(w, http.StatusNotFound, "Product not found")
+		return
+	}
+	if err := h.Catalog.DeleteProduct(id); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to delete product: "+err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// decodeCatalogProduct parses and validates a catalog product from the request body.
+// It responds with an error and returns false if the catalog is read-only or the product is invalid.
+func (h *Handlers) decodeCatalogProduct(w http.ResponseWriter, r *http.Request) (*models.Product, bool) {
+	// Without a local catalog, products come from Stripe and can't be edited here
+	if h.Catalog == nil {
+		respondWithError(w, http.StatusMethodNotAllowed, "Product catalog is read-only")
+		return nil, false
+	}
+
+	var product models.Product
+	if err := json.NewDecoder(r.Body).Decode(&product); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return nil, false
+	}
+
+	if id := chi.URLParam(r, "id"); id != "" && product.ID == "" {
+		product.ID = id
+	}
+	product.ID = strings.TrimSpace(product.ID)
+	product.Name = strings.TrimSpace(product.Name)
+	if product.Images == nil {
+		product.Images = []string{}
+	}
+
+	if product.ID == "" {
+		respondWithError(w, http.StatusBadRequest, "Product ID is required")
+		return nil, false
+	}
+	if product.Name == "" {
+		respondWithError(w, http.StatusBadRequest, "Product name is required")
+		return nil, false
+	}
+	if product.Price <= 0 {
+		respondWithError(w, http.StatusBadRequest, "Product price must be positive")
+		return nil, false
+	}
+
+	return &product, true
+}
+
+// catalogDownloadURL returns the file a catalog product is delivered as, from its "download_url"
+// metadata, or "" when there's no catalog or the product isn't a download
+func (h *Handlers) catalogDownloadURL(productID string) string {
+	if h.Catalog == nil {
+		return ""
+	}
+	product, err := h.Catalog.GetProduct(productID)
+	if err != nil {
+		return ""
+	}
+	return product.Metadata["download_url"]
+}
@@ -0,0 +1,53 @@
+// handlers/coupons.go
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/capactiyvirus/stripe-backend/models"
+	"github.com/capactiyvirus/stripe-backend/store"
+)
+
+// CreateCoupon adds a coupon code orders can be created with (admin endpoint)
+func (h *Handlers) CreateCoupon(w http.ResponseWriter, r *http.Request) {
+	var coupon models.Coupon
+	if err := json.NewDecoder(r.Body).Decode(&coupon); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body: "+err.Error())
+		return
+	}
+	coupon.Code = models.NormalizeCouponCode(coupon.Code)
+	if coupon.Currency != "" {
+		currency, err := models.ValidateCurrency(coupon.Currency)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid coupon: "+err.Error())
+			return
+		}
+		coupon.Currency = currency
+	}
+	if err := coupon.Validate(); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid coupon: "+err.Error())
+		return
+	}
+
+	if err := h.PaymentStore.CreateCoupon(r.Context(), &coupon); err != nil {
+		if errors.Is(err, store.ErrCouponExists) {
+			respondWithError(w, http.StatusConflict, "Coupon code already exists")
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Failed to create coupon: "+err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, coupon)
+}
+
+// isCouponRejection reports whether a ValidateCoupon error is the customer's code being unusable,
+// rather than the store failing
+func isCouponRejection(err error) bool {
+	return errors.Is(err, store.ErrCouponNotFound) ||
+		errors.Is(err, models.ErrCouponExpired) ||
+		errors.Is(err, models.ErrCouponExhausted) ||
+		errors.Is(err, models.ErrCouponCurrency)
+}
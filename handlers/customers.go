@@ -0,0 +1,104 @@
+// handlers/customers.go
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/capactiyvirus/stripe-backend/models"
+	"github.com/stripe/stripe-go/v82"
+)
+
+// normalizeEmail is the form emails are mapped to Stripe customers under
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// findOrCreateStripeCustomer returns the Stripe customer an order from info's email is charged to.
+// It reuses the customer saved for the email, then one Stripe already has with that email, and only
+// creates a customer when neither exists. A saved customer that was deleted, or whose email was
+// changed in Stripe, is no longer used for this email; a changed customer is remapped to its new email.
+func (h *Handlers) findOrCreateStripeCustomer(ctx context.Context, info models.CustomerInfo) (string, error) {
+	email := normalizeEmail(info.Email)
+
+	savedID, err := h.PaymentStore.GetStripeCustomerID(ctx, email)
+	if err != nil {
+		return "", err
+	}
+	if savedID != "" {
+		c, err := h.Gateway.GetCustomer(ctx, savedID, nil)
+		if err == nil && !c.Deleted {
+			if normalizeEmail(c.Email) == email {
+				return c.ID, nil
+			}
+			if c.Email != "" {
+				if err := h.PaymentStore.SaveStripeCustomerID(ctx, normalizeEmail(c.Email), c.ID); err != nil {
+					return "", err
+				}
+			}
+		} else if err != nil && !isStripeResourceMissing(err) {
+			return "", fmt.Errorf("failed to get Stripe customer %s: %w", savedID, err)
+		}
+	}
+
+	customerID, err := h.lookupStripeCustomer(ctx, email)
+	if err != nil {
+		return "", err
+	}
+	if customerID == "" {
+		params := &stripe.CustomerParams{Email: stripe.String(email)}
+		if info.Name != "" {
+			params.Name = stripe.String(info.Name)
+		}
+		if info.Phone != "" {
+			params.Phone = stripe.String(info.Phone)
+		}
+		params.SetIdempotencyKey(customerIdempotencyKey(email, info.Name, info.Phone))
+		c, err := h.Gateway.CreateCustomer(ctx, params)
+		if err != nil {
+			return "", fmt.Errorf("failed to create Stripe customer: %w", err)
+		}
+		customerID = c.ID
+		// Remember the new customer even if the client has gone away, so a retry doesn't create another
+		ctx = context.WithoutCancel(ctx)
+	}
+
+	if err := h.PaymentStore.SaveStripeCustomerID(ctx, email, customerID); err != nil {
+		return "", err
+	}
+	return customerID, nil
+}
+
+// customerIdempotencyKey is the Stripe idempotency key for creating the customer for email, so
+// concurrent first orders from one email share a customer. It hashes the email rather than
+// including it, and covers the name and phone too since Stripe rejects a key reused with other params.
+func customerIdempotencyKey(email, name, phone string) string {
+	sum := sha256.Sum256([]byte(email + "\n" + name + "\n" + phone))
+	return "customer-" + hex.EncodeToString(sum[:])
+}
+
+// lookupStripeCustomer returns the ID of a Stripe customer with email, or "" if there is none
+func (h *Handlers) lookupStripeCustomer(ctx context.Context, email string) (string, error) {
+	params := &stripe.CustomerListParams{Email: stripe.String(email)}
+	params.Limit = stripe.Int64(1)
+	params.Single = true
+
+	customers, err := h.Gateway.ListCustomers(ctx, params)
+	if err != nil {
+		return "", fmt.Errorf("failed to look up Stripe customer: %w", err)
+	}
+	if len(customers) == 0 {
+		return "", nil
+	}
+	return customers[0].ID, nil
+}
+
+// isStripeResourceMissing reports whether err is Stripe saying the requested object doesn't exist
+func isStripeResourceMissing(err error) bool {
+	var stripeErr *stripe.Error
+	return errors.As(err, &stripeErr) && stripeErr.Code == stripe.ErrorCodeResourceMissing
+}
@@ -0,0 +1,117 @@
+// handlers/disputes.go
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/capactiyvirus/stripe-backend/models"
+	"github.com/capactiyvirus/stripe-backend/store"
+	"github.com/stripe/stripe-go/v82"
+)
+
+// GetDisputes lists open disputes, newest first (admin endpoint). Closed disputes are included for
+// include_closed=true.
+func (h *Handlers) GetDisputes(w http.ResponseWriter, r *http.Request) {
+	includeClosed := r.URL.Query().Get("include_closed") == "true"
+
+	disputes, err := h.PaymentStore.GetDisputes(r.Context(), !includeClosed)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve disputes")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"disputes": disputes,
+		"count":    len(disputes),
+	})
+}
+
+// handleChargeDisputeCreated records a new dispute and flags the order it was opened against, then
+// emails ADMIN_EMAIL about it. A dispute whose payment matches no order is still recorded.
+func (h *Handlers) handleChargeDisputeCreated(ctx context.Context, event stripe.Event) {
+	logger := h.eventLogger(event)
+
+	var sd stripe.Dispute
+	err := json.Unmarshal(event.Data.Raw, &sd)
+	if err != nil {
+		logger.Error("Failed to parse webhook event", "error", err)
+		return
+	}
+	logger = logger.With("dispute_id", sd.ID)
+
+	dispute := &models.Dispute{
+		ID:       sd.ID,
+		Reason:   string(sd.Reason),
+		Amount:   sd.Amount,
+		Currency: string(sd.Currency),
+		Status:   string(sd.Status),
+	}
+	if sd.Charge != nil {
+		dispute.ChargeID = sd.Charge.ID
+	}
+	if sd.PaymentIntent != nil {
+		dispute.PaymentIntentID = sd.PaymentIntent.ID
+	}
+	if sd.Created > 0 {
+		dispute.CreatedAt = time.Unix(sd.Created, 0)
+	}
+	logger.Warn("Charge dispute created", "charge_id", dispute.ChargeID, "reason", dispute.Reason, "amount", dispute.Amount)
+
+	if dispute.PaymentIntentID != "" {
+		dispute.OrderID = h.findOrderByPaymentIntentID(ctx, dispute.PaymentIntentID)
+	}
+	if dispute.OrderID == "" {
+		logger.Warn("No order found for disputed payment", "payment_intent_id", dispute.PaymentIntentID)
+	} else {
+		unlock := h.orderLocks.Lock(dispute.OrderID)
+		defer unlock()
+		logger = logger.With("order_id", dispute.OrderID)
+	}
+
+	if err := h.PaymentStore.CreateDispute(ctx, dispute); err != nil {
+		if errors.Is(err, store.ErrDisputeExists) {
+			logger.Info("Dispute already recorded")
+		} else {
+			logger.Error("Failed to record dispute", "error", err)
+		}
+		return
+	}
+
+	var order *models.Order
+	if dispute.OrderID != "" {
+		if err := h.PaymentStore.MarkOrderDisputed(ctx, dispute.OrderID); err != nil {
+			logger.Error("Failed to flag order as disputed", "error", err)
+		}
+		if order, err = h.PaymentStore.GetOrder(ctx, dispute.OrderID); err != nil {
+			logger.Error("Failed to get order", "error", err)
+			order = nil
+		}
+
+		var paymentStatus models.PaymentStatus
+		if order != nil {
+			paymentStatus = order.Payment.Status
+		}
+		h.PaymentStore.AddPaymentEvent(ctx, models.PaymentEvent{
+			OrderID:   dispute.OrderID,
+			EventType: "dispute_created",
+			Status:    paymentStatus,
+			Data: map[string]interface{}{
+				"dispute_id":     dispute.ID,
+				"dispute_status": dispute.Status,
+				"charge_id":      dispute.ChargeID,
+				"amount":         dispute.Amount,
+				"reason":         dispute.Reason,
+			},
+		})
+	}
+
+	if h.EmailService != nil && h.Config.AdminEmail != "" {
+		if err := h.EmailService.SendDisputeNotification(h.Config.AdminEmail, dispute, order); err != nil {
+			logger.Error("Failed to send dispute notification", "error", err)
+		}
+	}
+}
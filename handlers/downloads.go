@@ -0,0 +1,69 @@
+// handlers/downloads.go
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/capactiyvirus/stripe-backend/models"
+	"github.com/capactiyvirus/stripe-backend/services"
+	"github.com/go-chi/chi/v5"
+)
+
+// DownloadProduct redirects a paid order's signed download link to the product file and records the download.
+// Links are signed with DOWNLOAD_TOKEN_SECRET, so downloads are unavailable without it, and expire
+// after DOWNLOAD_LINK_TTL.
+func (h *Handlers) DownloadProduct(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	orderID := chi.URLParam(r, "orderID")
+	productID := chi.URLParam(r, "productID")
+
+	secret := h.Config.DownloadTokenSecret
+	if secret == "" {
+		respondWithError(w, http.StatusNotFound, "Downloads are not available")
+		return
+	}
+	if err := services.VerifyDownloadToken(secret, orderID, productID, r.URL.Query().Get("token")); err != nil {
+		if errors.Is(err, services.ErrDownloadTokenExpired) {
+			respondWithError(w, http.StatusGone, "Download link has expired")
+			return
+		}
+		respondWithError(w, http.StatusForbidden, "Invalid download token")
+		return
+	}
+
+	order, err := h.PaymentStore.GetOrder(ctx, orderID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Order not found")
+		return
+	}
+	if order.Status != models.OrderStatusPaid && order.Status != models.OrderStatusFulfilled {
+		respondWithError(w, http.StatusForbidden, "Order has not been paid")
+		return
+	}
+
+	var downloadURL string
+	for _, item := range order.Items {
+		if item.ProductID == productID {
+			downloadURL = item.DownloadURL
+			break
+		}
+	}
+	if downloadURL == "" {
+		respondWithError(w, http.StatusNotFound, "No download available for this product")
+		return
+	}
+
+	h.PaymentStore.AddPaymentEvent(ctx, models.PaymentEvent{
+		OrderID:   orderID,
+		EventType: "downloaded",
+		Status:    order.Payment.Status,
+		Data: map[string]interface{}{
+			"product_id":    productID,
+			"downloaded_at": time.Now(),
+		},
+	})
+
+	http.Redirect(w, r, downloadURL, http.StatusFound)
+}
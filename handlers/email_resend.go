@@ -0,0 +1,143 @@
+// handlers/email_resend.go
+package handlers
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/capactiyvirus/stripe-backend/models"
+	"github.com/go-chi/chi/v5"
+)
+
+// Email types that ResendEmail can send again
+const (
+	resendConfirmation = "confirmation"
+	resendPayment      = "payment"
+	resendFulfillment  = "fulfillment"
+)
+
+// ResendEmailRequest is the body for resending an order email
+type ResendEmailRequest struct {
+	Type string `json:"type"` // "confirmation", "payment", or "fulfillment"
+}
+
+// resendLimiter remembers when each order's emails were last resent. The zero value is ready to use.
+type resendLimiter struct {
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+// reserve records a resend for an order now, or returns how long to wait if the last one was
+// less than interval ago. A zero interval never limits.
+func (l *resendLimiter) reserve(orderID string, interval time.Duration, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.last == nil {
+		l.last = make(map[string]time.Time)
+	}
+	// Forget resends that no longer limit anything so the map doesn't grow with every order
+	for id, at := range l.last {
+		if now.Sub(at) >= interval {
+			delete(l.last, id)
+		}
+	}
+
+	if at, ok := l.last[orderID]; ok {
+		return interval - now.Sub(at)
+	}
+	if interval > 0 {
+		l.last[orderID] = now
+	}
+	return 0
+}
+
+// release forgets an order's last resend, so a resend that failed doesn't hold up a retry
+func (l *resendLimiter) release(orderID string) {
+	l.mu.Lock()
+	delete(l.last, orderID)
+	l.mu.Unlock()
+}
+
+// ResendEmail sends an order's confirmation, payment, or fulfillment email again (admin endpoint).
+// Fulfillment emails get freshly generated download links. Resends of one order are spaced out by
+// EMAIL_RESEND_INTERVAL.
+func (h *Handlers) ResendEmail(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	orderID := chi.URLParam(r, "orderID")
+
+	var req ResendEmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body: "+err.Error())
+		return
+	}
+	if req.Type != resendConfirmation && req.Type != resendPayment && req.Type != resendFulfillment {
+		respondWithError(w, http.StatusBadRequest, `Email type must be "confirmation", "payment", or "fulfillment"`)
+		return
+	}
+
+	if h.EmailService == nil {
+		respondWithError(w, http.StatusServiceUnavailable, "Email is not configured")
+		return
+	}
+
+	order, err := h.PaymentStore.GetOrder(ctx, orderID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Order not found")
+		return
+	}
+
+	switch req.Type {
+	case resendPayment:
+		if order.Status != models.OrderStatusPaid && order.Status != models.OrderStatusFulfilled {
+			respondWithError(w, http.StatusConflict, "Order hasn't been paid: "+string(order.Status))
+			return
+		}
+	case resendFulfillment:
+		if order.Status != models.OrderStatusFulfilled {
+			respondWithError(w, http.StatusConflict, "Order hasn't been fulfilled: "+string(order.Status))
+			return
+		}
+	}
+
+	if wait := h.resends.reserve(orderID, h.Config.EmailResendInterval, time.Now()); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		respondWithError(w, http.StatusTooManyRequests, "An email for this order was resent recently")
+		return
+	}
+
+	switch req.Type {
+	case resendConfirmation:
+		err = h.EmailService.SendOrderConfirmation(order)
+	case resendPayment:
+		err = h.EmailService.SendPaymentConfirmation(order)
+	case resendFulfillment:
+		err = h.EmailService.SendFulfillmentEmail(order, h.EmailService.DownloadURLs(order))
+	}
+	if err != nil {
+		h.resends.release(orderID)
+		h.Logger.Error("Failed to resend email", "order_id", orderID, "type", req.Type, "error", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to resend email")
+		return
+	}
+
+	h.PaymentStore.AddPaymentEvent(ctx, models.PaymentEvent{
+		OrderID:   orderID,
+		EventType: "email_resent",
+		Status:    order.Payment.Status,
+		Data: map[string]interface{}{
+			"type": req.Type,
+			"to":   order.CustomerInfo.Email,
+		},
+	})
+
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"message":  "Email resent",
+		"order_id": orderID,
+		"type":     req.Type,
+	})
+}
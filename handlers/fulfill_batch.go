@@ -0,0 +1,102 @@
+// handlers/fulfill_batch.go
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/capactiyvirus/stripe-backend/models"
+)
+
+// maxFulfillBatchSize caps how many orders one FulfillOrders request can fulfill
+const maxFulfillBatchSize = 500
+
+// FulfillBatchRequest is the body for fulfilling several orders at once
+type FulfillBatchRequest struct {
+	OrderIDs []string `json:"order_ids"`
+}
+
+// FulfillBatchResult is the outcome of fulfilling one order of a batch
+type FulfillBatchResult struct {
+	Success          bool       `json:"success"`
+	FulfilledAt      *time.Time `json:"fulfilled_at,omitempty"`
+	AlreadyFulfilled bool       `json:"already_fulfilled,omitempty"`
+	Error            string     `json:"error,omitempty"` // Why the order wasn't fulfilled
+}
+
+// FulfillOrders fulfills each paid order in a batch (admin endpoint). Orders that can't be fulfilled,
+// such as unpaid ones, are reported in the results without stopping the rest of the batch.
+// Fulfillment emails are sent in the background.
+func (h *Handlers) FulfillOrders(w http.ResponseWriter, r *http.Request) {
+	var req FulfillBatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body: "+err.Error())
+		return
+	}
+	if len(req.OrderIDs) == 0 {
+		respondWithError(w, http.StatusBadRequest, "At least one order ID is required")
+		return
+	}
+	if len(req.OrderIDs) > maxFulfillBatchSize {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("At most %d orders can be fulfilled at once", maxFulfillBatchSize))
+		return
+	}
+
+	results := make(map[string]FulfillBatchResult, len(req.OrderIDs))
+	fulfilled, failed := 0, 0
+	for _, orderID := range req.OrderIDs {
+		if _, seen := results[orderID]; seen {
+			continue
+		}
+		result := h.fulfillBatchOrder(r.Context(), orderID)
+		results[orderID] = result
+		if result.Success {
+			fulfilled++
+		} else {
+			failed++
+		}
+	}
+
+	h.Logger.Info("Fulfilled order batch", "fulfilled", fulfilled, "failed", failed)
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"results":   results,
+		"fulfilled": fulfilled,
+		"failed":    failed,
+	})
+}
+
+// fulfillBatchOrder fulfills one order of a batch the way FulfillOrder does
+func (h *Handlers) fulfillBatchOrder(ctx context.Context, orderID string) FulfillBatchResult {
+	unlock := h.orderLocks.Lock(orderID)
+	defer unlock()
+
+	order, err := h.PaymentStore.GetOrder(ctx, orderID)
+	if err != nil {
+		return FulfillBatchResult{Error: "Order not found"}
+	}
+	if order.Status == models.OrderStatusFulfilled {
+		return FulfillBatchResult{Success: true, FulfilledAt: order.FulfilledAt, AlreadyFulfilled: true}
+	}
+	if order.Status != models.OrderStatusPaid {
+		return FulfillBatchResult{Error: "Order must be paid before fulfillment, but is " + string(order.Status)}
+	}
+
+	if err := h.storeDownloadURLs(ctx, order, nil); err != nil {
+		return FulfillBatchResult{Error: "Failed to save download URLs"}
+	}
+	fulfilledAt, alreadyFulfilled, err := h.fulfillPaidOrder(ctx, order, map[string]interface{}{"batch": true})
+	if err != nil {
+		switch {
+		case errors.Is(err, errFulfillHookFailed):
+			return FulfillBatchResult{Error: "Order hook failed"}
+		case errors.Is(err, models.ErrInvalidStatusTransition):
+			return FulfillBatchResult{Error: "Order cannot be fulfilled: " + err.Error()}
+		}
+		return FulfillBatchResult{Error: "Failed to fulfill order"}
+	}
+	return FulfillBatchResult{Success: true, FulfilledAt: &fulfilledAt, AlreadyFulfilled: alreadyFulfilled}
+}
@@ -0,0 +1,164 @@
+// handlers/gateway.go
+package handlers
+
+import (
+	"context"
+	"github.com/stripe/stripe-go/v82"
+	"github.com/stripe/stripe-go/v82/balance"
+	"github.com/stripe/stripe-go/v82/charge"
+	"github.com/stripe/stripe-go/v82/checkout/session"
+	"github.com/stripe/stripe-go/v82/customer"
+	"github.com/stripe/stripe-go/v82/paymentintent"
+	"github.com/stripe/stripe-go/v82/product"
+	"github.com/stripe/stripe-go/v82/refund"
+	"github.com/stripe/stripe-go/v82/webhook"
+)
+
+// PaymentGateway is the set of Stripe calls the handlers make, so they can run against a fake.
+// StripeGateway sends them to Stripe; FakeGateway answers them in memory for STRIPE_MODE=fake and tests.
+// List calls return every matching object unless params.Single is set.
+type PaymentGateway interface {
+	CreatePaymentIntent(ctx context.Context, params *stripe.PaymentIntentParams) (*stripe.PaymentIntent, error)
+	GetPaymentIntent(ctx context.Context, id string, params *stripe.PaymentIntentParams) (*stripe.PaymentIntent, error)
+	CancelPaymentIntent(ctx context.Context, id string, params *stripe.PaymentIntentCancelParams) (*stripe.PaymentIntent, error)
+	CreateCheckoutSession(ctx context.Context, params *stripe.CheckoutSessionParams) (*stripe.CheckoutSession, error)
+	ExpireCheckoutSession(ctx context.Context, id string, params *stripe.CheckoutSessionExpireParams) (*stripe.CheckoutSession, error)
+	CreateRefund(ctx context.Context, params *stripe.RefundParams) (*stripe.Refund, error)
+	ListProducts(ctx context.Context, params *stripe.ProductListParams) ([]*stripe.Product, error)
+	GetProduct(ctx context.Context, id string, params *stripe.ProductParams) (*stripe.Product, error)
+	CreateCustomer(ctx context.Context, params *stripe.CustomerParams) (*stripe.Customer, error)
+	GetCustomer(ctx context.Context, id string, params *stripe.CustomerParams) (*stripe.Customer, error)
+	ListCustomers(ctx context.Context, params *stripe.CustomerListParams) ([]*stripe.Customer, error)
+	ListCharges(ctx context.Context, params *stripe.ChargeListParams) ([]*stripe.Charge, error)
+	GetBalance(ctx context.Context, params *stripe.BalanceParams) (*stripe.Balance, error)
+
+	// ConstructWebhookEvent verifies a webhook payload's Stripe-Signature header against secret
+	ConstructWebhookEvent(payload []byte, signature, secret string) (stripe.Event, error)
+}
+
+// StripeGateway makes PaymentGateway calls against the Stripe API using stripe.Key. Each call's
+// ctx is set on its params, so the request is abandoned when ctx is done.
+type StripeGateway struct{}
+
+func (StripeGateway) CreatePaymentIntent(ctx context.Context, params *stripe.PaymentIntentParams) (*stripe.PaymentIntent, error) {
+	if params == nil {
+		params = &stripe.PaymentIntentParams{}
+	}
+	params.Context = ctx
+	return paymentintent.New(params)
+}
+
+func (StripeGateway) GetPaymentIntent(ctx context.Context, id string, params *stripe.PaymentIntentParams) (*stripe.PaymentIntent, error) {
+	if params == nil {
+		params = &stripe.PaymentIntentParams{}
+	}
+	params.Context = ctx
+	return paymentintent.Get(id, params)
+}
+
+func (StripeGateway) CancelPaymentIntent(ctx context.Context, id string, params *stripe.PaymentIntentCancelParams) (*stripe.PaymentIntent, error) {
+	if params == nil {
+		params = &stripe.PaymentIntentCancelParams{}
+	}
+	params.Context = ctx
+	return paymentintent.Cancel(id, params)
+}
+
+func (StripeGateway) CreateCheckoutSession(ctx context.Context, params *stripe.CheckoutSessionParams) (*stripe.CheckoutSession, error) {
+	if params == nil {
+		params = &stripe.CheckoutSessionParams{}
+	}
+	params.Context = ctx
+	return session.New(params)
+}
+
+func (StripeGateway) ExpireCheckoutSession(ctx context.Context, id string, params *stripe.CheckoutSessionExpireParams) (*stripe.CheckoutSession, error) {
+	if params == nil {
+		params = &stripe.CheckoutSessionExpireParams{}
+	}
+	params.Context = ctx
+	return session.Expire(id, params)
+}
+
+func (StripeGateway) CreateRefund(ctx context.Context, params *stripe.RefundParams) (*stripe.Refund, error) {
+	if params == nil {
+		params = &stripe.RefundParams{}
+	}
+	params.Context = ctx
+	return refund.New(params)
+}
+
+func (StripeGateway) ListProducts(ctx context.Context, params *stripe.ProductListParams) ([]*stripe.Product, error) {
+	if params == nil {
+		params = &stripe.ProductListParams{}
+	}
+	params.Context = ctx
+	var products []*stripe.Product
+	iter := product.List(params)
+	for iter.Next() {
+		products = append(products, iter.Product())
+	}
+	return products, iter.Err()
+}
+
+func (StripeGateway) GetProduct(ctx context.Context, id string, params *stripe.ProductParams) (*stripe.Product, error) {
+	if params == nil {
+		params = &stripe.ProductParams{}
+	}
+	params.Context = ctx
+	return product.Get(id, params)
+}
+
+func (StripeGateway) CreateCustomer(ctx context.Context, params *stripe.CustomerParams) (*stripe.Customer, error) {
+	if params == nil {
+		params = &stripe.CustomerParams{}
+	}
+	params.Context = ctx
+	return customer.New(params)
+}
+
+func (StripeGateway) GetCustomer(ctx context.Context, id string, params *stripe.CustomerParams) (*stripe.Customer, error) {
+	if params == nil {
+		params = &stripe.CustomerParams{}
+	}
+	params.Context = ctx
+	return customer.Get(id, params)
+}
+
+func (StripeGateway) ListCustomers(ctx context.Context, params *stripe.CustomerListParams) ([]*stripe.Customer, error) {
+	if params == nil {
+		params = &stripe.CustomerListParams{}
+	}
+	params.Context = ctx
+	var customers []*stripe.Customer
+	iter := customer.List(params)
+	for iter.Next() {
+		customers = append(customers, iter.Customer())
+	}
+	return customers, iter.Err()
+}
+
+func (StripeGateway) ListCharges(ctx context.Context, params *stripe.ChargeListParams) ([]*stripe.Charge, error) {
+	if params == nil {
+		params = &stripe.ChargeListParams{}
+	}
+	params.Context = ctx
+	var charges []*stripe.Charge
+	iter := charge.List(params)
+	for iter.Next() {
+		charges = append(charges, iter.Charge())
+	}
+	return charges, iter.Err()
+}
+
+func (StripeGateway) GetBalance(ctx context.Context, params *stripe.BalanceParams) (*stripe.Balance, error) {
+	if params == nil {
+		params = &stripe.BalanceParams{}
+	}
+	params.Context = ctx
+	return balance.Get(params)
+}
+
+func (StripeGateway) ConstructWebhookEvent(payload []byte, signature, secret string) (stripe.Event, error) {
+	return webhook.ConstructEvent(payload, signature, secret)
+}
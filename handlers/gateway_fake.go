@@ -0,0 +1,356 @@
+// handlers/gateway_fake.go
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/stripe/stripe-go/v82"
+	"github.com/stripe/stripe-go/v82/webhook"
+)
+
+// FakeGateway is an in-memory PaymentGateway for STRIPE_MODE=fake and tests. It never calls Stripe.
+// IDs are numbered per object type in creation order (pi_fake_1, cus_fake_1, ...), so a fresh client
+// always hands out the same IDs and client secrets for the same sequence of calls.
+// Payment intents stay in requires_payment_method until SetPaymentIntentStatus moves them on;
+// a succeeded intent gets one captured charge, which refunds are taken from.
+type FakeGateway struct {
+	mu             sync.Mutex
+	seq            map[string]int
+	paymentIntents map[string]*stripe.PaymentIntent
+	idempotent     map[string]string         // Idempotency key -> payment intent ID
+	charges        map[string]*stripe.Charge // Payment intent ID -> its charge
+	customers      map[string]*stripe.Customer
+	sessions       map[string]*stripe.CheckoutSession
+	products       []*stripe.Product
+}
+
+// NewFakeGateway creates a FakeGateway with no objects
+func NewFakeGateway() *FakeGateway {
+	return &FakeGateway{
+		seq:            make(map[string]int),
+		paymentIntents: make(map[string]*stripe.PaymentIntent),
+		idempotent:     make(map[string]string),
+		charges:        make(map[string]*stripe.Charge),
+		customers:      make(map[string]*stripe.Customer),
+		sessions:       make(map[string]*stripe.CheckoutSession),
+	}
+}
+
+// nextID returns the next ID for an object prefix such as "pi". Callers hold f.mu.
+func (f *FakeGateway) nextID(prefix string) string {
+	f.seq[prefix]++
+	return fmt.Sprintf("%s_fake_%d", prefix, f.seq[prefix])
+}
+
+// fakeResourceMissing is the error Stripe returns for an unknown object ID
+func fakeResourceMissing(kind, id string) error {
+	return &stripe.Error{
+		Type:           stripe.ErrorTypeInvalidRequest,
+		Code:           stripe.ErrorCodeResourceMissing,
+		HTTPStatusCode: http.StatusNotFound,
+		Msg:            fmt.Sprintf("No such %s: '%s'", kind, id),
+	}
+}
+
+func (f *FakeGateway) CreatePaymentIntent(ctx context.Context, params *stripe.PaymentIntentParams) (*stripe.PaymentIntent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if params.IdempotencyKey != nil {
+		if id, ok := f.idempotent[*params.IdempotencyKey]; ok {
+			pi := *f.paymentIntents[id]
+			return &pi, nil
+		}
+	}
+
+	id := f.nextID("pi")
+	pi := &stripe.PaymentIntent{
+		ID:           id,
+		Object:       "payment_intent",
+		Amount:       stripe.Int64Value(params.Amount),
+		Currency:     stripe.Currency(strings.ToLower(stripe.StringValue(params.Currency))),
+		Description:  stripe.StringValue(params.Description),
+		ClientSecret: id + "_secret_fake",
+		Status:       stripe.PaymentIntentStatusRequiresPaymentMethod,
+		Metadata:     make(map[string]string, len(params.Metadata)),
+	}
+	for k, v := range params.Metadata {
+		pi.Metadata[k] = v
+	}
+	if params.Customer != nil {
+		pi.Customer = &stripe.Customer{ID: *params.Customer}
+	}
+	f.paymentIntents[id] = pi
+	if params.IdempotencyKey != nil {
+		f.idempotent[*params.IdempotencyKey] = id
+	}
+
+	copied := *pi
+	return &copied, nil
+}
+
+func (f *FakeGateway) GetPaymentIntent(ctx context.Context, id string, params *stripe.PaymentIntentParams) (*stripe.PaymentIntent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pi, ok := f.paymentIntents[id]
+	if !ok {
+		return nil, fakeResourceMissing("payment_intent", id)
+	}
+	copied := *pi
+	return &copied, nil
+}
+
+func (f *FakeGateway) CancelPaymentIntent(ctx context.Context, id string, params *stripe.PaymentIntentCancelParams) (*stripe.PaymentIntent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pi, ok := f.paymentIntents[id]
+	if !ok {
+		return nil, fakeResourceMissing("payment_intent", id)
+	}
+	if pi.Status == stripe.PaymentIntentStatusSucceeded {
+		return nil, &stripe.Error{
+			Type:           stripe.ErrorTypeInvalidRequest,
+			Code:           stripe.ErrorCodePaymentIntentUnexpectedState,
+			HTTPStatusCode: http.StatusBadRequest,
+			Msg:            "You cannot cancel this PaymentIntent because it has a status of succeeded.",
+		}
+	}
+	pi.Status = stripe.PaymentIntentStatusCanceled
+	if params != nil && params.CancellationReason != nil {
+		pi.CancellationReason = stripe.PaymentIntentCancellationReason(*params.CancellationReason)
+	}
+	copied := *pi
+	return &copied, nil
+}
+
+// SetPaymentIntentStatus moves a fake payment intent to status, as a customer paying or Stripe
+// declining the payment would
+func (f *FakeGateway) SetPaymentIntentStatus(id string, status stripe.PaymentIntentStatus) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pi, ok := f.paymentIntents[id]
+	if !ok {
+		return fakeResourceMissing("payment_intent", id)
+	}
+	pi.Status = status
+	if status == stripe.PaymentIntentStatusSucceeded && f.charges[id] == nil {
+		ch := &stripe.Charge{
+			ID:             f.nextID("ch"),
+			Object:         "charge",
+			Amount:         pi.Amount,
+			AmountCaptured: pi.Amount,
+			Captured:       true,
+			Currency:       pi.Currency,
+			Paid:           true,
+			PaymentIntent:  &stripe.PaymentIntent{ID: id},
+			Status:         stripe.ChargeStatusSucceeded,
+		}
+		f.charges[id] = ch
+		pi.AmountReceived = pi.Amount
+		pi.LatestCharge = &stripe.Charge{ID: ch.ID}
+	}
+	return nil
+}
+
+func (f *FakeGateway) CreateCheckoutSession(ctx context.Context, params *stripe.CheckoutSessionParams) (*stripe.CheckoutSession, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id := f.nextID("cs")
+	s := &stripe.CheckoutSession{
+		ID:                id,
+		Object:            "checkout.session",
+		URL:               "https://checkout.stripe.com/fake/" + id,
+		ClientReferenceID: stripe.StringValue(params.ClientReferenceID),
+		CustomerEmail:     stripe.StringValue(params.CustomerEmail),
+		Metadata:          params.Metadata,
+		Status:            stripe.CheckoutSessionStatusOpen,
+	}
+	f.sessions[id] = s
+	copied := *s
+	return &copied, nil
+}
+
+func (f *FakeGateway) ExpireCheckoutSession(ctx context.Context, id string, params *stripe.CheckoutSessionExpireParams) (*stripe.CheckoutSession, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s, ok := f.sessions[id]
+	if !ok {
+		return nil, fakeResourceMissing("checkout.session", id)
+	}
+	if s.Status != stripe.CheckoutSessionStatusOpen {
+		return nil, &stripe.Error{
+			Type:           stripe.ErrorTypeInvalidRequest,
+			HTTPStatusCode: http.StatusBadRequest,
+			Msg:            "Only Checkout Sessions with a status in [\"open\"] can be expired.",
+		}
+	}
+	s.Status = stripe.CheckoutSessionStatusExpired
+	copied := *s
+	return &copied, nil
+}
+
+func (f *FakeGateway) CreateRefund(ctx context.Context, params *stripe.RefundParams) (*stripe.Refund, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	piID := stripe.StringValue(params.PaymentIntent)
+	pi, ok := f.paymentIntents[piID]
+	if !ok {
+		return nil, fakeResourceMissing("payment_intent", piID)
+	}
+
+	ch := f.charges[piID]
+	if ch == nil {
+		return nil, &stripe.Error{
+			Type:           stripe.ErrorTypeInvalidRequest,
+			Code:           stripe.ErrorCodeChargeNotRefundable,
+			HTTPStatusCode: http.StatusBadRequest,
+			Msg:            fmt.Sprintf("PaymentIntent %s does not have a successful charge to refund.", piID),
+		}
+	}
+
+	amount := ch.Amount - ch.AmountRefunded
+	if params.Amount != nil {
+		amount = *params.Amount
+	}
+	if amount <= 0 || amount > ch.Amount-ch.AmountRefunded {
+		return nil, &stripe.Error{
+			Type:           stripe.ErrorTypeInvalidRequest,
+			Code:           stripe.ErrorCodeAmountTooLarge,
+			HTTPStatusCode: http.StatusBadRequest,
+			Msg:            fmt.Sprintf("Refund amount (%d) is greater than unrefunded amount on charge (%d)", amount, ch.Amount-ch.AmountRefunded),
+		}
+	}
+	ch.AmountRefunded += amount
+	ch.Refunded = ch.AmountRefunded == ch.Amount
+
+	copied := *ch
+	return &stripe.Refund{
+		ID:            f.nextID("re"),
+		Object:        "refund",
+		Amount:        amount,
+		Charge:        &copied,
+		Currency:      pi.Currency,
+		PaymentIntent: &stripe.PaymentIntent{ID: pi.ID},
+		Reason:        stripe.RefundReason(stripe.StringValue(params.Reason)),
+		Status:        stripe.RefundStatusSucceeded,
+	}, nil
+}
+
+// AddProduct adds a product for ListProducts and GetProduct to return
+func (f *FakeGateway) AddProduct(p *stripe.Product) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.products = append(f.products, p)
+}
+
+func (f *FakeGateway) ListProducts(ctx context.Context, params *stripe.ProductListParams) ([]*stripe.Product, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var products []*stripe.Product
+	for _, p := range f.products {
+		if params != nil && params.Active != nil && p.Active != *params.Active {
+			continue
+		}
+		products = append(products, p)
+	}
+	return products, nil
+}
+
+func (f *FakeGateway) GetProduct(ctx context.Context, id string, params *stripe.ProductParams) (*stripe.Product, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, p := range f.products {
+		if p.ID == id {
+			return p, nil
+		}
+	}
+	return nil, fakeResourceMissing("product", id)
+}
+
+func (f *FakeGateway) CreateCustomer(ctx context.Context, params *stripe.CustomerParams) (*stripe.Customer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c := &stripe.Customer{
+		ID:     f.nextID("cus"),
+		Object: "customer",
+		Email:  stripe.StringValue(params.Email),
+		Name:   stripe.StringValue(params.Name),
+		Phone:  stripe.StringValue(params.Phone),
+	}
+	f.customers[c.ID] = c
+	copied := *c
+	return &copied, nil
+}
+
+func (f *FakeGateway) GetCustomer(ctx context.Context, id string, params *stripe.CustomerParams) (*stripe.Customer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c, ok := f.customers[id]
+	if !ok {
+		return nil, fakeResourceMissing("customer", id)
+	}
+	copied := *c
+	return &copied, nil
+}
+
+func (f *FakeGateway) ListCustomers(ctx context.Context, params *stripe.CustomerListParams) ([]*stripe.Customer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Walk IDs in creation order so results are deterministic
+	var customers []*stripe.Customer
+	for n := 1; n <= f.seq["cus"]; n++ {
+		c := f.customers[fmt.Sprintf("cus_fake_%d", n)]
+		if params != nil && params.Email != nil && !strings.EqualFold(c.Email, *params.Email) {
+			continue
+		}
+		copied := *c
+		customers = append(customers, &copied)
+		if params != nil && params.Limit != nil && int64(len(customers)) >= *params.Limit {
+			break
+		}
+	}
+	return customers, nil
+}
+
+// ListCharges returns the charge of params.PaymentIntent, or of every succeeded intent when it's unset
+func (f *FakeGateway) ListCharges(ctx context.Context, params *stripe.ChargeListParams) ([]*stripe.Charge, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var charges []*stripe.Charge
+	for n := 1; n <= f.seq["pi"]; n++ {
+		id := fmt.Sprintf("pi_fake_%d", n)
+		if params != nil && params.PaymentIntent != nil && *params.PaymentIntent != id {
+			continue
+		}
+		if ch := f.charges[id]; ch != nil {
+			copied := *ch
+			charges = append(charges, &copied)
+		}
+	}
+	return charges, nil
+}
+
+func (f *FakeGateway) GetBalance(ctx context.Context, params *stripe.BalanceParams) (*stripe.Balance, error) {
+	return &stripe.Balance{Object: "balance", Livemode: false}, nil
+}
+
+// ConstructWebhookEvent checks signatures like Stripe does, so signed test events still have to match the secret
+func (f *FakeGateway) ConstructWebhookEvent(payload []byte, signature, secret string) (stripe.Event, error) {
+	return webhook.ConstructEvent(payload, signature, secret)
+}
@@ -1,7 +1,13 @@
 // handlers/handlers.go
 package handlers
 
-import "net/http"
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/capactiyvirus/stripe-backend/store"
+)
 
 // Note: The main Handlers struct is now defined in payment_handlers.go
 // This file can contain shared handler utilities
@@ -12,3 +18,25 @@ func HealthCheck(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(`{"status": "ok"}`))
 }
+
+// Shutdown waits for background tasks, flushes queued emails and, for the in-memory store, saves the
+// snapshot if configured. Tasks still running and queued emails still unsent when ctx is done are dropped.
+func (h *Handlers) Shutdown(ctx context.Context) error {
+	// Background tasks may still queue emails, so they finish before the queue is flushed
+	drained, abandoned := h.background.Drain(ctx)
+	h.Logger.Info("Background tasks drained", "drained", drained, "abandoned", abandoned)
+
+	if h.EmailService != nil && h.EmailService.Dispatcher != nil {
+		flushed, dropped := h.EmailService.Dispatcher.Shutdown(ctx)
+		h.Logger.Info("Email queue flushed", "flushed", flushed, "dropped", dropped)
+	}
+
+	if memoryStore, ok := h.PaymentStore.(*store.MemoryStore); ok && h.Config.StoreSnapshotPath != "" {
+		if err := memoryStore.SnapshotToFile(h.Config.StoreSnapshotPath); err != nil {
+			return fmt.Errorf("failed to save store snapshot: %w", err)
+		}
+		h.Logger.Info("Saved store snapshot", "path", h.Config.StoreSnapshotPath)
+	}
+
+	return nil
+}
@@ -9,3 +9,40 @@ import (
 func (h *Handlers) HealthCheck(w http.ResponseWriter, r *http.Request) {
 	respondWithJSON(w, http.StatusOK, map[string]string{"status": "ok"})
 }
+
+// ReadinessCheck reports whether the store, and Stripe when ReadyCheckStripe is set, can be reached.
+// Any failing check makes it respond 503, with each component's status in "checks". The probe is public,
+// so a failure's details are only logged and the response just says "error".
+func (h *Handlers) ReadinessCheck(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	checks := map[string]string{}
+	ready := true
+
+	if err := h.PaymentStore.Ping(ctx); err != nil {
+		h.Logger.Error("Readiness check failed", "component", "store", "error", err)
+		checks["store"] = "error"
+		ready = false
+	} else {
+		checks["store"] = "ok"
+	}
+
+	if h.Config.ReadyCheckStripe {
+		// Retrieving the balance is the cheapest call that validates the secret key
+		if _, err := h.Gateway.GetBalance(ctx, nil); err != nil {
+			h.Logger.Error("Readiness check failed", "component", "stripe", "error", err)
+			checks["stripe"] = "error"
+			ready = false
+		} else {
+			checks["stripe"] = "ok"
+		}
+	}
+
+	status, code := "ok", http.StatusOK
+	if !ready {
+		status, code = "unavailable", http.StatusServiceUnavailable
+	}
+	respondWithJSON(w, code, map[string]interface{}{
+		"status": status,
+		"checks": checks,
+	})
+}
@@ -0,0 +1,114 @@
+// handlers/hooks.go
+package handlers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/capactiyvirus/stripe-backend/models"
+)
+
+// OrderHook runs deployment-specific logic at points in an order's lifecycle, such as enriching
+// metadata or notifying an ERP. Embed NoopOrderHook to implement only the points you need.
+//
+// OnOrderCreated runs once the order is saved, and changes it makes (e.g. to Metadata) are stored too.
+// OnOrderFulfilled runs before the order is marked fulfilled. With HOOK_ERRORS_FATAL set, an error from
+// either aborts the request, and a created order is canceled. OnOrderPaid and OnOrderRefunded run after the money has moved, so their
+// errors are only ever logged.
+type OrderHook interface {
+	OnOrderCreated(order *models.Order) error
+	OnOrderPaid(order *models.Order) error
+	OnOrderFulfilled(order *models.Order) error
+	OnOrderRefunded(order *models.Order) error
+}
+
+// NoopOrderHook is an OrderHook that does nothing
+type NoopOrderHook struct{}
+
+func (NoopOrderHook) OnOrderCreated(order *models.Order) error   { return nil }
+func (NoopOrderHook) OnOrderPaid(order *models.Order) error      { return nil }
+func (NoopOrderHook) OnOrderFulfilled(order *models.Order) error { return nil }
+func (NoopOrderHook) OnOrderRefunded(order *models.Order) error  { return nil }
+
+// RegisterHook adds a hook to run at each order lifecycle point. Register hooks before serving requests.
+func (h *Handlers) RegisterHook(hook OrderHook) {
+	h.hooks = append(h.hooks, hook)
+}
+
+// runHooks calls every registered hook for a lifecycle point, logging failures. It returns the first
+// error when HOOK_ERRORS_FATAL is set, and nil otherwise.
+func (h *Handlers) runHooks(point string, order *models.Order, call func(OrderHook, *models.Order) error) error {
+	var firstErr error
+	for _, hook := range h.hooks {
+		if err := call(hook, order); err != nil {
+			h.Logger.Error("Order hook failed", "hook", point, "order_id", order.ID, "error", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	if h.Config.HookErrorsFatal {
+		return firstErr
+	}
+	return nil
+}
+
+// runOrderCreatedHooks runs the OnOrderCreated hooks for an order that has just been saved and stores
+// what they changed. When they fail under HOOK_ERRORS_FATAL the order is canceled and the error returned.
+func (h *Handlers) runOrderCreatedHooks(ctx context.Context, order *models.Order) error {
+	if len(h.hooks) == 0 {
+		return nil
+	}
+
+	if err := h.runHooks("OnOrderCreated", order, OrderHook.OnOrderCreated); err != nil {
+		if cancelErr := h.PaymentStore.UpdateOrderStatus(ctx, order.ID, models.OrderStatusCanceled); cancelErr != nil {
+			h.Logger.Error("Failed to cancel order after hook failure", "order_id", order.ID, "error", cancelErr)
+		}
+		return err
+	}
+	if err := h.PaymentStore.UpdateOrder(ctx, order); err != nil {
+		return fmt.Errorf("failed to store hook changes: %w", err)
+	}
+	return nil
+}
+
+// notifyOrderPaid sends the payment confirmation and runs the paid hooks for an order that was just paid
+func (h *Handlers) notifyOrderPaid(ctx context.Context, orderID string) {
+	paidOrder, err := h.PaymentStore.GetOrder(ctx, orderID)
+	if err != nil {
+		return
+	}
+
+	if h.EmailService != nil {
+		if err := h.EmailService.SendPaymentConfirmation(paidOrder); err != nil {
+			h.Logger.Error("Failed to send payment confirmation", "order_id", orderID, "error", err)
+		}
+	}
+
+	h.runHooks("OnOrderPaid", paidOrder, OrderHook.OnOrderPaid)
+
+	if isDigitalOrder(paidOrder) {
+		h.fulfillDigitalOrder(ctx, paidOrder)
+	}
+}
+
+// isDigitalOrder reports whether every item in an order is a file download,
+// so the order can be fulfilled as soon as it's paid
+func isDigitalOrder(order *models.Order) bool {
+	if len(order.Items) == 0 {
+		return false
+	}
+	for _, item := range order.Items {
+		if item.DownloadURL == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// fulfillDigitalOrder marks a paid digital order fulfilled, which emails its download links
+func (h *Handlers) fulfillDigitalOrder(ctx context.Context, order *models.Order) {
+	if _, _, err := h.fulfillPaidOrder(ctx, order, map[string]interface{}{"automatic": true}); err != nil {
+		h.Logger.Warn("Not fulfilling order automatically", "order_id", order.ID, "error", err)
+	}
+}
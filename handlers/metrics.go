@@ -0,0 +1,84 @@
+// handlers/metrics.go
+package handlers
+
+import (
+	"math"
+	"strings"
+
+	"github.com/capactiyvirus/stripe-backend/models"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics counts orders, payments, and webhook deliveries for Prometheus. A nil *Metrics records nothing.
+type Metrics struct {
+	ordersCreated     prometheus.Counter
+	paymentsSucceeded prometheus.Counter
+	paymentsFailed    prometheus.Counter
+	webhooksReceived  *prometheus.CounterVec
+	orderAmount       *prometheus.HistogramVec
+}
+
+// NewMetrics creates the order and payment metrics and registers them with reg
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		ordersCreated: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "orders_created_total",
+			Help: "Orders created",
+		}),
+		paymentsSucceeded: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "payments_succeeded_total",
+			Help: "Orders whose payment succeeded in full",
+		}),
+		paymentsFailed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "payments_failed_total",
+			Help: "Order payments that failed",
+		}),
+		webhooksReceived: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "webhooks_received_total",
+			Help: "Stripe webhook events received with a valid signature, by event type",
+		}, []string{"type"}),
+		orderAmount: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "order_amount",
+			Help:    "Created order totals in major currency units, by currency",
+			Buckets: []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000, 5000},
+		}, []string{"currency"}),
+	}
+	reg.MustRegister(m.ordersCreated, m.paymentsSucceeded, m.paymentsFailed, m.webhooksReceived, m.orderAmount)
+	return m
+}
+
+// orderCreated counts a new order and records its total
+func (m *Metrics) orderCreated(order *models.Order) {
+	if m == nil {
+		return
+	}
+	currency := strings.ToLower(order.Payment.Currency)
+	amount := float64(order.Payment.Amount) / math.Pow10(int(models.CurrencyDecimals(currency)))
+
+	m.ordersCreated.Inc()
+	m.orderAmount.WithLabelValues(currency).Observe(amount)
+}
+
+// paymentSucceeded counts an order that became paid
+func (m *Metrics) paymentSucceeded() {
+	if m == nil {
+		return
+	}
+	m.paymentsSucceeded.Inc()
+}
+
+// paymentFailed counts an order whose payment failed
+func (m *Metrics) paymentFailed() {
+	if m == nil {
+		return
+	}
+	m.paymentsFailed.Inc()
+}
+
+// webhookReceived counts a verified webhook event by its type
+func (m *Metrics) webhookReceived(eventType string) {
+	if m == nil {
+		return
+	}
+	m.webhooksReceived.WithLabelValues(eventType).Inc()
+}
@@ -0,0 +1,82 @@
+// handlers/notes.go
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	appmiddleware "github.com/capactiyvirus/stripe-backend/middleware"
+	"github.com/capactiyvirus/stripe-backend/models"
+	"github.com/go-chi/chi/v5"
+)
+
+// AddOrderNoteRequest is the body for adding a note to an order
+type AddOrderNoteRequest struct {
+	Body string `json:"body"`
+}
+
+// AddOrderNote adds an internal note to an order (admin endpoint). The note's author is the ID of
+// the API key the request was made with.
+func (h *Handlers) AddOrderNote(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	orderID := chi.URLParam(r, "orderID")
+
+	var req AddOrderNoteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body: "+err.Error())
+		return
+	}
+	body := strings.TrimSpace(req.Body)
+	if body == "" {
+		respondWithError(w, http.StatusBadRequest, "Note body is required")
+		return
+	}
+	if utf8.RuneCountInString(body) > models.MaxOrderNoteLength {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Note body can be at most %d characters", models.MaxOrderNoteLength))
+		return
+	}
+
+	if _, err := h.PaymentStore.GetOrder(ctx, orderID); err != nil {
+		respondWithError(w, http.StatusNotFound, "Order not found")
+		return
+	}
+
+	note := &models.OrderNote{
+		OrderID: orderID,
+		Author:  appmiddleware.APIKeyID(r.Context()),
+		Body:    body,
+	}
+	if err := h.PaymentStore.AddOrderNote(ctx, note); err != nil {
+		h.Logger.Error("Failed to add order note", "order_id", orderID, "error", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to add note")
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, note)
+}
+
+// GetOrderNotes lists an order's internal notes, newest first (admin endpoint)
+func (h *Handlers) GetOrderNotes(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	orderID := chi.URLParam(r, "orderID")
+
+	if _, err := h.PaymentStore.GetOrder(ctx, orderID); err != nil {
+		respondWithError(w, http.StatusNotFound, "Order not found")
+		return
+	}
+
+	notes, err := h.PaymentStore.GetOrderNotes(ctx, orderID)
+	if err != nil {
+		h.Logger.Error("Failed to get order notes", "order_id", orderID, "error", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to get notes")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"order_id": orderID,
+		"notes":    notes,
+	})
+}
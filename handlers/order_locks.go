@@ -0,0 +1,46 @@
+// handlers/order_locks.go
+package handlers
+
+import "sync"
+
+// orderLocks serializes work on a single order while letting different
+// orders proceed concurrently. The zero value is ready to use.
+type orderLocks struct {
+	mu    sync.Mutex
+	locks map[string]*orderLock
+}
+
+// orderLock is a per-order mutex with a count of goroutines holding or waiting on it
+type orderLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// Lock acquires the lock for an order and returns the function that releases it
+func (l *orderLocks) Lock(orderID string) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*orderLock)
+	}
+	lock, exists := l.locks[orderID]
+	if !exists {
+		lock = &orderLock{}
+		l.locks[orderID] = lock
+	}
+	lock.refs++
+	l.mu.Unlock()
+
+	lock.mu.Lock()
+
+	return func() {
+		lock.mu.Unlock()
+
+		// Drop the entry once nobody is using it so the map doesn't grow with every order
+		l.mu.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(l.locks, orderID)
+		}
+		l.mu.Unlock()
+	}
+}
@@ -2,48 +2,110 @@
 package handlers
 
 import (
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/capactiyvirus/stripe-backend/config"
 	"github.com/capactiyvirus/stripe-backend/models"
+	"github.com/capactiyvirus/stripe-backend/services"
 	"github.com/capactiyvirus/stripe-backend/store"
 	"github.com/go-chi/chi/v5"
+	"github.com/shopspring/decimal"
 	"github.com/stripe/stripe-go/v82"
-	"github.com/stripe/stripe-go/v82/paymentintent"
 )
 
 // Enhanced Handlers struct with payment store
 type Handlers struct {
 	Config       *config.Config
-	PaymentStore *store.PaymentStore
+	PaymentStore store.PaymentStore
+	EmailService *services.EmailService // Optional; no emails are sent when nil
+	Catalog      *store.ProductCatalog  // Optional editable catalog; products come from Stripe when nil
+	ProductCache *services.ProductCache // Optional cache in front of Stripe product lookups
+	Logger       *slog.Logger           // Structured logger; NewHandlers uses slog.Default()
+	Metrics      *Metrics               // Optional; no order or payment metrics are recorded when nil
+	Gateway      PaymentGateway         // Stripe API calls; NewHandlers uses StripeGateway, or FakeGateway when STRIPE_MODE=fake
+
+	orderLocks orderLocks      // Serializes webhook processing per order
+	hooks      []OrderHook     // Lifecycle hooks added with RegisterHook
+	background backgroundTasks // Goroutines started with RunInBackground
+	resends    resendLimiter   // Spaces out ResendEmail calls per order
 }
 
-// NewHandlers creates a new Handlers instance with payment store
-func NewHandlers(cfg *config.Config) *Handlers {
+// NewHandlers creates a new Handlers instance backed by paymentStore
+func NewHandlers(cfg *config.Config, paymentStore store.PaymentStore) *Handlers {
+	var gateway PaymentGateway = StripeGateway{}
+	if cfg != nil && cfg.StripeMode == config.StripeModeFake {
+		gateway = NewFakeGateway()
+	}
+
 	return &Handlers{
 		Config:       cfg,
-		PaymentStore: store.NewPaymentStore(),
+		PaymentStore: paymentStore,
+		Logger:       slog.Default(),
+		Gateway:      gateway,
 	}
 }
 
 // Request/Response types
 type CreateOrderRequest struct {
+	ID           string              `json:"id,omitempty"` // Optional client-generated UUID for idempotent creation
 	CustomerInfo models.CustomerInfo `json:"customer_info"`
 	Items        []OrderItemRequest  `json:"items"`
 	Metadata     map[string]string   `json:"metadata,omitempty"`
+	Currency     string              `json:"currency,omitempty"`    // One of models.SupportedCurrencies, defaulting to DEFAULT_CURRENCY
+	CouponCode   string              `json:"coupon_code,omitempty"` // Optional promotion code, matched case-insensitively
+
+	// SavePaymentMethod saves the payment method for later off-session charges (subscriptions, installments)
+	SavePaymentMethod bool `json:"save_payment_method,omitempty"`
 }
 
 type OrderItemRequest struct {
-	ProductID   string  `json:"product_id"`
-	ProductName string  `json:"product_name"`
-	FileType    string  `json:"file_type"`
-	Price       float64 `json:"price"`
-	Quantity    int     `json:"quantity"`
+	ProductID   string `json:"product_id"`
+	ProductName string `json:"product_name"`
+	FileType    string `json:"file_type"`
+	Price       Price  `json:"price"` // String ("19.99") for exact decimals, or a legacy number
+	Quantity    int    `json:"quantity"`
+}
+
+// FulfillOrderRequest is the optional body for fulfilling an order
+type FulfillOrderRequest struct {
+	DownloadURLs map[string]string `json:"download_urls,omitempty"` // productID -> file the item is delivered as
+}
+
+// RefundRequest is the optional body for a refund. A zero amount refunds whatever is left.
+type RefundRequest struct {
+	Amount         int64  `json:"amount,omitempty"` // Amount in cents
+	Reason         string `json:"reason,omitempty"`
+	OverrideMaxAge bool   `json:"override_max_age,omitempty"` // Requires the X-Refund-Override-Token header
+}
+
+// refundReasons are the refund reasons Stripe accepts
+var refundReasons = map[string]bool{
+	string(stripe.RefundReasonDuplicate):           true,
+	string(stripe.RefundReasonFraudulent):          true,
+	string(stripe.RefundReasonRequestedByCustomer): true,
+}
+
+type CustomerCancelRequest struct {
+	TrackingID string `json:"tracking_id"`
+	Email      string `json:"email"`
 }
 
 type CreateOrderResponse struct {
@@ -52,6 +114,13 @@ type CreateOrderResponse struct {
 	CheckoutURL  string        `json:"checkout_url,omitempty"`
 }
 
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// isValidUUID reports whether id is a canonical hyphenated UUID
+func isValidUUID(id string) bool {
+	return uuidPattern.MatchString(id)
+}
+
 // generateTrackingID generates a unique tracking ID
 func generateTrackingID() string {
 	bytes := make([]byte, 8)
@@ -66,8 +135,150 @@ func generateOrderID() string {
 	return "ORD" + hex.EncodeToString(bytes)
 }
 
+// clientIP returns the request's client address without its port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// defaultCurrency is the currency of requests that don't name one
+func (h *Handlers) defaultCurrency() string {
+	if h.Config.DefaultCurrency != "" {
+		return h.Config.DefaultCurrency
+	}
+	return config.DefaultCurrency
+}
+
+// maxItemQuantity is the most of one item an order can have
+const maxItemQuantity = 1000
+
+// buildOrderItems converts requested items into order items, defaulting quantities to 1,
+// and returns them with their total in the currency's smallest unit. The total is summed exactly,
+// so a quantity over maxItemQuantity or a total too large for int64 is an error rather than wrapping.
+func (h *Handlers) buildOrderItems(ctx context.Context, items []OrderItemRequest, currency string) ([]models.OrderItem, int64, error) {
+	total := decimal.Zero
+	orderItems := make([]models.OrderItem, len(items))
+	imageURLs := make(map[string]string)
+	for i, item := range items {
+		if item.Quantity <= 0 {
+			item.Quantity = 1
+		}
+		if item.Quantity > maxItemQuantity {
+			return nil, 0, fmt.Errorf("quantity %d exceeds the maximum of %d", item.Quantity, maxItemQuantity)
+		}
+		total = total.Add(item.Price.minorUnitsDecimal(currency).Mul(decimal.NewFromInt(int64(item.Quantity))))
+		if total.GreaterThan(decimal.NewFromInt(math.MaxInt64)) {
+			return nil, 0, errors.New("order total is too large")
+		}
+
+		orderItems[i] = models.OrderItem{
+			ProductID:   item.ProductID,
+			ProductName: item.ProductName,
+			FileType:    item.FileType,
+			Price:       item.Price.Float64(),
+			Quantity:    item.Quantity,
+			DownloadURL: h.catalogDownloadURL(item.ProductID),
+		}
+
+		imageURL, resolved := imageURLs[item.ProductID]
+		if !resolved {
+			imageURL = h.productImageURL(ctx, item.ProductID)
+			imageURLs[item.ProductID] = imageURL
+		}
+		orderItems[i].ImageURL = imageURL
+	}
+	return orderItems, total.IntPart(), nil
+}
+
+// productImageURL returns the first image of a product from the local catalog or, without one,
+// from Stripe through the product cache. Emails show it, so it never comes from the client.
+// A product that can't be found has no image.
+func (h *Handlers) productImageURL(ctx context.Context, productID string) string {
+	var images []string
+	if h.Catalog != nil {
+		product, err := h.Catalog.GetProduct(productID)
+		if err != nil {
+			return ""
+		}
+		images = product.Images
+	} else {
+		product, err := h.getStripeProduct(ctx, productID)
+		if err != nil {
+			h.Logger.Warn("Failed to look up product image", "product_id", productID, "error", err)
+			return ""
+		}
+		images = product.Images
+	}
+	if len(images) == 0 {
+		return ""
+	}
+	return images[0]
+}
+
+// Stripe's limits on object metadata
+const (
+	stripeMetadataMaxKeys     = 50
+	stripeMetadataMaxKeyLen   = 40
+	stripeMetadataMaxValueLen = 500
+)
+
+// validateStripeMetadata returns an error if metadata can't be sent to Stripe as is
+func validateStripeMetadata(metadata map[string]string) error {
+	if len(metadata) > stripeMetadataMaxKeys {
+		return fmt.Errorf("at most %d keys are allowed, got %d", stripeMetadataMaxKeys, len(metadata))
+	}
+	for key, value := range metadata {
+		if key == "" || utf8.RuneCountInString(key) > stripeMetadataMaxKeyLen {
+			return fmt.Errorf("key %q must be 1 to %d characters", key, stripeMetadataMaxKeyLen)
+		}
+		if utf8.RuneCountInString(value) > stripeMetadataMaxValueLen {
+			return fmt.Errorf("value for %q is longer than %d characters", key, stripeMetadataMaxValueLen)
+		}
+	}
+	return nil
+}
+
+// reservedStripeMetadataKeys are the payment intent metadata keys the API sets itself. Callers can't
+// set them even when the order leaves them out, so a non-exempt order can't claim "tax_exempt".
+var reservedStripeMetadataKeys = map[string]bool{
+	"order_id":         true,
+	"tracking_id":      true,
+	"customer_email":   true,
+	"coupon_code":      true,
+	"tax_exempt":       true,
+	"tax_exemption_id": true,
+}
+
+// mergeStripeMetadata adds the caller's metadata to the built-in keys, leaving out reserved keys.
+// Caller keys that no longer fit under Stripe's key limit are dropped in key order and returned.
+func mergeStripeMetadata(builtin, extra map[string]string) (map[string]string, []string) {
+	keys := make([]string, 0, len(extra))
+	for key := range extra {
+		if _, ok := builtin[key]; !ok && !reservedStripeMetadataKeys[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	merged := make(map[string]string, len(builtin)+len(keys))
+	for key, value := range builtin {
+		merged[key] = value
+	}
+	for i, key := range keys {
+		if len(merged) >= stripeMetadataMaxKeys {
+			return merged, keys[i:]
+		}
+		merged[key] = extra[key]
+	}
+	return merged, nil
+}
+
 // CreateOrder creates a new order with payment tracking
 func (h *Handlers) CreateOrder(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 	var req CreateOrderRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		respondWithError(w, http.StatusBadRequest, "Invalid request body: "+err.Error())
@@ -79,90 +290,337 @@ func (h *Handlers) CreateOrder(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusBadRequest, "Customer email is required")
 		return
 	}
+	// Stored normalized so customer history lookups find every order
+	email, err := models.ValidateEmail(req.CustomerInfo.Email)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid customer email: "+err.Error())
+		return
+	}
+	req.CustomerInfo.Email = email
 	if len(req.Items) == 0 {
 		respondWithError(w, http.StatusBadRequest, "At least one item is required")
 		return
 	}
+	// Saved payment details only ever come from Stripe
+	req.CustomerInfo.StripeCustomerID = ""
+	req.CustomerInfo.SavedPaymentMethodID = ""
+	// The IP address comes from the connection, which RealIP rewrites from X-Forwarded-For behind a trusted proxy
+	req.CustomerInfo.IPAddress = clientIP(r)
 
-	// Calculate total amount
-	var totalAmount int64
-	orderItems := make([]models.OrderItem, len(req.Items))
-	for i, item := range req.Items {
-		if item.Quantity <= 0 {
-			item.Quantity = 1
+	if !req.CustomerInfo.TaxExempt {
+		req.CustomerInfo.TaxExemptionID = ""
+	} else if h.Config.RequireTaxExemptionID && req.CustomerInfo.TaxExemptionID == "" {
+		respondWithError(w, http.StatusBadRequest, "Tax exemption ID is required for tax-exempt orders")
+		return
+	}
+
+	currency := h.defaultCurrency()
+	if req.Currency != "" {
+		if currency, err = models.ValidateCurrency(req.Currency); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid currency: "+err.Error())
+			return
 		}
-		itemTotal := int64(item.Price * 100 * float64(item.Quantity)) // Convert to cents
-		totalAmount += itemTotal
+	}
 
-		orderItems[i] = models.OrderItem{
-			ProductID:   item.ProductID,
-			ProductName: item.ProductName,
-			FileType:    item.FileType,
-			Price:       item.Price,
-			Quantity:    item.Quantity,
+	// Metadata is passed through to the payment intent, so it has to fit Stripe's limits
+	if err := validateStripeMetadata(req.Metadata); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid metadata: "+err.Error())
+		return
+	}
+
+	if h.Config.VerifyPrices {
+		if status, err := h.verifyItemPrices(ctx, req.Items, currency); err != nil {
+			respondWithError(w, status, "Invalid item price: "+err.Error())
+			return
+		}
+	}
+
+	// Client-generated IDs make creation idempotent: a repeat returns the existing order
+	orderID := generateOrderID()
+	if req.ID != "" {
+		if !isValidUUID(req.ID) {
+			respondWithError(w, http.StatusBadRequest, "Order ID must be a valid UUID")
+			return
+		}
+		if existing, err := h.PaymentStore.GetOrder(ctx, req.ID); err == nil {
+			h.respondWithExistingOrder(ctx, w, existing, &req, currency)
+			return
 		}
+		orderID = req.ID
+	}
+
+	// An Idempotency-Key maps retries of the same checkout to one order. The key is released if the
+	// order isn't created, so a retry after a failure starts over.
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	created := false
+	if idempotencyKey != "" {
+		ttl := h.Config.IdempotencyTTL
+		if ttl <= 0 {
+			ttl = 24 * time.Hour
+		}
+		existingID, err := h.PaymentStore.ClaimOrderIdempotencyKey(ctx, idempotencyKey, orderID, ttl)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to check idempotency key: "+err.Error())
+			return
+		}
+		if existingID != "" {
+			existing, err := h.PaymentStore.GetOrder(ctx, existingID)
+			// A key reused for a different checkout must not hand out the first checkout's order
+			if err == nil && !req.matchesOrder(existing, currency) {
+				respondWithError(w, http.StatusUnprocessableEntity, "Idempotency-Key was already used for a different order")
+				return
+			}
+			if err != nil || existing.Payment.StripePaymentIntentID == "" {
+				respondWithError(w, http.StatusConflict, "An order for this Idempotency-Key is still being created")
+				return
+			}
+			h.respondWithExistingOrder(ctx, w, existing, nil, currency)
+			return
+		}
+		defer func() {
+			if !created {
+				h.PaymentStore.ReleaseOrderIdempotencyKey(ctx, idempotencyKey, orderID)
+			}
+		}()
 	}
 
+	// Calculate total amount
+	orderItems, totalAmount, err := h.buildOrderItems(ctx, req.Items, currency)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid items: "+err.Error())
+		return
+	}
+	if totalAmount <= 0 {
+		respondWithError(w, http.StatusBadRequest, "Order total must be greater than zero")
+		return
+	}
+
+	// A coupon's use is counted now and given back if the order isn't created, or by the store when it's canceled
+	var discount int64
+	couponReleased := false
+	couponCode := models.NormalizeCouponCode(req.CouponCode)
+	if couponCode != "" {
+		var err error
+		discount, err = h.PaymentStore.ValidateCoupon(ctx, couponCode, totalAmount, currency)
+		if err != nil {
+			if isCouponRejection(err) {
+				respondWithError(w, http.StatusBadRequest, "Invalid coupon: "+err.Error())
+				return
+			}
+			respondWithError(w, http.StatusInternalServerError, "Failed to apply coupon: "+err.Error())
+			return
+		}
+		defer func() {
+			if !created && !couponReleased {
+				h.PaymentStore.ReleaseCoupon(ctx, couponCode)
+			}
+		}()
+		if discount >= totalAmount {
+			respondWithError(w, http.StatusBadRequest, "Coupon covers the whole order, which can't be charged")
+			return
+		}
+		totalAmount -= discount
+	}
+
+	// A total this large is a client bug, so don't let it reach Stripe
+	if limit := h.Config.MaxOrderAmount; limit > 0 && totalAmount > limit {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Order total of %d exceeds the maximum of %d", totalAmount, limit))
+		return
+	}
+
+	// Link the order to the buyer's Stripe customer so returning buyers can reuse saved cards.
+	// Without one the order can still be paid, so a Stripe customer failure isn't fatal.
+	customerID, err := h.findOrCreateStripeCustomer(ctx, req.CustomerInfo)
+	if err != nil {
+		h.Logger.Warn("Failed to find or create Stripe customer", "order_id", orderID, "error", err)
+	}
+	req.CustomerInfo.StripeCustomerID = customerID
+
 	// Create order
 	order := &models.Order{
-		ID:           generateOrderID(),
+		ID:           orderID,
 		TrackingID:   generateTrackingID(),
 		CustomerInfo: req.CustomerInfo,
 		Items:        orderItems,
 		Payment: models.PaymentInfo{
-			Amount:   totalAmount,
-			Currency: "usd", // Default to USD
-			Status:   models.PaymentStatusPending,
+			Amount:         totalAmount,
+			DiscountAmount: discount,
+			Currency:       currency,
+			Status:         models.PaymentStatusPending,
 		},
-		Status:   models.OrderStatusCreated,
-		Metadata: req.Metadata,
+		Status:     models.OrderStatusCreated,
+		Metadata:   req.Metadata,
+		CouponCode: couponCode,
 	}
 
 	// Store the order
-	if err := h.PaymentStore.CreateOrder(order); err != nil {
+	if err := h.PaymentStore.CreateOrder(ctx, order); err != nil {
+		// A concurrent request with the same client ID won the race
+		if errors.Is(err, store.ErrOrderExists) {
+			if existing, getErr := h.PaymentStore.GetOrder(ctx, order.ID); getErr == nil {
+				h.respondWithExistingOrder(ctx, w, existing, &req, currency)
+				return
+			}
+		}
 		respondWithError(w, http.StatusInternalServerError, "Failed to create order: "+err.Error())
 		return
 	}
 
-	// Create Stripe payment intent
+	// Hooks may enrich the stored order
+	if err := h.runOrderCreatedHooks(ctx, order); err != nil {
+		if stored, getErr := h.PaymentStore.GetOrder(ctx, order.ID); getErr == nil && stored.Status == models.OrderStatusCanceled {
+			couponReleased = true
+		}
+		respondWithError(w, http.StatusInternalServerError, "Order hook failed")
+		return
+	}
+
+	pi, err := h.startOrderPayment(ctx, order, &req)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	ctx = context.WithoutCancel(ctx)
+
+	// Log payment event
+	eventData := map[string]interface{}{"payment_intent_id": pi.ID}
+	if order.CustomerInfo.IPAddress != "" {
+		eventData["ip_address"] = order.CustomerInfo.IPAddress
+	}
+	if order.CouponCode != "" {
+		eventData["coupon_code"] = order.CouponCode
+		eventData["discount_amount"] = order.Payment.DiscountAmount
+	}
+	if order.CustomerInfo.TaxExempt {
+		eventData["tax_exempt"] = true
+		eventData["tax_exemption_id"] = order.CustomerInfo.TaxExemptionID
+	}
+	h.PaymentStore.AddPaymentEvent(ctx, models.PaymentEvent{
+		OrderID:   order.ID,
+		EventType: "order_created",
+		Status:    models.PaymentStatusPending,
+		Data:      eventData,
+	})
+
+	if h.EmailService != nil && h.Config.EmailOnOrderCreate {
+		if err := h.EmailService.SendOrderConfirmation(order); err != nil {
+			h.Logger.Error("Failed to send order confirmation", "order_id", order.ID, "error", err)
+		}
+	}
+
+	response := CreateOrderResponse{
+		Order:        order,
+		ClientSecret: pi.ClientSecret,
+	}
+
+	created = true
+	h.Metrics.orderCreated(order)
+	respondWithJSON(w, http.StatusCreated, response)
+}
+
+// startOrderPayment creates the payment intent for a stored order and moves the order to pending.
+// The intent is created idempotently per order, so a retry for the same order gets the same intent
+// while a new order never collides with an earlier one's parameters.
+func (h *Handlers) startOrderPayment(ctx context.Context, order *models.Order, req *CreateOrderRequest) (*stripe.PaymentIntent, error) {
 	params := &stripe.PaymentIntentParams{
-		Amount:   stripe.Int64(totalAmount),
-		Currency: stripe.String("usd"),
+		Amount:   stripe.Int64(order.Payment.Amount),
+		Currency: stripe.String(order.Payment.Currency),
 		Metadata: map[string]string{
 			"order_id":       order.ID,
 			"tracking_id":    order.TrackingID,
-			"customer_email": req.CustomerInfo.Email,
+			"customer_email": order.CustomerInfo.Email,
 		},
 	}
+	params.SetIdempotencyKey("order-" + order.ID)
+	if order.CustomerInfo.StripeCustomerID != "" {
+		params.Customer = stripe.String(order.CustomerInfo.StripeCustomerID)
+	}
+	if req.SavePaymentMethod {
+		params.SetupFutureUsage = stripe.String(string(stripe.PaymentIntentSetupFutureUsageOffSession))
+	}
+	h.setAutomaticPaymentMethods(params)
+	if order.CouponCode != "" {
+		params.Metadata["coupon_code"] = order.CouponCode
+	}
+	if order.CustomerInfo.TaxExempt {
+		params.Metadata["tax_exempt"] = "true"
+		params.Metadata["tax_exemption_id"] = order.CustomerInfo.TaxExemptionID
+	}
+	var dropped []string
+	params.Metadata, dropped = mergeStripeMetadata(params.Metadata, req.Metadata)
+	if len(dropped) > 0 {
+		h.Logger.Warn("Metadata keys left off the payment intent", "order_id", order.ID, "keys", dropped)
+	}
 
-	pi, err := paymentintent.New(params)
+	pi, err := h.Gateway.CreatePaymentIntent(ctx, params)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to create payment intent: "+err.Error())
-		return
+		return nil, fmt.Errorf("Failed to create payment intent: %w", err)
 	}
+	// The intent exists in Stripe now, so link it to the order even if the client has gone away
+	ctx = context.WithoutCancel(ctx)
 
 	// Update order with payment intent ID
 	order.Payment.StripePaymentIntentID = pi.ID
 	order.Status = models.OrderStatusPending
-	if err := h.PaymentStore.UpdateOrder(order); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to update order: "+err.Error())
+	if err := h.PaymentStore.UpdateOrder(ctx, order); err != nil {
+		return nil, fmt.Errorf("Failed to update order: %w", err)
+	}
+	return pi, nil
+}
+
+// respondWithExistingOrder returns an already-created order along with its payment intent's client
+// secret. When req is the request that asked for the order again, it must be for the same customer
+// and items, and an order whose payment intent was never created gets one now.
+func (h *Handlers) respondWithExistingOrder(ctx context.Context, w http.ResponseWriter, order *models.Order, req *CreateOrderRequest, currency string) {
+	if req != nil && !req.matchesOrder(order, currency) {
+		respondWithError(w, http.StatusConflict, "Order ID is already used by a different order")
 		return
 	}
 
-	// Log payment event
-	h.PaymentStore.AddPaymentEvent(models.PaymentEvent{
-		OrderID:   order.ID,
-		EventType: "order_created",
-		Status:    models.PaymentStatusPending,
-		Data:      map[string]interface{}{"payment_intent_id": pi.ID},
-	})
+	response := CreateOrderResponse{Order: order}
+	if order.Payment.StripePaymentIntentID == "" {
+		if req == nil || order.Status != models.OrderStatusCreated {
+			respondWithError(w, http.StatusConflict, "Order has no payment intent")
+			return
+		}
+		pi, err := h.startOrderPayment(ctx, order, req)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		response.ClientSecret = pi.ClientSecret
+		respondWithJSON(w, http.StatusOK, response)
+		return
+	}
 
-	response := CreateOrderResponse{
-		Order:        order,
-		ClientSecret: pi.ClientSecret,
+	pi, err := h.Gateway.GetPaymentIntent(ctx, order.Payment.StripePaymentIntentID, nil)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve payment intent: "+err.Error())
+		return
 	}
+	response.ClientSecret = pi.ClientSecret
 
-	respondWithJSON(w, http.StatusCreated, response)
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+// matchesOrder reports whether req asks for the same order as order: the same customer, currency,
+// and items at the same prices
+func (req *CreateOrderRequest) matchesOrder(order *models.Order, currency string) bool {
+	if req.CustomerInfo.Email != order.CustomerInfo.Email || currency != order.Payment.Currency || len(req.Items) != len(order.Items) {
+		return false
+	}
+	for i, item := range req.Items {
+		stored := order.Items[i]
+		quantity := item.Quantity
+		if quantity <= 0 {
+			quantity = 1
+		}
+		if item.ProductID != stored.ProductID || quantity != stored.Quantity ||
+			item.Price.MinorUnits(currency) != priceFromFloat64(stored.Price).MinorUnits(currency) {
+			return false
+		}
+	}
+	return true
 }
 
 // GetPaymentStatus gets the current status of a payment by order ID
@@ -173,25 +631,91 @@ func (h *Handlers) GetPaymentStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	order, err := h.PaymentStore.GetOrder(orderID)
+	order, err := h.PaymentStore.GetOrder(r.Context(), orderID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Order not found")
+		return
+	}
+
+	h.respondWithPaymentStatus(w, r, order)
+}
+
+// GetOrderByPaymentIntentID gets payment status by Stripe payment intent ID, for pages that only know
+// the intent Stripe.js confirmed
+func (h *Handlers) GetOrderByPaymentIntentID(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	paymentIntentID := chi.URLParam(r, "paymentIntentID")
+	if paymentIntentID == "" {
+		respondWithError(w, http.StatusBadRequest, "Payment intent ID is required")
+		return
+	}
+
+	orderID, err := h.PaymentStore.FindOrderByPaymentIntentID(ctx, paymentIntentID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Order not found")
+		return
+	}
+	order, err := h.PaymentStore.GetOrder(ctx, orderID)
 	if err != nil {
 		respondWithError(w, http.StatusNotFound, "Order not found")
 		return
 	}
 
+	h.respondWithPaymentStatus(w, r, order)
+}
+
+// respondWithPaymentStatus syncs an order's payment status from Stripe and writes the status payload
+func (h *Handlers) respondWithPaymentStatus(w http.ResponseWriter, r *http.Request, order *models.Order) {
+	ctx := r.Context()
 	// If we have a Stripe payment intent, sync the status
 	if order.Payment.StripePaymentIntentID != "" {
-		pi, err := paymentintent.Get(order.Payment.StripePaymentIntentID, nil)
+		var params *stripe.PaymentIntentParams
+		if order.Payment.Method == "" {
+			// The latest charge says how the intent was paid
+			params = &stripe.PaymentIntentParams{}
+			params.AddExpand("latest_charge")
+		}
+
+		pi, err := h.Gateway.GetPaymentIntent(ctx, order.Payment.StripePaymentIntentID, params)
 		if err == nil {
+			changed := false
+
 			// Update our local status if it differs
 			stripeStatus := convertStripeStatus(string(pi.Status))
 			if stripeStatus != order.Payment.Status {
-				h.PaymentStore.UpdatePaymentStatus(order.ID, stripeStatus)
+				h.PaymentStore.UpdatePaymentStatus(ctx, order.ID, stripeStatus)
 				order.Payment.Status = stripeStatus
+				changed = true
+			}
+
+			// Backfill the payment method of orders paid without it being recorded
+			if order.Payment.Method == "" && stripeStatus == models.PaymentStatusSucceeded {
+				var method models.PaymentMethod
+				if pi.LatestCharge != nil {
+					method = chargePaymentMethod(pi.LatestCharge)
+				}
+				if method == "" {
+					method = getPaymentMethod(pi.PaymentMethod)
+				}
+				if err := h.PaymentStore.UpdatePaymentMethod(ctx, order.ID, method); err != nil {
+					h.Logger.Error("Failed to update payment method", "order_id", order.ID, "error", err)
+				}
+				changed = true
+			}
+
+			// Reload so the ETag matches what the next poll will see
+			if changed {
+				if updated, err := h.PaymentStore.GetOrder(ctx, order.ID); err == nil {
+					order = updated
+				}
 			}
 		}
 	}
 
+	if notModified(w, r, orderETag(order)) {
+		return
+	}
+
 	respondWithJSON(w, http.StatusOK, map[string]interface{}{
 		"order_id":       order.ID,
 		"tracking_id":    order.TrackingID,
@@ -212,31 +736,75 @@ func (h *Handlers) GetOrderDetails(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	order, err := h.PaymentStore.GetOrder(orderID)
+	order, err := h.PaymentStore.GetOrder(r.Context(), orderID)
 	if err != nil {
 		respondWithError(w, http.StatusNotFound, "Order not found")
 		return
 	}
 
+	if notModified(w, r, orderETag(order)) {
+		return
+	}
+
 	respondWithJSON(w, http.StatusOK, order)
 }
 
-// TrackPayment tracks a payment by tracking ID
+// GetOrderByStripeID retrieves full order details by Stripe payment intent or checkout session ID (admin endpoint)
+func (h *Handlers) GetOrderByStripeID(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	stripeID := chi.URLParam(r, "stripeID")
+	if stripeID == "" {
+		respondWithError(w, http.StatusBadRequest, "Stripe ID is required")
+		return
+	}
+
+	orderID := h.findOrderByPaymentIntentID(ctx, stripeID)
+	if orderID == "" {
+		orderID = h.findOrderBySessionID(ctx, stripeID)
+	}
+	if orderID == "" {
+		respondWithError(w, http.StatusNotFound, "Order not found")
+		return
+	}
+
+	order, err := h.PaymentStore.GetOrder(r.Context(), orderID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Order not found")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, order)
+}
+
+// TrackPayment tracks a payment by tracking ID, requiring a signed token when TRACKING_TOKEN_SECRET is set
 func (h *Handlers) TrackPayment(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 	trackingID := chi.URLParam(r, "trackingID")
 	if trackingID == "" {
 		respondWithError(w, http.StatusBadRequest, "Tracking ID is required")
 		return
 	}
 
-	order, err := h.PaymentStore.GetOrderByTrackingID(trackingID)
+	// Check the token before looking the order up so guessed tracking IDs reveal nothing
+	if secret := h.Config.TrackingTokenSecret; secret != "" {
+		if !services.ValidTrackingToken(secret, trackingID, r.URL.Query().Get("token")) {
+			respondWithError(w, http.StatusForbidden, "Invalid tracking token")
+			return
+		}
+	}
+
+	order, err := h.PaymentStore.GetOrderByTrackingID(ctx, trackingID)
 	if err != nil {
 		respondWithError(w, http.StatusNotFound, "Order not found")
 		return
 	}
 
 	// Get payment events
-	events, _ := h.PaymentStore.GetPaymentEvents(order.ID)
+	events, err := h.PaymentStore.GetPaymentEvents(ctx, order.ID)
+	if err != nil {
+		h.Logger.Error("Failed to get payment events", "order_id", order.ID, "error", err)
+		events = []models.PaymentEvent{}
+	}
 
 	response := map[string]interface{}{
 		"order":  order,
@@ -246,7 +814,7 @@ func (h *Handlers) TrackPayment(w http.ResponseWriter, r *http.Request) {
 	respondWithJSON(w, http.StatusOK, response)
 }
 
-// GetCustomerPayments retrieves all payments for a customer
+// GetCustomerPayments retrieves a page of a customer's order summaries, newest first
 func (h *Handlers) GetCustomerPayments(w http.ResponseWriter, r *http.Request) {
 	email := chi.URLParam(r, "email")
 	if email == "" {
@@ -254,7 +822,18 @@ func (h *Handlers) GetCustomerPayments(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	orders, err := h.PaymentStore.GetCustomerOrders(email)
+	if normalized, err := models.ValidateEmail(email); err == nil {
+		email = normalized
+	}
+
+	// Summaries keep item lists and Stripe IDs out of the history; GetOrderDetails has the full order
+	limit, offset := parsePagination(r)
+	orders, err := h.PaymentStore.GetCustomerOrderSummaries(r.Context(), email, limit, offset)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve customer orders")
+		return
+	}
+	total, err := h.PaymentStore.CountCustomerOrders(r.Context(), email)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve customer orders")
 		return
@@ -263,46 +842,178 @@ func (h *Handlers) GetCustomerPayments(w http.ResponseWriter, r *http.Request) {
 	respondWithJSON(w, http.StatusOK, map[string]interface{}{
 		"customer_email": email,
 		"orders":         orders,
-		"total_orders":   len(orders),
+		"total_orders":   total,
+		"limit":          limit,
+		"offset":         offset,
 	})
 }
 
-// GetAllPayments retrieves all payments (admin endpoint)
-func (h *Handlers) GetAllPayments(w http.ResponseWriter, r *http.Request) {
-	// Parse pagination parameters
-	limitStr := r.URL.Query().Get("limit")
-	offsetStr := r.URL.Query().Get("offset")
+// parsePagination reads the limit (default 50) and offset query parameters, ignoring invalid values
+func parsePagination(r *http.Request) (limit, offset int) {
+	limit = 50
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 {
+		limit = l
+	}
+	if o, err := strconv.Atoi(r.URL.Query().Get("offset")); err == nil && o >= 0 {
+		offset = o
+	}
+	return limit, offset
+}
+
+// parseOrderFilter reads the status, from, and to (RFC3339) query parameters of an order listing.
+// Archived orders are left out unless include_archived=true.
+func parseOrderFilter(r *http.Request) (models.OrderFilter, error) {
+	query := r.URL.Query()
+	filter := models.OrderFilter{IncludeArchived: includeArchived(r)}
 
-	limit := 50 // default
-	if limitStr != "" {
-		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
-			limit = l
+	if status := query.Get("status"); status != "" {
+		filter.Status = models.OrderStatus(status)
+		valid := false
+		for _, known := range models.OrderStatuses {
+			if filter.Status == known {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return filter, fmt.Errorf("Unknown order status: %s", status)
 		}
 	}
 
-	offset := 0 // default
-	if offsetStr != "" {
-		if o, err := strconv.Atoi(offsetStr); err == nil && o >= 0 {
-			offset = o
+	from, to, err := parseDateRange(r)
+	if err != nil {
+		return filter, err
+	}
+	filter.From, filter.To = from, to
+
+	return filter, nil
+}
+
+// includeArchived reports whether a listing or stats request asked for archived orders too
+func includeArchived(r *http.Request) bool {
+	return r.URL.Query().Get("include_archived") == "true"
+}
+
+// parseDateRange reads the optional from and to (RFC3339) query parameters, returning nil for those not given
+func parseDateRange(r *http.Request) (from, to *time.Time, err error) {
+	for _, param := range []struct {
+		name string
+		dst  **time.Time
+	}{{"from", &from}, {"to", &to}} {
+		value := r.URL.Query().Get(param.name)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid %s date, expected RFC3339: %s", param.name, value)
 		}
+		*param.dst = &t
+	}
+
+	if from != nil && to != nil && from.After(*to) {
+		return nil, nil, fmt.Errorf("The from date must not be after the to date")
+	}
+
+	return from, to, nil
+}
+
+// GetAllPayments retrieves all payments (admin endpoint)
+func (h *Handlers) GetAllPayments(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	limit, offset := parsePagination(r)
+
+	filter, err := parseOrderFilter(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
 	}
 
-	orders, err := h.PaymentStore.GetAllOrders(limit, offset)
+	orders, err := h.PaymentStore.GetAllOrders(ctx, limit, offset, filter)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve orders")
 		return
 	}
 
+	total, err := h.PaymentStore.CountOrders(ctx, filter)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to count orders")
+		return
+	}
+
 	respondWithJSON(w, http.StatusOK, map[string]interface{}{
 		"orders": orders,
+		"total":  total,
 		"limit":  limit,
 		"offset": offset,
 	})
 }
 
-// GetPaymentStats retrieves payment statistics
+// maxSearchResults caps how many orders SearchOrders returns
+const maxSearchResults = 100
+
+// SearchOrders finds orders whose email, customer name, or tracking ID contains q, newest first (admin endpoint)
+func (h *Handlers) SearchOrders(w http.ResponseWriter, r *http.Request) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		respondWithError(w, http.StatusBadRequest, "Search query is required")
+		return
+	}
+
+	limit := 20 // default
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 {
+		limit = l
+	}
+	if limit > maxSearchResults {
+		limit = maxSearchResults
+	}
+
+	orders, err := h.PaymentStore.SearchOrders(r.Context(), query, limit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to search orders")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"orders": orders,
+		"query":  query,
+		"limit":  limit,
+	})
+}
+
+// statsCurrency returns the currency stats amounts are reported in, from the currency parameter
+// or DEFAULT_CURRENCY
+func (h *Handlers) statsCurrency(r *http.Request) (string, error) {
+	currency := r.URL.Query().Get("currency")
+	if currency == "" {
+		return h.defaultCurrency(), nil
+	}
+	return models.ValidateCurrency(currency)
+}
+
+// GetPaymentStats retrieves payment statistics, leaving out archived orders unless include_archived=true
 func (h *Handlers) GetPaymentStats(w http.ResponseWriter, r *http.Request) {
-	stats, err := h.PaymentStore.GetPaymentStats()
+	from, to, err := parseDateRange(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	currency, err := h.statsCurrency(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid currency: "+err.Error())
+		return
+	}
+
+	// Without a range the stats cover every order
+	var fromTime, toTime time.Time
+	if from != nil {
+		fromTime = *from
+	}
+	if to != nil {
+		toTime = *to
+	}
+
+	stats, err := h.PaymentStore.GetPaymentStatsRange(r.Context(), fromTime, toTime, includeArchived(r), currency)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve payment stats")
 		return
@@ -311,55 +1022,253 @@ func (h *Handlers) GetPaymentStats(w http.ResponseWriter, r *http.Request) {
 	respondWithJSON(w, http.StatusOK, stats)
 }
 
+// Daily revenue covers the last defaultRevenueDays days unless a range is given, and at most maxRevenueDays
+const (
+	defaultRevenueDays = 30
+	maxRevenueDays     = 366
+)
+
+// GetDailyRevenue returns paid revenue in one currency per UTC day between the optional from and to dates,
+// with zero days filled in, leaving out archived orders unless include_archived=true (admin endpoint)
+func (h *Handlers) GetDailyRevenue(w http.ResponseWriter, r *http.Request) {
+	from, to, err := parseDateRange(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	currency, err := h.statsCurrency(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid currency: "+err.Error())
+		return
+	}
+
+	if to == nil {
+		now := time.Now().UTC()
+		to = &now
+	}
+	if from == nil {
+		start := to.UTC().Truncate(24*time.Hour).AddDate(0, 0, 1-defaultRevenueDays)
+		from = &start
+	}
+	if to.Sub(*from) > maxRevenueDays*24*time.Hour {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Date range must be at most %d days", maxRevenueDays))
+		return
+	}
+
+	days, err := h.PaymentStore.GetRevenueByDay(r.Context(), *from, *to, currency, includeArchived(r))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve daily revenue")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"from":     from,
+		"to":       to,
+		"currency": currency,
+		"days":     days,
+	})
+}
+
 // FulfillOrder marks an order as fulfilled
 func (h *Handlers) FulfillOrder(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 	orderID := chi.URLParam(r, "orderID")
 	if orderID == "" {
 		respondWithError(w, http.StatusBadRequest, "Order ID is required")
 		return
 	}
 
+	var req FulfillOrderRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body: "+err.Error())
+		return
+	}
+
+	// Serialize fulfillment so a retried request doesn't run the hooks twice
+	unlock := h.orderLocks.Lock(orderID)
+	defer unlock()
+
 	// Check if order exists and is paid
-	order, err := h.PaymentStore.GetOrder(orderID)
+	order, err := h.PaymentStore.GetOrder(ctx, orderID)
 	if err != nil {
 		respondWithError(w, http.StatusNotFound, "Order not found")
 		return
 	}
 
+	if order.Status == models.OrderStatusFulfilled {
+		respondWithFulfillment(w, order.ID, order.FulfilledAt, true)
+		return
+	}
 	if order.Status != models.OrderStatusPaid {
-		respondWithError(w, http.StatusBadRequest, "Order must be paid before fulfillment")
+		respondWithError(w, http.StatusConflict, "Order must be paid before fulfillment")
 		return
 	}
 
-	// Update order status
-	if err := h.PaymentStore.UpdateOrderStatus(orderID, models.OrderStatusFulfilled); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to fulfill order")
+	for productID := range req.DownloadURLs {
+		if !orderHasProduct(order, productID) {
+			respondWithError(w, http.StatusBadRequest, "Order has no item for product: "+productID)
+			return
+		}
+	}
+	if err := h.storeDownloadURLs(ctx, order, req.DownloadURLs); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to save download URLs")
 		return
 	}
 
-	// Log fulfillment event
-	h.PaymentStore.AddPaymentEvent(models.PaymentEvent{
-		OrderID:   orderID,
+	fulfilledAt, alreadyFulfilled, err := h.fulfillPaidOrder(ctx, order, nil)
+	if err != nil {
+		switch {
+		case errors.Is(err, errFulfillHookFailed):
+			respondWithError(w, http.StatusInternalServerError, "Order hook failed")
+		case errors.Is(err, models.ErrInvalidStatusTransition):
+			respondWithError(w, http.StatusConflict, "Order cannot be fulfilled: "+err.Error())
+		default:
+			respondWithError(w, http.StatusInternalServerError, "Failed to fulfill order")
+		}
+		return
+	}
+
+	respondWithFulfillment(w, orderID, &fulfilledAt, alreadyFulfilled)
+}
+
+// errFulfillHookFailed wraps the OnOrderFulfilled hook error that stopped a fulfillment
+var errFulfillHookFailed = errors.New("order hook failed")
+
+// fulfillPaidOrder fulfills a paid order for FulfillOrder, FulfillOrders, and automatic digital
+// fulfillment: it runs the fulfilled hooks, marks the order fulfilled, records the fulfillment event
+// with eventData, and emails the customer their download links in the background. Callers hold the
+// order's lock and have already stored its download URLs.
+func (h *Handlers) fulfillPaidOrder(ctx context.Context, order *models.Order, eventData map[string]interface{}) (time.Time, bool, error) {
+	if err := h.runHooks("OnOrderFulfilled", order, OrderHook.OnOrderFulfilled); err != nil {
+		return time.Time{}, false, fmt.Errorf("%w: %v", errFulfillHookFailed, err)
+	}
+
+	// The store only lets one caller move the order to fulfilled, so an order fulfilled in the
+	// meantime, e.g. by another instance, is reported without logging or emailing a second fulfillment
+	fulfilledAt, alreadyFulfilled, err := h.PaymentStore.MarkOrderFulfilled(ctx, order.ID)
+	if err != nil {
+		h.Logger.Error("Failed to fulfill order", "order_id", order.ID, "error", err)
+		return time.Time{}, false, err
+	}
+	if alreadyFulfilled {
+		return fulfilledAt, true, nil
+	}
+
+	data := map[string]interface{}{"fulfilled_at": fulfilledAt}
+	for key, value := range eventData {
+		data[key] = value
+	}
+	h.PaymentStore.AddPaymentEvent(ctx, models.PaymentEvent{
+		OrderID:   order.ID,
 		EventType: "order_fulfilled",
 		Status:    models.PaymentStatusSucceeded,
-		Data:      map[string]interface{}{"fulfilled_at": time.Now()},
+		Data:      data,
 	})
 
-	respondWithJSON(w, http.StatusOK, map[string]string{
-		"message":  "Order fulfilled successfully",
-		"order_id": orderID,
+	if h.EmailService != nil {
+		h.RunInBackground(func() {
+			if err := h.EmailService.SendFulfillmentEmail(order, h.EmailService.DownloadURLs(order)); err != nil {
+				h.Logger.Error("Failed to send fulfillment email", "order_id", order.ID, "error", err)
+			}
+		})
+	}
+	return fulfilledAt, false, nil
+}
+
+// respondWithFulfillment reports an order's fulfillment; repeating a fulfillment succeeds with the original time
+func respondWithFulfillment(w http.ResponseWriter, orderID string, fulfilledAt *time.Time, alreadyFulfilled bool) {
+	message := "Order fulfilled successfully"
+	if alreadyFulfilled {
+		message = "Order already fulfilled"
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"message":           message,
+		"order_id":          orderID,
+		"fulfilled_at":      fulfilledAt,
+		"already_fulfilled": alreadyFulfilled,
 	})
 }
 
-// RefundOrder processes a refund for an order
+// orderHasProduct reports whether an order has an item for a product
+func orderHasProduct(order *models.Order, productID string) bool {
+	for _, item := range order.Items {
+		if item.ProductID == productID {
+			return true
+		}
+	}
+	return false
+}
+
+// storeDownloadURLs saves the download URL of each of an order's items, taking it from urls or, for
+// items that have none yet, the catalog, and updates order.Items to match
+func (h *Handlers) storeDownloadURLs(ctx context.Context, order *models.Order, urls map[string]string) error {
+	for i, item := range order.Items {
+		url, ok := urls[item.ProductID]
+		if !ok && item.DownloadURL == "" {
+			url = h.catalogDownloadURL(item.ProductID)
+		}
+		if url == "" || url == item.DownloadURL {
+			continue
+		}
+
+		if err := h.PaymentStore.SetItemDownloadURL(ctx, order.ID, item.ProductID, url); err != nil {
+			h.Logger.Error("Failed to save download URL", "order_id", order.ID, "product_id", item.ProductID, "error", err)
+			return err
+		}
+		order.Items[i].DownloadURL = url
+	}
+	return nil
+}
+
+// refundTooOld reports whether an order was paid longer ago than MaxRefundAge
+func (h *Handlers) refundTooOld(order *models.Order) bool {
+	if h.Config.MaxRefundAge <= 0 {
+		return false
+	}
+	paidAt := order.CreatedAt
+	if order.Payment.ProcessedAt != nil {
+		paidAt = *order.Payment.ProcessedAt
+	}
+	return time.Since(paidAt) > h.Config.MaxRefundAge
+}
+
+// validRefundOverride reports whether a request carries the configured refund override token
+func (h *Handlers) validRefundOverride(r *http.Request) bool {
+	token := r.Header.Get("X-Refund-Override-Token")
+	if h.Config.RefundOverrideToken == "" || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(h.Config.RefundOverrideToken)) == 1
+}
+
+// RefundOrder refunds an order's payment through Stripe, in full or for the amount in an optional request body
 func (h *Handlers) RefundOrder(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 	orderID := chi.URLParam(r, "orderID")
 	if orderID == "" {
 		respondWithError(w, http.StatusBadRequest, "Order ID is required")
 		return
 	}
 
-	order, err := h.PaymentStore.GetOrder(orderID)
+	var req RefundRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body: "+err.Error())
+		return
+	}
+	if req.Amount < 0 {
+		respondWithError(w, http.StatusBadRequest, "Refund amount must be positive")
+		return
+	}
+	if req.Reason != "" && !refundReasons[req.Reason] {
+		respondWithError(w, http.StatusBadRequest, "Refund reason must be duplicate, fraudulent, or requested_by_customer")
+		return
+	}
+
+	// Serialize refunds so concurrent partial refunds can't exceed the payment
+	unlock := h.orderLocks.Lock(orderID)
+	defer unlock()
+
+	order, err := h.PaymentStore.GetOrder(ctx, orderID)
 	if err != nil {
 		respondWithError(w, http.StatusNotFound, "Order not found")
 		return
@@ -370,32 +1279,301 @@ func (h *Handlers) RefundOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Process refund with Stripe (implement based on your needs)
-	// For now, just update the status
-	if err := h.PaymentStore.UpdateOrderStatus(orderID, models.OrderStatusRefunded); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to process refund")
+	if !models.CanTransition(order.Status, models.OrderStatusRefunded) {
+		respondWithError(w, http.StatusConflict, "Order cannot be refunded in status: "+string(order.Status))
 		return
 	}
 
-	if err := h.PaymentStore.UpdatePaymentStatus(orderID, models.PaymentStatusRefunded); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to update payment status")
+	if h.refundTooOld(order) {
+		if !req.OverrideMaxAge {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Order was paid more than %d days ago and can no longer be refunded", int(h.Config.MaxRefundAge.Hours()/24)))
+			return
+		}
+		if !h.validRefundOverride(r) {
+			respondWithError(w, http.StatusForbidden, "Invalid refund override token")
+			return
+		}
+	}
+
+	remaining := order.Payment.Amount - order.Payment.AmountRefunded
+	if remaining <= 0 {
+		respondWithError(w, http.StatusBadRequest, "Order has already been fully refunded")
+		return
+	}
+	if req.Amount == 0 {
+		req.Amount = remaining
+	}
+	if req.Amount > remaining {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Refund amount exceeds the %d cents still refundable", remaining))
+		return
+	}
+
+	// Return the money through Stripe before touching local state
+	params := &stripe.RefundParams{
+		PaymentIntent: stripe.String(order.Payment.StripePaymentIntentID),
+		Amount:        stripe.Int64(req.Amount),
+	}
+	if req.Reason != "" {
+		params.Reason = stripe.String(req.Reason)
+	}
+	params.AddExpand("charge") // For the card shown in the refund email
+	re, err := h.Gateway.CreateRefund(ctx, params)
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Stripe refund failed: "+stripeErrorMessage(err))
+		return
+	}
+	// Stripe has refunded the money, so record it even if the client has gone away
+	ctx = context.WithoutCancel(ctx)
+
+	amountRefunded := order.Payment.AmountRefunded + re.Amount
+	if err := h.PaymentStore.UpdatePaymentRefund(ctx, orderID, re.ID, amountRefunded); err != nil {
+		h.refundNotRecorded(ctx, w, orderID, re, err)
+		return
+	}
+
+	// A partial refund leaves the order paid or fulfilled
+	eventType, paymentStatus := "order_partially_refunded", models.PaymentStatusPartiallyRefunded
+	if amountRefunded >= order.Payment.Amount {
+		eventType, paymentStatus = "order_refunded", models.PaymentStatusRefunded
+
+		if err := h.PaymentStore.UpdateOrderStatus(ctx, orderID, models.OrderStatusRefunded); err != nil {
+			h.refundNotRecorded(ctx, w, orderID, re, err)
+			return
+		}
+	}
+
+	if err := h.PaymentStore.UpdatePaymentStatus(ctx, orderID, paymentStatus); err != nil {
+		h.refundNotRecorded(ctx, w, orderID, re, err)
 		return
 	}
 
 	// Log refund event
-	h.PaymentStore.AddPaymentEvent(models.PaymentEvent{
+	h.PaymentStore.AddPaymentEvent(ctx, models.PaymentEvent{
 		OrderID:   orderID,
-		EventType: "order_refunded",
-		Status:    models.PaymentStatusRefunded,
-		Data:      map[string]interface{}{"refunded_at": time.Now()},
+		EventType: eventType,
+		Status:    paymentStatus,
+		Data: map[string]interface{}{
+			"refunded_at":      time.Now(),
+			"stripe_refund_id": re.ID,
+			"refund_status":    re.Status,
+			"amount":           re.Amount,
+			"amount_refunded":  amountRefunded,
+			"reason":           req.Reason,
+		},
+	})
+
+	// Partial refunds run the hooks too; the payment status tells them apart
+	if refundedOrder, err := h.PaymentStore.GetOrder(ctx, orderID); err == nil {
+		h.runHooks("OnOrderRefunded", refundedOrder, OrderHook.OnOrderRefunded)
+		h.sendRefundNotification(refundedOrder, re.Amount, chargeCardLast4(re.Charge))
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"message":         "Order refunded successfully",
+		"order_id":        orderID,
+		"refund_id":       re.ID,
+		"amount":          re.Amount,
+		"amount_refunded": amountRefunded,
+		"payment_status":  paymentStatus,
+	})
+}
+
+// refundNotRecorded handles a refund Stripe made that the store failed to record. It adds a
+// refund_not_recorded event so the refund can be reconciled, and responds 500 with the Stripe refund ID
+// so the caller syncs the order rather than retrying and refunding it again.
+func (h *Handlers) refundNotRecorded(ctx context.Context, w http.ResponseWriter, orderID string, re *stripe.Refund, err error) {
+	h.Logger.Error("Failed to record refund", "order_id", orderID, "refund_id", re.ID, "error", err)
+	eventErr := h.PaymentStore.AddPaymentEvent(ctx, models.PaymentEvent{
+		OrderID:   orderID,
+		EventType: "refund_not_recorded",
+		Data: map[string]interface{}{
+			"stripe_refund_id": re.ID,
+			"amount":           re.Amount,
+			"error":            err.Error(),
+		},
+	})
+	if eventErr != nil {
+		h.Logger.Error("Failed to record refund failure", "order_id", orderID, "refund_id", re.ID, "error", eventErr)
+	}
+	respondWithError(w, http.StatusInternalServerError,
+		fmt.Sprintf("Stripe issued refund %s but it couldn't be recorded; sync the order instead of retrying", re.ID))
+}
+
+// sendRefundNotification emails the customer about a refund of amount cents in the background, logging failures.
+// RefundOrder and the charge.refunded webhook each notify for the refunds they record, so a refund isn't announced twice.
+func (h *Handlers) sendRefundNotification(order *models.Order, amount int64, cardLast4 string) {
+	if h.EmailService == nil {
+		return
+	}
+	h.RunInBackground(func() {
+		if err := h.EmailService.SendRefundNotification(order, amount, cardLast4); err != nil {
+			h.Logger.Error("Failed to send refund notification", "order_id", order.ID, "error", err)
+		}
+	})
+}
+
+// chargeCardLast4 returns the last 4 digits of the card a charge was paid with, or "" for other
+// payment methods and unexpanded charges
+func chargeCardLast4(ch *stripe.Charge) string {
+	if ch == nil || ch.PaymentMethodDetails == nil || ch.PaymentMethodDetails.Card == nil {
+		return ""
+	}
+	return ch.PaymentMethodDetails.Card.Last4
+}
+
+// CancelOrderByCustomer lets a customer cancel their own unpaid order using its tracking ID and email
+func (h *Handlers) CancelOrderByCustomer(w http.ResponseWriter, r *http.Request) {
+	var req CustomerCancelRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body: "+err.Error())
+		return
+	}
+
+	if req.TrackingID == "" || req.Email == "" {
+		respondWithError(w, http.StatusBadRequest, "Tracking ID and email are required")
+		return
+	}
+
+	// Don't reveal whether the tracking ID exists when the email doesn't match
+	order, err := h.PaymentStore.GetOrderByTrackingID(r.Context(), req.TrackingID)
+	if err != nil || !strings.EqualFold(order.CustomerInfo.Email, strings.TrimSpace(req.Email)) {
+		respondWithError(w, http.StatusNotFound, "Order not found")
+		return
+	}
+
+	// Don't race a payment webhook for the same order, and cancel the order as it is once locked
+	unlock := h.orderLocks.Lock(order.ID)
+	defer unlock()
+
+	order, err = h.PaymentStore.GetOrder(r.Context(), order.ID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Order not found")
+		return
+	}
+
+	h.cancelUnpaidOrder(r.Context(), w, order, "customer", stripe.PaymentIntentCancellationReasonRequestedByCustomer)
+}
+
+// CancelOrder cancels an order that was never paid (admin endpoint), so abandoned orders don't stay pending
+func (h *Handlers) CancelOrder(w http.ResponseWriter, r *http.Request) {
+	orderID := chi.URLParam(r, "orderID")
+	if orderID == "" {
+		respondWithError(w, http.StatusBadRequest, "Order ID is required")
+		return
+	}
+
+	// Don't race a payment webhook for the same order
+	unlock := h.orderLocks.Lock(orderID)
+	defer unlock()
+
+	order, err := h.PaymentStore.GetOrder(r.Context(), orderID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Order not found")
+		return
+	}
+
+	h.cancelUnpaidOrder(r.Context(), w, order, "admin", stripe.PaymentIntentCancellationReasonAbandoned)
+}
+
+// cancelUnpaidOrder cancels a created or pending order and its payment intent, or its checkout session
+// when it has no payment intent yet, recording who canceled it
+func (h *Handlers) cancelUnpaidOrder(ctx context.Context, w http.ResponseWriter, order *models.Order, actor string, reason stripe.PaymentIntentCancellationReason) {
+	switch order.Status {
+	case models.OrderStatusCreated, models.OrderStatusPending:
+	case models.OrderStatusPaid, models.OrderStatusFulfilled:
+		respondWithError(w, http.StatusBadRequest, "Order has already been paid; please request a refund instead")
+		return
+	default:
+		respondWithError(w, http.StatusBadRequest, "Order cannot be canceled in status: "+string(order.Status))
+		return
+	}
+
+	// Cancel the payment intent so the customer can't complete payment afterwards
+	if order.Payment.StripePaymentIntentID != "" {
+		params := &stripe.PaymentIntentCancelParams{
+			CancellationReason: stripe.String(string(reason)),
+		}
+		if _, err := h.Gateway.CancelPaymentIntent(ctx, order.Payment.StripePaymentIntentID, params); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to cancel payment intent: "+err.Error())
+			return
+		}
+	} else if order.Payment.StripeSessionID != "" {
+		// A checkout order only gets a payment intent once it's paid, so its hosted page has to be closed instead
+		if _, err := h.Gateway.ExpireCheckoutSession(ctx, order.Payment.StripeSessionID, nil); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to expire checkout session: "+err.Error())
+			return
+		}
+	}
+	// The order can no longer be paid, so finish canceling even if the client has gone away
+	ctx = context.WithoutCancel(ctx)
+
+	if err := h.PaymentStore.UpdateOrderStatus(ctx, order.ID, models.OrderStatusCanceled); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to cancel order")
+		return
+	}
+
+	if err := h.PaymentStore.UpdatePaymentStatus(ctx, order.ID, models.PaymentStatusCanceled); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to update payment status")
+		return
+	}
+
+	// Log cancellation event
+	h.PaymentStore.AddPaymentEvent(ctx, models.PaymentEvent{
+		OrderID:   order.ID,
+		EventType: "order_canceled",
+		Status:    models.PaymentStatusCanceled,
+		Data: map[string]interface{}{
+			"actor":             actor,
+			"payment_intent_id": order.Payment.StripePaymentIntentID,
+			"session_id":        order.Payment.StripeSessionID,
+			"canceled_at":       time.Now(),
+		},
 	})
 
 	respondWithJSON(w, http.StatusOK, map[string]string{
-		"message":  "Order refunded successfully",
-		"order_id": orderID,
+		"message":     "Order canceled successfully",
+		"order_id":    order.ID,
+		"tracking_id": order.TrackingID,
 	})
 }
 
+// MigrateToPostgres copies the orders in the in-memory store snapshot at STORE_SNAPSHOT_PATH into
+// the Postgres store (admin endpoint). It is idempotent, so it can be re-run until the cut-over.
+func (h *Handlers) MigrateToPostgres(w http.ResponseWriter, r *http.Request) {
+	dst, ok := h.PaymentStore.(*store.PostgresStore)
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "DATABASE_URL is not configured")
+		return
+	}
+	if h.Config.StoreSnapshotPath == "" {
+		respondWithError(w, http.StatusBadRequest, "STORE_SNAPSHOT_PATH is not configured")
+		return
+	}
+
+	src := store.NewMemoryStore()
+	if err := src.LoadFromFile(h.Config.StoreSnapshotPath); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to load store snapshot: "+err.Error())
+		return
+	}
+
+	result, err := store.MigrateInMemoryToPostgres(r.Context(), src, dst)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Migration failed: "+err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, result)
+}
+
+// stripeErrorMessage returns the message from a Stripe API error, or the error text otherwise
+func stripeErrorMessage(err error) string {
+	var stripeErr *stripe.Error
+	if errors.As(err, &stripeErr) && stripeErr.Msg != "" {
+		return stripeErr.Msg
+	}
+	return err.Error()
+}
+
 // convertStripeStatus converts Stripe payment intent status to our internal status
 func convertStripeStatus(stripeStatus string) models.PaymentStatus {
 	switch stripeStatus {
@@ -410,6 +1588,26 @@ func convertStripeStatus(stripeStatus string) models.PaymentStatus {
 	}
 }
 
+// orderETag derives an ETag from the fields that change whenever an order is updated
+func orderETag(order *models.Order) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d|%s|%s", order.UpdatedAt.UnixNano(), order.Status, order.Payment.Status)))
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// notModified sets the ETag header and writes a 304 if the client's If-None-Match already matches it
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+
+	for _, candidate := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
 // Helper functions (keep existing ones and add these)
 func respondWithError(w http.ResponseWriter, code int, message string) {
 	respondWithJSON(w, code, map[string]string{"error": message})
@@ -0,0 +1,127 @@
+// handlers/price.go
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/capactiyvirus/stripe-backend/models"
+	"github.com/shopspring/decimal"
+)
+
+// pricePattern is the accepted format for string and legacy number prices: whole units with up to
+// two decimal places
+var pricePattern = regexp.MustCompile(`^\d+(\.\d{1,2})?$`)
+
+// Price is an item price that accepts either a JSON string such as "19.99", parsed exactly,
+// or a legacy JSON number
+type Price struct {
+	value decimal.Decimal
+}
+
+// UnmarshalJSON parses a string or number price
+func (p *Price) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(data, []byte(`"`)) {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		if !pricePattern.MatchString(s) {
+			return fmt.Errorf("invalid price %q: expected a decimal amount like \"19.99\"", s)
+		}
+		value, err := decimal.NewFromString(s)
+		if err != nil {
+			return fmt.Errorf("invalid price %q: %w", s, err)
+		}
+		p.value = value
+		return nil
+	}
+
+	// Legacy float prices are read from their decimal text, so 19.99 stays exactly 19.99, and follow
+	// the string rules, which leave out negative and exponent values such as -1 or 1e9
+	if !pricePattern.Match(data) {
+		return fmt.Errorf("invalid price %s: expected a decimal amount like 19.99", data)
+	}
+	value, err := decimal.NewFromString(string(data))
+	if err != nil {
+		return fmt.Errorf("invalid price %s", data)
+	}
+	p.value = value
+	return nil
+}
+
+// MarshalJSON writes the price as a JSON number
+func (p Price) MarshalJSON() ([]byte, error) {
+	return []byte(p.value.String()), nil
+}
+
+// Cents returns the price in cents, rounding any fraction of a cent
+func (p Price) Cents() int64 {
+	return p.MinorUnits("usd")
+}
+
+// MinorUnits returns the price in the currency's smallest unit (cents, or whole yen for JPY),
+// rounding any fraction of that unit
+func (p Price) MinorUnits(currency string) int64 {
+	return p.minorUnitsDecimal(currency).IntPart()
+}
+
+// minorUnitsDecimal is MinorUnits without the conversion to int64, for sums that could overflow it
+func (p Price) minorUnitsDecimal(currency string) decimal.Decimal {
+	return p.value.Shift(models.CurrencyDecimals(currency)).Round(0)
+}
+
+// priceFromMinorUnits builds a price from an amount in the currency's smallest unit
+func priceFromMinorUnits(amount int64, currency string) Price {
+	return Price{value: decimal.New(amount, -models.CurrencyDecimals(currency))}
+}
+
+// priceFromFloat64 builds a price from a stored amount in whole currency units
+func priceFromFloat64(amount float64) Price {
+	return Price{value: decimal.NewFromFloat(amount)}
+}
+
+// Float64 returns the price in whole currency units
+func (p Price) Float64() float64 {
+	f, _ := p.value.Float64()
+	return f
+}
+
+// verifyItemPrices checks each item's price against its Stripe product's default price, as enabled
+// by VERIFY_PRICES, and replaces it with Stripe's so totals never come from the client. An item
+// sent without a price takes Stripe's. It returns the status code to respond with on failure.
+func (h *Handlers) verifyItemPrices(ctx context.Context, items []OrderItemRequest, currency string) (int, error) {
+	for i, item := range items {
+		if item.ProductID == "" {
+			return http.StatusBadRequest, fmt.Errorf("item %d has no product_id to check its price against", i+1)
+		}
+
+		p, err := h.getStripeProduct(ctx, item.ProductID)
+		if isStripeResourceMissing(err) {
+			return http.StatusBadRequest, fmt.Errorf("unknown product %s", item.ProductID)
+		}
+		if err != nil {
+			h.Logger.Error("Failed to look up product price", "product_id", item.ProductID, "error", err)
+			return http.StatusBadGateway, fmt.Errorf("failed to look up the price of product %s", item.ProductID)
+		}
+
+		price := p.DefaultPrice
+		if price == nil || price.Currency == "" {
+			return http.StatusBadRequest, fmt.Errorf("product %s has no price", item.ProductID)
+		}
+		if string(price.Currency) != currency {
+			return http.StatusBadRequest, fmt.Errorf("product %s is priced in %s, not %s", item.ProductID, price.Currency, currency)
+		}
+
+		stripePrice := priceFromMinorUnits(price.UnitAmount, currency)
+		if !item.Price.value.IsZero() && item.Price.MinorUnits(currency) != price.UnitAmount {
+			return http.StatusBadRequest, fmt.Errorf("price for product %s is %s, not %s", item.ProductID, stripePrice.value.StringFixed(int32(models.CurrencyDecimals(currency))), item.Price.value.String())
+		}
+		items[i].Price = stripePrice
+	}
+	return http.StatusOK, nil
+}
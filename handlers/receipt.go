@@ -0,0 +1,41 @@
+// handlers/receipt.go
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/capactiyvirus/stripe-backend/models"
+	"github.com/capactiyvirus/stripe-backend/services"
+	"github.com/go-chi/chi/v5"
+)
+
+// GetOrderReceipt serves a paid or fulfilled order's receipt as a PDF download, branded with
+// COMPANY_NAME and SUPPORT_EMAIL
+func (h *Handlers) GetOrderReceipt(w http.ResponseWriter, r *http.Request) {
+	orderID := chi.URLParam(r, "orderID")
+
+	order, err := h.PaymentStore.GetOrder(r.Context(), orderID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Order not found")
+		return
+	}
+	if order.Status != models.OrderStatusPaid && order.Status != models.OrderStatusFulfilled {
+		respondWithError(w, http.StatusBadRequest, "Order hasn't been paid: "+string(order.Status))
+		return
+	}
+
+	receipt, err := services.NewReceiptService(h.Config).GeneratePDF(order)
+	if err != nil {
+		h.Logger.Error("Failed to generate receipt", "order_id", orderID, "error", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to generate receipt")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="receipt-%s.pdf"`, order.TrackingID))
+	w.Header().Set("Content-Length", strconv.Itoa(len(receipt)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(receipt)
+}
@@ -2,15 +2,15 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"strconv"
 
+	"github.com/capactiyvirus/stripe-backend/models"
+	"github.com/capactiyvirus/stripe-backend/services"
 	"github.com/go-chi/chi/v5"
 	"github.com/stripe/stripe-go/v82"
-	"github.com/stripe/stripe-go/v82/checkout/session"
-	"github.com/stripe/stripe-go/v82/paymentintent"
-	"github.com/stripe/stripe-go/v82/product"
 )
 
 // Response types
@@ -24,8 +24,10 @@ type PaymentIntentResponse struct {
 }
 
 type CheckoutResponse struct {
-	URL string `json:"url"`
-	ID  string `json:"id"`
+	URL        string `json:"url"`
+	ID         string `json:"id"`
+	OrderID    string `json:"orderId,omitempty"`    // Set when the session was created with an order
+	TrackingID string `json:"trackingId,omitempty"` // Set when the session was created with an order
 }
 
 // CreatePaymentIntent creates a Stripe payment intent
@@ -45,8 +47,14 @@ func (h *Handlers) CreatePaymentIntent(w http.ResponseWriter, r *http.Request) {
 
 	// Default values
 	if data.Currency == "" {
-		data.Currency = "usd"
+		data.Currency = h.defaultCurrency()
 	}
+	currency, err := models.ValidateCurrency(data.Currency)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid currency: "+err.Error())
+		return
+	}
+	data.Currency = currency
 
 	// Create payment intent
 	params := &stripe.PaymentIntentParams{
@@ -54,6 +62,7 @@ func (h *Handlers) CreatePaymentIntent(w http.ResponseWriter, r *http.Request) {
 		Currency:    stripe.String(data.Currency),
 		Description: stripe.String(data.Description),
 	}
+	h.setAutomaticPaymentMethods(params)
 
 	// Add metadata if provided
 	if data.Metadata != nil {
@@ -63,7 +72,7 @@ func (h *Handlers) CreatePaymentIntent(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	pi, err := paymentintent.New(params)
+	pi, err := h.Gateway.CreatePaymentIntent(r.Context(), params)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
@@ -76,15 +85,35 @@ func (h *Handlers) CreatePaymentIntent(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// CreateCheckoutSession creates a Stripe checkout session
-func (h *Handlers) CreateCheckoutSession(w http.ResponseWriter, r *http.Request) {
-	var data struct {
-		ProductName string `json:"productName"`
-		Amount      int64  `json:"amount"`
-		Currency    string `json:"currency"`
-		SuccessURL  string `json:"successUrl"`
-		CancelURL   string `json:"cancelUrl"`
+// setAutomaticPaymentMethods lets the intent be paid with any method enabled in the Stripe dashboard,
+// including wallets like Apple Pay and Google Pay, when ENABLE_AUTOMATIC_PAYMENT_METHODS is on
+func (h *Handlers) setAutomaticPaymentMethods(params *stripe.PaymentIntentParams) {
+	if h.Config.AutomaticPaymentMethods {
+		params.AutomaticPaymentMethods = &stripe.PaymentIntentAutomaticPaymentMethodsParams{Enabled: stripe.Bool(true)}
 	}
+}
+
+// CreateCheckoutSessionRequest is the body for CreateCheckoutSession. Carts list their items; the legacy
+// single-item shape of productName and amount (in the currency's smallest unit) is still accepted.
+type CreateCheckoutSessionRequest struct {
+	Items       []OrderItemRequest `json:"items,omitempty"`
+	ProductName string             `json:"productName,omitempty"`
+	Amount      int64              `json:"amount,omitempty"`
+	Currency    string             `json:"currency"`
+	SuccessURL  string             `json:"successUrl"`
+	CancelURL   string             `json:"cancelUrl"`
+
+	// A tracked order linked to the session, so webhooks update it, is created whenever
+	// customer_info has an email; CreateOrder requires one
+	CreateOrder  bool                `json:"create_order,omitempty"`
+	CustomerInfo models.CustomerInfo `json:"customer_info"`
+	Metadata     map[string]string   `json:"metadata,omitempty"`
+}
+
+// CreateCheckoutSession creates a Stripe Checkout session for one or more items
+func (h *Handlers) CreateCheckoutSession(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var data CreateCheckoutSessionRequest
 
 	// Parse request body
 	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
@@ -94,8 +123,15 @@ func (h *Handlers) CreateCheckoutSession(w http.ResponseWriter, r *http.Request)
 
 	// Default values
 	if data.Currency == "" {
-		data.Currency = "usd"
+		data.Currency = h.defaultCurrency()
 	}
+	currency, err := models.ValidateCurrency(data.Currency)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid currency: "+err.Error())
+		return
+	}
+	data.Currency = currency
+
 	if data.SuccessURL == "" {
 		data.SuccessURL = "https://your-domain.com/success"
 	}
@@ -103,38 +139,182 @@ func (h *Handlers) CreateCheckoutSession(w http.ResponseWriter, r *http.Request)
 		data.CancelURL = "https://your-domain.com/cancel"
 	}
 
+	if len(data.Items) == 0 {
+		data.Items = []OrderItemRequest{{
+			ProductName: data.ProductName,
+			Price:       priceFromMinorUnits(data.Amount, currency),
+			Quantity:    1,
+		}}
+	}
+	for _, item := range data.Items {
+		if item.ProductName == "" {
+			respondWithError(w, http.StatusBadRequest, "Every item needs a product name")
+			return
+		}
+	}
+	if h.Config.VerifyPrices {
+		if status, err := h.verifyItemPrices(ctx, data.Items, currency); err != nil {
+			respondWithError(w, status, "Invalid item price: "+err.Error())
+			return
+		}
+	}
+	orderItems, totalAmount, err := h.buildOrderItems(ctx, data.Items, currency)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid items: "+err.Error())
+		return
+	}
+
 	// Create checkout session
 	params := &stripe.CheckoutSessionParams{
 		PaymentMethodTypes: stripe.StringSlice([]string{
 			"card",
 		}),
-		LineItems: []*stripe.CheckoutSessionLineItemParams{
-			{
-				PriceData: &stripe.CheckoutSessionLineItemPriceDataParams{
-					Currency: stripe.String(data.Currency),
-					ProductData: &stripe.CheckoutSessionLineItemPriceDataProductDataParams{
-						Name: stripe.String(data.ProductName),
-					},
-					UnitAmount: stripe.Int64(data.Amount),
-				},
-				Quantity: stripe.Int64(1),
-			},
-		},
 		Mode:       stripe.String(string(stripe.CheckoutSessionModePayment)),
 		SuccessURL: stripe.String(data.SuccessURL),
 		CancelURL:  stripe.String(data.CancelURL),
 	}
+	for i, item := range data.Items {
+		params.LineItems = append(params.LineItems, &stripe.CheckoutSessionLineItemParams{
+			PriceData: &stripe.CheckoutSessionLineItemPriceDataParams{
+				Currency: stripe.String(currency),
+				ProductData: &stripe.CheckoutSessionLineItemPriceDataProductDataParams{
+					Name: stripe.String(item.ProductName),
+				},
+				UnitAmount: stripe.Int64(item.Price.MinorUnits(currency)),
+			},
+			Quantity: stripe.Int64(int64(orderItems[i].Quantity)),
+		})
+	}
+
+	var order *models.Order
+	if data.CreateOrder || data.CustomerInfo.Email != "" {
+		if order = h.createCheckoutOrder(w, r, &data, orderItems, totalAmount); order == nil {
+			return
+		}
+		params.ClientReferenceID = stripe.String(order.ID)
+		// Checkout takes either a customer or an email to prefill
+		if order.CustomerInfo.StripeCustomerID != "" {
+			params.Customer = stripe.String(order.CustomerInfo.StripeCustomerID)
+		} else {
+			params.CustomerEmail = stripe.String(order.CustomerInfo.Email)
+		}
+		params.Metadata = map[string]string{
+			"order_id":    order.ID,
+			"tracking_id": order.TrackingID,
+		}
+		params.PaymentIntentData = &stripe.CheckoutSessionPaymentIntentDataParams{
+			Metadata: map[string]string{
+				"order_id":       order.ID,
+				"tracking_id":    order.TrackingID,
+				"customer_email": order.CustomerInfo.Email,
+			},
+		}
+	}
 
-	s, err := session.New(params)
+	s, err := h.Gateway.CreateCheckoutSession(ctx, params)
 	if err != nil {
+		// Nothing can pay the order without a session, so don't leave it open
+		if order != nil {
+			if cancelErr := h.PaymentStore.UpdateOrderStatus(context.WithoutCancel(ctx), order.ID, models.OrderStatusCanceled); cancelErr != nil {
+				h.Logger.Error("Failed to cancel order after checkout session failure", "order_id", order.ID, "error", cancelErr)
+			}
+		}
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	// The session exists in Stripe now, so link it to the order even if the client has gone away
+	ctx = context.WithoutCancel(ctx)
 
-	respondWithJSON(w, http.StatusOK, CheckoutResponse{
+	response := CheckoutResponse{
 		URL: s.URL,
 		ID:  s.ID,
-	})
+	}
+
+	if order != nil {
+		// Link the session so checkout webhooks find the order
+		order.Payment.StripeSessionID = s.ID
+		order.Status = models.OrderStatusPending
+		if err := h.PaymentStore.UpdateOrder(ctx, order); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to update order: "+err.Error())
+			return
+		}
+
+		h.PaymentStore.AddPaymentEvent(ctx, models.PaymentEvent{
+			OrderID:   order.ID,
+			EventType: "order_created",
+			Status:    models.PaymentStatusPending,
+			Data:      map[string]interface{}{"session_id": s.ID},
+		})
+		h.Metrics.orderCreated(order)
+
+		response.OrderID = order.ID
+		response.TrackingID = order.TrackingID
+	}
+
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+// createCheckoutOrder validates and stores the order for a checkout session, responding with
+// an error and returning nil if it can't be created
+func (h *Handlers) createCheckoutOrder(w http.ResponseWriter, r *http.Request, data *CreateCheckoutSessionRequest,
+	items []models.OrderItem, totalAmount int64) *models.Order {
+	if data.CustomerInfo.Email == "" {
+		respondWithError(w, http.StatusBadRequest, "Customer email is required")
+		return nil
+	}
+	email, err := models.ValidateEmail(data.CustomerInfo.Email)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid customer email: "+err.Error())
+		return nil
+	}
+
+	customerInfo := data.CustomerInfo
+	customerInfo.Email = email
+	// Saved payment details only ever come from Stripe
+	customerInfo.StripeCustomerID = ""
+	customerInfo.SavedPaymentMethodID = ""
+	customerInfo.IPAddress = clientIP(r)
+	if !customerInfo.TaxExempt {
+		customerInfo.TaxExemptionID = ""
+	} else if h.Config.RequireTaxExemptionID && customerInfo.TaxExemptionID == "" {
+		respondWithError(w, http.StatusBadRequest, "Tax exemption ID is required for tax-exempt orders")
+		return nil
+	}
+
+	orderID := generateOrderID()
+
+	// As with CreateOrder, a Stripe customer failure isn't fatal
+	customerID, err := h.findOrCreateStripeCustomer(r.Context(), customerInfo)
+	if err != nil {
+		h.Logger.Warn("Failed to find or create Stripe customer", "order_id", orderID, "error", err)
+	}
+	customerInfo.StripeCustomerID = customerID
+
+	order := &models.Order{
+		ID:           orderID,
+		TrackingID:   generateTrackingID(),
+		CustomerInfo: customerInfo,
+		Items:        items,
+		Payment: models.PaymentInfo{
+			Amount:   totalAmount,
+			Currency: data.Currency,
+			Status:   models.PaymentStatusPending,
+		},
+		Status:   models.OrderStatusCreated,
+		Metadata: data.Metadata,
+	}
+
+	if err := h.PaymentStore.CreateOrder(r.Context(), order); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create order: "+err.Error())
+		return nil
+	}
+
+	// Hooks may enrich the stored order
+	if err := h.runOrderCreatedHooks(r.Context(), order); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Order hook failed")
+		return nil
+	}
+	return order
 }
 
 // VerifyPayment verifies a payment
@@ -145,7 +325,7 @@ func (h *Handlers) VerifyPayment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	pi, err := paymentintent.Get(id, nil)
+	pi, err := h.Gateway.GetPaymentIntent(r.Context(), id, nil)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
@@ -158,32 +338,42 @@ func (h *Handlers) VerifyPayment(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// ListProducts lists Stripe products
+// maxProductListLimit is the most products Stripe returns in one list call
+const maxProductListLimit = 100
+
+// ListProducts lists Stripe products, or the local catalog's when one is configured. Stripe products
+// are the active ones unless active=false asks for the archived ones.
 func (h *Handlers) ListProducts(w http.ResponseWriter, r *http.Request) {
+	if h.Catalog != nil {
+		respondWithJSON(w, http.StatusOK, map[string]interface{}{
+			"products": h.Catalog.ListProducts(),
+		})
+		return
+	}
+
+	// Clamp the limit to what Stripe accepts, so an arbitrary limit can't add to the cache
 	limit := 10
 	if limitParam := r.URL.Query().Get("limit"); limitParam != "" {
-		if parsedLimit, err := strconv.Atoi(limitParam); err == nil {
-			limit = parsedLimit
+		if parsedLimit, err := strconv.Atoi(limitParam); err == nil && parsedLimit > 0 {
+			limit = min(parsedLimit, maxProductListLimit)
 		}
 	}
 
 	params := &stripe.ProductListParams{
-		Active: stripe.Bool(true),
+		Active: stripe.Bool(r.URL.Query().Get("active") != "false"),
 	}
 	params.Limit = stripe.Int64(int64(limit))
+	params.AddExpand("data.default_price") // For the amount and currency shown with each product
 
-	iterator := product.List(params)
-	products := []map[string]interface{}{}
+	stripeProducts, err := h.listStripeProducts(r.Context(), params)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
 
-	for iterator.Next() {
-		p := iterator.Product()
-		products = append(products, map[string]interface{}{
-			"id":          p.ID,
-			"name":        p.Name,
-			"description": p.Description,
-			"images":      p.Images,
-			"metadata":    p.Metadata,
-		})
+	products := []map[string]interface{}{}
+	for _, p := range stripeProducts {
+		products = append(products, stripeProductResponse(p))
 	}
 
 	respondWithJSON(w, http.StatusOK, map[string]interface{}{
@@ -191,7 +381,7 @@ func (h *Handlers) ListProducts(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// GetProduct gets a single product by ID
+// GetProduct gets a single product by ID from Stripe or the local catalog
 func (h *Handlers) GetProduct(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
 	if id == "" {
@@ -199,17 +389,84 @@ func (h *Handlers) GetProduct(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	p, err := product.Get(id, nil)
+	if h.Catalog != nil {
+		p, err := h.Catalog.GetProduct(id)
+		if err != nil {
+			respondWithError(w, http.StatusNotFound, "Product not found")
+			return
+		}
+		respondWithJSON(w, http.StatusOK, p)
+		return
+	}
+
+	p, err := h.getStripeProduct(r.Context(), id)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
+	respondWithJSON(w, http.StatusOK, stripeProductResponse(p))
+}
+
+// stripeProductResponse formats a Stripe product with its default price's amount and currency.
+// Products without a default price have null price fields.
+func stripeProductResponse(p *stripe.Product) map[string]interface{} {
+	response := map[string]interface{}{
+		"id":            p.ID,
+		"name":          p.Name,
+		"description":   p.Description,
+		"images":        p.Images,
+		"metadata":      p.Metadata,
+		"default_price": nil,
+		"unit_amount":   nil,
+		"currency":      nil,
+	}
+	if price := p.DefaultPrice; price != nil {
+		response["default_price"] = price.ID
+		// An unexpanded price only carries its ID
+		if price.Currency != "" {
+			response["unit_amount"] = price.UnitAmount
+			response["currency"] = price.Currency
+		}
+	}
+	return response
+}
+
+// listStripeProducts lists products from Stripe, through the product cache when there is one
+func (h *Handlers) listStripeProducts(ctx context.Context, params *stripe.ProductListParams) ([]*stripe.Product, error) {
+	load := func() ([]*stripe.Product, error) { return h.Gateway.ListProducts(ctx, params) }
+	if h.ProductCache == nil {
+		return load()
+	}
+	key := services.ProductListKey{Limit: stripe.Int64Value(params.Limit), Active: stripe.BoolValue(params.Active)}
+	return h.ProductCache.ListProducts(key, load)
+}
+
+// getStripeProduct gets a product from Stripe, through the product cache when there is one
+func (h *Handlers) getStripeProduct(ctx context.Context, id string) (*stripe.Product, error) {
+	load := func() (*stripe.Product, error) {
+		params := &stripe.ProductParams{}
+		params.AddExpand("default_price")
+		return h.Gateway.GetProduct(ctx, id, params)
+	}
+	if h.ProductCache == nil {
+		return load()
+	}
+	return h.ProductCache.GetProduct(id, load)
+}
+
+// RefreshProducts empties the product cache so the next requests reload products from Stripe (admin endpoint)
+func (h *Handlers) RefreshProducts(w http.ResponseWriter, r *http.Request) {
+	if h.ProductCache == nil {
+		respondWithJSON(w, http.StatusOK, map[string]interface{}{
+			"message": "Product cache is disabled",
+		})
+		return
+	}
+
+	h.ProductCache.Invalidate()
+	h.Logger.Info("Product cache cleared")
 	respondWithJSON(w, http.StatusOK, map[string]interface{}{
-		"id":          p.ID,
-		"name":        p.Name,
-		"description": p.Description,
-		"images":      p.Images,
-		"metadata":    p.Metadata,
+		"message": "Product cache cleared",
 	})
 }
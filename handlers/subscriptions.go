@@ -0,0 +1,273 @@
+// handlers/subscriptions.go
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/capactiyvirus/stripe-backend/models"
+	"github.com/capactiyvirus/stripe-backend/store"
+	"github.com/go-chi/chi/v5"
+	"github.com/stripe/stripe-go/v82"
+)
+
+// GetCustomerSubscriptions lists a customer's subscriptions, newest first. has_access says whether
+// any of them is active or trialing, so a site can gate member content on it.
+func (h *Handlers) GetCustomerSubscriptions(w http.ResponseWriter, r *http.Request) {
+	email := chi.URLParam(r, "email")
+	if email == "" {
+		respondWithError(w, http.StatusBadRequest, "Customer email is required")
+		return
+	}
+
+	if normalized, err := models.ValidateEmail(email); err == nil {
+		email = normalized
+	}
+
+	subscriptions, err := h.PaymentStore.GetCustomerSubscriptions(r.Context(), email)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve customer subscriptions")
+		return
+	}
+
+	hasAccess := false
+	for _, subscription := range subscriptions {
+		if subscription.Status.GrantsAccess() {
+			hasAccess = true
+			break
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"customer_email": email,
+		"subscriptions":  subscriptions,
+		"has_access":     hasAccess,
+	})
+}
+
+// handleSubscriptionChanged tracks a subscription through its customer.subscription.created, .updated,
+// and .deleted events. Stripe never reactivates a canceled subscription, so a late update for one
+// is ignored.
+func (h *Handlers) handleSubscriptionChanged(ctx context.Context, event stripe.Event) {
+	logger := h.eventLogger(event)
+
+	var sub stripe.Subscription
+	err := json.Unmarshal(event.Data.Raw, &sub)
+	if err != nil {
+		logger.Error("Failed to parse webhook event", "error", err)
+		return
+	}
+	logger = logger.With("subscription_id", sub.ID)
+
+	// Subscription IDs never collide with order IDs, so the order locks serialize these events too
+	unlock := h.orderLocks.Lock(sub.ID)
+	defer unlock()
+
+	subscription, err := h.PaymentStore.GetSubscription(ctx, sub.ID)
+	if err != nil && !errors.Is(err, store.ErrSubscriptionNotFound) {
+		logger.Error("Failed to get subscription", "error", err)
+		return
+	}
+	var previousStatus models.SubscriptionStatus
+	if subscription == nil {
+		subscription = &models.Subscription{StripeSubscriptionID: sub.ID}
+		if sub.Created > 0 {
+			subscription.CreatedAt = time.Unix(sub.Created, 0)
+		}
+	} else {
+		previousStatus = subscription.Status
+	}
+
+	// Stripe doesn't deliver events in order, so an update older than the last one applied would
+	// roll the status and period back. Deletion is final whenever it arrives.
+	eventAt := time.Unix(event.Created, 0)
+	if event.Type != "customer.subscription.deleted" && subscription.LastEventAt != nil && eventAt.Before(*subscription.LastEventAt) {
+		logger.Info("Ignoring stale subscription event", "event_created", eventAt, "last_event_at", *subscription.LastEventAt)
+		return
+	}
+
+	status := models.SubscriptionStatus(sub.Status)
+	if event.Type == "customer.subscription.deleted" {
+		status = models.SubscriptionStatusCanceled
+	}
+	if previousStatus == models.SubscriptionStatusCanceled && status != models.SubscriptionStatusCanceled {
+		logger.Warn("Ignoring update to canceled subscription", "stripe_status", status)
+		return
+	}
+
+	subscription.Status = status
+	if sub.Customer != nil && sub.Customer.ID != "" {
+		subscription.StripeCustomerID = sub.Customer.ID
+	}
+	if subscription.CustomerEmail == "" {
+		subscription.CustomerEmail = h.subscriptionEmail(ctx, logger, sub.Customer, sub.Metadata["customer_email"])
+	}
+	if end := subscriptionPeriodEnd(&sub); end != nil {
+		subscription.CurrentPeriodEnd = end
+	}
+	if sub.CanceledAt > 0 {
+		canceledAt := time.Unix(sub.CanceledAt, 0)
+		subscription.CanceledAt = &canceledAt
+	}
+	if subscription.LastEventAt == nil || eventAt.After(*subscription.LastEventAt) {
+		subscription.LastEventAt = &eventAt
+	}
+
+	if err := h.PaymentStore.SaveSubscription(ctx, subscription); err != nil {
+		logger.Error("Failed to save subscription", "error", err)
+		return
+	}
+
+	eventType := "subscription_updated"
+	switch event.Type {
+	case "customer.subscription.created":
+		eventType = "subscription_created"
+	case "customer.subscription.deleted":
+		eventType = "subscription_canceled"
+	}
+	h.PaymentStore.AddSubscriptionEvent(ctx, models.SubscriptionEvent{
+		SubscriptionID: sub.ID,
+		EventType:      eventType,
+		Status:         status,
+		Data: map[string]interface{}{
+			"previous_status":    previousStatus,
+			"current_period_end": subscription.CurrentPeriodEnd,
+			"customer_email":     subscription.CustomerEmail,
+		},
+	})
+
+	logger.Info("Subscription tracked", "status", status, "previous_status", previousStatus)
+}
+
+// handleInvoicePaymentSucceeded records a paid subscription invoice, moving the subscription to
+// active and on to the newly paid period. Invoices that aren't for a subscription are only logged.
+func (h *Handlers) handleInvoicePaymentSucceeded(ctx context.Context, event stripe.Event) {
+	logger := h.eventLogger(event)
+
+	var invoice stripe.Invoice
+	err := json.Unmarshal(event.Data.Raw, &invoice)
+	if err != nil {
+		logger.Error("Failed to parse webhook event", "error", err)
+		return
+	}
+	logger = logger.With("invoice_id", invoice.ID)
+
+	logger.Info("Invoice payment succeeded")
+
+	var subscriptionID string
+	if invoice.Parent != nil && invoice.Parent.SubscriptionDetails != nil && invoice.Parent.SubscriptionDetails.Subscription != nil {
+		subscriptionID = invoice.Parent.SubscriptionDetails.Subscription.ID
+	}
+	if subscriptionID == "" {
+		return
+	}
+	logger = logger.With("subscription_id", subscriptionID)
+
+	unlock := h.orderLocks.Lock(subscriptionID)
+	defer unlock()
+
+	// The invoice can arrive before customer.subscription.created
+	subscription, err := h.PaymentStore.GetSubscription(ctx, subscriptionID)
+	if err != nil && !errors.Is(err, store.ErrSubscriptionNotFound) {
+		logger.Error("Failed to get subscription", "error", err)
+		return
+	}
+	var previousStatus models.SubscriptionStatus
+	if subscription == nil {
+		subscription = &models.Subscription{StripeSubscriptionID: subscriptionID}
+	} else {
+		previousStatus = subscription.Status
+	}
+
+	if invoice.Customer != nil && invoice.Customer.ID != "" {
+		subscription.StripeCustomerID = invoice.Customer.ID
+	}
+	if subscription.CustomerEmail == "" {
+		subscription.CustomerEmail = h.subscriptionEmail(ctx, logger, invoice.Customer, invoice.CustomerEmail)
+	}
+	// A paid invoice settles a past due or incomplete subscription, but can't bring back a canceled one
+	if previousStatus != models.SubscriptionStatusCanceled && previousStatus != models.SubscriptionStatusTrialing {
+		subscription.Status = models.SubscriptionStatusActive
+	}
+	if end := invoicePeriodEnd(&invoice); end != nil && (subscription.CurrentPeriodEnd == nil || end.After(*subscription.CurrentPeriodEnd)) {
+		subscription.CurrentPeriodEnd = end
+	}
+
+	if err := h.PaymentStore.SaveSubscription(ctx, subscription); err != nil {
+		logger.Error("Failed to save subscription", "error", err)
+		return
+	}
+
+	h.PaymentStore.AddSubscriptionEvent(ctx, models.SubscriptionEvent{
+		SubscriptionID: subscriptionID,
+		EventType:      "subscription_payment_succeeded",
+		Status:         subscription.Status,
+		Data: map[string]interface{}{
+			"invoice_id":         invoice.ID,
+			"amount_paid":        invoice.AmountPaid,
+			"currency":           invoice.Currency,
+			"previous_status":    previousStatus,
+			"current_period_end": subscription.CurrentPeriodEnd,
+		},
+	})
+}
+
+// subscriptionEmail works out the email a subscription belongs to: the customer's email when Stripe
+// expanded it, then fallback, then the Stripe customer itself
+func (h *Handlers) subscriptionEmail(ctx context.Context, logger *slog.Logger, customer *stripe.Customer, fallback string) string {
+	email := fallback
+	if customer != nil && customer.Email != "" {
+		email = customer.Email
+	}
+	if email == "" && customer != nil && customer.ID != "" {
+		c, err := h.Gateway.GetCustomer(ctx, customer.ID, nil)
+		if err != nil {
+			logger.Warn("Failed to look up subscription customer", "customer_id", customer.ID, "error", err)
+			return ""
+		}
+		email = c.Email
+	}
+
+	if normalized, err := models.ValidateEmail(email); err == nil {
+		email = normalized
+	}
+	return email
+}
+
+// subscriptionPeriodEnd is when the latest of a subscription's items runs out, or nil if Stripe didn't say
+func subscriptionPeriodEnd(sub *stripe.Subscription) *time.Time {
+	var end int64
+	if sub.Items != nil {
+		for _, item := range sub.Items.Data {
+			if item.CurrentPeriodEnd > end {
+				end = item.CurrentPeriodEnd
+			}
+		}
+	}
+	if end == 0 {
+		return nil
+	}
+	t := time.Unix(end, 0)
+	return &t
+}
+
+// invoicePeriodEnd is the end of the latest period an invoice's lines pay for, or nil if it has none
+func invoicePeriodEnd(invoice *stripe.Invoice) *time.Time {
+	var end int64
+	if invoice.Lines != nil {
+		for _, line := range invoice.Lines.Data {
+			if line.Period != nil && line.Period.End > end {
+				end = line.Period.End
+			}
+		}
+	}
+	if end == 0 {
+		return nil
+	}
+	t := time.Unix(end, 0)
+	return &t
+}
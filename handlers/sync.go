@@ -0,0 +1,163 @@
+// handlers/sync.go
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/capactiyvirus/stripe-backend/models"
+	"github.com/go-chi/chi/v5"
+	"github.com/stripe/stripe-go/v82"
+)
+
+// SyncOrder reconciles an order with its payment intent in Stripe (admin endpoint), for recovering
+// from a missed webhook. The payment status, payment method, charges, fees, and refunded amount are
+// taken from Stripe, and the order is marked paid, canceled, or refunded to match. An order that
+// becomes paid is recorded exactly as the payment_intent.succeeded webhook would have, payment
+// confirmation included. Orders without a payment intent are returned unchanged.
+func (h *Handlers) SyncOrder(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	orderID := chi.URLParam(r, "orderID")
+
+	unlock := h.orderLocks.Lock(orderID)
+	defer unlock()
+
+	order, err := h.PaymentStore.GetOrder(ctx, orderID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Order not found")
+		return
+	}
+
+	paymentIntentID := order.Payment.StripePaymentIntentID
+	if paymentIntentID == "" {
+		respondWithJSON(w, http.StatusOK, map[string]interface{}{
+			"order":   order,
+			"synced":  false,
+			"message": "Order has no payment intent to sync from",
+		})
+		return
+	}
+	logger := h.Logger.With("order_id", orderID, "payment_intent_id", paymentIntentID)
+
+	params := &stripe.PaymentIntentParams{}
+	params.AddExpand("latest_charge.refunds")
+	pi, err := h.Gateway.GetPaymentIntent(ctx, paymentIntentID, params)
+	if err != nil {
+		logger.Error("Failed to get payment intent", "error", err)
+		respondWithError(w, http.StatusBadGateway, "Failed to get payment intent from Stripe: "+stripeErrorMessage(err))
+		return
+	}
+
+	paymentStatus := convertStripeStatus(string(pi.Status))
+	orderStatus := order.Status
+	changes := make(map[string]interface{})
+
+	switch paymentStatus {
+	case models.PaymentStatusSucceeded:
+		charges := collectPaymentCharges(ctx, h.Gateway, logger, pi)
+		if err := h.PaymentStore.UpdatePaymentCharges(ctx, orderID, charges.ChargeIDs, charges.AmountCaptured); err != nil {
+			logger.Error("Failed to update payment charges", "error", err)
+		}
+		if charges.AmountCaptured != order.Payment.AmountCaptured {
+			changes["amount_captured"] = charges.AmountCaptured
+		}
+		if charges.HasBalanceTransaction {
+			if err := h.PaymentStore.UpdatePaymentFees(ctx, orderID, charges.Fee, charges.Net); err != nil {
+				logger.Error("Failed to update payment fees", "error", err)
+			}
+		}
+
+		// A payment no webhook reported is recorded the way payment_intent.succeeded would have,
+		// so a later refund below finds the order paid
+		if !paymentRecorded(order.Payment.Status) && charges.AmountCaptured >= order.Payment.Amount {
+			if h.applySucceededIntent(ctx, logger, order, pi, charges) {
+				changes["payment_status"] = models.PaymentStatusSucceeded
+				changes["order_status"] = models.OrderStatusPaid
+			}
+			if updated, err := h.PaymentStore.GetOrder(ctx, orderID); err == nil {
+				order = updated
+			}
+			orderStatus = order.Status
+		}
+
+		method := intentPaymentMethod(pi, charges)
+		if method != "" && method != order.Payment.Method {
+			if err := h.PaymentStore.UpdatePaymentMethod(ctx, orderID, method); err != nil {
+				logger.Error("Failed to update payment method", "error", err)
+			}
+			changes["payment_method"] = method
+		}
+
+		if charges.AmountRefunded > order.Payment.AmountRefunded {
+			// Stripe lists the charge's refunds newest first
+			refundID := order.Payment.StripeRefundID
+			if ch := pi.LatestCharge; ch != nil && ch.Refunds != nil && len(ch.Refunds.Data) > 0 {
+				refundID = ch.Refunds.Data[0].ID
+			}
+			if err := h.PaymentStore.UpdatePaymentRefund(ctx, orderID, refundID, charges.AmountRefunded); err != nil {
+				logger.Error("Failed to record refund", "refund_id", refundID, "error", err)
+			}
+			changes["amount_refunded"] = charges.AmountRefunded
+		}
+
+		// Mirror what the payment and refund webhooks would have recorded
+		switch {
+		case charges.AmountRefunded > 0 && charges.AmountRefunded >= order.Payment.Amount:
+			paymentStatus, orderStatus = models.PaymentStatusRefunded, models.OrderStatusRefunded
+		case charges.AmountCaptured < order.Payment.Amount:
+			paymentStatus = models.PaymentStatusPartiallyPaid
+		case charges.AmountRefunded > 0:
+			paymentStatus = models.PaymentStatusPartiallyRefunded
+		}
+	case models.PaymentStatusCanceled:
+		orderStatus = models.OrderStatusCanceled
+	}
+
+	if paymentStatus != order.Payment.Status {
+		if err := h.PaymentStore.UpdatePaymentStatus(ctx, orderID, paymentStatus); err != nil {
+			logger.Error("Failed to update payment status", "error", err)
+		} else {
+			changes["payment_status"] = paymentStatus
+		}
+	}
+	if orderStatus != order.Status {
+		// Final statuses such as a refunded order stay as they are
+		if !models.CanTransition(order.Status, orderStatus) {
+			logger.Warn("Order status can't follow Stripe", "status", order.Status, "stripe_status", orderStatus)
+		} else if err := h.PaymentStore.UpdateOrderStatus(ctx, orderID, orderStatus); err != nil {
+			logger.Error("Failed to update order status", "error", err)
+		} else {
+			changes["order_status"] = orderStatus
+		}
+	}
+
+	h.PaymentStore.AddPaymentEvent(ctx, models.PaymentEvent{
+		OrderID:   orderID,
+		EventType: "synced_from_stripe",
+		Status:    paymentStatus,
+		Data: map[string]interface{}{
+			"payment_intent_id": paymentIntentID,
+			"stripe_status":     pi.Status,
+			"changes":           changes,
+		},
+	})
+
+	logger.Info("Order synced from Stripe", "changes", len(changes))
+
+	if updated, err := h.PaymentStore.GetOrder(ctx, orderID); err == nil {
+		order = updated
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"order":   order,
+		"synced":  true,
+		"changes": changes,
+	})
+}
+
+// paymentRecorded reports whether a payment status means the payment's success was already recorded
+func paymentRecorded(status models.PaymentStatus) bool {
+	switch status {
+	case models.PaymentStatusSucceeded, models.PaymentStatusPartiallyRefunded, models.PaymentStatusRefunded:
+		return true
+	}
+	return false
+}
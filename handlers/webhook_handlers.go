@@ -2,12 +2,17 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"strings"
 	"time"
 
+	"github.com/capactiyvirus/stripe-backend/config"
 	"github.com/capactiyvirus/stripe-backend/models"
 	"github.com/stripe/stripe-go/v82"
 	"github.com/stripe/stripe-go/v82/webhook"
@@ -15,117 +20,369 @@ import (
 
 // HandleStripeWebhook handles Stripe webhook events with enhanced tracking
 func (h *Handlers) HandleStripeWebhook(w http.ResponseWriter, r *http.Request) {
-	const MaxBodyBytes = int64(65536)
-	r.Body = http.MaxBytesReader(w, r.Body, MaxBodyBytes)
+	// The event is marked processed before it's handled, so handling must not stop halfway
+	// when Stripe drops the connection
+	ctx := context.WithoutCancel(r.Context())
+	maxBodyBytes := h.webhookMaxBodyBytes()
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
 	payload, err := io.ReadAll(r.Body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		// A cut-off payload would only fail signature verification, so say what actually went wrong
+		h.Logger.Error("Webhook body is too large", "content_length", r.ContentLength, "read_bytes", len(payload), "max_bytes", maxBodyBytes)
+		respondWithError(w, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("Webhook payload is larger than %d bytes; raise WEBHOOK_MAX_BODY_BYTES", maxBodyBytes))
+		return
+	}
 	if err != nil {
-		log.Printf("Error reading request body: %v", err)
+		h.Logger.Error("Failed to read webhook body", "error", err)
 		respondWithError(w, http.StatusServiceUnavailable, "Error reading request body")
 		return
 	}
 
-	// Verify webhook signature
-	endpointSecret := h.Config.StripeWebhookSecret
-	event, err := webhook.ConstructEvent(payload, r.Header.Get("Stripe-Signature"), endpointSecret)
+	// Verify webhook signature. A missing header usually means the request didn't come from Stripe
+	// or a proxy dropped it, while a bad signature points at a wrong secret or tampering.
+	signature := r.Header.Get("Stripe-Signature")
+	if strings.TrimSpace(signature) == "" {
+		h.Logger.Warn("Webhook request has no Stripe-Signature header")
+		respondWithError(w, http.StatusBadRequest, "Missing Stripe-Signature header")
+		return
+	}
+	event, secretIndex, err := h.constructWebhookEvent(payload, signature)
+	if isWebhookSignatureError(err) {
+		h.Logger.Warn("Webhook signature verification failed", "error", err)
+		respondWithError(w, http.StatusUnauthorized, "Webhook signature verification failed")
+		return
+	}
 	if err != nil {
-		log.Printf("Webhook signature verification failed: %v", err)
-		respondWithError(w, http.StatusBadRequest, "Webhook signature verification failed")
+		h.Logger.Warn("Invalid webhook payload", "error", err)
+		respondWithError(w, http.StatusBadRequest, "Invalid webhook payload")
+		return
+	}
+	logger := h.eventLogger(event)
+	logger.Debug("Webhook signature verified", "secret_index", secretIndex)
+	h.Metrics.webhookReceived(string(event.Type))
+
+	// Keep the event as delivered so it can be replayed if handling it goes wrong
+	if h.Config.WebhookEventRetention > 0 {
+		stored := models.WebhookEvent{ID: event.ID, Type: string(event.Type), Payload: payload, ReceivedAt: time.Now()}
+		if err := h.PaymentStore.SaveWebhookEvent(ctx, stored, h.Config.WebhookEventRetention); err != nil {
+			logger.Error("Failed to store webhook event", "error", err)
+		}
+	}
+
+	// Stripe retries deliveries, so skip events that have already been handled
+	alreadyProcessed, err := h.PaymentStore.MarkEventProcessed(ctx, event.ID)
+	if err != nil {
+		logger.Error("Failed to record webhook event", "error", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to record webhook event")
+		return
+	}
+	if alreadyProcessed {
+		logger.Info("Skipping already processed webhook event")
+		respondWithJSON(w, http.StatusOK, map[string]string{"status": "already_processed"})
+		return
+	}
+
+	if err := h.dispatchWebhookEvent(ctx, event); err != nil {
+		// Answer with an error so Stripe retries the event later
+		logger.Warn("Deferring webhook event", "error", err)
+		if err := h.PaymentStore.UnmarkEventProcessed(ctx, event.ID); err != nil {
+			logger.Error("Failed to unmark webhook event", "error", err)
+		}
+		respondWithError(w, http.StatusInternalServerError, "Order not found yet, retry later")
 		return
 	}
 
-	// Handle the event
+	respondWithJSON(w, http.StatusOK, map[string]string{"status": "success"})
+}
+
+// dispatchWebhookEvent hands a verified event to the handler for its type. It returns an error when
+// the event should be retried later.
+func (h *Handlers) dispatchWebhookEvent(ctx context.Context, event stripe.Event) error {
 	switch event.Type {
 	case "payment_intent.succeeded":
-		h.handlePaymentIntentSucceeded(event)
+		return h.handlePaymentIntentSucceeded(ctx, event)
+	case "payment_intent.partially_funded":
+		h.handlePaymentIntentPartiallyFunded(ctx, event)
 	case "payment_intent.payment_failed":
-		h.handlePaymentIntentFailed(event)
+		h.handlePaymentIntentFailed(ctx, event)
 	case "payment_intent.canceled":
-		h.handlePaymentIntentCanceled(event)
+		h.handlePaymentIntentCanceled(ctx, event)
 	case "checkout.session.completed":
-		h.handleCheckoutSessionCompleted(event)
+		h.handleCheckoutSessionCompleted(ctx, event)
+	case "checkout.session.async_payment_succeeded":
+		h.handleCheckoutSessionAsyncPaymentSucceeded(ctx, event)
+	case "checkout.session.async_payment_failed":
+		h.handleCheckoutSessionAsyncPaymentFailed(ctx, event)
 	case "invoice.payment_succeeded":
-		h.handleInvoicePaymentSucceeded(event)
+		h.handleInvoicePaymentSucceeded(ctx, event)
+	case "customer.subscription.created", "customer.subscription.updated", "customer.subscription.deleted":
+		h.handleSubscriptionChanged(ctx, event)
+	case "charge.refunded":
+		h.handleChargeRefunded(ctx, event)
 	case "charge.dispute.created":
-		h.handleChargeDisputeCreated(event)
+		h.handleChargeDisputeCreated(ctx, event)
+	case "charge.dispute.closed":
+		h.handleChargeDisputeClosed(ctx, event)
 	default:
-		log.Printf("Unhandled event type: %s", event.Type)
+		h.eventLogger(event).Debug("Unhandled webhook event type")
 	}
-
-	respondWithJSON(w, http.StatusOK, map[string]string{"status": "success"})
+	return nil
 }
 
-// handlePaymentIntentSucceeded processes successful payment intents
-func (h *Handlers) handlePaymentIntentSucceeded(event stripe.Event) {
+// handlePaymentIntentSucceeded processes successful payment intents. It returns an error when
+// no order matches yet, since the event can arrive before CreateOrder has saved the order.
+func (h *Handlers) handlePaymentIntentSucceeded(ctx context.Context, event stripe.Event) error {
+	logger := h.eventLogger(event)
+
 	var paymentIntent stripe.PaymentIntent
 	err := json.Unmarshal(event.Data.Raw, &paymentIntent)
 	if err != nil {
-		log.Printf("Error parsing payment_intent.succeeded: %v", err)
-		return
+		logger.Error("Failed to parse webhook event", "error", err)
+		return nil
 	}
+	logger = logger.With("payment_intent_id", paymentIntent.ID)
 
-	log.Printf("Payment succeeded: %s", paymentIntent.ID)
+	logger.Info("Payment succeeded")
 
 	// Find the order by payment intent ID
-	orderID := h.findOrderByPaymentIntentID(paymentIntent.ID)
+	orderID := h.findOrderByPaymentIntentID(ctx, paymentIntent.ID)
 	if orderID == "" {
-		log.Printf("No order found for payment intent: %s", paymentIntent.ID)
-		return
+		return fmt.Errorf("no order found for payment intent: %s", paymentIntent.ID)
+	}
+
+	// Process events for the same order one at a time so concurrent webhooks
+	// don't overwrite each other's read-modify-write
+	unlock := h.orderLocks.Lock(orderID)
+	defer unlock()
+	logger = logger.With("order_id", orderID)
+
+	order, err := h.PaymentStore.GetOrder(ctx, orderID)
+	if err != nil {
+		logger.Error("Failed to get order", "error", err)
+		return nil
+	}
+
+	// Some payment methods split one intent across several charges, so total them up
+	charges := collectPaymentCharges(ctx, h.Gateway, logger, &paymentIntent)
+	if err := h.PaymentStore.UpdatePaymentCharges(ctx, orderID, charges.ChargeIDs, charges.AmountCaptured); err != nil {
+		logger.Error("Failed to update payment charges", "error", err)
+	}
+
+	// Record Stripe's processing fee for margin reporting
+	if charges.HasBalanceTransaction {
+		if err := h.PaymentStore.UpdatePaymentFees(ctx, orderID, charges.Fee, charges.Net); err != nil {
+			logger.Error("Failed to update payment fees", "error", err)
+		}
+	}
+
+	// A completed checkout session may already have marked the order paid
+	if order.Payment.Status == models.PaymentStatusSucceeded {
+		logger.Info("Order already paid")
+		return nil
+	}
+
+	// Only mark the order paid once the captured total covers the order amount
+	if charges.AmountCaptured < order.Payment.Amount {
+		logger.Info("Order partially paid", "amount_captured", charges.AmountCaptured, "amount", order.Payment.Amount)
+
+		if err := h.PaymentStore.UpdatePaymentStatus(ctx, orderID, models.PaymentStatusPartiallyPaid); err != nil {
+			logger.Error("Failed to update payment status", "error", err)
+			return nil
+		}
+
+		h.PaymentStore.AddPaymentEvent(ctx, models.PaymentEvent{
+			OrderID:   orderID,
+			EventType: "payment_partially_paid",
+			Status:    models.PaymentStatusPartiallyPaid,
+			Data:      intentEventData(&paymentIntent, charges),
+		})
+		return nil
+	}
+
+	h.applySucceededIntent(ctx, logger, order, &paymentIntent, charges)
+	return nil
+}
+
+// intentPaymentMethod is how a payment intent was paid. The charges say whether a card payment went
+// through Apple Pay or Google Pay, while the intent's payment method is usually just an ID.
+func intentPaymentMethod(pi *stripe.PaymentIntent, charges paymentCharges) models.PaymentMethod {
+	if charges.Method != "" {
+		return charges.Method
+	}
+	return getPaymentMethod(pi.PaymentMethod)
+}
+
+// intentEventData is the payment event data recorded for a payment intent and its charges
+func intentEventData(pi *stripe.PaymentIntent, charges paymentCharges) map[string]interface{} {
+	eventData := map[string]interface{}{
+		"payment_intent_id": pi.ID,
+		"amount":            pi.Amount,
+		"amount_captured":   charges.AmountCaptured,
+		"charge_ids":        charges.ChargeIDs,
+		"currency":          pi.Currency,
+		"payment_method":    intentPaymentMethod(pi, charges),
+	}
+	if charges.HasBalanceTransaction {
+		eventData["stripe_fee"] = charges.Fee
+		eventData["net_amount"] = charges.Net
+	}
+	return eventData
+}
+
+// applySucceededIntent records a succeeded payment intent whose charges cover the order, for the
+// payment_intent.succeeded webhook and SyncOrder: it keeps the payment method Stripe saved, marks
+// the order paid with a payment_succeeded event, and sends the payment confirmation. The charges and
+// fees are already stored. It reports whether the order was marked paid.
+func (h *Handlers) applySucceededIntent(ctx context.Context, logger *slog.Logger, order *models.Order, pi *stripe.PaymentIntent, charges paymentCharges) bool {
+	orderID := order.ID
+	eventData := intentEventData(pi, charges)
+
+	// Keep the payment method Stripe saved for later off-session charges
+	if pi.SetupFutureUsage == stripe.PaymentIntentSetupFutureUsageOffSession && pi.PaymentMethod != nil {
+		var customerID string
+		if pi.Customer != nil {
+			customerID = pi.Customer.ID
+		}
+		if err := h.PaymentStore.UpdateSavedPaymentMethod(ctx, orderID, customerID, pi.PaymentMethod.ID); err != nil {
+			logger.Error("Failed to save payment method", "error", err)
+		}
+		eventData["saved_payment_method_id"] = pi.PaymentMethod.ID
+	}
+
+	if err := h.PaymentStore.UpdatePaymentMethod(ctx, orderID, intentPaymentMethod(pi, charges)); err != nil {
+		logger.Error("Failed to update payment method", "error", err)
 	}
 
 	// Update payment status
-	if err := h.PaymentStore.UpdatePaymentStatus(orderID, models.PaymentStatusSucceeded); err != nil {
-		log.Printf("Failed to update payment status for order %s: %v", orderID, err)
-		return
+	if err := h.PaymentStore.UpdatePaymentStatus(ctx, orderID, models.PaymentStatusSucceeded); err != nil {
+		logger.Error("Failed to update payment status", "error", err)
+		return false
 	}
 
 	// Update order status to paid
-	if err := h.PaymentStore.UpdateOrderStatus(orderID, models.OrderStatusPaid); err != nil {
-		log.Printf("Failed to update order status for order %s: %v", orderID, err)
-		return
+	if err := h.PaymentStore.UpdateOrderStatus(ctx, orderID, models.OrderStatusPaid); err != nil {
+		if order.Status == models.OrderStatusCanceled && errors.Is(err, models.ErrInvalidStatusTransition) {
+			h.recordCanceledOrderPaid(ctx, logger, order, eventData)
+			return false
+		}
+		logger.Error("Failed to update order status", "error", err)
+		return false
 	}
 
 	// Log payment event
-	h.PaymentStore.AddPaymentEvent(models.PaymentEvent{
+	h.PaymentStore.AddPaymentEvent(ctx, models.PaymentEvent{
 		OrderID:   orderID,
 		EventType: "payment_succeeded",
 		Status:    models.PaymentStatusSucceeded,
+		Data:      eventData,
+	})
+
+	h.notifyOrderPaid(ctx, orderID)
+	h.Metrics.paymentSucceeded()
+
+	logger.Info("Order is paid")
+	return true
+}
+
+// recordCanceledOrderPaid records a payment that succeeded after its order was canceled and alerts
+// ADMIN_EMAIL, since the customer has been charged for an order that won't be fulfilled
+func (h *Handlers) recordCanceledOrderPaid(ctx context.Context, logger *slog.Logger, order *models.Order, eventData map[string]interface{}) {
+	logger.Error("Payment succeeded for a canceled order; it needs a refund")
+
+	h.PaymentStore.AddPaymentEvent(ctx, models.PaymentEvent{
+		OrderID:   order.ID,
+		EventType: "payment_succeeded_on_canceled_order",
+		Status:    models.PaymentStatusSucceeded,
+		Data:      eventData,
+	})
+
+	if h.EmailService != nil && h.Config.AdminEmail != "" {
+		if err := h.EmailService.SendCanceledOrderPaidNotification(h.Config.AdminEmail, order); err != nil {
+			logger.Error("Failed to send canceled order notification", "error", err)
+		}
+	}
+}
+
+// handlePaymentIntentPartiallyFunded records a partial customer balance payment (e.g. gift card + bank
+// transfer). The order stays pending until payment_intent.succeeded reports it fully funded.
+func (h *Handlers) handlePaymentIntentPartiallyFunded(ctx context.Context, event stripe.Event) {
+	logger := h.eventLogger(event)
+
+	var paymentIntent stripe.PaymentIntent
+	err := json.Unmarshal(event.Data.Raw, &paymentIntent)
+	if err != nil {
+		logger.Error("Failed to parse webhook event", "error", err)
+		return
+	}
+	logger = logger.With("payment_intent_id", paymentIntent.ID)
+
+	orderID := h.findOrderByPaymentIntentID(ctx, paymentIntent.ID)
+	if orderID == "" {
+		logger.Warn("No order found for payment intent")
+		return
+	}
+
+	unlock := h.orderLocks.Lock(orderID)
+	defer unlock()
+	logger = logger.With("order_id", orderID)
+
+	// Stripe reports what's still owed in the bank transfer instructions
+	amountRemaining := paymentIntent.Amount
+	if paymentIntent.NextAction != nil && paymentIntent.NextAction.DisplayBankTransferInstructions != nil {
+		amountRemaining = paymentIntent.NextAction.DisplayBankTransferInstructions.AmountRemaining
+	}
+	amountFunded := paymentIntent.Amount - amountRemaining
+
+	logger.Info("Payment partially funded", "amount_funded", amountFunded, "amount", paymentIntent.Amount)
+
+	h.PaymentStore.AddPaymentEvent(ctx, models.PaymentEvent{
+		OrderID:   orderID,
+		EventType: "payment_partially_funded",
+		Status:    models.PaymentStatusPending,
 		Data: map[string]interface{}{
 			"payment_intent_id": paymentIntent.ID,
 			"amount":            paymentIntent.Amount,
+			"amount_funded":     amountFunded,
+			"amount_remaining":  amountRemaining,
 			"currency":          paymentIntent.Currency,
-			"payment_method":    getPaymentMethod(paymentIntent.PaymentMethod),
 		},
 	})
-
-	// TODO: Trigger order fulfillment (send download links, etc.)
-	log.Printf("Order %s is ready for fulfillment", orderID)
 }
 
 // handlePaymentIntentFailed processes failed payment intents
-func (h *Handlers) handlePaymentIntentFailed(event stripe.Event) {
+func (h *Handlers) handlePaymentIntentFailed(ctx context.Context, event stripe.Event) {
+	logger := h.eventLogger(event)
+
 	var paymentIntent stripe.PaymentIntent
 	err := json.Unmarshal(event.Data.Raw, &paymentIntent)
 	if err != nil {
-		log.Printf("Error parsing payment_intent.payment_failed: %v", err)
+		logger.Error("Failed to parse webhook event", "error", err)
 		return
 	}
+	logger = logger.With("payment_intent_id", paymentIntent.ID)
 
-	log.Printf("Payment failed: %s", paymentIntent.ID)
+	logger.Info("Payment failed")
 
-	orderID := h.findOrderByPaymentIntentID(paymentIntent.ID)
+	orderID := h.findOrderByPaymentIntentID(ctx, paymentIntent.ID)
 	if orderID == "" {
-		log.Printf("No order found for payment intent: %s", paymentIntent.ID)
+		logger.Warn("No order found for payment intent")
 		return
 	}
 
+	unlock := h.orderLocks.Lock(orderID)
+	defer unlock()
+	logger = logger.With("order_id", orderID)
+
 	// Update payment status
-	if err := h.PaymentStore.UpdatePaymentStatus(orderID, models.PaymentStatusFailed); err != nil {
-		log.Printf("Failed to update payment status for order %s: %v", orderID, err)
+	if err := h.PaymentStore.UpdatePaymentStatus(ctx, orderID, models.PaymentStatusFailed); err != nil {
+		logger.Error("Failed to update payment status", "error", err)
 		return
 	}
 
 	// Log payment event
-	h.PaymentStore.AddPaymentEvent(models.PaymentEvent{
+	h.PaymentStore.AddPaymentEvent(ctx, models.PaymentEvent{
 		OrderID:   orderID,
 		EventType: "payment_failed",
 		Status:    models.PaymentStatusFailed,
@@ -135,31 +392,39 @@ func (h *Handlers) handlePaymentIntentFailed(event stripe.Event) {
 			// "failure_message":   getFailureMessage(paymentIntent.LastPaymentError),
 		},
 	})
+	h.Metrics.paymentFailed()
 }
 
 // handlePaymentIntentCanceled processes canceled payment intents
-func (h *Handlers) handlePaymentIntentCanceled(event stripe.Event) {
+func (h *Handlers) handlePaymentIntentCanceled(ctx context.Context, event stripe.Event) {
+	logger := h.eventLogger(event)
+
 	var paymentIntent stripe.PaymentIntent
 	err := json.Unmarshal(event.Data.Raw, &paymentIntent)
 	if err != nil {
-		log.Printf("Error parsing payment_intent.canceled: %v", err)
+		logger.Error("Failed to parse webhook event", "error", err)
 		return
 	}
+	logger = logger.With("payment_intent_id", paymentIntent.ID)
 
-	log.Printf("Payment canceled: %s", paymentIntent.ID)
+	logger.Info("Payment canceled")
 
-	orderID := h.findOrderByPaymentIntentID(paymentIntent.ID)
+	orderID := h.findOrderByPaymentIntentID(ctx, paymentIntent.ID)
 	if orderID == "" {
-		log.Printf("No order found for payment intent: %s", paymentIntent.ID)
+		logger.Warn("No order found for payment intent")
 		return
 	}
 
+	unlock := h.orderLocks.Lock(orderID)
+	defer unlock()
+	logger = logger.With("order_id", orderID)
+
 	// Update statuses
-	h.PaymentStore.UpdatePaymentStatus(orderID, models.PaymentStatusCanceled)
-	h.PaymentStore.UpdateOrderStatus(orderID, models.OrderStatusCanceled)
+	h.PaymentStore.UpdatePaymentStatus(ctx, orderID, models.PaymentStatusCanceled)
+	h.PaymentStore.UpdateOrderStatus(ctx, orderID, models.OrderStatusCanceled)
 
 	// Log payment event
-	h.PaymentStore.AddPaymentEvent(models.PaymentEvent{
+	h.PaymentStore.AddPaymentEvent(ctx, models.PaymentEvent{
 		OrderID:   orderID,
 		EventType: "payment_canceled",
 		Status:    models.PaymentStatusCanceled,
@@ -171,31 +436,33 @@ func (h *Handlers) handlePaymentIntentCanceled(event stripe.Event) {
 }
 
 // handleCheckoutSessionCompleted processes completed checkout sessions
-func (h *Handlers) handleCheckoutSessionCompleted(event stripe.Event) {
+func (h *Handlers) handleCheckoutSessionCompleted(ctx context.Context, event stripe.Event) {
+	logger := h.eventLogger(event)
+
 	var session stripe.CheckoutSession
 	err := json.Unmarshal(event.Data.Raw, &session)
 	if err != nil {
-		log.Printf("Error parsing checkout.session.completed: %v", err)
+		logger.Error("Failed to parse webhook event", "error", err)
 		return
 	}
+	logger = logger.With("session_id", session.ID)
 
-	log.Printf("Checkout session completed: %s", session.ID)
-
-	// Find order by session ID or payment intent ID
-	orderID := h.findOrderBySessionID(session.ID)
-	if orderID == "" && session.PaymentIntent != nil {
-		orderID = h.findOrderByPaymentIntentID(session.PaymentIntent.ID)
-	}
+	logger.Info("Checkout session completed")
 
+	orderID := h.findOrderForSession(ctx, &session)
 	if orderID == "" {
-		log.Printf("No order found for checkout session: %s", session.ID)
+		logger.Warn("No order found for checkout session")
 		return
 	}
 
+	unlock := h.orderLocks.Lock(orderID)
+	defer unlock()
+	logger = logger.With("order_id", orderID)
+
 	// Update order with session information
-	order, err := h.PaymentStore.GetOrder(orderID)
+	order, err := h.PaymentStore.GetOrder(ctx, orderID)
 	if err != nil {
-		log.Printf("Failed to get order %s: %v", orderID, err)
+		logger.Error("Failed to get order", "error", err)
 		return
 	}
 
@@ -216,13 +483,13 @@ func (h *Handlers) handleCheckoutSessionCompleted(event stripe.Event) {
 	}
 	order.Payment.StripeSessionID = session.ID
 
-	if err := h.PaymentStore.UpdateOrder(order); err != nil {
-		log.Printf("Failed to update order %s: %v", orderID, err)
+	if err := h.PaymentStore.UpdateOrder(ctx, order); err != nil {
+		logger.Error("Failed to update order", "error", err)
 		return
 	}
 
 	// Log checkout event
-	h.PaymentStore.AddPaymentEvent(models.PaymentEvent{
+	h.PaymentStore.AddPaymentEvent(ctx, models.PaymentEvent{
 		OrderID:   orderID,
 		EventType: "checkout_completed",
 		Status:    models.PaymentStatusSucceeded,
@@ -232,90 +499,414 @@ func (h *Handlers) handleCheckoutSessionCompleted(event stripe.Event) {
 			"customer_email":    getCustomerEmail(session.CustomerDetails),
 		},
 	})
+
+	// Delayed payment methods complete the session unpaid and settle in async_payment_succeeded
+	if session.PaymentStatus != stripe.CheckoutSessionPaymentStatusPaid || order.Payment.Status == models.PaymentStatusSucceeded {
+		return
+	}
+
+	eventData := map[string]interface{}{
+		"session_id":        session.ID,
+		"payment_intent_id": getPaymentIntentID(session.PaymentIntent),
+		"amount_total":      session.AmountTotal,
+	}
+	if err := h.PaymentStore.UpdatePaymentStatus(ctx, orderID, models.PaymentStatusSucceeded); err != nil {
+		logger.Error("Failed to update payment status", "error", err)
+		return
+	}
+	if err := h.PaymentStore.UpdateOrderStatus(ctx, orderID, models.OrderStatusPaid); err != nil {
+		if order.Status == models.OrderStatusCanceled && errors.Is(err, models.ErrInvalidStatusTransition) {
+			h.recordCanceledOrderPaid(ctx, logger, order, eventData)
+			return
+		}
+		logger.Error("Failed to update order status", "error", err)
+		return
+	}
+
+	h.PaymentStore.AddPaymentEvent(ctx, models.PaymentEvent{
+		OrderID:   orderID,
+		EventType: "payment_succeeded",
+		Status:    models.PaymentStatusSucceeded,
+		Data:      eventData,
+	})
+
+	h.notifyOrderPaid(ctx, orderID)
+	h.Metrics.paymentSucceeded()
+
+	logger.Info("Order is paid")
 }
 
-// handleInvoicePaymentSucceeded processes successful invoice payments
-func (h *Handlers) handleInvoicePaymentSucceeded(event stripe.Event) {
-	var invoice stripe.Invoice
-	err := json.Unmarshal(event.Data.Raw, &invoice)
+// handleCheckoutSessionAsyncPaymentSucceeded marks an order paid once a delayed payment method
+// (bank debit, voucher) used in hosted checkout settles
+func (h *Handlers) handleCheckoutSessionAsyncPaymentSucceeded(ctx context.Context, event stripe.Event) {
+	logger := h.eventLogger(event)
+
+	var session stripe.CheckoutSession
+	err := json.Unmarshal(event.Data.Raw, &session)
+	if err != nil {
+		logger.Error("Failed to parse webhook event", "error", err)
+		return
+	}
+	logger = logger.With("session_id", session.ID)
+
+	logger.Info("Checkout session async payment succeeded")
+
+	orderID := h.findOrderForSession(ctx, &session)
+	if orderID == "" {
+		logger.Warn("No order found for checkout session")
+		return
+	}
+
+	unlock := h.orderLocks.Lock(orderID)
+	defer unlock()
+	logger = logger.With("order_id", orderID)
+
+	order, err := h.PaymentStore.GetOrder(ctx, orderID)
 	if err != nil {
-		log.Printf("Error parsing invoice.payment_succeeded: %v", err)
+		logger.Error("Failed to get order", "error", err)
+		return
+	}
+	// The payment intent's own webhook may already have marked the order paid
+	if order.Payment.Status == models.PaymentStatusSucceeded {
+		logger.Info("Order already paid")
+		return
+	}
+
+	eventData := map[string]interface{}{
+		"session_id":        session.ID,
+		"payment_intent_id": getPaymentIntentID(session.PaymentIntent),
+		"async":             true,
+	}
+	if err := h.PaymentStore.UpdatePaymentStatus(ctx, orderID, models.PaymentStatusSucceeded); err != nil {
+		logger.Error("Failed to update payment status", "error", err)
+		return
+	}
+	if err := h.PaymentStore.UpdateOrderStatus(ctx, orderID, models.OrderStatusPaid); err != nil {
+		if order.Status == models.OrderStatusCanceled && errors.Is(err, models.ErrInvalidStatusTransition) {
+			h.recordCanceledOrderPaid(ctx, logger, order, eventData)
+			return
+		}
+		logger.Error("Failed to update order status", "error", err)
 		return
 	}
 
-	log.Printf("Invoice payment succeeded: %s", invoice.ID)
+	h.PaymentStore.AddPaymentEvent(ctx, models.PaymentEvent{
+		OrderID:   orderID,
+		EventType: "payment_succeeded",
+		Status:    models.PaymentStatusSucceeded,
+		Data:      eventData,
+	})
 
-	// Log the event for tracking purposes
-	// You might want to implement subscription or recurring payment logic here
+	h.notifyOrderPaid(ctx, orderID)
+	h.Metrics.paymentSucceeded()
+
+	logger.Info("Order is paid")
 }
 
-// handleChargeDisputeCreated processes charge disputes
-func (h *Handlers) handleChargeDisputeCreated(event stripe.Event) {
+// handleCheckoutSessionAsyncPaymentFailed marks an order's payment failed when a delayed payment
+// method used in hosted checkout doesn't settle
+func (h *Handlers) handleCheckoutSessionAsyncPaymentFailed(ctx context.Context, event stripe.Event) {
+	logger := h.eventLogger(event)
+
+	var session stripe.CheckoutSession
+	err := json.Unmarshal(event.Data.Raw, &session)
+	if err != nil {
+		logger.Error("Failed to parse webhook event", "error", err)
+		return
+	}
+	logger = logger.With("session_id", session.ID)
+
+	logger.Info("Checkout session async payment failed")
+
+	orderID := h.findOrderForSession(ctx, &session)
+	if orderID == "" {
+		logger.Warn("No order found for checkout session")
+		return
+	}
+
+	unlock := h.orderLocks.Lock(orderID)
+	defer unlock()
+	logger = logger.With("order_id", orderID)
+
+	if err := h.PaymentStore.UpdatePaymentStatus(ctx, orderID, models.PaymentStatusFailed); err != nil {
+		logger.Error("Failed to update payment status", "error", err)
+		return
+	}
+
+	h.PaymentStore.AddPaymentEvent(ctx, models.PaymentEvent{
+		OrderID:   orderID,
+		EventType: "payment_failed",
+		Status:    models.PaymentStatusFailed,
+		Data: map[string]interface{}{
+			"session_id":        session.ID,
+			"payment_intent_id": getPaymentIntentID(session.PaymentIntent),
+			"async":             true,
+		},
+	})
+	h.Metrics.paymentFailed()
+
+	if h.EmailService != nil {
+		if failedOrder, err := h.PaymentStore.GetOrder(ctx, orderID); err == nil {
+			if err := h.EmailService.SendPaymentFailedNotification(failedOrder); err != nil {
+				logger.Error("Failed to send payment failure notification", "error", err)
+			}
+		}
+	}
+}
+
+// handleChargeRefunded syncs refunds issued outside RefundOrder, such as from the Stripe dashboard.
+// Refunds RefundOrder already recorded are skipped.
+func (h *Handlers) handleChargeRefunded(ctx context.Context, event stripe.Event) {
+	logger := h.eventLogger(event)
+
+	var ch stripe.Charge
+	err := json.Unmarshal(event.Data.Raw, &ch)
+	if err != nil {
+		logger.Error("Failed to parse webhook event", "error", err)
+		return
+	}
+	logger = logger.With("charge_id", ch.ID)
+
+	if ch.PaymentIntent == nil || ch.PaymentIntent.ID == "" {
+		logger.Warn("Refunded charge has no payment intent")
+		return
+	}
+	logger = logger.With("payment_intent_id", ch.PaymentIntent.ID)
+
+	orderID := h.findOrderByPaymentIntentID(ctx, ch.PaymentIntent.ID)
+	if orderID == "" {
+		logger.Warn("No order found for payment intent")
+		return
+	}
+
+	unlock := h.orderLocks.Lock(orderID)
+	defer unlock()
+	logger = logger.With("order_id", orderID)
+
+	order, err := h.PaymentStore.GetOrder(ctx, orderID)
+	if err != nil {
+		logger.Error("Failed to get order", "error", err)
+		return
+	}
+
+	amountRefunded := refundedAcrossCharges(ctx, h.Gateway, logger, order, &ch)
+	if amountRefunded <= order.Payment.AmountRefunded {
+		logger.Info("Refund already recorded")
+		return
+	}
+
+	// Stripe lists the charge's refunds newest first
+	refundID := order.Payment.StripeRefundID
+	if ch.Refunds != nil && len(ch.Refunds.Data) > 0 {
+		refundID = ch.Refunds.Data[0].ID
+	}
+	if err := h.PaymentStore.UpdatePaymentRefund(ctx, orderID, refundID, amountRefunded); err != nil {
+		logger.Error("Failed to record refund", "refund_id", refundID, "error", err)
+		return
+	}
+
+	// A partial refund leaves the order paid or fulfilled
+	eventType, paymentStatus := "order_partially_refunded", models.PaymentStatusPartiallyRefunded
+	if amountRefunded >= order.Payment.Amount {
+		eventType, paymentStatus = "order_refunded", models.PaymentStatusRefunded
+
+		if err := h.PaymentStore.UpdateOrderStatus(ctx, orderID, models.OrderStatusRefunded); err != nil {
+			logger.Error("Failed to update order status", "error", err)
+			return
+		}
+	}
+	if err := h.PaymentStore.UpdatePaymentStatus(ctx, orderID, paymentStatus); err != nil {
+		logger.Error("Failed to update payment status", "error", err)
+		return
+	}
+
+	h.PaymentStore.AddPaymentEvent(ctx, models.PaymentEvent{
+		OrderID:   orderID,
+		EventType: eventType,
+		Status:    paymentStatus,
+		Data: map[string]interface{}{
+			"refunded_at":      time.Now(),
+			"stripe_refund_id": refundID,
+			"charge_id":        ch.ID,
+			"amount":           amountRefunded - order.Payment.AmountRefunded,
+			"amount_refunded":  amountRefunded,
+			"source":           "stripe",
+		},
+	})
+
+	if refundedOrder, err := h.PaymentStore.GetOrder(ctx, orderID); err == nil {
+		h.runHooks("OnOrderRefunded", refundedOrder, OrderHook.OnOrderRefunded)
+		h.sendRefundNotification(refundedOrder, amountRefunded-order.Payment.AmountRefunded, chargeCardLast4(&ch))
+	}
+
+	logger.Info("Refund recorded", "amount_refunded", amountRefunded)
+}
+
+// refundedAcrossCharges returns the total refunded on an order's payment intent. Orders paid with
+// one charge use the refunded charge's total; split payments list every charge, falling back to
+// adding this charge's refunds to the recorded total if Stripe can't be reached.
+func refundedAcrossCharges(ctx context.Context, gateway PaymentGateway, logger *slog.Logger, order *models.Order, refunded *stripe.Charge) int64 {
+	if len(order.Payment.ChargeIDs) <= 1 {
+		return refunded.AmountRefunded
+	}
+
+	charges, err := gateway.ListCharges(ctx, &stripe.ChargeListParams{PaymentIntent: stripe.String(refunded.PaymentIntent.ID)})
+	if err != nil {
+		logger.Error("Failed to list charges for payment intent", "error", err)
+		return order.Payment.AmountRefunded + refunded.AmountRefunded
+	}
+
+	var total int64
+	for _, ch := range charges {
+		total += ch.AmountRefunded
+	}
+	return total
+}
+
+// handleChargeDisputeClosed records a dispute's outcome, taking it off the open disputes list. A lost
+// dispute returned the payment to the customer, so the order is marked refunded; won and inquiry-only
+// disputes leave the order as it was.
+func (h *Handlers) handleChargeDisputeClosed(ctx context.Context, event stripe.Event) {
+	logger := h.eventLogger(event)
+
 	var dispute stripe.Dispute
 	err := json.Unmarshal(event.Data.Raw, &dispute)
 	if err != nil {
-		log.Printf("Error parsing charge.dispute.created: %v", err)
+		logger.Error("Failed to parse webhook event", "error", err)
+		return
+	}
+	logger = logger.With("dispute_id", dispute.ID, "dispute_status", string(dispute.Status))
+
+	if err := h.PaymentStore.UpdateDisputeStatus(ctx, dispute.ID, string(dispute.Status)); err != nil {
+		// Disputes opened before they were recorded have nothing to update
+		logger.Warn("Failed to update dispute status", "error", err)
+	}
+
+	if dispute.PaymentIntent == nil || dispute.PaymentIntent.ID == "" {
+		logger.Warn("Closed dispute has no payment intent")
+		return
+	}
+	logger = logger.With("payment_intent_id", dispute.PaymentIntent.ID)
+
+	orderID := h.findOrderByPaymentIntentID(ctx, dispute.PaymentIntent.ID)
+	if orderID == "" {
+		logger.Warn("No order found for payment intent")
+		return
+	}
+
+	unlock := h.orderLocks.Lock(orderID)
+	defer unlock()
+	logger = logger.With("order_id", orderID)
+
+	order, err := h.PaymentStore.GetOrder(ctx, orderID)
+	if err != nil {
+		logger.Error("Failed to get order", "error", err)
 		return
 	}
 
-	log.Printf("Charge dispute created: %s for charge: %s", dispute.ID, dispute.Charge.ID)
+	eventType, paymentStatus := "dispute_closed", order.Payment.Status
+	switch dispute.Status {
+	case stripe.DisputeStatusWon:
+		eventType = "dispute_won"
+	case stripe.DisputeStatusLost:
+		eventType, paymentStatus = "dispute_lost", models.PaymentStatusRefunded
+
+		if err := h.PaymentStore.UpdateOrderStatus(ctx, orderID, models.OrderStatusRefunded); err != nil {
+			logger.Error("Failed to update order status", "error", err)
+			return
+		}
+		if err := h.PaymentStore.UpdatePaymentStatus(ctx, orderID, paymentStatus); err != nil {
+			logger.Error("Failed to update payment status", "error", err)
+			return
+		}
+	}
 
-	// Find order by charge ID or payment intent ID
-	// You might need to implement additional tracking for this
-	// For now, just log it for manual review
+	var chargeID string
+	if dispute.Charge != nil {
+		chargeID = dispute.Charge.ID
+	}
+	h.PaymentStore.AddPaymentEvent(ctx, models.PaymentEvent{
+		OrderID:   orderID,
+		EventType: eventType,
+		Status:    paymentStatus,
+		Data: map[string]interface{}{
+			"dispute_id":     dispute.ID,
+			"dispute_status": dispute.Status,
+			"charge_id":      chargeID,
+			"amount":         dispute.Amount,
+			"reason":         dispute.Reason,
+		},
+	})
 
-	// TODO: Implement dispute handling logic
-	// - Find related order
-	// - Update order status
-	// - Send notification to admin
-	// - Prepare dispute response materials
+	logger.Info("Dispute closed")
 }
 
 // Helper functions
 
-// findOrderByPaymentIntentID finds an order by Stripe payment intent ID
-func (h *Handlers) findOrderByPaymentIntentID(paymentIntentID string) string {
-	// This is a simple implementation - in a real database, you'd do a query
-	// For now, we'll iterate through orders (this should be optimized with proper indexing)
-
-	// Get all orders and search (this is inefficient but works for the demo)
-	orders, err := h.PaymentStore.GetAllOrders(1000, 0) // Get a large batch
-	if err != nil {
-		return ""
+// webhookMaxBodyBytes is the largest webhook payload HandleStripeWebhook reads
+func (h *Handlers) webhookMaxBodyBytes() int64 {
+	if h.Config.WebhookMaxBodyBytes > 0 {
+		return h.Config.WebhookMaxBodyBytes
 	}
+	return config.DefaultWebhookMaxBodyBytes
+}
 
-	for _, summary := range orders {
-		order, err := h.PaymentStore.GetOrder(summary.ID)
-		if err != nil {
-			continue
+// constructWebhookEvent verifies a webhook payload against each of the comma-separated secrets
+// in STRIPE_WEBHOOK_SECRET, so events signed with either secret are accepted while one is rotated.
+// It returns the index of the secret that matched. Once a secret matches, errors reading the
+// payload are returned rather than trying the remaining secrets.
+func (h *Handlers) constructWebhookEvent(payload []byte, signature string) (stripe.Event, int, error) {
+	var event stripe.Event
+	err := webhook.ErrNoValidSignature // No secrets configured verifies nothing
+	for i, secret := range h.Config.WebhookSecrets() {
+		event, err = h.Gateway.ConstructWebhookEvent(payload, signature, secret)
+		if err == nil {
+			return event, i, nil
 		}
-		if order.Payment.StripePaymentIntentID == paymentIntentID {
-			return order.ID
+		if !isWebhookSignatureError(err) {
+			return event, -1, err
 		}
 	}
+	return event, -1, err
+}
 
-	return ""
+// isWebhookSignatureError reports whether err is a webhook's signature failing verification,
+// as opposed to a verified payload that couldn't be read
+func isWebhookSignatureError(err error) bool {
+	return errors.Is(err, webhook.ErrNoValidSignature) || errors.Is(err, webhook.ErrTooOld) ||
+		errors.Is(err, webhook.ErrInvalidHeader) || errors.Is(err, webhook.ErrNotSigned)
 }
 
-// findOrderBySessionID finds an order by Stripe checkout session ID
-func (h *Handlers) findOrderBySessionID(sessionID string) string {
-	// Similar to findOrderByPaymentIntentID but searches by session ID
-	orders, err := h.PaymentStore.GetAllOrders(1000, 0)
+// eventLogger returns the logger with a webhook event's ID and type attached
+func (h *Handlers) eventLogger(event stripe.Event) *slog.Logger {
+	return h.Logger.With("event_id", event.ID, "event_type", string(event.Type))
+}
+
+// findOrderByPaymentIntentID finds an order by Stripe payment intent ID, returning "" if none matches
+func (h *Handlers) findOrderByPaymentIntentID(ctx context.Context, paymentIntentID string) string {
+	orderID, err := h.PaymentStore.FindOrderByPaymentIntentID(ctx, paymentIntentID)
 	if err != nil {
 		return ""
 	}
+	return orderID
+}
 
-	for _, summary := range orders {
-		order, err := h.PaymentStore.GetOrder(summary.ID)
-		if err != nil {
-			continue
-		}
-		if order.Payment.StripeSessionID == sessionID {
-			return order.ID
-		}
+// findOrderBySessionID finds an order by Stripe checkout session ID, returning "" if none matches
+func (h *Handlers) findOrderBySessionID(ctx context.Context, sessionID string) string {
+	orderID, err := h.PaymentStore.FindOrderBySessionID(ctx, sessionID)
+	if err != nil {
+		return ""
 	}
+	return orderID
+}
 
-	return ""
+// findOrderForSession finds a checkout session's order by session ID, falling back to its payment intent
+func (h *Handlers) findOrderForSession(ctx context.Context, session *stripe.CheckoutSession) string {
+	orderID := h.findOrderBySessionID(ctx, session.ID)
+	if orderID == "" && session.PaymentIntent != nil {
+		orderID = h.findOrderByPaymentIntentID(ctx, session.PaymentIntent.ID)
+	}
+	return orderID
 }
 
 // getPaymentMethod extracts payment method information from Stripe payment method
@@ -324,12 +915,104 @@ func getPaymentMethod(pm *stripe.PaymentMethod) models.PaymentMethod {
 		return models.PaymentMethodCard // default
 	}
 
-	switch pm.Type {
-	case stripe.PaymentMethodTypeCard:
-		return models.PaymentMethodCard
-	default:
-		return models.PaymentMethodCard
+	var wallet stripe.PaymentMethodCardWalletType
+	if pm.Card != nil && pm.Card.Wallet != nil {
+		wallet = pm.Card.Wallet.Type
+	}
+	return paymentMethodOfType(string(pm.Type), wallet)
+}
+
+// chargePaymentMethod returns the payment method a charge was paid with, or "" if the charge
+// doesn't say
+func chargePaymentMethod(ch *stripe.Charge) models.PaymentMethod {
+	details := ch.PaymentMethodDetails
+	if details == nil || details.Type == "" {
+		return ""
+	}
+
+	var wallet stripe.PaymentMethodCardWalletType
+	if details.Card != nil && details.Card.Wallet != nil {
+		wallet = details.Card.Wallet.Type
+	}
+	return paymentMethodOfType(string(details.Type), wallet)
+}
+
+// paymentMethodOfType maps a Stripe payment method type to ours. Apple Pay and Google Pay are
+// card payments made through a wallet.
+func paymentMethodOfType(methodType string, wallet stripe.PaymentMethodCardWalletType) models.PaymentMethod {
+	switch methodType {
+	case string(stripe.PaymentMethodTypePaypal):
+		return models.PaymentMethodPayPal
+	case string(stripe.PaymentMethodTypeCard):
+		switch wallet {
+		case stripe.PaymentMethodCardWalletTypeApplePay:
+			return models.PaymentMethodApplePay
+		case stripe.PaymentMethodCardWalletTypeGooglePay:
+			return models.PaymentMethodGooglePay
+		}
 	}
+	return models.PaymentMethodCard
+}
+
+// paymentCharges summarizes the captured charges of a payment intent
+type paymentCharges struct {
+	ChargeIDs             []string
+	AmountCaptured        int64
+	AmountRefunded        int64
+	Method                models.PaymentMethod // From the first charge that says how it was paid
+	Fee                   int64
+	Net                   int64
+	HasBalanceTransaction bool
+}
+
+// collectPaymentCharges lists the intent's charges from Stripe and totals the captured
+// amounts and fees, falling back to the webhook payload if the list call fails
+func collectPaymentCharges(ctx context.Context, gateway PaymentGateway, logger *slog.Logger, pi *stripe.PaymentIntent) paymentCharges {
+	var result paymentCharges
+
+	params := &stripe.ChargeListParams{PaymentIntent: stripe.String(pi.ID)}
+	params.AddExpand("data.balance_transaction")
+
+	charges, err := gateway.ListCharges(ctx, params)
+	for _, ch := range charges {
+		if ch.Status != stripe.ChargeStatusSucceeded || !ch.Captured {
+			continue
+		}
+
+		result.ChargeIDs = append(result.ChargeIDs, ch.ID)
+		result.AmountCaptured += ch.AmountCaptured
+		result.AmountRefunded += ch.AmountRefunded
+		if result.Method == "" {
+			result.Method = chargePaymentMethod(ch)
+		}
+		if bt := ch.BalanceTransaction; bt != nil {
+			result.Fee += bt.Fee
+			result.Net += bt.Net
+			result.HasBalanceTransaction = true
+		}
+	}
+	if err == nil {
+		return result
+	}
+	logger.Error("Failed to list charges for payment intent", "error", err)
+
+	// Trust Stripe's succeeded status when the charges can't be listed
+	result = paymentCharges{AmountCaptured: pi.AmountReceived}
+	if result.AmountCaptured == 0 {
+		result.AmountCaptured = pi.Amount
+	}
+	if ch := pi.LatestCharge; ch != nil && ch.ID != "" {
+		result.ChargeIDs = []string{ch.ID}
+		result.AmountRefunded = ch.AmountRefunded
+		result.Method = chargePaymentMethod(ch)
+		if bt := ch.BalanceTransaction; bt != nil && bt.Amount != 0 {
+			result.Fee = bt.Fee
+			result.Net = bt.Net
+			result.HasBalanceTransaction = true
+		}
+	}
+
+	return result
 }
 
 // Helper functions for safe access to potentially nil fields
@@ -0,0 +1,71 @@
+// handlers/webhook_replay.go
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stripe/stripe-go/v82"
+)
+
+// ReplayWebhookEvent handles a stored webhook event again, as if Stripe had redelivered it (admin
+// endpoint). Events that were already processed are only handled again with ?force=true, so a
+// replay can't fulfill or refund an order twice by accident.
+func (h *Handlers) ReplayWebhookEvent(w http.ResponseWriter, r *http.Request) {
+	// Like a delivery, a replay must not stop halfway if the client goes away
+	ctx := context.WithoutCancel(r.Context())
+	eventID := chi.URLParam(r, "eventID")
+	force := r.URL.Query().Get("force") == "true"
+
+	stored, err := h.PaymentStore.GetWebhookEvent(ctx, eventID)
+	if err != nil {
+		h.Logger.Error("Failed to get webhook event", "event_id", eventID, "error", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to get webhook event")
+		return
+	}
+	if stored == nil {
+		respondWithError(w, http.StatusNotFound, "Webhook event not found")
+		return
+	}
+
+	// The payload was verified when it was delivered
+	var event stripe.Event
+	if err := json.Unmarshal(stored.Payload, &event); err != nil {
+		h.Logger.Error("Failed to parse stored webhook event", "event_id", eventID, "error", err)
+		respondWithError(w, http.StatusInternalServerError, "Stored webhook event can't be read")
+		return
+	}
+	logger := h.eventLogger(event).With("replay", true)
+
+	alreadyProcessed, err := h.PaymentStore.MarkEventProcessed(ctx, event.ID)
+	if err != nil {
+		logger.Error("Failed to record webhook event", "error", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to record webhook event")
+		return
+	}
+	if alreadyProcessed && !force {
+		respondWithError(w, http.StatusConflict, "Webhook event was already processed; replay it with force=true to process it again")
+		return
+	}
+
+	if err := h.dispatchWebhookEvent(ctx, event); err != nil {
+		logger.Warn("Replayed webhook event failed", "error", err)
+		if !alreadyProcessed {
+			if err := h.PaymentStore.UnmarkEventProcessed(ctx, event.ID); err != nil {
+				logger.Error("Failed to unmark webhook event", "error", err)
+			}
+		}
+		respondWithError(w, http.StatusConflict, "Webhook event couldn't be processed: "+err.Error())
+		return
+	}
+
+	logger.Info("Replayed webhook event", "forced", alreadyProcessed)
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"status":   "replayed",
+		"event_id": event.ID,
+		"type":     string(event.Type),
+		"forced":   alreadyProcessed,
+	})
+}
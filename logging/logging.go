@@ -0,0 +1,28 @@
+// logging/logging.go
+package logging
+
+import (
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// ParseLevel maps a LOG_LEVEL value (debug, info, warn, or error) to its slog level,
+// falling back to info for anything else
+func ParseLevel(level string) slog.Level {
+	switch strings.ToLower(strings.TrimSpace(level)) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn", "warning":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// New returns a logger writing JSON lines to w that drops records below level
+func New(w io.Writer, level string) *slog.Logger {
+	return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: ParseLevel(level)}))
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
@@ -13,8 +14,14 @@ import (
 
 	"github.com/capactiyvirus/stripe-backend/config"
 	"github.com/capactiyvirus/stripe-backend/handlers"
+	"github.com/capactiyvirus/stripe-backend/logging"
+	appmiddleware "github.com/capactiyvirus/stripe-backend/middleware"
+	"github.com/capactiyvirus/stripe-backend/services"
+	"github.com/capactiyvirus/stripe-backend/store"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/stripe/stripe-go/v82"
 )
 
@@ -22,22 +29,74 @@ func main() {
 	// Load configuration
 	cfg := config.Load()
 
+	// Structured logging, filtered by LOG_LEVEL
+	logger := logging.New(os.Stdout, cfg.LogLevel)
+	slog.SetDefault(logger)
+
 	// Set Stripe API key
 	stripe.Key = cfg.StripeSecretKey
 
+	// Keep orders in Postgres when DATABASE_URL is set, otherwise in memory
+	var paymentStore store.PaymentStore
+	if cfg.DatabaseURL != "" {
+		postgresStore, err := store.NewPostgresStore(cfg.DatabaseURL)
+		if err != nil {
+			log.Fatalf("Failed to connect to Postgres: %v", err)
+		}
+		defer postgresStore.Close()
+		paymentStore = postgresStore
+		log.Println("Using Postgres payment store")
+	} else {
+		memoryStore := store.NewMemoryStore()
+
+		// Restore orders saved at the last shutdown
+		if cfg.StoreSnapshotPath != "" {
+			if err := memoryStore.LoadFromFile(cfg.StoreSnapshotPath); err != nil {
+				log.Fatalf("Failed to load store snapshot: %v", err)
+			}
+			log.Printf("Loaded store snapshot from %s", cfg.StoreSnapshotPath)
+		}
+		paymentStore = memoryStore
+	}
+
 	// Create handlers with payment store
-	h := handlers.NewHandlers(cfg)
+	h := handlers.NewHandlers(cfg, paymentStore)
+	h.Logger = logger
+	h.Metrics = handlers.NewMetrics(prometheus.DefaultRegisterer)
+	if cfg.StripeMode == config.StripeModeFake {
+		logger.Warn("STRIPE_MODE=fake: Stripe calls are answered in memory and no payments are taken")
+	}
+
+	// Serve an editable local product catalog instead of Stripe's
+	if cfg.ProductCatalogPath != "" {
+		catalog, err := store.NewProductCatalog(cfg.ProductCatalogPath)
+		if err != nil {
+			log.Fatalf("Failed to load product catalog: %v", err)
+		}
+		h.Catalog = catalog
+	}
+
+	// Cache Stripe products, which rarely change, instead of fetching them on every request
+	if cfg.ProductCacheTTL > 0 {
+		h.ProductCache = services.NewProductCache(cfg.ProductCacheTTL)
+	}
+
+	// Send customer emails when an SMTP relay is configured
+	if emailService := services.NewEmailService(cfg); emailService.SMTPHost != "" {
+		h.EmailService = emailService
+	}
 
 	// Setup routes
 	r := setupRouter(cfg, h)
 
 	// Start server
 	server := &http.Server{
-		Addr:         ":" + cfg.Port,
-		Handler:      r,
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
-		IdleTimeout:  60 * time.Second,
+		Addr:           ":" + cfg.Port,
+		Handler:        r,
+		ReadTimeout:    cfg.ServerReadTimeout,
+		WriteTimeout:   cfg.ServerWriteTimeout,
+		IdleTimeout:    cfg.ServerIdleTimeout,
+		MaxHeaderBytes: cfg.ServerMaxHeaderBytes,
 	}
 
 	// Start server in a goroutine
@@ -45,6 +104,9 @@ func main() {
 		log.Printf("Starting server on port %s", cfg.Port)
 		log.Printf("Environment: %s", cfg.Environment)
 		log.Printf("CORS allowed origins: %v", cfg.CorsAllowedOrigins)
+		if len(cfg.AdminAPIKeys) == 0 {
+			log.Println("ADMIN_API_KEYS is not set, so admin routes will reject every request")
+		}
 
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Server failed to start: %v", err)
@@ -66,6 +128,11 @@ func main() {
 		log.Printf("Server forced to shutdown: %v", err)
 	}
 
+	// Wait for background tasks, flush queues, and persist the store once no more requests can come in
+	if err := h.Shutdown(ctx); err != nil {
+		log.Printf("Shutdown incomplete: %v", err)
+	}
+
 	log.Println("Server exited")
 }
 
@@ -73,12 +140,15 @@ func setupRouter(cfg *config.Config, h *handlers.Handlers) chi.Router {
 	r := chi.NewRouter()
 
 	// Basic middleware
-	r.Use(middleware.Logger)
-	r.Use(middleware.Recoverer)
-	r.Use(middleware.RealIP)
+	r.Use(appmiddleware.RealIP(cfg.TrustedProxies))
 	r.Use(middleware.RequestID)
+	r.Use(appmiddleware.RequestLogger(h.Logger))
+	r.Use(middleware.Recoverer)
 	r.Use(middleware.Timeout(60 * time.Second))
 
+	// Per-route latency metrics
+	r.Use(appmiddleware.NewRouteMetrics(prometheus.DefaultRegisterer).Handler)
+
 	// CORS middleware
 	r.Use(corsMiddleware(cfg.CorsAllowedOrigins))
 
@@ -87,6 +157,8 @@ func setupRouter(cfg *config.Config, h *handlers.Handlers) chi.Router {
 
 	// Health check endpoint - Fixed to use handler method
 	r.Get("/health", h.HealthCheck)
+	r.Get("/ready", h.ReadinessCheck)                                                         // Readiness probe: store and, optionally, Stripe connectivity
+	r.With(appmiddleware.APIKeyAuth(cfg.AdminAPIKeys)).Handle("/metrics", promhttp.Handler()) // Prometheus metrics (admin)
 	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
@@ -95,6 +167,12 @@ func setupRouter(cfg *config.Config, h *handlers.Handlers) chi.Router {
 
 	// API routes
 	r.Route("/api", func(r chi.Router) {
+		// Per-IP rate limit; Stripe's webhook deliveries come from a few IPs in bursts, so they're exempt
+		r.Use(appmiddleware.RateLimit(cfg.RateLimitRPS, cfg.RateLimitBurst, "/api/payments/webhook"))
+
+		// Replay responses to retried mutating requests that carry an Idempotency-Key, once they're past the rate limit
+		r.Use(appmiddleware.Idempotency(h.PaymentStore, cfg.IdempotencyTTL, cfg.IdempotencyMaxBody, h.Logger))
+
 		// Payment routes with enhanced tracking
 		r.Route("/payments", func(r chi.Router) {
 			// Payment creation routes
@@ -103,30 +181,73 @@ func setupRouter(cfg *config.Config, h *handlers.Handlers) chi.Router {
 			r.Post("/create-order", h.CreateOrder)              // New: Create order with tracking
 
 			// Payment verification and status
-			r.Get("/verify/{id}", h.VerifyPayment)         // Legacy support
-			r.Get("/status/{orderID}", h.GetPaymentStatus) // New: Get payment status by order ID
-			r.Get("/order/{orderID}", h.GetOrderDetails)   // New: Get full order details
+			r.Get("/verify/{id}", h.VerifyPayment)                             // Legacy support
+			r.Get("/status/{orderID}", h.GetPaymentStatus)                     // New: Get payment status by order ID
+			r.Get("/by-intent/{paymentIntentID}", h.GetOrderByPaymentIntentID) // Get payment status by Stripe payment intent ID
+			r.Get("/order/{orderID}", h.GetOrderDetails)                       // New: Get full order details
+			r.Get("/{orderID}/receipt.pdf", h.GetOrderReceipt)                 // Download a paid order's receipt
 
 			// Payment tracking
 			r.Get("/track/{trackingID}", h.TrackPayment)      // New: Track payment by tracking ID
 			r.Get("/customer/{email}", h.GetCustomerPayments) // New: Get customer payment history
 
-			// Admin routes (consider adding authentication middleware)
-			r.Get("/all", h.GetAllPayments)    // New: Get all payments (admin)
-			r.Get("/stats", h.GetPaymentStats) // New: Get payment statistics
+			// Admin routes, which require an X-API-Key from ADMIN_API_KEYS
+			r.Group(func(r chi.Router) {
+				r.Use(appmiddleware.APIKeyAuth(cfg.AdminAPIKeys))
+
+				r.Get("/all", h.GetAllPayments)                      // New: Get all payments (admin)
+				r.Get("/export.csv", h.ExportOrdersCSV)              // Download the same orders as CSV (admin)
+				r.Get("/stats", h.GetPaymentStats)                   // New: Get payment statistics
+				r.Get("/stats/daily", h.GetDailyRevenue)             // Revenue per day for charts (admin)
+				r.Get("/search", h.SearchOrders)                     // Search orders by email, name, or tracking ID (admin)
+				r.Get("/by-stripe/{stripeID}", h.GetOrderByStripeID) // Look up an order by payment intent or session ID (admin)
+				r.Post("/migrate-to-postgres", h.MigrateToPostgres)  // Copy the in-memory store snapshot into Postgres (admin)
+				r.Post("/coupons", h.CreateCoupon)                   // Add a coupon code (admin)
+				r.Get("/disputes", h.GetDisputes)                    // List open disputes, newest first (admin)
+
+				// Order fulfillment
+				r.Post("/fulfill/{orderID}", h.FulfillOrder) // New: Mark order as fulfilled
+				r.Post("/fulfill-batch", h.FulfillOrders)    // Fulfill several paid orders at once (admin)
+				r.Post("/refund/{orderID}", h.RefundOrder)   // New: Process refund
+				r.Post("/cancel/{orderID}", h.CancelOrder)   // Cancel an unpaid order (admin)
 
-			// Order fulfillment
-			r.Post("/fulfill/{orderID}", h.FulfillOrder) // New: Mark order as fulfilled
-			r.Post("/refund/{orderID}", h.RefundOrder)   // New: Process refund
+				r.Post("/{orderID}/resend-email", h.ResendEmail) // Resend an order's confirmation, payment, or fulfillment email (admin)
+				r.Post("/{orderID}/notes", h.AddOrderNote)       // Add an internal note to an order (admin)
+				r.Get("/{orderID}/notes", h.GetOrderNotes)       // List an order's internal notes, newest first (admin)
+				r.Post("/{orderID}/archive", h.ArchiveOrder)     // Hide an order from listings and stats (admin)
+				r.Post("/{orderID}/sync", h.SyncOrder)           // Reconcile an order with its payment intent in Stripe (admin)
+
+				r.Post("/webhook/replay/{eventID}", h.ReplayWebhookEvent) // Handle a stored webhook event again (admin)
+			})
+
+			r.Post("/cancel", h.CancelOrderByCustomer) // Customer cancels an unpaid order
+
+			// Product downloads
+			r.Get("/download/{orderID}/{productID}", h.DownloadProduct) // Signed download link for a paid order's product
 
 			// Webhook handler
 			r.Post("/webhook", h.HandleStripeWebhook) // Enhanced webhook handling
 		})
 
+		// Subscription routes, kept apart from one-time orders
+		r.Route("/subscriptions", func(r chi.Router) {
+			r.Get("/{email}", h.GetCustomerSubscriptions) // A customer's subscriptions and whether they grant access
+		})
+
 		// Product routes (for integration with your Next.js app)
 		r.Route("/products", func(r chi.Router) {
 			r.Get("/", h.ListProducts)   // List available products
 			r.Get("/{id}", h.GetProduct) // Get single product details
+
+			// Catalog editing (admin, requires PRODUCT_CATALOG_PATH)
+			r.Group(func(r chi.Router) {
+				r.Use(appmiddleware.APIKeyAuth(cfg.AdminAPIKeys))
+
+				r.Post("/", h.CreateProduct)
+				r.Put("/{id}", h.UpdateProduct)
+				r.Delete("/{id}", h.DeleteProduct)
+				r.Post("/refresh", h.RefreshProducts) // Drop cached Stripe products after editing them in Stripe
+			})
 		})
 	})
 
@@ -153,7 +274,8 @@ func corsMiddleware(allowedOrigins []string) func(http.Handler) http.Handler {
 			}
 
 			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Accept, Authorization, Content-Type, X-CSRF-Token, X-Requested-With")
+			w.Header().Set("Access-Control-Allow-Headers", "Accept, Authorization, Content-Type, Idempotency-Key, If-None-Match, X-API-Key, X-CSRF-Token, X-Refund-Override-Token, X-Requested-With")
+			w.Header().Set("Access-Control-Expose-Headers", "ETag, Retry-After")
 			w.Header().Set("Access-Control-Allow-Credentials", "true")
 			w.Header().Set("Access-Control-Max-Age", "86400")
 
@@ -0,0 +1,67 @@
+// middleware/auth.go
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// apiKeyIDContextKey is the request context key holding the authenticated API key's ID
+type apiKeyIDContextKey struct{}
+
+// APIKeyAuth rejects requests whose X-API-Key header isn't one of validKeys with 401.
+// With no valid keys every request is rejected. Accepted requests carry the key's ID,
+// see APIKeyID.
+func APIKeyAuth(validKeys []string) func(http.Handler) http.Handler {
+	keys := make([][]byte, 0, len(validKeys))
+	for _, key := range validKeys {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, []byte(key))
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !validAPIKey(keys, r.Header.Get("X-API-Key")) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusUnauthorized)
+				json.NewEncoder(w).Encode(map[string]string{"error": "Invalid or missing API key"})
+				return
+			}
+			ctx := context.WithValue(r.Context(), apiKeyIDContextKey{}, KeyID(r.Header.Get("X-API-Key")))
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// validAPIKey compares the key against every valid key in constant time,
+// so neither the match nor its position leaks through timing
+func validAPIKey(keys [][]byte, key string) bool {
+	if key == "" {
+		return false
+	}
+
+	matched := 0
+	for _, valid := range keys {
+		matched |= subtle.ConstantTimeCompare(valid, []byte(key))
+	}
+	return matched == 1
+}
+
+// KeyID identifies an API key without revealing it: "key_" followed by the first 12 hex digits of
+// the key's SHA-256 hash
+func KeyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "key_" + hex.EncodeToString(sum[:])[:12]
+}
+
+// APIKeyID returns the ID of the API key APIKeyAuth accepted for a request, or "" outside APIKeyAuth
+func APIKeyID(ctx context.Context) string {
+	id, _ := ctx.Value(apiKeyIDContextKey{}).(string)
+	return id
+}
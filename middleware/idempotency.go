@@ -0,0 +1,180 @@
+// middleware/idempotency.go
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/capactiyvirus/stripe-backend/store"
+)
+
+// IdempotencyStore keeps the responses replayed for repeated Idempotency-Key requests
+type IdempotencyStore interface {
+	GetIdempotentResponse(ctx context.Context, key string) (*store.IdempotentResponse, error)
+	SaveIdempotentResponse(ctx context.Context, key string, response store.IdempotentResponse, ttl time.Duration) error
+}
+
+// Idempotency replays the stored response when a mutating request repeats an Idempotency-Key
+// on the same method, path, and credentials within ttl, so client retries don't run the handler twice.
+// A repeat with a different body gets a 422 instead of the other request's response.
+// Server errors aren't stored, so those requests can be retried. Bodies are buffered to compare
+// repeats, so a body over maxBodyBytes gets a 413 before more of it is read.
+func Idempotency(s IdempotencyStore, ttl time.Duration, maxBodyBytes int64, logger *slog.Logger) func(http.Handler) http.Handler {
+	var locks keyLocks
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			clientKey := r.Header.Get("Idempotency-Key")
+			if clientKey == "" || !mutatingMethods[r.Method] {
+				next.ServeHTTP(w, r)
+				return
+			}
+			key := r.Method + " " + r.URL.Path + " " + clientKey
+
+			// Scope keys to the caller's credentials so one caller's response is never replayed to another
+			if apiKey, authorization := r.Header.Get("X-API-Key"), r.Header.Get("Authorization"); apiKey != "" || authorization != "" {
+				sum := sha256.Sum256([]byte(apiKey + "\x00" + authorization))
+				key += " " + hex.EncodeToString(sum[:])
+			}
+
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+			if err != nil {
+				var tooLarge *http.MaxBytesError
+				if errors.As(err, &tooLarge) {
+					respondWithError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body is larger than %d bytes", maxBodyBytes))
+					return
+				}
+				respondWithError(w, http.StatusBadRequest, "Failed to read request body")
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			bodySum := sha256.Sum256(body)
+			bodyHash := hex.EncodeToString(bodySum[:])
+
+			// Concurrent duplicates wait for the first request instead of running alongside it
+			unlock := locks.Lock(key)
+			defer unlock()
+
+			cached, err := s.GetIdempotentResponse(r.Context(), key)
+			if err != nil {
+				logger.Error("Failed to look up idempotency key", "error", err)
+			}
+			if cached != nil && cached.BodyHash != bodyHash {
+				respondWithError(w, http.StatusUnprocessableEntity, "Idempotency-Key was already used with a different request body")
+				return
+			}
+			if cached != nil {
+				if cached.ContentType != "" {
+					w.Header().Set("Content-Type", cached.ContentType)
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(cached.StatusCode)
+				w.Write(cached.Body)
+				return
+			}
+
+			rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rec, r)
+
+			if rec.status >= http.StatusInternalServerError {
+				return
+			}
+			response := store.IdempotentResponse{
+				StatusCode:  rec.status,
+				ContentType: w.Header().Get("Content-Type"),
+				Body:        rec.body.Bytes(),
+				BodyHash:    bodyHash,
+			}
+			// The request has been handled, so its response is kept even if the client has gone away
+			if err := s.SaveIdempotentResponse(context.WithoutCancel(r.Context()), key, response, ttl); err != nil {
+				logger.Error("Failed to save idempotent response", "error", err)
+			}
+		})
+	}
+}
+
+func respondWithError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+// mutatingMethods are the methods whose responses are stored for replay
+var mutatingMethods = map[string]bool{
+	http.MethodPost:   true,
+	http.MethodPut:    true,
+	http.MethodPatch:  true,
+	http.MethodDelete: true,
+}
+
+// responseRecorder passes a response through while keeping a copy of its status and body
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// keyLocks serializes requests sharing an idempotency key. The zero value is ready to use.
+type keyLocks struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+// keyLock is a per-key mutex with a count of requests holding or waiting on it
+type keyLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// Lock acquires the lock for a key and returns the function that releases it
+func (l *keyLocks) Lock(key string) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*keyLock)
+	}
+	lock, exists := l.locks[key]
+	if !exists {
+		lock = &keyLock{}
+		l.locks[key] = lock
+	}
+	lock.refs++
+	l.mu.Unlock()
+
+	lock.mu.Lock()
+
+	return func() {
+		lock.mu.Unlock()
+
+		l.mu.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(l.locks, key)
+		}
+		l.mu.Unlock()
+	}
+}
@@ -0,0 +1,109 @@
+// middleware/ratelimit.go
+package middleware
+
+import (
+	"encoding/json"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimitSweepInterval is how often idle client buckets are dropped
+const rateLimitSweepInterval = time.Minute
+
+// RateLimit limits each client IP to rps requests per second with bursts of up to burst, answering
+// 429 with a Retry-After header once a client runs out. It keys on r.RemoteAddr, so it belongs after
+// RealIP. Requests to exempt paths, and every request when rps is zero, pass through.
+func RateLimit(rps float64, burst int, exempt ...string) func(http.Handler) http.Handler {
+	if rps <= 0 {
+		return func(next http.Handler) http.Handler { return next }
+	}
+	if burst < 1 {
+		burst = 1
+	}
+
+	exemptPaths := make(map[string]bool, len(exempt))
+	for _, path := range exempt {
+		exemptPaths[path] = true
+	}
+	limiter := &ipRateLimiter{rps: rps, burst: float64(burst), buckets: make(map[string]*tokenBucket)}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if exemptPaths[r.URL.Path] {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ip, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				ip = r.RemoteAddr
+			}
+
+			if wait := limiter.take(ip, time.Now()); wait > 0 {
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				w.WriteHeader(http.StatusTooManyRequests)
+				json.NewEncoder(w).Encode(map[string]string{"error": "Rate limit exceeded"})
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ipRateLimiter holds a token bucket per client IP
+type ipRateLimiter struct {
+	rps       float64
+	burst     float64
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// tokenBucket is one client's remaining tokens as of updated
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// take spends one of the client's tokens, returning zero if it had one and otherwise how long
+// until it will
+func (l *ipRateLimiter) take(ip string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	bucket, exists := l.buckets[ip]
+	if !exists {
+		bucket = &tokenBucket{tokens: l.burst, updated: now}
+		l.buckets[ip] = bucket
+	}
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.updated).Seconds()*l.rps)
+	bucket.updated = now
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return 0
+	}
+	return time.Duration((1 - bucket.tokens) / l.rps * float64(time.Second))
+}
+
+// sweep drops buckets that have refilled completely, since a new bucket starts out full anyway
+func (l *ipRateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	refill := time.Duration(l.burst / l.rps * float64(time.Second))
+	for ip, bucket := range l.buckets {
+		if now.Sub(bucket.updated) >= refill {
+			delete(l.buckets, ip)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+// middleware/realip.go
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// RealIP sets r.RemoteAddr to the client IP that a trusted proxy reported in X-Forwarded-For (or
+// X-Real-IP). The headers are ignored unless the connection comes from one of trustedProxies, since
+// any client can send them, e.g. to get a fresh rate limit on every request. X-Forwarded-For is read
+// from the right, skipping trusted proxies, so addresses a client prepends don't count. With no
+// trusted proxies the connection's address is always kept.
+func RealIP(trustedProxies []*net.IPNet) func(http.Handler) http.Handler {
+	trusted := func(ip net.IP) bool {
+		for _, network := range trustedProxies {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				host = r.RemoteAddr
+			}
+			if peer := net.ParseIP(host); peer != nil && trusted(peer) {
+				if ip := forwardedClientIP(r, trusted); ip != "" {
+					r.RemoteAddr = ip
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// forwardedClientIP returns the rightmost X-Forwarded-For address that isn't a trusted proxy, or
+// X-Real-IP when there's no X-Forwarded-For. It returns "" if neither names a valid IP.
+func forwardedClientIP(r *http.Request, trusted func(net.IP) bool) string {
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	if len(hops) == 0 {
+		if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+			return ip.String()
+		}
+		return ""
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			return ""
+		}
+		if i == 0 || !trusted(ip) {
+			return ip.String()
+		}
+	}
+	return ""
+}
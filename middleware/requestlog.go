@@ -0,0 +1,45 @@
+// middleware/requestlog.go
+package middleware
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	chimiddleware "github.com/go-chi/chi/v5/middleware"
+)
+
+// RequestLogger logs each request's method, path, status, and duration once it completes.
+// It reads the request ID set by chi's RequestID middleware, so it belongs after it.
+func RequestLogger(logger *slog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			ww := chimiddleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+			defer func() {
+				status := ww.Status()
+				if status == 0 {
+					status = http.StatusOK
+				}
+
+				level := slog.LevelInfo
+				if status >= http.StatusInternalServerError {
+					level = slog.LevelError
+				}
+
+				logger.LogAttrs(r.Context(), level, "Request completed",
+					slog.String("method", r.Method),
+					slog.String("path", r.URL.Path),
+					slog.Int("status", status),
+					slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+					slog.Int("bytes", ww.BytesWritten()),
+					slog.String("remote_addr", r.RemoteAddr),
+					slog.String("request_id", chimiddleware.GetReqID(r.Context())),
+				)
+			}()
+
+			next.ServeHTTP(ww, r)
+		})
+	}
+}
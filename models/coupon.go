@@ -0,0 +1,82 @@
+// models/coupon.go
+package models
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// Coupon is a promotion code taking a percentage or a fixed amount off an order
+type Coupon struct {
+	Code       string     `json:"code"`
+	PercentOff int64      `json:"percent_off,omitempty"` // 1-100
+	AmountOff  int64      `json:"amount_off,omitempty"`  // In Currency's smallest unit (e.g. cents)
+	Currency   string     `json:"currency,omitempty"`    // The only currency an amount_off coupon applies to
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	MaxUses    int        `json:"max_uses,omitempty"` // 0 means unlimited
+	Uses       int        `json:"uses"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+var (
+	// ErrCouponExpired is returned when redeeming a coupon past its expiry
+	ErrCouponExpired = errors.New("coupon has expired")
+	// ErrCouponExhausted is returned when redeeming a coupon that has reached its maximum uses
+	ErrCouponExhausted = errors.New("coupon has reached its maximum uses")
+	// ErrCouponCurrency is returned when redeeming an amount_off coupon on an order in another currency
+	ErrCouponCurrency = errors.New("coupon doesn't apply to this currency")
+)
+
+// NormalizeCouponCode is the form coupon codes are stored and looked up in, so codes are case-insensitive
+func NormalizeCouponCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// Validate checks a coupon before it's saved
+func (c *Coupon) Validate() error {
+	switch {
+	case c.Code == "":
+		return errors.New("coupon code is required")
+	case (c.PercentOff == 0) == (c.AmountOff == 0):
+		return errors.New("exactly one of percent_off and amount_off is required")
+	case c.PercentOff < 0 || c.PercentOff > 100:
+		return errors.New("percent_off must be between 1 and 100")
+	case c.AmountOff < 0:
+		return errors.New("amount_off must be positive")
+	case c.AmountOff > 0 && c.Currency == "":
+		return errors.New("currency is required with amount_off")
+	case c.PercentOff > 0 && c.Currency != "":
+		return errors.New("currency only applies to amount_off")
+	case c.MaxUses < 0:
+		return errors.New("max_uses can't be negative")
+	}
+	return nil
+}
+
+// Redeemable reports why the coupon can't be used at now on an order in currency, or nil if it can
+func (c *Coupon) Redeemable(now time.Time, currency string) error {
+	if c.AmountOff > 0 && c.Currency != currency {
+		return ErrCouponCurrency
+	}
+	if c.ExpiresAt != nil && !now.Before(*c.ExpiresAt) {
+		return ErrCouponExpired
+	}
+	if c.MaxUses > 0 && c.Uses >= c.MaxUses {
+		return ErrCouponExhausted
+	}
+	return nil
+}
+
+// Discount returns the amount the coupon takes off subtotal, in the same units and never more than subtotal.
+// Percentages round to the nearest unit.
+func (c *Coupon) Discount(subtotal int64) int64 {
+	discount := c.AmountOff
+	if c.PercentOff > 0 {
+		discount = (subtotal*c.PercentOff + 50) / 100
+	}
+	if discount > subtotal {
+		discount = subtotal
+	}
+	return discount
+}
@@ -0,0 +1,31 @@
+// models/dispute.go
+package models
+
+import "time"
+
+// Dispute is a customer's chargeback on a charge, as Stripe reported it
+type Dispute struct {
+	ID              string    `json:"id"` // Stripe dispute ID
+	ChargeID        string    `json:"charge_id"`
+	PaymentIntentID string    `json:"payment_intent_id,omitempty"`
+	OrderID         string    `json:"order_id,omitempty"` // Empty when no order matched the payment intent
+	Reason          string    `json:"reason"`
+	Amount          int64     `json:"amount"` // Disputed amount in the currency's minor unit
+	Currency        string    `json:"currency"`
+	Status          string    `json:"status"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// OpenDisputeStatuses are the Stripe dispute statuses still waiting on evidence or a decision
+var OpenDisputeStatuses = []string{"warning_needs_response", "warning_under_review", "needs_response", "under_review"}
+
+// Open reports whether the dispute is still waiting on evidence or a decision
+func (d *Dispute) Open() bool {
+	for _, status := range OpenDisputeStatuses {
+		if d.Status == status {
+			return true
+		}
+	}
+	return false
+}
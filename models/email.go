@@ -0,0 +1,24 @@
+// models/email.go
+package models
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+)
+
+// ValidateEmail parses a customer email address, which may carry a display name such as
+// "Jane Doe <jane@example.com>", and returns the bare address with its domain lowercased.
+// The local part keeps its case, since mail servers may treat it as case-sensitive.
+func ValidateEmail(email string) (string, error) {
+	address, err := mail.ParseAddress(strings.TrimSpace(email))
+	if err != nil {
+		return "", fmt.Errorf("invalid email address %q", email)
+	}
+
+	at := strings.LastIndex(address.Address, "@")
+	if at < 1 || at == len(address.Address)-1 {
+		return "", fmt.Errorf("invalid email address %q", email)
+	}
+	return address.Address[:at] + "@" + strings.ToLower(address.Address[at+1:]), nil
+}
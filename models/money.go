@@ -0,0 +1,67 @@
+// models/money.go
+package models
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// SupportedCurrencies are the currencies orders and payment intents can be created in
+var SupportedCurrencies = map[string]bool{
+	"aud": true, "cad": true, "chf": true, "dkk": true, "eur": true, "gbp": true, "hkd": true, "jpy": true,
+	"krw": true, "mxn": true, "nok": true, "nzd": true, "sek": true, "sgd": true, "usd": true,
+}
+
+// ValidateCurrency returns the lowercase form of a supported currency code, or an error naming the
+// supported ones
+func ValidateCurrency(currency string) (string, error) {
+	normalized := strings.ToLower(strings.TrimSpace(currency))
+	if SupportedCurrencies[normalized] {
+		return normalized, nil
+	}
+
+	supported := make([]string, 0, len(SupportedCurrencies))
+	for code := range SupportedCurrencies {
+		supported = append(supported, code)
+	}
+	sort.Strings(supported)
+	return "", fmt.Errorf("unsupported currency %q: supported currencies are %s", currency, strings.Join(supported, ", "))
+}
+
+// zeroDecimalCurrencies are charged in whole units, so Stripe amounts aren't in cents
+var zeroDecimalCurrencies = map[string]bool{
+	"bif": true, "clp": true, "djf": true, "gnf": true, "jpy": true, "kmf": true, "krw": true, "mga": true,
+	"pyg": true, "rwf": true, "ugx": true, "vnd": true, "vuv": true, "xaf": true, "xof": true, "xpf": true,
+}
+
+// ToMajorUnits converts an amount in a currency's smallest unit (e.g. cents) into a display amount,
+// rounded to the smallest unit. Averages may pass fractional minor units.
+func ToMajorUnits(minor float64, currency string) float64 {
+	if zeroDecimalCurrencies[strings.ToLower(currency)] {
+		return math.Round(minor)
+	}
+	return math.Round(minor) / 100
+}
+
+// FormatAmount formats an amount in a currency's smallest unit for display, e.g. "12.50 USD" or
+// "1500 JPY"
+func FormatAmount(minor int64, currency string) string {
+	return FormatPrice(ToMajorUnits(float64(minor), currency), currency)
+}
+
+// FormatPrice formats a display amount, such as an item's price, with the currency's decimal places,
+// e.g. "9.99 USD" or "1500 JPY"
+func FormatPrice(major float64, currency string) string {
+	return fmt.Sprintf("%.*f %s", int(CurrencyDecimals(currency)), major, strings.ToUpper(currency))
+}
+
+// CurrencyDecimals returns the number of decimal places between a currency's display amount and the
+// smallest unit Stripe charges in: 0 for zero-decimal currencies like JPY, 2 otherwise
+func CurrencyDecimals(currency string) int32 {
+	if zeroDecimalCurrencies[strings.ToLower(currency)] {
+		return 0
+	}
+	return 2
+}
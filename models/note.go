@@ -0,0 +1,16 @@
+// models/note.go
+package models
+
+import "time"
+
+// MaxOrderNoteLength is the longest order note body accepted, in characters
+const MaxOrderNoteLength = 2000
+
+// OrderNote is an internal comment left on an order by an admin, never shown to the customer
+type OrderNote struct {
+	ID        string    `json:"id"`
+	OrderID   string    `json:"order_id"`
+	Author    string    `json:"author"` // The admin API key's ID
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -0,0 +1,40 @@
+// models/order_status.go
+package models
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidStatusTransition is returned when an order status change isn't allowed from the order's current status
+var ErrInvalidStatusTransition = errors.New("invalid order status transition")
+
+// orderTransitions lists the statuses each order status can move to. Canceled and refunded orders are final.
+var orderTransitions = map[OrderStatus][]OrderStatus{
+	// Stripe can report a payment before a checkout order has been marked pending
+	OrderStatusCreated:   {OrderStatusPending, OrderStatusPaid, OrderStatusCanceled},
+	OrderStatusPending:   {OrderStatusPaid, OrderStatusCanceled},
+	OrderStatusPaid:      {OrderStatusFulfilled, OrderStatusRefunded},
+	OrderStatusFulfilled: {OrderStatusRefunded},
+}
+
+// CanTransition reports whether an order can move from one status to another. Keeping the current status is always allowed.
+func CanTransition(from, to OrderStatus) bool {
+	if from == to {
+		return true
+	}
+	for _, next := range orderTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckTransition returns an error wrapping ErrInvalidStatusTransition if an order can't move from one status to another
+func CheckTransition(from, to OrderStatus) error {
+	if !CanTransition(from, to) {
+		return fmt.Errorf("%w: %s to %s", ErrInvalidStatusTransition, from, to)
+	}
+	return nil
+}
@@ -16,6 +16,10 @@ const (
 	PaymentStatusFailed    PaymentStatus = "failed"
 	PaymentStatusCanceled  PaymentStatus = "canceled"
 	PaymentStatusRefunded  PaymentStatus = "refunded"
+	// Partially paid means Stripe captured less than the order amount across the intent's charges
+	PaymentStatusPartiallyPaid PaymentStatus = "partially_paid"
+	// Partially refunded means some, but not all, of the payment has been refunded
+	PaymentStatusPartiallyRefunded PaymentStatus = "partially_refunded"
 
 	// Order statuses
 	OrderStatusCreated   OrderStatus = "created"
@@ -32,6 +36,42 @@ const (
 	PaymentMethodGooglePay PaymentMethod = "google_pay"
 )
 
+// OrderStatuses lists every order status
+var OrderStatuses = []OrderStatus{
+	OrderStatusCreated,
+	OrderStatusPending,
+	OrderStatusPaid,
+	OrderStatusFulfilled,
+	OrderStatusCanceled,
+	OrderStatusRefunded,
+}
+
+// OrderFilter narrows an order listing. Zero fields match every order that isn't archived; From and To bound
+// the creation time inclusively.
+type OrderFilter struct {
+	Status          OrderStatus
+	From            *time.Time
+	To              *time.Time
+	IncludeArchived bool
+}
+
+// Matches reports whether an order passes the filter
+func (f OrderFilter) Matches(order *Order) bool {
+	if f.Status != "" && order.Status != f.Status {
+		return false
+	}
+	if f.From != nil && order.CreatedAt.Before(*f.From) {
+		return false
+	}
+	if f.To != nil && order.CreatedAt.After(*f.To) {
+		return false
+	}
+	if !f.IncludeArchived && order.ArchivedAt != nil {
+		return false
+	}
+	return true
+}
+
 // Order represents a customer order
 type Order struct {
 	ID           string            `json:"id"`
@@ -41,9 +81,12 @@ type Order struct {
 	Payment      PaymentInfo       `json:"payment"`
 	Status       OrderStatus       `json:"status"`
 	Metadata     map[string]string `json:"metadata,omitempty"`
+	CouponCode   string            `json:"coupon_code,omitempty"`
 	CreatedAt    time.Time         `json:"created_at"`
 	UpdatedAt    time.Time         `json:"updated_at"`
 	FulfilledAt  *time.Time        `json:"fulfilled_at,omitempty"`
+	ArchivedAt   *time.Time        `json:"archived_at,omitempty"` // Archived orders are left out of listings and stats
+	Disputed     bool              `json:"disputed,omitempty"`    // A chargeback was opened against the payment
 }
 
 // OrderItem represents an item in an order
@@ -53,6 +96,7 @@ type OrderItem struct {
 	FileType    string  `json:"file_type"`
 	Price       float64 `json:"price"`
 	Quantity    int     `json:"quantity"`
+	ImageURL    string  `json:"image_url,omitempty"` // Absolute or relative to ASSET_BASE_URL
 	DownloadURL string  `json:"download_url,omitempty"`
 }
 
@@ -62,16 +106,31 @@ type CustomerInfo struct {
 	Name      string `json:"name,omitempty"`
 	Phone     string `json:"phone,omitempty"`
 	IPAddress string `json:"ip_address,omitempty"`
+
+	// Tax exemption for B2B customers, kept on the order for audit
+	TaxExempt      bool   `json:"tax_exempt,omitempty"`
+	TaxExemptionID string `json:"tax_exemption_id,omitempty"`
+
+	// Payment method saved for later off-session charges, set from Stripe after payment succeeds
+	StripeCustomerID     string `json:"stripe_customer_id,omitempty"`
+	SavedPaymentMethodID string `json:"saved_payment_method_id,omitempty"`
 }
 
 // PaymentInfo holds payment-related information
 type PaymentInfo struct {
 	StripePaymentIntentID string        `json:"stripe_payment_intent_id,omitempty"`
 	StripeSessionID       string        `json:"stripe_session_id,omitempty"`
-	Amount                int64         `json:"amount"` // Amount in cents
+	Amount                int64         `json:"amount"`                    // Amount in cents, after any discount
+	DiscountAmount        int64         `json:"discount_amount,omitempty"` // Coupon discount in cents
 	Currency              string        `json:"currency"`
 	Status                PaymentStatus `json:"status"`
 	Method                PaymentMethod `json:"method,omitempty"`
+	StripeFee             int64         `json:"stripe_fee,omitempty"` // Stripe processing fee in cents
+	NetAmount             int64         `json:"net_amount,omitempty"` // Amount after fees in cents
+	AmountCaptured        int64         `json:"amount_captured,omitempty"`
+	ChargeIDs             []string      `json:"charge_ids,omitempty"`
+	StripeRefundID        string        `json:"stripe_refund_id,omitempty"` // Most recent refund
+	AmountRefunded        int64         `json:"amount_refunded,omitempty"`  // Total refunded in cents
 	ProcessedAt           *time.Time    `json:"processed_at,omitempty"`
 	RefundedAt            *time.Time    `json:"refunded_at,omitempty"`
 }
@@ -86,19 +145,36 @@ type PaymentEvent struct {
 	CreatedAt time.Time     `json:"created_at"`
 }
 
+// WebhookEvent is a Stripe webhook event as delivered, kept so it can be replayed
+type WebhookEvent struct {
+	ID         string    `json:"id"`
+	Type       string    `json:"type"`
+	Payload    []byte    `json:"payload"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// EventTypeStatusChanged is the event the stores add whenever an order or payment status changes.
+// Its data holds the field that changed ("order_status" or "payment_status") and its old and new status.
+const EventTypeStatusChanged = "status_changed"
+
 // OrderSummary provides a summary view of orders
 type OrderSummary struct {
 	ID            string      `json:"id"`
 	TrackingID    string      `json:"tracking_id"`
 	CustomerEmail string      `json:"customer_email"`
-	TotalAmount   float64     `json:"total_amount"`
+	TotalAmount   float64     `json:"total_amount"` // In major units of Currency, e.g. dollars
+	Currency      string      `json:"currency"`
 	Status        OrderStatus `json:"status"`
 	ItemCount     int         `json:"item_count"`
+	Disputed      bool        `json:"disputed,omitempty"`
 	CreatedAt     time.Time   `json:"created_at"`
 }
 
 // PaymentStats provides statistics about payments
 type PaymentStats struct {
+	// Currency is the currency of the top-level amounts and the status breakdown's amounts, which only
+	// count orders in it; the order counts cover every currency
+	Currency          string  `json:"currency"`
 	TotalOrders       int     `json:"total_orders"`
 	TotalRevenue      float64 `json:"total_revenue"`
 	PendingOrders     int     `json:"pending_orders"`
@@ -107,4 +183,48 @@ type PaymentStats struct {
 	AverageOrderValue float64 `json:"average_order_value"`
 	RevenueToday      float64 `json:"revenue_today"`
 	RevenueThisMonth  float64 `json:"revenue_this_month"`
+	TotalFees         float64 `json:"total_fees"`
+	NetRevenue        float64 `json:"net_revenue"`
+	DownloadedOrders  int     `json:"downloaded_orders"` // Orders with at least one recorded download
+
+	// From and To bound the creation time of the orders counted, when the stats cover a date range
+	From *time.Time `json:"from,omitempty"`
+	To   *time.Time `json:"to,omitempty"`
+
+	StatusBreakdown map[OrderStatus]StatusTotals `json:"status_breakdown"`
+	Currencies      map[string]CurrencyStats     `json:"currencies"` // Monetary stats per currency, in that currency's units
+}
+
+// CurrencyStats provides monetary statistics for orders in a single currency
+type CurrencyStats struct {
+	TotalOrders       int     `json:"total_orders"`
+	CompletedOrders   int     `json:"completed_orders"`
+	TotalRevenue      float64 `json:"total_revenue"`
+	AverageOrderValue float64 `json:"average_order_value"`
+	TotalFees         float64 `json:"total_fees"`
+	NetRevenue        float64 `json:"net_revenue"`
+}
+
+// DailyRevenue is one UTC day of revenue from paid and fulfilled orders, by order creation date
+type DailyRevenue struct {
+	Date       string  `json:"date"` // YYYY-MM-DD
+	Revenue    float64 `json:"revenue"`
+	OrderCount int     `json:"order_count"`
+}
+
+// StatusTotals holds the order count and amount for a single order status
+type StatusTotals struct {
+	Count  int     `json:"count"`
+	Amount float64 `json:"amount"`
+}
+
+// Product is an entry in the local product catalog
+type Product struct {
+	ID          string            `json:"id"`
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Price       float64           `json:"price"`
+	FileType    string            `json:"file_type,omitempty"`
+	Images      []string          `json:"images"`
+	Metadata    map[string]string `json:"metadata"`
 }
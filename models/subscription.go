@@ -0,0 +1,46 @@
+// models/subscription.go
+package models
+
+import "time"
+
+// SubscriptionStatus is the status Stripe reports for a subscription
+type SubscriptionStatus string
+
+const (
+	SubscriptionStatusIncomplete        SubscriptionStatus = "incomplete"
+	SubscriptionStatusIncompleteExpired SubscriptionStatus = "incomplete_expired"
+	SubscriptionStatusTrialing          SubscriptionStatus = "trialing"
+	SubscriptionStatusActive            SubscriptionStatus = "active"
+	SubscriptionStatusPastDue           SubscriptionStatus = "past_due"
+	SubscriptionStatusCanceled          SubscriptionStatus = "canceled"
+	SubscriptionStatusUnpaid            SubscriptionStatus = "unpaid"
+	SubscriptionStatusPaused            SubscriptionStatus = "paused"
+)
+
+// GrantsAccess reports whether a subscription in this status should get the member content
+func (s SubscriptionStatus) GrantsAccess() bool {
+	return s == SubscriptionStatusActive || s == SubscriptionStatusTrialing
+}
+
+// Subscription is a customer's recurring Stripe subscription, tracked apart from one-time orders
+type Subscription struct {
+	StripeSubscriptionID string             `json:"stripe_subscription_id"`
+	StripeCustomerID     string             `json:"stripe_customer_id,omitempty"`
+	CustomerEmail        string             `json:"customer_email"`
+	Status               SubscriptionStatus `json:"status"`
+	CurrentPeriodEnd     *time.Time         `json:"current_period_end,omitempty"` // When the paid-up period ends
+	CanceledAt           *time.Time         `json:"canceled_at,omitempty"`
+	LastEventAt          *time.Time         `json:"last_event_at,omitempty"` // Creation time of the last subscription event applied
+	CreatedAt            time.Time          `json:"created_at"`
+	UpdatedAt            time.Time          `json:"updated_at"`
+}
+
+// SubscriptionEvent records a change in a subscription's lifecycle
+type SubscriptionEvent struct {
+	ID             string             `json:"id"`
+	SubscriptionID string             `json:"subscription_id"`
+	EventType      string             `json:"event_type"`
+	Status         SubscriptionStatus `json:"status"`
+	Data           interface{}        `json:"data"`
+	CreatedAt      time.Time          `json:"created_at"`
+}
@@ -3,6 +3,7 @@ package routes
 
 import (
 	"github.com/capactiyvirus/stripe-backend/handlers"
+	appmiddleware "github.com/capactiyvirus/stripe-backend/middleware"
 	"github.com/go-chi/chi/v5"
 )
 
@@ -15,22 +16,50 @@ func SetupPaymentRoutes(r chi.Router, h *handlers.Handlers) {
 
 		// Payment verification and status
 		r.Get("/verify/{id}", h.VerifyPayment)
-		r.Get("/status/{orderID}", h.GetPaymentStatus) // New: Get payment status by order ID
-		r.Get("/order/{orderID}", h.GetOrderDetails)   // New: Get full order details
+		r.Get("/status/{orderID}", h.GetPaymentStatus)                     // New: Get payment status by order ID
+		r.Get("/by-intent/{paymentIntentID}", h.GetOrderByPaymentIntentID) // Get payment status by Stripe payment intent ID
+		r.Get("/order/{orderID}", h.GetOrderDetails)                       // New: Get full order details
+		r.Get("/{orderID}/receipt.pdf", h.GetOrderReceipt)                 // Download a paid order's receipt
 
 		// Payment tracking
 		r.Get("/track/{trackingID}", h.TrackPayment)      // New: Track payment by tracking ID
 		r.Get("/customer/{email}", h.GetCustomerPayments) // New: Get customer payment history
 
-		// Admin routes (you may want to add auth middleware)
-		r.Get("/all", h.GetAllPayments)    // New: Get all payments (admin)
-		r.Get("/stats", h.GetPaymentStats) // New: Get payment statistics
+		// Admin routes, which require an X-API-Key from ADMIN_API_KEYS
+		r.Group(func(r chi.Router) {
+			r.Use(appmiddleware.APIKeyAuth(h.Config.AdminAPIKeys))
+
+			r.Get("/all", h.GetAllPayments)                      // New: Get all payments (admin)
+			r.Get("/export.csv", h.ExportOrdersCSV)              // Download the same orders as CSV (admin)
+			r.Get("/stats", h.GetPaymentStats)                   // New: Get payment statistics
+			r.Get("/stats/daily", h.GetDailyRevenue)             // Revenue per day for charts (admin)
+			r.Get("/search", h.SearchOrders)                     // Search orders by email, name, or tracking ID (admin)
+			r.Get("/by-stripe/{stripeID}", h.GetOrderByStripeID) // Look up an order by payment intent or session ID (admin)
+			r.Post("/migrate-to-postgres", h.MigrateToPostgres)  // Copy the in-memory store snapshot into Postgres (admin)
+			r.Post("/coupons", h.CreateCoupon)                   // Add a coupon code (admin)
+			r.Get("/disputes", h.GetDisputes)                    // List open disputes, newest first (admin)
+
+			// Order fulfillment
+			r.Post("/fulfill/{orderID}", h.FulfillOrder) // New: Mark order as fulfilled
+			r.Post("/fulfill-batch", h.FulfillOrders)    // Fulfill several paid orders at once (admin)
+			r.Post("/refund/{orderID}", h.RefundOrder)   // New: Process refund
+			r.Post("/cancel/{orderID}", h.CancelOrder)   // Cancel an unpaid order (admin)
+
+			r.Post("/{orderID}/resend-email", h.ResendEmail) // Resend an order's confirmation, payment, or fulfillment email (admin)
+			r.Post("/{orderID}/notes", h.AddOrderNote)       // Add an internal note to an order (admin)
+			r.Get("/{orderID}/notes", h.GetOrderNotes)       // List an order's internal notes, newest first (admin)
+			r.Post("/{orderID}/archive", h.ArchiveOrder)     // Hide an order from listings and stats (admin)
+			r.Post("/{orderID}/sync", h.SyncOrder)           // Reconcile an order with its payment intent in Stripe (admin)
+
+			r.Post("/webhook/replay/{eventID}", h.ReplayWebhookEvent) // Handle a stored webhook event again (admin)
+		})
 
 		// Webhook handler
 		r.Post("/webhook", h.HandleStripeWebhook)
 
-		// Order fulfillment
-		r.Post("/fulfill/{orderID}", h.FulfillOrder) // New: Mark order as fulfilled
-		r.Post("/refund/{orderID}", h.RefundOrder)   // New: Process refund
+		r.Post("/cancel", h.CancelOrderByCustomer) // Customer cancels an unpaid order
+
+		// Product downloads
+		r.Get("/download/{orderID}/{productID}", h.DownloadProduct) // Signed download link for a paid order's product
 	})
 }
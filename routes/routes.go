@@ -5,6 +5,7 @@ import (
 	"net/http"
 
 	"github.com/capactiyvirus/stripe-backend/handlers"
+	appmiddleware "github.com/capactiyvirus/stripe-backend/middleware"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 )
@@ -15,7 +16,7 @@ func SetupRoutes(h *handlers.Handlers) chi.Router {
 	// Middleware
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
-	r.Use(middleware.RealIP)
+	r.Use(appmiddleware.RealIP(h.Config.TrustedProxies))
 	r.Use(middleware.RequestID)
 
 	// CORS middleware (adjust origins as needed)
@@ -36,6 +37,7 @@ func SetupRoutes(h *handlers.Handlers) chi.Router {
 
 	// Health check
 	r.Get("/health", handlers.HealthCheck)
+	r.Get("/ready", h.ReadinessCheck)
 
 	// API routes
 	r.Route("/api", func(r chi.Router) {
@@ -47,30 +49,73 @@ func SetupRoutes(h *handlers.Handlers) chi.Router {
 			r.Post("/create-order", h.CreateOrder)              // New: Create order with tracking
 
 			// Payment verification and status
-			r.Get("/verify/{id}", h.VerifyPayment)         // Legacy support
-			r.Get("/status/{orderID}", h.GetPaymentStatus) // New: Get payment status by order ID
-			r.Get("/order/{orderID}", h.GetOrderDetails)   // New: Get full order details
+			r.Get("/verify/{id}", h.VerifyPayment)                             // Legacy support
+			r.Get("/status/{orderID}", h.GetPaymentStatus)                     // New: Get payment status by order ID
+			r.Get("/by-intent/{paymentIntentID}", h.GetOrderByPaymentIntentID) // Get payment status by Stripe payment intent ID
+			r.Get("/order/{orderID}", h.GetOrderDetails)                       // New: Get full order details
+			r.Get("/{orderID}/receipt.pdf", h.GetOrderReceipt)                 // Download a paid order's receipt
 
 			// Payment tracking
 			r.Get("/track/{trackingID}", h.TrackPayment)      // New: Track payment by tracking ID
 			r.Get("/customer/{email}", h.GetCustomerPayments) // New: Get customer payment history
 
-			// Admin routes (consider adding authentication middleware)
-			r.Get("/all", h.GetAllPayments)    // New: Get all payments (admin)
-			r.Get("/stats", h.GetPaymentStats) // New: Get payment statistics
+			// Admin routes, which require an X-API-Key from ADMIN_API_KEYS
+			r.Group(func(r chi.Router) {
+				r.Use(appmiddleware.APIKeyAuth(h.Config.AdminAPIKeys))
 
-			// Order fulfillment
-			r.Post("/fulfill/{orderID}", h.FulfillOrder) // New: Mark order as fulfilled
-			r.Post("/refund/{orderID}", h.RefundOrder)   // New: Process refund
+				r.Get("/all", h.GetAllPayments)                      // New: Get all payments (admin)
+				r.Get("/export.csv", h.ExportOrdersCSV)              // Download the same orders as CSV (admin)
+				r.Get("/stats", h.GetPaymentStats)                   // New: Get payment statistics
+				r.Get("/stats/daily", h.GetDailyRevenue)             // Revenue per day for charts (admin)
+				r.Get("/search", h.SearchOrders)                     // Search orders by email, name, or tracking ID (admin)
+				r.Get("/by-stripe/{stripeID}", h.GetOrderByStripeID) // Look up an order by payment intent or session ID (admin)
+				r.Post("/migrate-to-postgres", h.MigrateToPostgres)  // Copy the in-memory store snapshot into Postgres (admin)
+				r.Post("/coupons", h.CreateCoupon)                   // Add a coupon code (admin)
+				r.Get("/disputes", h.GetDisputes)                    // List open disputes, newest first (admin)
+
+				// Order fulfillment
+				r.Post("/fulfill/{orderID}", h.FulfillOrder) // New: Mark order as fulfilled
+				r.Post("/fulfill-batch", h.FulfillOrders)    // Fulfill several paid orders at once (admin)
+				r.Post("/refund/{orderID}", h.RefundOrder)   // New: Process refund
+				r.Post("/cancel/{orderID}", h.CancelOrder)   // Cancel an unpaid order (admin)
+
+				r.Post("/{orderID}/resend-email", h.ResendEmail) // Resend an order's confirmation, payment, or fulfillment email (admin)
+				r.Post("/{orderID}/notes", h.AddOrderNote)       // Add an internal note to an order (admin)
+				r.Get("/{orderID}/notes", h.GetOrderNotes)       // List an order's internal notes, newest first (admin)
+				r.Post("/{orderID}/archive", h.ArchiveOrder)     // Hide an order from listings and stats (admin)
+				r.Post("/{orderID}/sync", h.SyncOrder)           // Reconcile an order with its payment intent in Stripe (admin)
+
+				r.Post("/webhook/replay/{eventID}", h.ReplayWebhookEvent) // Handle a stored webhook event again (admin)
+			})
+
+			r.Post("/cancel", h.CancelOrderByCustomer) // Customer cancels an unpaid order
+
+			// Product downloads
+			r.Get("/download/{orderID}/{productID}", h.DownloadProduct) // Signed download link for a paid order's product
 
 			// Webhook handler
 			r.Post("/webhook", h.HandleStripeWebhook) // Enhanced webhook handling
 		})
 
+		// Subscription routes, kept apart from one-time orders
+		r.Route("/subscriptions", func(r chi.Router) {
+			r.Get("/{email}", h.GetCustomerSubscriptions) // A customer's subscriptions and whether they grant access
+		})
+
 		// Product routes (for integration with your Next.js app)
 		r.Route("/products", func(r chi.Router) {
 			r.Get("/", h.ListProducts)   // List available products
 			r.Get("/{id}", h.GetProduct) // Get single product details
+
+			// Catalog editing (admin, requires PRODUCT_CATALOG_PATH)
+			r.Group(func(r chi.Router) {
+				r.Use(appmiddleware.APIKeyAuth(h.Config.AdminAPIKeys))
+
+				r.Post("/", h.CreateProduct)
+				r.Put("/{id}", h.UpdateProduct)
+				r.Delete("/{id}", h.DeleteProduct)
+				r.Post("/refresh", h.RefreshProducts) // Drop cached Stripe products (admin)
+			})
 		})
 	})
 
@@ -86,9 +131,21 @@ func SetupRoutesWithAuth(h *handlers.Handlers, authMiddleware func(http.Handler)
 		r.Use(authMiddleware) // Apply auth middleware to all admin routes
 
 		r.Get("/payments", h.GetAllPayments)
+		r.Get("/export.csv", h.ExportOrdersCSV)
 		r.Get("/stats", h.GetPaymentStats)
+		r.Get("/stats/daily", h.GetDailyRevenue)
 		r.Post("/fulfill/{orderID}", h.FulfillOrder)
+		r.Post("/fulfill-batch", h.FulfillOrders)
 		r.Post("/refund/{orderID}", h.RefundOrder)
+		r.Post("/cancel/{orderID}", h.CancelOrder)
+		r.Get("/payments/disputes", h.GetDisputes)
+		r.Post("/payments/{orderID}/resend-email", h.ResendEmail)
+		r.Post("/payments/{orderID}/notes", h.AddOrderNote)
+		r.Get("/payments/{orderID}/notes", h.GetOrderNotes)
+		r.Post("/payments/{orderID}/archive", h.ArchiveOrder)
+		r.Post("/payments/{orderID}/sync", h.SyncOrder)
+		r.Post("/webhook/replay/{eventID}", h.ReplayWebhookEvent)
+		r.Post("/products/refresh", h.RefreshProducts)
 	})
 
 	return r
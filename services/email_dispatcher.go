@@ -0,0 +1,158 @@
+// services/email_dispatcher.go
+package services
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// EmailDispatcher sends queued emails through a single worker so the SMTP
+// relay never sees more than the configured number of emails per second
+type EmailDispatcher struct {
+	Logger *slog.Logger // Logs failed sends; NewEmailDispatcher uses slog.Default()
+
+	queue    chan func() error
+	abort    chan struct{} // Closed to make the worker give up on the rest of the queue
+	queued   int           // Emails accepted by Enqueue, guarded by mu
+	sent     int           // Emails the relay accepted, guarded by mu
+	failed   int           // Emails that failed to send, guarded by mu
+	interval time.Duration
+	closed   bool
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+}
+
+// NewEmailDispatcher creates a dispatcher sending at most ratePerSecond emails
+func NewEmailDispatcher(ratePerSecond float64, queueSize int) *EmailDispatcher {
+	if queueSize <= 0 {
+		queueSize = 1000
+	}
+
+	var interval time.Duration
+	if ratePerSecond > 0 {
+		interval = time.Duration(float64(time.Second) / ratePerSecond)
+	}
+
+	return &EmailDispatcher{
+		Logger:   slog.Default(),
+		queue:    make(chan func() error, queueSize),
+		abort:    make(chan struct{}),
+		interval: interval,
+	}
+}
+
+// Start launches the dispatcher worker
+func (d *EmailDispatcher) Start() {
+	d.wg.Add(1)
+	go d.run()
+}
+
+// Enqueue adds a send to the queue, failing if the queue is full or stopped
+func (d *EmailDispatcher) Enqueue(send func() error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return fmt.Errorf("email dispatcher is stopped")
+	}
+
+	select {
+	case d.queue <- send:
+		d.queued++
+		return nil
+	default:
+		return fmt.Errorf("email queue is full")
+	}
+}
+
+// Stop stops accepting new emails and waits for queued ones to be sent
+func (d *EmailDispatcher) Stop() {
+	d.Shutdown(context.Background())
+}
+
+// Shutdown stops accepting new emails and sends the queued ones until ctx is done, returning then
+// even if a send is still in progress. It returns how many queued emails were sent and how many were
+// dropped: those still queued, plus one being sent when ctx ended. Emails that failed count as neither.
+func (d *EmailDispatcher) Shutdown(ctx context.Context) (flushed, dropped int) {
+	d.mu.Lock()
+	sentBefore := d.sent
+	if !d.closed {
+		d.closed = true
+		close(d.queue)
+	}
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		// The worker stops at its next check; a send it's in the middle of isn't waited for
+		d.mu.Lock()
+		select {
+		case <-d.abort:
+		default:
+			close(d.abort)
+		}
+		d.mu.Unlock()
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.sent - sentBefore, d.queued - d.sent - d.failed
+}
+
+// run sends queued emails, spacing them by the configured interval
+func (d *EmailDispatcher) run() {
+	defer d.wg.Done()
+
+	var lastSent time.Time
+	for {
+		// Check abort first, since select picks at random when the queue also has an email ready
+		select {
+		case <-d.abort:
+			return
+		default:
+		}
+
+		var send func() error
+		select {
+		case <-d.abort:
+			return
+		case next, ok := <-d.queue:
+			if !ok {
+				return
+			}
+			send = next
+		}
+
+		// Only wait when the previous send was too recent, so a quiet queue sends immediately
+		if wait := d.interval - time.Since(lastSent); !lastSent.IsZero() && wait > 0 {
+			select {
+			case <-d.abort:
+				return // The email it was holding is counted as dropped
+			case <-time.After(wait):
+			}
+		}
+		lastSent = time.Now()
+
+		err := send()
+		d.mu.Lock()
+		if err != nil {
+			d.failed++
+		} else {
+			d.sent++
+		}
+		d.mu.Unlock()
+		if err != nil {
+			d.Logger.Error("Failed to send queued email", "error", err)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+// services/email_mime.go
+package services
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"regexp"
+	"strings"
+)
+
+// Attachment is a file attached to an email
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+var (
+	htmlBlockPattern = regexp.MustCompile(`(?is)<(style|script|head)[^>]*>.*?</(style|script|head)>`)
+	htmlBreakPattern = regexp.MustCompile(`(?i)<(br|/p|/div|/h[1-6]|/li|/tr)[^>]*>`)
+	htmlTagPattern   = regexp.MustCompile(`<[^>]*>`)
+	blankLinePattern = regexp.MustCompile(`\n\s*\n+`)
+)
+
+// htmlToText derives a plain-text alternative from an HTML email body
+func htmlToText(htmlBody string) string {
+	text := htmlBlockPattern.ReplaceAllString(htmlBody, "")
+	text = htmlBreakPattern.ReplaceAllString(text, "\n")
+	text = htmlTagPattern.ReplaceAllString(text, "")
+	text = html.UnescapeString(text)
+
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = strings.Join(strings.Fields(line), " ")
+	}
+	text = blankLinePattern.ReplaceAllString(strings.Join(lines, "\n"), "\n\n")
+
+	return strings.TrimSpace(text) + "\n"
+}
+
+// buildAlternativeBody builds a multipart/alternative body holding the plain-text and HTML versions,
+// returning the body and its Content-Type header. The HTML part comes last so clients that can render
+// it prefer it.
+func buildAlternativeBody(htmlBody, textBody string) (string, string, error) {
+	var body bytes.Buffer
+	alternative := multipart.NewWriter(&body)
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain; charset=UTF-8", textBody},
+		{"text/html; charset=UTF-8", htmlBody},
+	} {
+		w, err := alternative.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return "", "", err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(part.content)); err != nil {
+			return "", "", err
+		}
+		if err := qp.Close(); err != nil {
+			return "", "", err
+		}
+	}
+	if err := alternative.Close(); err != nil {
+		return "", "", err
+	}
+
+	return body.String(), "multipart/alternative; boundary=" + alternative.Boundary(), nil
+}
+
+// buildMultipartBody builds a multipart/mixed body holding a text/HTML alternative followed by the
+// attachments, returning the body and its Content-Type header
+func buildMultipartBody(htmlBody, textBody string, attachments []Attachment) (string, string, error) {
+	var body bytes.Buffer
+	mixed := multipart.NewWriter(&body)
+
+	// The alternative part nests inside mixed so clients show one body plus the attachments
+	alternativeBody, alternativeType, err := buildAlternativeBody(htmlBody, textBody)
+	if err != nil {
+		return "", "", err
+	}
+	w, err := mixed.CreatePart(textproto.MIMEHeader{"Content-Type": {alternativeType}})
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := io.WriteString(w, alternativeBody); err != nil {
+		return "", "", err
+	}
+
+	for _, attachment := range attachments {
+		w, err := mixed.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {mime.FormatMediaType(attachment.ContentType, map[string]string{"name": attachment.Filename})},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename})},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		if err != nil {
+			return "", "", err
+		}
+		if err := writeBase64Lines(w, attachment.Data); err != nil {
+			return "", "", fmt.Errorf("failed to encode attachment %s: %w", attachment.Filename, err)
+		}
+	}
+	if err := mixed.Close(); err != nil {
+		return "", "", err
+	}
+
+	return body.String(), "multipart/mixed; boundary=" + mixed.Boundary(), nil
+}
+
+// writeBase64Lines writes data as base64 wrapped at 76 characters, as MIME requires
+func writeBase64Lines(w io.Writer, data []byte) error {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		if _, err := fmt.Fprintf(w, "%s\r\n", encoded[:76]); err != nil {
+			return err
+		}
+		encoded = encoded[76:]
+	}
+	_, err := fmt.Fprintf(w, "%s\r\n", encoded)
+	return err
+}
@@ -3,14 +3,34 @@ package services
 
 import (
 	"bytes"
+	"crypto/tls"
+	"embed"
+	"errors"
 	"fmt"
 	"html/template"
+	"io/fs"
+	"mime"
+	"net"
 	"net/smtp"
+	"net/textproto"
+	"net/url"
 	"os"
-
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/capactiyvirus/stripe-backend/config"
 	"github.com/capactiyvirus/stripe-backend/models"
 )
 
+// embeddedTemplates are the default email templates, used when EMAIL_TEMPLATE_DIR doesn't override them
+//
+//go:embed templates/*.html
+var embeddedTemplates embed.FS
+
 type EmailService struct {
 	SMTPHost     string
 	SMTPPort     string
@@ -18,6 +38,51 @@ type EmailService struct {
 	SMTPPassword string
 	FromEmail    string
 	FromName     string
+	AssetBaseURL string // Base for resolving relative product image paths
+
+	// TLSMode is how the SMTP connection is encrypted (SMTP_TLS_MODE): "none" never encrypts,
+	// "starttls" requires STARTTLS, and "tls" connects with implicit TLS, usually on port 465.
+	// Empty upgrades with STARTTLS only when the server offers it.
+	TLSMode string
+	// TLSInsecure skips verifying the server certificate in the starttls and tls modes, for
+	// self-signed development servers only (SMTP_TLS_INSECURE)
+	TLSInsecure bool
+
+	// MaxRetries and RetryBackoff retry transient SMTP failures, doubling the wait after each
+	// attempt (SMTP_MAX_RETRIES, SMTP_RETRY_BACKOFF). Zero MaxRetries sends once.
+	MaxRetries   int
+	RetryBackoff time.Duration
+
+	// TrackingSecret signs emailed tracking links when set (TRACKING_TOKEN_SECRET)
+	TrackingSecret string
+
+	// DownloadBaseURL is the API's public URL that emailed download links point at (DOWNLOAD_BASE_URL)
+	DownloadBaseURL string
+
+	// DownloadSecret signs emailed download links (DOWNLOAD_TOKEN_SECRET), which expire after
+	// DownloadLinkTTL (DOWNLOAD_LINK_TTL; zero means DefaultDownloadLinkTTL)
+	DownloadSecret  string
+	DownloadLinkTTL time.Duration
+
+	// AttachReceiptPDF attaches a receipt PDF to payment confirmations (ATTACH_RECEIPT_PDF)
+	AttachReceiptPDF bool
+
+	// TemplateDir holds email templates that replace the embedded ones by file name (EMAIL_TEMPLATE_DIR)
+	TemplateDir string
+
+	// CompanyName, SupportEmail, and TrackingBaseURL brand every email (COMPANY_NAME, SUPPORT_EMAIL,
+	// TRACKING_BASE_URL), falling back to the config defaults when empty
+	CompanyName     string
+	SupportEmail    string
+	TrackingBaseURL string
+
+	// Dispatcher sends emails in the background, rate-limited when EMAIL_SEND_RATE is set.
+	// NewEmailService only starts one when SMTP_HOST is set. Emails are sent synchronously when nil.
+	Dispatcher *EmailDispatcher
+
+	templatesMu   sync.Mutex
+	templates     map[string]*template.Template     // parsed templates by name
+	textTemplates map[string]*texttemplate.Template // parsed plain-text templates, nil when TemplateDir has none
 }
 
 type EmailData struct {
@@ -26,106 +91,258 @@ type EmailData struct {
 	SupportEmail string
 	CompanyName  string
 	DownloadURLs map[string]string // productID -> downloadURL
+	Dispute      *models.Dispute   // The dispute an admin notification is about
+	RefundAmount int64             // Cents refunded, for refund notifications
+	CardLast4    string            // Last 4 digits of the refunded card, when known
 }
 
-// NewEmailService creates a new email service
-func NewEmailService() *EmailService {
-	return &EmailService{
+// NewEmailService creates a new email service branded from cfg
+func NewEmailService(cfg *config.Config) *EmailService {
+	e := &EmailService{
 		SMTPHost:     os.Getenv("SMTP_HOST"),
 		SMTPPort:     os.Getenv("SMTP_PORT"),
 		SMTPUsername: os.Getenv("SMTP_USERNAME"),
 		SMTPPassword: os.Getenv("SMTP_PASSWORD"),
 		FromEmail:    os.Getenv("FROM_EMAIL"),
 		FromName:     os.Getenv("FROM_NAME"),
+		TLSMode:      os.Getenv("SMTP_TLS_MODE"),
+		TLSInsecure:  os.Getenv("SMTP_TLS_INSECURE") == "true",
+		AssetBaseURL: os.Getenv("ASSET_BASE_URL"),
+		MaxRetries:   2,
+		RetryBackoff: time.Second,
+
+		TrackingSecret:   os.Getenv("TRACKING_TOKEN_SECRET"),
+		DownloadBaseURL:  os.Getenv("DOWNLOAD_BASE_URL"),
+		DownloadSecret:   cfg.DownloadTokenSecret,
+		DownloadLinkTTL:  cfg.DownloadLinkTTL,
+		AttachReceiptPDF: os.Getenv("ATTACH_RECEIPT_PDF") == "true",
+		TemplateDir:      os.Getenv("EMAIL_TEMPLATE_DIR"),
+
+		CompanyName:     cfg.CompanyName,
+		SupportEmail:    cfg.SupportEmail,
+		TrackingBaseURL: cfg.TrackingBaseURL,
+	}
+
+	if retries, err := strconv.Atoi(os.Getenv("SMTP_MAX_RETRIES")); err == nil && retries >= 0 {
+		e.MaxRetries = retries
+	}
+	if backoff, err := time.ParseDuration(os.Getenv("SMTP_RETRY_BACKOFF")); err == nil && backoff >= 0 {
+		e.RetryBackoff = backoff
 	}
+
+	// Queue emails through a single dispatcher so a slow relay doesn't hold up webhook responses,
+	// spacing them out to stay under the relay's rate limit when EMAIL_SEND_RATE is set.
+	// Without SMTP_HOST nothing is sent, so there's nothing to dispatch.
+	if e.SMTPHost != "" {
+		rate, _ := strconv.ParseFloat(os.Getenv("EMAIL_SEND_RATE"), 64)
+		queueSize, _ := strconv.Atoi(os.Getenv("EMAIL_QUEUE_SIZE"))
+		e.Dispatcher = NewEmailDispatcher(rate, queueSize)
+		e.Dispatcher.Start()
+	}
+
+	return e
 }
 
 // SendOrderConfirmation sends order confirmation email
 func (e *EmailService) SendOrderConfirmation(order *models.Order) error {
 	subject := fmt.Sprintf("Order Confirmation - %s", order.TrackingID)
 
-	data := EmailData{
-		Order:        order,
-		TrackingURL:  fmt.Sprintf("https://yourdomain.com/track-order?id=%s", order.TrackingID),
-		SupportEmail: "support@yourdomain.com",
-		CompanyName:  "PlannerPalette",
-	}
+	data := e.emailData(order)
 
 	htmlBody, err := e.renderTemplate("order_confirmation.html", data)
 	if err != nil {
 		return err
 	}
+	textBody, err := e.renderTextTemplate("order_confirmation.txt", data, htmlBody)
+	if err != nil {
+		return err
+	}
 
-	return e.sendEmail(order.CustomerInfo.Email, subject, htmlBody)
+	return e.queueEmail(order.CustomerInfo.Email, subject, htmlBody, textBody)
 }
 
 // SendPaymentConfirmation sends payment confirmation email
 func (e *EmailService) SendPaymentConfirmation(order *models.Order) error {
 	subject := fmt.Sprintf("Payment Confirmed - %s", order.TrackingID)
 
-	data := EmailData{
-		Order:        order,
-		TrackingURL:  fmt.Sprintf("https://yourdomain.com/track-order?id=%s", order.TrackingID),
-		SupportEmail: "support@yourdomain.com",
-		CompanyName:  "PlannerPalette",
-	}
+	data := e.emailData(order)
 
 	htmlBody, err := e.renderTemplate("payment_confirmation.html", data)
 	if err != nil {
 		return err
 	}
+	textBody, err := e.renderTextTemplate("payment_confirmation.txt", data, htmlBody)
+	if err != nil {
+		return err
+	}
 
-	return e.sendEmail(order.CustomerInfo.Email, subject, htmlBody)
+	var attachments []Attachment
+	if e.AttachReceiptPDF {
+		receipts := &ReceiptService{CompanyName: data.CompanyName, SupportEmail: data.SupportEmail}
+		receipt, err := receipts.GeneratePDF(order)
+		if err != nil {
+			return err
+		}
+		attachments = append(attachments, Attachment{
+			Filename:    fmt.Sprintf("receipt-%s.pdf", order.TrackingID),
+			ContentType: "application/pdf",
+			Data:        receipt,
+		})
+	}
+
+	return e.queueEmail(order.CustomerInfo.Email, subject, htmlBody, textBody, attachments...)
+}
+
+// SendPaymentFailedNotification tells the customer their payment didn't go through
+func (e *EmailService) SendPaymentFailedNotification(order *models.Order) error {
+	subject := fmt.Sprintf("Payment Failed - %s", order.TrackingID)
+
+	data := e.emailData(order)
+
+	htmlBody, err := e.renderTemplate("payment_failed.html", data)
+	if err != nil {
+		return err
+	}
+	textBody, err := e.renderTextTemplate("payment_failed.txt", data, htmlBody)
+	if err != nil {
+		return err
+	}
+
+	return e.queueEmail(order.CustomerInfo.Email, subject, htmlBody, textBody)
 }
 
 // SendFulfillmentEmail sends order fulfillment email with download links
 func (e *EmailService) SendFulfillmentEmail(order *models.Order, downloadURLs map[string]string) error {
 	subject := fmt.Sprintf("Your Order is Ready for Download - %s", order.TrackingID)
 
-	data := EmailData{
-		Order:        order,
-		TrackingURL:  fmt.Sprintf("https://yourdomain.com/track-order?id=%s", order.TrackingID),
-		SupportEmail: "support@yourdomain.com",
-		CompanyName:  "PlannerPalette",
-		DownloadURLs: downloadURLs,
-	}
+	data := e.emailData(order)
+	data.DownloadURLs = downloadURLs
 
 	htmlBody, err := e.renderTemplate("order_fulfillment.html", data)
 	if err != nil {
 		return err
 	}
+	textBody, err := e.renderTextTemplate("order_fulfillment.txt", data, htmlBody)
+	if err != nil {
+		return err
+	}
+
+	return e.queueEmail(order.CustomerInfo.Email, subject, htmlBody, textBody)
+}
 
-	return e.sendEmail(order.CustomerInfo.Email, subject, htmlBody)
+// DownloadURLs returns each downloadable item's link, keyed by product ID. Links go through the signed
+// download endpoint when DownloadSecret and DownloadBaseURL are set, and straight to the file otherwise.
+func (e *EmailService) DownloadURLs(order *models.Order) map[string]string {
+	ttl := e.DownloadLinkTTL
+	if ttl <= 0 {
+		ttl = DefaultDownloadLinkTTL
+	}
+	expires := time.Now().Add(ttl)
+
+	urls := make(map[string]string, len(order.Items))
+	for _, item := range order.Items {
+		if item.DownloadURL == "" {
+			continue
+		}
+		if e.DownloadSecret == "" || e.DownloadBaseURL == "" {
+			urls[item.ProductID] = item.DownloadURL
+			continue
+		}
+		urls[item.ProductID] = fmt.Sprintf("%s/api/payments/download/%s/%s?token=%s",
+			strings.TrimRight(e.DownloadBaseURL, "/"), url.PathEscape(order.ID), url.PathEscape(item.ProductID),
+			GenerateDownloadToken(e.DownloadSecret, order.ID, item.ProductID, expires))
+	}
+	return urls
 }
 
-// SendRefundNotification sends refund notification email
-func (e *EmailService) SendRefundNotification(order *models.Order) error {
+// SendRefundNotification sends refund notification email for a refund of amount cents, which is less
+// than the order total for partial refunds. cardLast4 may be empty when the card isn't known.
+func (e *EmailService) SendRefundNotification(order *models.Order, amount int64, cardLast4 string) error {
 	subject := fmt.Sprintf("Refund Processed - %s", order.TrackingID)
 
-	data := EmailData{
-		Order:        order,
-		TrackingURL:  fmt.Sprintf("https://yourdomain.com/track-order?id=%s", order.TrackingID),
-		SupportEmail: "support@yourdomain.com",
-		CompanyName:  "PlannerPalette",
-	}
+	data := e.emailData(order)
+	data.RefundAmount = amount
+	data.CardLast4 = cardLast4
 
 	htmlBody, err := e.renderTemplate("refund_notification.html", data)
 	if err != nil {
 		return err
 	}
+	textBody, err := e.renderTextTemplate("refund_notification.txt", data, htmlBody)
+	if err != nil {
+		return err
+	}
 
-	return e.sendEmail(order.CustomerInfo.Email, subject, htmlBody)
+	return e.queueEmail(order.CustomerInfo.Email, subject, htmlBody, textBody)
+}
+
+// SendDisputeNotification tells an admin at to that a dispute was opened. order is nil when no
+// order matched the disputed payment.
+func (e *EmailService) SendDisputeNotification(to string, dispute *models.Dispute, order *models.Order) error {
+	subject := fmt.Sprintf("Dispute Opened - %s", dispute.ID)
+	if order != nil {
+		subject += " - " + order.TrackingID
+	}
+
+	data := e.emailData(order)
+	data.Dispute = dispute
+
+	htmlBody, err := e.renderTemplate("dispute_notification.html", data)
+	if err != nil {
+		return err
+	}
+	textBody, err := e.renderTextTemplate("dispute_notification.txt", data, htmlBody)
+	if err != nil {
+		return err
+	}
+
+	return e.queueEmail(to, subject, htmlBody, textBody)
+}
+
+// SendCanceledOrderPaidNotification tells an admin at to that a payment succeeded for a canceled order,
+// so it can be refunded
+func (e *EmailService) SendCanceledOrderPaidNotification(to string, order *models.Order) error {
+	subject := fmt.Sprintf("Canceled Order Paid - %s", order.TrackingID)
+
+	data := e.emailData(order)
+
+	htmlBody, err := e.renderTemplate("canceled_order_paid.html", data)
+	if err != nil {
+		return err
+	}
+	textBody, err := e.renderTextTemplate("canceled_order_paid.txt", data, htmlBody)
+	if err != nil {
+		return err
+	}
+
+	return e.queueEmail(to, subject, htmlBody, textBody)
 }
 
 // renderTemplate renders an email template with data
 func (e *EmailService) renderTemplate(templateName string, data EmailData) (string, error) {
-	// Get template content based on template name
-	templateContent := e.getEmailTemplate(templateName)
+	tmpl, err := e.getEmailTemplate(templateName)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
 
-	tmpl, err := template.New(templateName).Parse(templateContent)
+// renderTextTemplate renders the plain-text version of an email from a text template in TemplateDir,
+// falling back to text derived from the HTML body when there is none
+func (e *EmailService) renderTextTemplate(templateName string, data EmailData, htmlBody string) (string, error) {
+	tmpl, err := e.getTextTemplate(templateName)
 	if err != nil {
 		return "", err
 	}
+	if tmpl == nil {
+		return htmlToText(htmlBody), nil
+	}
 
 	var buf bytes.Buffer
 	if err := tmpl.Execute(&buf, data); err != nil {
@@ -135,313 +352,292 @@ func (e *EmailService) renderTemplate(templateName string, data EmailData) (stri
 	return buf.String(), nil
 }
 
+// templateFuncs returns the helper functions available to email templates
+func (e *EmailService) templateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"div": func(amount int64, divisor float64) float64 {
+			return float64(amount) / divisor
+		},
+		"money":    models.FormatAmount,
+		"price":    models.FormatPrice,
+		"assetURL": e.resolveAssetURL,
+	}
+}
+
+// trackingURL builds the customer's tracking link, signed when a tracking secret is configured
+func (e *EmailService) trackingURL(order *models.Order) string {
+	base := e.TrackingBaseURL
+	if base == "" {
+		base = config.DefaultTrackingBaseURL
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return base
+	}
+
+	query := u.Query()
+	query.Set("id", order.TrackingID)
+	if e.TrackingSecret != "" {
+		query.Set("token", GenerateTrackingToken(e.TrackingSecret, order.TrackingID))
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// emailData returns the template data every email starts from: the order, its tracking link, and the store's branding.
+// A nil order leaves out the tracking link.
+func (e *EmailService) emailData(order *models.Order) EmailData {
+	data := EmailData{
+		Order:        order,
+		SupportEmail: e.SupportEmail,
+		CompanyName:  e.CompanyName,
+	}
+	if order != nil {
+		data.TrackingURL = e.trackingURL(order)
+	}
+	if data.SupportEmail == "" {
+		data.SupportEmail = config.DefaultSupportEmail
+	}
+	if data.CompanyName == "" {
+		data.CompanyName = config.DefaultCompanyName
+	}
+	return data
+}
+
+// resolveAssetURL resolves a relative asset path against AssetBaseURL, leaving absolute URLs untouched
+func (e *EmailService) resolveAssetURL(path string) string {
+	if path == "" || e.AssetBaseURL == "" {
+		return path
+	}
+	if u, err := url.Parse(path); err == nil && u.IsAbs() {
+		return path
+	}
+
+	return strings.TrimRight(e.AssetBaseURL, "/") + "/" + strings.TrimLeft(path, "/")
+}
+
+// queueEmail hands the email to the dispatcher if one is configured, otherwise sends it immediately
+func (e *EmailService) queueEmail(to, subject, htmlBody, textBody string, attachments ...Attachment) error {
+	if e.Dispatcher == nil {
+		return e.sendEmail(to, subject, htmlBody, textBody, attachments...)
+	}
+
+	return e.Dispatcher.Enqueue(func() error {
+		return e.sendEmail(to, subject, htmlBody, textBody, attachments...)
+	})
+}
+
 // sendEmail sends an email using SMTP
-func (e *EmailService) sendEmail(to, subject, htmlBody string) error {
+func (e *EmailService) sendEmail(to, subject, htmlBody, textBody string, attachments ...Attachment) error {
 	// Create the email message
-	msg := e.buildEmailMessage(to, subject, htmlBody)
+	msg, err := e.buildEmailMessage(to, subject, htmlBody, textBody, attachments)
+	if err != nil {
+		return err
+	}
 
 	// Connect to SMTP server
 	auth := smtp.PlainAuth("", e.SMTPUsername, e.SMTPPassword, e.SMTPHost)
 
-	// Send the email
-	err := smtp.SendMail(
-		e.SMTPHost+":"+e.SMTPPort,
-		auth,
-		e.FromEmail,
-		[]string{to},
-		[]byte(msg),
-	)
+	// Send the email, retrying transient failures
+	backoff := e.RetryBackoff
+	attempts := 0
+	for {
+		attempts++
+		err = e.deliver(auth, to, []byte(msg))
+		if err == nil {
+			return nil
+		}
+		if isPermanentSMTPError(err) || attempts > e.MaxRetries {
+			break
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+	return fmt.Errorf("failed to send email after %d attempt(s): %w", attempts, err)
+}
+
+// SMTP TLS modes, see EmailService.TLSMode
+const (
+	SMTPTLSNone     = "none"
+	SMTPTLSStartTLS = "starttls"
+	SMTPTLS         = "tls"
+)
+
+// errSMTPConfig is returned for SMTP settings no retry can fix
+var errSMTPConfig = errors.New("invalid SMTP configuration")
+
+// deliver sends one message over a new SMTP connection encrypted according to TLSMode
+func (e *EmailService) deliver(auth smtp.Auth, to string, msg []byte) error {
+	addr := net.JoinHostPort(e.SMTPHost, e.SMTPPort)
+	if e.TLSMode == "" {
+		// smtp.SendMail upgrades with STARTTLS whenever the server offers it
+		return smtp.SendMail(addr, auth, e.FromEmail, []string{to}, msg)
+	}
+
+	tlsConfig := &tls.Config{ServerName: e.SMTPHost, InsecureSkipVerify: e.TLSInsecure}
+	var client *smtp.Client
+	switch e.TLSMode {
+	case SMTPTLS:
+		conn, err := tls.Dial("tcp", addr, tlsConfig)
+		if err != nil {
+			return err
+		}
+		if client, err = smtp.NewClient(conn, e.SMTPHost); err != nil {
+			conn.Close()
+			return err
+		}
+	case SMTPTLSStartTLS, SMTPTLSNone:
+		var err error
+		if client, err = smtp.Dial(addr); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%w: unknown SMTP_TLS_MODE %q, expected none, starttls, or tls", errSMTPConfig, e.TLSMode)
+	}
+	defer client.Close()
+
+	if e.TLSMode == SMTPTLSStartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("%w: server doesn't support STARTTLS", errSMTPConfig)
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if ok, _ := client.Extension("AUTH"); ok && auth != nil {
+		if err := client.Auth(auth); err != nil {
+			return err
+		}
+	}
 
-	return err
+	if err := client.Mail(e.FromEmail); err != nil {
+		return err
+	}
+	if err := client.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// isPermanentSMTPError reports whether retrying a send can't help: the server rejected it with
+// a 5xx reply (bad credentials, unknown recipient), authentication was refused before sending,
+// or the SMTP settings are invalid
+func isPermanentSMTPError(err error) bool {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code >= 500
+	}
+	return errors.Is(err, errSMTPConfig) || strings.Contains(err.Error(), "unencrypted connection")
 }
 
-// buildEmailMessage builds the email message with headers
-func (e *EmailService) buildEmailMessage(to, subject, htmlBody string) string {
+// buildEmailMessage builds the email message with headers. The body is a multipart/alternative of the
+// plain-text and HTML versions, wrapped in multipart/mixed when there are attachments.
+func (e *EmailService) buildEmailMessage(to, subject, htmlBody, textBody string, attachments []Attachment) (string, error) {
 	from := fmt.Sprintf("%s <%s>", e.FromName, e.FromEmail)
 
+	var body, contentType string
+	var err error
+	if len(attachments) > 0 {
+		body, contentType, err = buildMultipartBody(htmlBody, textBody, attachments)
+	} else {
+		body, contentType, err = buildAlternativeBody(htmlBody, textBody)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to build email: %w", err)
+	}
+
 	msg := fmt.Sprintf("From: %s\r\n", from)
 	msg += fmt.Sprintf("To: %s\r\n", to)
-	msg += fmt.Sprintf("Subject: %s\r\n", subject)
+	msg += fmt.Sprintf("Subject: %s\r\n", mime.QEncoding.Encode("UTF-8", subject))
+	msg += fmt.Sprintf("Date: %s\r\n", time.Now().Format(time.RFC1123Z))
 	msg += "MIME-Version: 1.0\r\n"
-	msg += "Content-Type: text/html; charset=UTF-8\r\n"
+	msg += fmt.Sprintf("Content-Type: %s\r\n", contentType)
 	msg += "\r\n"
-	msg += htmlBody
+	msg += body
 
-	return msg
+	return msg, nil
 }
 
-// getEmailTemplate returns email template content
-func (e *EmailService) getEmailTemplate(templateName string) string {
-	switch templateName {
-	case "order_confirmation.html":
-		return orderConfirmationTemplate
-	case "payment_confirmation.html":
-		return paymentConfirmationTemplate
-	case "order_fulfillment.html":
-		return orderFulfillmentTemplate
-	case "refund_notification.html":
-		return refundNotificationTemplate
-	default:
-		return basicEmailTemplate
+// getEmailTemplate returns the parsed template, loading it from TemplateDir when the directory
+// has a file of that name and from the embedded templates otherwise. Parsed templates are cached,
+// so edits to TemplateDir take effect on restart.
+func (e *EmailService) getEmailTemplate(templateName string) (*template.Template, error) {
+	e.templatesMu.Lock()
+	defer e.templatesMu.Unlock()
+
+	if tmpl, ok := e.templates[templateName]; ok {
+		return tmpl, nil
+	}
+
+	tmpl, err := e.parseEmailTemplate(templateName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load email template %s: %w", templateName, err)
+	}
+
+	if e.templates == nil {
+		e.templates = make(map[string]*template.Template)
+	}
+	e.templates[templateName] = tmpl
+	return tmpl, nil
+}
+
+// getTextTemplate returns the parsed plain-text template from TemplateDir, or nil when there isn't one.
+// Like HTML templates, the result is cached.
+func (e *EmailService) getTextTemplate(templateName string) (*texttemplate.Template, error) {
+	e.templatesMu.Lock()
+	defer e.templatesMu.Unlock()
+
+	if tmpl, ok := e.textTemplates[templateName]; ok {
+		return tmpl, nil
+	}
+
+	var tmpl *texttemplate.Template
+	if e.TemplateDir != "" {
+		path := filepath.Join(e.TemplateDir, templateName)
+		_, err := os.Stat(path)
+		if err == nil {
+			tmpl, err = texttemplate.New(templateName).Funcs(texttemplate.FuncMap(e.templateFuncs())).ParseFiles(path)
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to load email template %s: %w", templateName, err)
+		}
+	}
+
+	if e.textTemplates == nil {
+		e.textTemplates = make(map[string]*texttemplate.Template)
 	}
+	e.textTemplates[templateName] = tmpl
+	return tmpl, nil
 }
 
-// Email Templates
-const orderConfirmationTemplate = `
-<!DOCTYPE html>
-<html>
-<head>
-    <meta charset="UTF-8">
-    <meta name="viewport" content="width=device-width, initial-scale=1.0">
-    <title>Order Confirmation</title>
-    <style>
-        body { font-family: Arial, sans-serif; line-height: 1.6; color: #333; margin: 0; padding: 20px; }
-        .container { max-width: 600px; margin: 0 auto; background: #f9f9f9; padding: 20px; }
-        .header { background: #2c3b3a; color: white; padding: 20px; text-align: center; }
-        .content { background: white; padding: 30px; }
-        .order-details { background: #f5f5f5; padding: 20px; margin: 20px 0; }
-        .item { border-bottom: 1px solid #eee; padding: 10px 0; }
-        .total { font-weight: bold; font-size: 18px; margin-top: 10px; }
-        .tracking { background: #e8f4f8; padding: 15px; margin: 20px 0; border-left: 5px solid #2c3b3a; }
-        .button { background: #6e725a; color: white; padding: 12px 24px; text-decoration: none; border-radius: 5px; display: inline-block; margin: 20px 0; }
-        .footer { text-align: center; margin-top: 30px; color: #666; }
-    </style>
-</head>
-<body>
-    <div class="container">
-        <div class="header">
-            <h1>{{.CompanyName}}</h1>
-            <h2>Order Confirmation</h2>
-        </div>
-        
-        <div class="content">
-            <p>Hi {{.Order.CustomerInfo.Name}},</p>
-            
-            <p>Thank you for your order! We've received your purchase and are processing it now.</p>
-            
-            <div class="tracking">
-                <strong>Your Tracking ID: {{.Order.TrackingID}}</strong><br>
-                Use this ID to track your order status at any time.
-            </div>
-            
-            <div class="order-details">
-                <h3>Order Details</h3>
-                <p><strong>Order ID:</strong> {{.Order.ID}}</p>
-                <p><strong>Date:</strong> {{.Order.CreatedAt.Format "January 2, 2006"}}</p>
-                
-                <h4>Items Ordered:</h4>
-                {{range .Order.Items}}
-                <div class="item">
-                    <strong>{{.ProductName}}</strong><br>
-                    {{.FileType}} • Quantity: {{.Quantity}}<br>
-                    Price: ${{printf "%.2f" .Price}}
-                </div>
-                {{end}}
-                
-                <div class="total">
-                    Total: ${{printf "%.2f" (div .Order.Payment.Amount 100.0)}}
-                </div>
-            </div>
-            
-            <p>You will receive another email once your payment is confirmed and your order is ready for download.</p>
-            
-            <a href="{{.TrackingURL}}" class="button">Track Your Order</a>
-            
-            <p>If you have any questions, please contact us at {{.SupportEmail}}.</p>
-            
-            <p>Thank you for choosing {{.CompanyName}}!</p>
-        </div>
-        
-        <div class="footer">
-            <p>&copy; {{.CompanyName}} - Empowering Writers Worldwide</p>
-        </div>
-    </div>
-</body>
-</html>
-`
-
-const paymentConfirmationTemplate = `
-<!DOCTYPE html>
-<html>
-<head>
-    <meta charset="UTF-8">
-    <meta name="viewport" content="width=device-width, initial-scale=1.0">
-    <title>Payment Confirmed</title>
-    <style>
-        body { font-family: Arial, sans-serif; line-height: 1.6; color: #333; margin: 0; padding: 20px; }
-        .container { max-width: 600px; margin: 0 auto; background: #f9f9f9; padding: 20px; }
-        .header { background: #2c3b3a; color: white; padding: 20px; text-align: center; }
-        .content { background: white; padding: 30px; }
-        .success { background: #d4edda; border: 1px solid #c3e6cb; color: #155724; padding: 15px; border-radius: 5px; margin: 20px 0; }
-        .tracking { background: #e8f4f8; padding: 15px; margin: 20px 0; border-left: 5px solid #2c3b3a; }
-        .button { background: #6e725a; color: white; padding: 12px 24px; text-decoration: none; border-radius: 5px; display: inline-block; margin: 20px 0; }
-        .footer { text-align: center; margin-top: 30px; color: #666; }
-    </style>
-</head>
-<body>
-    <div class="container">
-        <div class="header">
-            <h1>{{.CompanyName}}</h1>
-            <h2>Payment Confirmed! 🎉</h2>
-        </div>
-        
-        <div class="content">
-            <div class="success">
-                <strong>Great news!</strong> Your payment has been successfully processed.
-            </div>
-            
-            <p>Hi {{.Order.CustomerInfo.Name}},</p>
-            
-            <p>Your payment of <strong>${{printf "%.2f" (div .Order.Payment.Amount 100.0)}}</strong> has been confirmed for order {{.Order.TrackingID}}.</p>
-            
-            <div class="tracking">
-                <strong>What's Next?</strong><br>
-                We're now preparing your digital downloads. You'll receive an email with download links within the next few hours.
-            </div>
-            
-            <a href="{{.TrackingURL}}" class="button">Track Your Order</a>
-            
-            <p>Thank you for your business!</p>
-        </div>
-        
-        <div class="footer">
-            <p>&copy; {{.CompanyName}} - Crafting Stories, One Guide at a Time</p>
-        </div>
-    </div>
-</body>
-</html>
-`
-
-const orderFulfillmentTemplate = `
-<!DOCTYPE html>
-<html>
-<head>
-    <meta charset="UTF-8">
-    <meta name="viewport" content="width=device-width, initial-scale=1.0">
-    <title>Your Downloads Are Ready!</title>
-    <style>
-        body { font-family: Arial, sans-serif; line-height: 1.6; color: #333; margin: 0; padding: 20px; }
-        .container { max-width: 600px; margin: 0 auto; background: #f9f9f9; padding: 20px; }
-        .header { background: #2c3b3a; color: white; padding: 20px; text-align: center; }
-        .content { background: white; padding: 30px; }
-        .success { background: #d4edda; border: 1px solid #c3e6cb; color: #155724; padding: 20px; border-radius: 5px; margin: 20px 0; text-align: center; }
-        .downloads { background: #f8f9fa; padding: 20px; margin: 20px 0; border-radius: 5px; }
-        .download-item { background: white; padding: 15px; margin: 10px 0; border-radius: 5px; border: 1px solid #ddd; }
-        .download-button { background: #6e725a; color: white; padding: 10px 20px; text-decoration: none; border-radius: 5px; display: inline-block; }
-        .important { background: #fff3cd; border: 1px solid #ffeaa7; padding: 15px; border-radius: 5px; margin: 20px 0; }
-        .footer { text-align: center; margin-top: 30px; color: #666; }
-    </style>
-</head>
-<body>
-    <div class="container">
-        <div class="header">
-            <h1>{{.CompanyName}}</h1>
-            <h2>Your Downloads Are Ready! 📥</h2>
-        </div>
-        
-        <div class="content">
-            <div class="success">
-                <h3>🎉 Order Complete!</h3>
-                <p>Your writing resources are ready for download.</p>
-            </div>
-            
-            <p>Hi {{.Order.CustomerInfo.Name}},</p>
-            
-            <p>Great news! Your order <strong>{{.Order.TrackingID}}</strong> has been processed and your digital writing guides are ready for download.</p>
-            
-            <div class="downloads">
-                <h3>Your Downloads:</h3>
-                {{range .Order.Items}}
-                <div class="download-item">
-                    <strong>{{.ProductName}}</strong><br>
-                    Format: {{.FileType}}<br>
-                    {{if index $.DownloadURLs .ProductID}}
-                    <a href="{{index $.DownloadURLs .ProductID}}" class="download-button">Download {{.FileType}}</a>
-                    {{else}}
-                    <span style="color: #666;">Download link will be available shortly</span>
-                    {{end}}
-                </div>
-                {{end}}
-            </div>
-            
-            <div class="important">
-                <strong>Important:</strong> Download links are valid for 30 days. Please save your files to your device. If you need to re-download after this period, please contact us.
-            </div>
-            
-            <p>We hope these resources help you craft amazing stories! If you have any questions or need support, please don't hesitate to contact us at {{.SupportEmail}}.</p>
-            
-            <p>Happy writing!</p>
-        </div>
-        
-        <div class="footer">
-            <p>&copy; {{.CompanyName}} - Empowering Your Creative Journey</p>
-        </div>
-    </div>
-</body>
-</html>
-`
-
-const refundNotificationTemplate = `
-<!DOCTYPE html>
-<html>
-<head>
-    <meta charset="UTF-8">
-    <meta name="viewport" content="width=device-width, initial-scale=1.0">
-    <title>Refund Processed</title>
-    <style>
-        body { font-family: Arial, sans-serif; line-height: 1.6; color: #333; margin: 0; padding: 20px; }
-        .container { max-width: 600px; margin: 0 auto; background: #f9f9f9; padding: 20px; }
-        .header { background: #2c3b3a; color: white; padding: 20px; text-align: center; }
-        .content { background: white; padding: 30px; }
-        .refund-info { background: #e3f2fd; border: 1px solid #bbdefb; padding: 20px; border-radius: 5px; margin: 20px 0; }
-        .footer { text-align: center; margin-top: 30px; color: #666; }
-    </style>
-</head>
-<body>
-    <div class="container">
-        <div class="header">
-            <h1>{{.CompanyName}}</h1>
-            <h2>Refund Processed</h2>
-        </div>
-        
-        <div class="content">
-            <p>Hi {{.Order.CustomerInfo.Name}},</p>
-            
-            <p>We've processed a refund for your order <strong>{{.Order.TrackingID}}</strong>.</p>
-            
-            <div class="refund-info">
-                <h3>Refund Details:</h3>
-                <p><strong>Order ID:</strong> {{.Order.TrackingID}}</p>
-                <p><strong>Refund Amount:</strong> ${{printf "%.2f" (div .Order.Payment.Amount 100.0)}}</p>
-                <p><strong>Original Payment Method:</strong> Card ending in ****</p>
-                <p><strong>Processing Time:</strong> 3-5 business days</p>
-            </div>
-            
-            <p>The refund will appear on your original payment method within 3-5 business days, depending on your bank or card issuer.</p>
-            
-            <p>If you have any questions about this refund, please contact us at {{.SupportEmail}}.</p>
-            
-            <p>Thank you for your understanding.</p>
-        </div>
-        
-        <div class="footer">
-            <p>&copy; {{.CompanyName}} - Customer Service</p>
-        </div>
-    </div>
-</body>
-</html>
-`
-
-const basicEmailTemplate = `
-<!DOCTYPE html>
-<html>
-<head>
-    <meta charset="UTF-8">
-    <title>{{.CompanyName}}</title>
-</head>
-<body>
-    <h2>{{.CompanyName}}</h2>
-    <p>This is a basic email template.</p>
-</body>
-</html>
-`
+// parseEmailTemplate parses a template from TemplateDir or the embedded templates.
+// Unknown template names get the basic template.
+func (e *EmailService) parseEmailTemplate(templateName string) (*template.Template, error) {
+	if e.TemplateDir != "" {
+		path := filepath.Join(e.TemplateDir, templateName)
+		_, err := os.Stat(path)
+		if err == nil {
+			return template.New(templateName).Funcs(e.templateFuncs()).ParseFiles(path)
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	if _, err := fs.Stat(embeddedTemplates, "templates/"+templateName); err != nil {
+		templateName = "basic.html"
+	}
+	return template.New(templateName).Funcs(e.templateFuncs()).ParseFS(embeddedTemplates, "templates/"+templateName)
+}
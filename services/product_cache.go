@@ -0,0 +1,99 @@
+// services/product_cache.go
+package services
+
+import (
+	"sync"
+	"time"
+
+	"github.com/stripe/stripe-go/v82"
+)
+
+// ProductCache memoizes Stripe product lookups for TTL. Expired entries are refetched by the
+// next lookup that needs them, and Invalidate drops everything so edits show up straight away.
+// It's safe for concurrent use; lookups of cached entries only take a read lock.
+type ProductCache struct {
+	TTL time.Duration
+
+	mu       sync.RWMutex
+	lists    map[ProductListKey]cachedProductList
+	products map[string]cachedProduct
+}
+
+// ProductListKey identifies a cached product list by the parameters it was listed with
+type ProductListKey struct {
+	Limit  int64
+	Active bool
+}
+
+type cachedProductList struct {
+	products  []*stripe.Product
+	expiresAt time.Time
+}
+
+type cachedProduct struct {
+	product   *stripe.Product
+	expiresAt time.Time
+}
+
+// NewProductCache creates an empty ProductCache whose entries live for ttl
+func NewProductCache(ttl time.Duration) *ProductCache {
+	return &ProductCache{
+		TTL:      ttl,
+		lists:    make(map[ProductListKey]cachedProductList),
+		products: make(map[string]cachedProduct),
+	}
+}
+
+// ListProducts returns the cached product list for key, calling load to fetch it when it's
+// missing or expired. Errors from load aren't cached.
+func (c *ProductCache) ListProducts(key ProductListKey, load func() ([]*stripe.Product, error)) ([]*stripe.Product, error) {
+	c.mu.RLock()
+	entry, ok := c.lists[key]
+	c.mu.RUnlock()
+	if ok && time.Now().Before(entry.expiresAt) {
+		return entry.products, nil
+	}
+
+	products, err := load()
+	if err != nil {
+		return nil, err
+	}
+
+	expiresAt := time.Now().Add(c.TTL)
+	c.mu.Lock()
+	c.lists[key] = cachedProductList{products: products, expiresAt: expiresAt}
+	for _, p := range products {
+		c.products[p.ID] = cachedProduct{product: p, expiresAt: expiresAt}
+	}
+	c.mu.Unlock()
+	return products, nil
+}
+
+// GetProduct returns the cached product with id, calling load to fetch it when it's missing or
+// expired. Errors from load, such as the product not existing, aren't cached.
+func (c *ProductCache) GetProduct(id string, load func() (*stripe.Product, error)) (*stripe.Product, error) {
+	c.mu.RLock()
+	entry, ok := c.products[id]
+	c.mu.RUnlock()
+	if ok && time.Now().Before(entry.expiresAt) {
+		return entry.product, nil
+	}
+
+	p, err := load()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.products[id] = cachedProduct{product: p, expiresAt: time.Now().Add(c.TTL)}
+	c.mu.Unlock()
+	return p, nil
+}
+
+// Invalidate drops every cached list and product, so the next lookups go to Stripe
+func (c *ProductCache) Invalidate() {
+	c.mu.Lock()
+	c.lists = make(map[ProductListKey]cachedProductList)
+	c.products = make(map[string]cachedProduct)
+	c.mu.Unlock()
+}
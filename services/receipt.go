@@ -0,0 +1,134 @@
+// services/receipt.go
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/capactiyvirus/stripe-backend/config"
+	"github.com/capactiyvirus/stripe-backend/models"
+	"github.com/go-pdf/fpdf"
+)
+
+// ReceiptService renders receipt PDFs for paid orders, for customers and accounting
+type ReceiptService struct {
+	// CompanyName and SupportEmail brand every receipt (COMPANY_NAME, SUPPORT_EMAIL), falling back
+	// to the config defaults when empty
+	CompanyName  string
+	SupportEmail string
+}
+
+// NewReceiptService creates a receipt service branded from cfg
+func NewReceiptService(cfg *config.Config) *ReceiptService {
+	return &ReceiptService{
+		CompanyName:  cfg.CompanyName,
+		SupportEmail: cfg.SupportEmail,
+	}
+}
+
+// receiptLine is one labelled line of a receipt
+type receiptLine struct {
+	Label string
+	Value string
+	Bold  bool
+}
+
+// receiptLines returns the order summary shown on the receipt PDF
+func receiptLines(order *models.Order) []receiptLine {
+	currency := order.Payment.Currency
+	if currency == "" {
+		currency = "usd"
+	}
+	amount := func(minor int64) string {
+		return models.FormatAmount(minor, currency)
+	}
+
+	// The receipt is dated when the payment went through, falling back to the order date
+	paidAt := order.CreatedAt
+	if order.Payment.ProcessedAt != nil {
+		paidAt = *order.Payment.ProcessedAt
+	}
+
+	lines := []receiptLine{
+		{Label: "Order ID", Value: order.ID},
+		{Label: "Tracking ID", Value: order.TrackingID},
+		{Label: "Date", Value: paidAt.Format("January 2, 2006")},
+		{Label: "Customer", Value: strings.TrimSpace(order.CustomerInfo.Name + " <" + order.CustomerInfo.Email + ">")},
+	}
+	if order.Payment.Method != "" {
+		lines = append(lines, receiptLine{Label: "Payment method", Value: paymentMethodLabel(order.Payment.Method)})
+	}
+	for _, item := range order.Items {
+		lines = append(lines, receiptLine{
+			Label: fmt.Sprintf("%s (%s) x%d", item.ProductName, item.FileType, item.Quantity),
+			Value: models.FormatPrice(item.Price*float64(item.Quantity), currency),
+		})
+	}
+	if order.Payment.DiscountAmount > 0 {
+		lines = append(lines,
+			receiptLine{Label: "Subtotal", Value: amount(order.Payment.Amount + order.Payment.DiscountAmount)},
+			receiptLine{Label: strings.TrimSpace("Discount " + order.CouponCode), Value: "-" + amount(order.Payment.DiscountAmount)},
+		)
+	}
+	// Orders don't carry a tax amount, so only an exemption is shown
+	if order.CustomerInfo.TaxExempt {
+		lines = append(lines, receiptLine{Label: "Tax exempt", Value: "Exemption ID: " + order.CustomerInfo.TaxExemptionID})
+	}
+	lines = append(lines, receiptLine{Label: "Total", Value: amount(order.Payment.Amount), Bold: true})
+	if order.Payment.AmountRefunded > 0 {
+		lines = append(lines, receiptLine{Label: "Refunded", Value: "-" + amount(order.Payment.AmountRefunded)})
+	}
+
+	return lines
+}
+
+// paymentMethodLabel spells out a payment method for the receipt, e.g. "Apple Pay" for apple_pay
+func paymentMethodLabel(method models.PaymentMethod) string {
+	words := strings.Fields(strings.ReplaceAll(string(method), "_", " "))
+	for i, word := range words {
+		words[i] = strings.ToUpper(word[:1]) + word[1:]
+	}
+	return strings.Join(words, " ")
+}
+
+// GeneratePDF renders a receipt for a paid order
+func (s *ReceiptService) GeneratePDF(order *models.Order) ([]byte, error) {
+	companyName, supportEmail := s.CompanyName, s.SupportEmail
+	if companyName == "" {
+		companyName = config.DefaultCompanyName
+	}
+	if supportEmail == "" {
+		supportEmail = config.DefaultSupportEmail
+	}
+
+	pdf := fpdf.New("P", "mm", "A4", "")
+	pdf.SetTitle("Receipt "+order.TrackingID, true)
+	pdf.SetAuthor(companyName, true)
+	pdf.AddPage()
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+
+	pdf.SetFont("Helvetica", "B", 18)
+	pdf.CellFormat(0, 12, tr(companyName+" Receipt"), "", 1, "L", false, 0, "")
+	pdf.Ln(4)
+
+	for _, line := range receiptLines(order) {
+		if line.Bold {
+			pdf.SetFont("Helvetica", "B", 12)
+		} else {
+			pdf.SetFont("Helvetica", "", 11)
+		}
+		pdf.CellFormat(110, 8, tr(line.Label), "B", 0, "L", false, 0, "")
+		pdf.CellFormat(0, 8, tr(line.Value), "B", 1, "R", false, 0, "")
+	}
+
+	pdf.Ln(8)
+	pdf.SetFont("Helvetica", "", 9)
+	pdf.CellFormat(0, 6, tr("Questions about this order? Contact "+supportEmail+" and quote "+order.TrackingID+"."), "", 1, "L", false, 0, "")
+
+	var buf bytes.Buffer
+	if err := pdf.Output(&buf); err != nil {
+		return nil, fmt.Errorf("failed to render receipt: %w", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,56 @@
+// services/tracking_token.go
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultDownloadLinkTTL is how long emailed download links work when no TTL is set
+const DefaultDownloadLinkTTL = 7 * 24 * time.Hour
+
+var (
+	ErrInvalidDownloadToken = errors.New("invalid download token")
+	ErrDownloadTokenExpired = errors.New("download token has expired")
+)
+
+// GenerateTrackingToken signs a tracking ID so emailed tracking links can't be guessed from other tracking IDs
+func GenerateTrackingToken(secret, trackingID string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(trackingID))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// ValidTrackingToken reports whether token was generated for trackingID with secret
+func ValidTrackingToken(secret, trackingID, token string) bool {
+	return hmac.Equal([]byte(GenerateTrackingToken(secret, trackingID)), []byte(token))
+}
+
+// GenerateDownloadToken signs an order's product download link until expires. The token carries
+// its expiry as "<unix seconds>.<signature>", so a leaked link stops working.
+func GenerateDownloadToken(secret, orderID, productID string, expires time.Time) string {
+	expiry := strconv.FormatInt(expires.Unix(), 10)
+	return expiry + "." + GenerateTrackingToken(secret, orderID+"/"+productID+"/"+expiry)
+}
+
+// VerifyDownloadToken checks that token was generated for the order's product with secret, returning
+// ErrDownloadTokenExpired once its expiry has passed and ErrInvalidDownloadToken otherwise
+func VerifyDownloadToken(secret, orderID, productID, token string) error {
+	expiry, signature, ok := strings.Cut(token, ".")
+	if !ok || !ValidTrackingToken(secret, orderID+"/"+productID+"/"+expiry, signature) {
+		return ErrInvalidDownloadToken
+	}
+	expires, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		return ErrInvalidDownloadToken
+	}
+	if time.Now().Unix() > expires {
+		return ErrDownloadTokenExpired
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+// store/catalog.go
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/capactiyvirus/stripe-backend/models"
+)
+
+// ErrProductExists is returned when creating a product whose ID is already taken
+var ErrProductExists = errors.New("product already exists")
+
+// ProductCatalog is an editable product catalog backed by a JSON file
+type ProductCatalog struct {
+	path     string
+	products map[string]*models.Product
+	cache    []*models.Product // Sorted listing, rebuilt after every change
+	mu       sync.RWMutex
+}
+
+// NewProductCatalog loads the catalog stored at path. A missing file starts an empty catalog.
+func NewProductCatalog(path string) (*ProductCatalog, error) {
+	c := &ProductCatalog{
+		path:     path,
+		products: make(map[string]*models.Product),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read product catalog: %w", err)
+	}
+
+	var products []*models.Product
+	if err := json.Unmarshal(data, &products); err != nil {
+		return nil, fmt.Errorf("failed to decode product catalog: %w", err)
+	}
+	for _, p := range products {
+		c.products[p.ID] = withEmptyLists(p)
+	}
+
+	return c, nil
+}
+
+// ListProducts returns every product sorted by ID. The listing is shared and must not be modified.
+func (c *ProductCatalog) ListProducts() []*models.Product {
+	c.mu.RLock()
+	if c.cache != nil {
+		defer c.mu.RUnlock()
+		return c.cache
+	}
+	c.mu.RUnlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cache == nil {
+		cache := make([]*models.Product, 0, len(c.products))
+		for _, p := range c.products {
+			productCopy := *p
+			cache = append(cache, &productCopy)
+		}
+		sort.Slice(cache, func(i, j int) bool { return cache[i].ID < cache[j].ID })
+		c.cache = cache
+	}
+	return c.cache
+}
+
+// GetProduct retrieves a product by ID
+func (c *ProductCatalog) GetProduct(id string) (*models.Product, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	p, exists := c.products[id]
+	if !exists {
+		return nil, fmt.Errorf("product not found: %s", id)
+	}
+
+	productCopy := *p
+	return &productCopy, nil
+}
+
+// CreateProduct adds a new product, failing with ErrProductExists if the ID is taken
+func (c *ProductCatalog) CreateProduct(product *models.Product) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, exists := c.products[product.ID]; exists {
+		return fmt.Errorf("%w: %s", ErrProductExists, product.ID)
+	}
+
+	return c.save(product.ID, withEmptyLists(product))
+}
+
+// UpdateProduct replaces an existing product
+func (c *ProductCatalog) UpdateProduct(product *models.Product) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, exists := c.products[product.ID]; !exists {
+		return fmt.Errorf("product not found: %s", product.ID)
+	}
+
+	return c.save(product.ID, withEmptyLists(product))
+}
+
+// DeleteProduct removes a product
+func (c *ProductCatalog) DeleteProduct(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, exists := c.products[id]; !exists {
+		return fmt.Errorf("product not found: %s", id)
+	}
+
+	return c.save(id, nil)
+}
+
+// save sets (or, for a nil product, removes) the product with the given ID, writes
+// the catalog file, and invalidates the cached listing. The caller must hold c.mu.
+func (c *ProductCatalog) save(id string, product *models.Product) error {
+	products := make(map[string]*models.Product, len(c.products)+1)
+	for k, v := range c.products {
+		products[k] = v
+	}
+	if product == nil {
+		delete(products, id)
+	} else {
+		products[id] = product
+	}
+
+	list := make([]*models.Product, 0, len(products))
+	for _, p := range products {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode product catalog: %w", err)
+	}
+	if err := writeFileAtomic(c.path, data); err != nil {
+		return fmt.Errorf("failed to write product catalog: %w", err)
+	}
+
+	c.products = products
+	c.cache = nil
+	return nil
+}
+
+// withEmptyLists copies a product, replacing a nil image list with an empty one so it encodes as []
+func withEmptyLists(product *models.Product) *models.Product {
+	productCopy := *product
+	if productCopy.Images == nil {
+		productCopy.Images = []string{}
+	}
+	return &productCopy
+}
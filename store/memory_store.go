@@ -0,0 +1,1131 @@
+// store/memory_store.go
+package store
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/capactiyvirus/stripe-backend/models"
+)
+
+// MemoryStore is an in-memory PaymentStore. Its orders never leave mu: reads of whole orders return
+// copies made with copyOrder, and bulk reads such as GetAllOrders and the stats build their results
+// while holding the read lock.
+type MemoryStore struct {
+	orders             map[string]*models.Order
+	events             map[string][]models.PaymentEvent
+	notes              map[string][]models.OrderNote // orderID -> notes, oldest first
+	trackingIDs        map[string]string             // trackingID -> orderID
+	customerIndex      map[string][]string           // email -> []orderID
+	paymentIntentIndex map[string]string             // paymentIntentID -> orderID
+	sessionIndex       map[string]string             // sessionID -> orderID
+	processedEvents    map[string]bool               // Stripe webhook event IDs already handled
+	webhookEvents      map[string]models.WebhookEvent
+	idempotencyKeys    map[string]idempotencyEntry
+	orderKeys          map[string]orderKeyEntry // CreateOrder Idempotency-Key -> order
+	stripeCustomers    map[string]string        // email -> Stripe customer ID
+	coupons            map[string]*models.Coupon
+	subscriptions      map[string]*models.Subscription       // Stripe subscription ID -> subscription
+	subscriptionEvents map[string][]models.SubscriptionEvent // Stripe subscription ID -> events, oldest first
+	disputes           map[string]*models.Dispute            // Stripe dispute ID -> dispute
+	mu                 sync.RWMutex
+}
+
+// NewMemoryStore creates a new in-memory payment store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		orders:             make(map[string]*models.Order),
+		events:             make(map[string][]models.PaymentEvent),
+		notes:              make(map[string][]models.OrderNote),
+		trackingIDs:        make(map[string]string),
+		customerIndex:      make(map[string][]string),
+		paymentIntentIndex: make(map[string]string),
+		sessionIndex:       make(map[string]string),
+		processedEvents:    make(map[string]bool),
+		webhookEvents:      make(map[string]models.WebhookEvent),
+		idempotencyKeys:    make(map[string]idempotencyEntry),
+		orderKeys:          make(map[string]orderKeyEntry),
+		stripeCustomers:    make(map[string]string),
+		coupons:            make(map[string]*models.Coupon),
+		subscriptions:      make(map[string]*models.Subscription),
+		subscriptionEvents: make(map[string][]models.SubscriptionEvent),
+		disputes:           make(map[string]*models.Dispute),
+	}
+}
+
+// idempotencyEntry is a stored response and when it stops being replayed
+type idempotencyEntry struct {
+	response  IdempotentResponse
+	expiresAt time.Time
+}
+
+// orderKeyEntry is the order created for an idempotency key and when the key can be reused
+type orderKeyEntry struct {
+	orderID   string
+	expiresAt time.Time
+}
+
+// Ping always succeeds; the in-memory store has no connection to check
+func (s *MemoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+// CreateOrder creates a new order
+func (s *MemoryStore) CreateOrder(ctx context.Context, order *models.Order) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if order.ID == "" {
+		return fmt.Errorf("order ID cannot be empty")
+	}
+	if _, exists := s.orders[order.ID]; exists {
+		return fmt.Errorf("%w: %s", ErrOrderExists, order.ID)
+	}
+
+	// Set timestamps
+	now := time.Now()
+	order.CreatedAt = now
+	order.UpdatedAt = now
+
+	// Store a copy, since the caller keeps using the order it passed in
+	s.orders[order.ID] = copyOrder(order)
+
+	// Index by tracking ID
+	if order.TrackingID != "" {
+		s.trackingIDs[order.TrackingID] = order.ID
+	}
+
+	// Index by customer email
+	if order.CustomerInfo.Email != "" {
+		s.customerIndex[order.CustomerInfo.Email] = append(
+			s.customerIndex[order.CustomerInfo.Email],
+			order.ID,
+		)
+	}
+
+	// Index by Stripe payment intent and checkout session
+	s.indexPayment(order)
+
+	return nil
+}
+
+// GetOrder retrieves an order by ID
+func (s *MemoryStore) GetOrder(ctx context.Context, orderID string) (*models.Order, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	order, exists := s.orders[orderID]
+	if !exists {
+		return nil, fmt.Errorf("order not found: %s", orderID)
+	}
+
+	// Return a copy to prevent external modifications
+	return copyOrder(order), nil
+}
+
+// copyOrder copies an order, with an empty rather than nil item list to match PostgresStore. Items,
+// metadata, and charge IDs are copied too, so the copy shares nothing with the store's own order
+// that the store might change later.
+func copyOrder(order *models.Order) *models.Order {
+	orderCopy := *order
+	orderCopy.Items = append([]models.OrderItem{}, order.Items...)
+	if order.Metadata != nil {
+		orderCopy.Metadata = make(map[string]string, len(order.Metadata))
+		for k, v := range order.Metadata {
+			orderCopy.Metadata[k] = v
+		}
+	}
+	if order.Payment.ChargeIDs != nil {
+		orderCopy.Payment.ChargeIDs = append([]string(nil), order.Payment.ChargeIDs...)
+	}
+	return &orderCopy
+}
+
+// GetOrderByTrackingID retrieves an order by tracking ID
+func (s *MemoryStore) GetOrderByTrackingID(ctx context.Context, trackingID string) (*models.Order, error) {
+	s.mu.RLock()
+	orderID, exists := s.trackingIDs[trackingID]
+	s.mu.RUnlock()
+
+	if !exists {
+		return nil, fmt.Errorf("order not found with tracking ID: %s", trackingID)
+	}
+
+	return s.GetOrder(ctx, orderID)
+}
+
+// FindOrderByPaymentIntentID returns the ID of the order paid with a Stripe payment intent
+func (s *MemoryStore) FindOrderByPaymentIntentID(ctx context.Context, paymentIntentID string) (string, error) {
+	s.mu.RLock()
+	orderID, exists := s.paymentIntentIndex[paymentIntentID]
+	s.mu.RUnlock()
+
+	if !exists {
+		return "", fmt.Errorf("order not found for payment intent: %s", paymentIntentID)
+	}
+	return orderID, nil
+}
+
+// FindOrderBySessionID returns the ID of the order paid through a Stripe checkout session
+func (s *MemoryStore) FindOrderBySessionID(ctx context.Context, sessionID string) (string, error) {
+	s.mu.RLock()
+	orderID, exists := s.sessionIndex[sessionID]
+	s.mu.RUnlock()
+
+	if !exists {
+		return "", fmt.Errorf("order not found for checkout session: %s", sessionID)
+	}
+	return orderID, nil
+}
+
+// indexPayment indexes an order by its Stripe payment intent and checkout session IDs
+func (s *MemoryStore) indexPayment(order *models.Order) {
+	if order.Payment.StripePaymentIntentID != "" {
+		s.paymentIntentIndex[order.Payment.StripePaymentIntentID] = order.ID
+	}
+	if order.Payment.StripeSessionID != "" {
+		s.sessionIndex[order.Payment.StripeSessionID] = order.ID
+	}
+}
+
+// unindexPayment removes an order's payment intent and checkout session index entries
+func (s *MemoryStore) unindexPayment(order *models.Order) {
+	if s.paymentIntentIndex[order.Payment.StripePaymentIntentID] == order.ID {
+		delete(s.paymentIntentIndex, order.Payment.StripePaymentIntentID)
+	}
+	if s.sessionIndex[order.Payment.StripeSessionID] == order.ID {
+		delete(s.sessionIndex, order.Payment.StripeSessionID)
+	}
+}
+
+// UpdateOrder updates an existing order
+func (s *MemoryStore) UpdateOrder(ctx context.Context, order *models.Order) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, exists := s.orders[order.ID]
+	if !exists {
+		return fmt.Errorf("order not found: %s", order.ID)
+	}
+
+	// Re-index in case a payment intent or session was assigned after creation
+	s.unindexPayment(existing)
+	s.indexPayment(order)
+
+	order.UpdatedAt = time.Now()
+	s.orders[order.ID] = copyOrder(order)
+
+	return nil
+}
+
+// UpdateOrderStatus updates the status of an order, rejecting transitions models.CanTransition doesn't allow
+func (s *MemoryStore) UpdateOrderStatus(ctx context.Context, orderID string, status models.OrderStatus) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order, exists := s.orders[orderID]
+	if !exists {
+		return fmt.Errorf("order not found: %s", orderID)
+	}
+	if err := models.CheckTransition(order.Status, status); err != nil {
+		return err
+	}
+
+	if order.Status != status {
+		s.events[orderID] = append(s.events[orderID], statusChangedEvent(orderID, "order_status", string(order.Status), string(status), order.Payment.Status))
+		// A canceled order will never be paid, so its coupon use goes back
+		if status == models.OrderStatusCanceled && order.CouponCode != "" {
+			s.releaseCoupon(order.CouponCode)
+		}
+	}
+	order.Status = status
+	order.UpdatedAt = time.Now()
+
+	// Set fulfilled timestamp if order is fulfilled
+	if status == models.OrderStatusFulfilled && order.FulfilledAt == nil {
+		now := time.Now()
+		order.FulfilledAt = &now
+	}
+
+	return nil
+}
+
+// MarkOrderFulfilled moves a paid order to fulfilled and returns its fulfillment time. An order that's
+// already fulfilled is left alone and its original fulfillment time returned with alreadyFulfilled set,
+// so concurrent callers can't both fulfill it.
+func (s *MemoryStore) MarkOrderFulfilled(ctx context.Context, orderID string) (time.Time, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order, exists := s.orders[orderID]
+	if !exists {
+		return time.Time{}, false, fmt.Errorf("order not found: %s", orderID)
+	}
+	if order.Status == models.OrderStatusFulfilled {
+		var fulfilledAt time.Time
+		if order.FulfilledAt != nil {
+			fulfilledAt = *order.FulfilledAt
+		}
+		return fulfilledAt, true, nil
+	}
+	if err := models.CheckTransition(order.Status, models.OrderStatusFulfilled); err != nil {
+		return time.Time{}, false, err
+	}
+
+	s.events[orderID] = append(s.events[orderID], statusChangedEvent(orderID, "order_status", string(order.Status), string(models.OrderStatusFulfilled), order.Payment.Status))
+	now := time.Now()
+	order.Status = models.OrderStatusFulfilled
+	order.UpdatedAt = now
+	order.FulfilledAt = &now
+
+	return now, false, nil
+}
+
+// ArchiveOrder archives an order so listings and stats leave it out, returning when it was archived.
+// An order that's already archived keeps its original archive time, returned with alreadyArchived set.
+func (s *MemoryStore) ArchiveOrder(ctx context.Context, orderID string) (time.Time, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order, exists := s.orders[orderID]
+	if !exists {
+		return time.Time{}, false, fmt.Errorf("order not found: %s", orderID)
+	}
+	if order.ArchivedAt != nil {
+		return *order.ArchivedAt, true, nil
+	}
+
+	now := time.Now()
+	order.ArchivedAt = &now
+	order.UpdatedAt = now
+	return now, false, nil
+}
+
+// MarkOrderDisputed flags an order as having a chargeback against its payment
+func (s *MemoryStore) MarkOrderDisputed(ctx context.Context, orderID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order, exists := s.orders[orderID]
+	if !exists {
+		return fmt.Errorf("order not found: %s", orderID)
+	}
+	if !order.Disputed {
+		order.Disputed = true
+		order.UpdatedAt = time.Now()
+	}
+	return nil
+}
+
+// UpdatePaymentStatus updates the payment status of an order
+func (s *MemoryStore) UpdatePaymentStatus(ctx context.Context, orderID string, status models.PaymentStatus) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order, exists := s.orders[orderID]
+	if !exists {
+		return fmt.Errorf("order not found: %s", orderID)
+	}
+
+	if order.Payment.Status != status {
+		s.events[orderID] = append(s.events[orderID], statusChangedEvent(orderID, "payment_status", string(order.Payment.Status), string(status), status))
+	}
+	order.Payment.Status = status
+	order.UpdatedAt = time.Now()
+
+	// Update processed timestamp
+	if status == models.PaymentStatusSucceeded && order.Payment.ProcessedAt == nil {
+		now := time.Now()
+		order.Payment.ProcessedAt = &now
+		// Also update order status to paid, unless the order has already moved past payment
+		if order.Status != models.OrderStatusPaid && models.CanTransition(order.Status, models.OrderStatusPaid) {
+			s.events[orderID] = append(s.events[orderID], statusChangedEvent(orderID, "order_status", string(order.Status), string(models.OrderStatusPaid), status))
+			order.Status = models.OrderStatusPaid
+		}
+	}
+
+	return nil
+}
+
+// UpdatePaymentFees records the Stripe processing fee and net amount for an order
+func (s *MemoryStore) UpdatePaymentFees(ctx context.Context, orderID string, fee, net int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order, exists := s.orders[orderID]
+	if !exists {
+		return fmt.Errorf("order not found: %s", orderID)
+	}
+
+	order.Payment.StripeFee = fee
+	order.Payment.NetAmount = net
+	order.UpdatedAt = time.Now()
+
+	return nil
+}
+
+// UpdatePaymentMethod records how an order was paid
+func (s *MemoryStore) UpdatePaymentMethod(ctx context.Context, orderID string, method models.PaymentMethod) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order, exists := s.orders[orderID]
+	if !exists {
+		return fmt.Errorf("order not found: %s", orderID)
+	}
+
+	order.Payment.Method = method
+	order.UpdatedAt = time.Now()
+
+	return nil
+}
+
+// UpdatePaymentCharges records the Stripe charges captured against an order's payment intent
+func (s *MemoryStore) UpdatePaymentCharges(ctx context.Context, orderID string, chargeIDs []string, amountCaptured int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order, exists := s.orders[orderID]
+	if !exists {
+		return fmt.Errorf("order not found: %s", orderID)
+	}
+
+	order.Payment.ChargeIDs = append([]string(nil), chargeIDs...)
+	order.Payment.AmountCaptured = amountCaptured
+	order.UpdatedAt = time.Now()
+
+	return nil
+}
+
+// UpdatePaymentRefund records a Stripe refund issued for an order's payment and the total refunded so far
+func (s *MemoryStore) UpdatePaymentRefund(ctx context.Context, orderID, refundID string, amountRefunded int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order, exists := s.orders[orderID]
+	if !exists {
+		return fmt.Errorf("order not found: %s", orderID)
+	}
+
+	now := time.Now()
+	order.Payment.StripeRefundID = refundID
+	order.Payment.AmountRefunded = amountRefunded
+	order.Payment.RefundedAt = &now
+	order.UpdatedAt = now
+
+	return nil
+}
+
+// UpdateSavedPaymentMethod records the Stripe customer and payment method saved for off-session charges
+func (s *MemoryStore) UpdateSavedPaymentMethod(ctx context.Context, orderID, customerID, paymentMethodID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order, exists := s.orders[orderID]
+	if !exists {
+		return fmt.Errorf("order not found: %s", orderID)
+	}
+
+	order.CustomerInfo.StripeCustomerID = customerID
+	order.CustomerInfo.SavedPaymentMethodID = paymentMethodID
+	order.UpdatedAt = time.Now()
+
+	return nil
+}
+
+// SetItemDownloadURL sets the download URL of an order's items for a product
+func (s *MemoryStore) SetItemDownloadURL(ctx context.Context, orderID, productID, url string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order, exists := s.orders[orderID]
+	if !exists {
+		return fmt.Errorf("order not found: %s", orderID)
+	}
+
+	found := false
+	for i := range order.Items {
+		if order.Items[i].ProductID == productID {
+			order.Items[i].DownloadURL = url
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("order %s has no item for product %s", orderID, productID)
+	}
+	order.UpdatedAt = time.Now()
+
+	return nil
+}
+
+// GetCustomerOrders retrieves all orders for a customer by email
+func (s *MemoryStore) GetCustomerOrders(ctx context.Context, email string) ([]*models.Order, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	orderIDs, exists := s.customerIndex[email]
+	if !exists {
+		return []*models.Order{}, nil
+	}
+
+	orders := make([]*models.Order, 0, len(orderIDs))
+	for _, orderID := range orderIDs {
+		if order, exists := s.orders[orderID]; exists {
+			orders = append(orders, copyOrder(order))
+		}
+	}
+
+	newestFirst(orders)
+	return orders, nil
+}
+
+// GetCustomerOrderSummaries retrieves a page of a customer's order summaries, newest first
+func (s *MemoryStore) GetCustomerOrderSummaries(ctx context.Context, email string, limit, offset int) ([]*models.OrderSummary, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	orderList := make([]*models.Order, 0, len(s.customerIndex[email]))
+	for _, orderID := range s.customerIndex[email] {
+		if order, exists := s.orders[orderID]; exists {
+			orderList = append(orderList, order)
+		}
+	}
+
+	newestFirst(orderList)
+	start, end := pageBounds(len(orderList), limit, offset)
+	return orderSummaries(orderList[start:end]), nil
+}
+
+// CountCustomerOrders returns how many orders a customer has
+func (s *MemoryStore) CountCustomerOrders(ctx context.Context, email string) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	count := 0
+	for _, orderID := range s.customerIndex[email] {
+		if _, exists := s.orders[orderID]; exists {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// GetAllOrders retrieves the orders matching filter with optional pagination
+func (s *MemoryStore) GetAllOrders(ctx context.Context, limit, offset int, filter models.OrderFilter) ([]*models.OrderSummary, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// Convert to slice for sorting
+	orderList := make([]*models.Order, 0, len(s.orders))
+	for _, order := range s.orders {
+		if filter.Matches(order) {
+			orderList = append(orderList, order)
+		}
+	}
+
+	newestFirst(orderList)
+	start, end := pageBounds(len(orderList), limit, offset)
+	return orderSummaries(orderList[start:end]), nil
+}
+
+// EachOrder calls fn with every order matching filter, newest first, stopping at the first error fn returns.
+// Each order is copied just before fn gets it, with the store unlocked while fn runs, so fn can take its
+// time without holding up the store or every order being copied up front. An order changed to no longer
+// match filter before its turn is skipped.
+func (s *MemoryStore) EachOrder(ctx context.Context, filter models.OrderFilter, fn func(order *models.Order) error) error {
+	s.mu.RLock()
+	orderList := make([]*models.Order, 0, len(s.orders))
+	for _, order := range s.orders {
+		if filter.Matches(order) {
+			orderList = append(orderList, order)
+		}
+	}
+	newestFirst(orderList)
+	s.mu.RUnlock()
+
+	for _, order := range orderList {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		s.mu.RLock()
+		current := copyOrder(order)
+		s.mu.RUnlock()
+		if !filter.Matches(current) {
+			continue
+		}
+		if err := fn(current); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SearchOrders returns up to limit orders, newest first, whose email, customer name, or
+// tracking ID contains query, ignoring case
+func (s *MemoryStore) SearchOrders(ctx context.Context, query string, limit int) ([]*models.OrderSummary, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	query = strings.ToLower(query)
+	matches := make([]*models.Order, 0)
+	for _, order := range s.orders {
+		if strings.Contains(strings.ToLower(order.CustomerInfo.Email), query) ||
+			strings.Contains(strings.ToLower(order.CustomerInfo.Name), query) ||
+			strings.Contains(strings.ToLower(order.TrackingID), query) {
+			matches = append(matches, order)
+		}
+	}
+
+	newestFirst(matches)
+	_, end := pageBounds(len(matches), limit, 0)
+	return orderSummaries(matches[:end]), nil
+}
+
+// orderSummary builds the listing view of an order
+func orderSummary(order *models.Order) *models.OrderSummary {
+	return &models.OrderSummary{
+		ID:            order.ID,
+		TrackingID:    order.TrackingID,
+		CustomerEmail: order.CustomerInfo.Email,
+		TotalAmount:   models.ToMajorUnits(float64(order.Payment.Amount), order.Payment.Currency),
+		Currency:      order.Payment.Currency,
+		Status:        order.Status,
+		ItemCount:     len(order.Items),
+		Disputed:      order.Disputed,
+		CreatedAt:     order.CreatedAt,
+	}
+}
+
+// orderSummaries builds the listing view of each order. Summaries share nothing with the orders, so
+// they're safe to return once the caller releases the store's lock.
+func orderSummaries(orders []*models.Order) []*models.OrderSummary {
+	summaries := make([]*models.OrderSummary, 0, len(orders))
+	for _, order := range orders {
+		summaries = append(summaries, orderSummary(order))
+	}
+	return summaries
+}
+
+// newestFirst sorts orders by creation time, newest first. It only reorders the slice, so sorting
+// the store's own orders is safe under the read lock.
+func newestFirst(orders []*models.Order) {
+	sort.Slice(orders, func(i, j int) bool {
+		return orders[i].CreatedAt.After(orders[j].CreatedAt)
+	})
+}
+
+// pageBounds returns the bounds of the page of up to limit entries starting at offset in a list of n
+func pageBounds(n, limit, offset int) (start, end int) {
+	start = offset
+	if start > n {
+		start = n
+	}
+	end = start + limit
+	if end > n {
+		end = n
+	}
+	return start, end
+}
+
+// CountOrders counts the orders matching filter
+func (s *MemoryStore) CountOrders(ctx context.Context, filter models.OrderFilter) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	count := 0
+	for _, order := range s.orders {
+		if filter.Matches(order) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// AddPaymentEvent adds a payment event
+func (s *MemoryStore) AddPaymentEvent(ctx context.Context, event models.PaymentEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if event.ID == "" {
+		event.ID = newEventID()
+	}
+	event.CreatedAt = time.Now()
+
+	s.events[event.OrderID] = append(s.events[event.OrderID], event)
+	return nil
+}
+
+// GetPaymentEvents retrieves payment events for an order
+func (s *MemoryStore) GetPaymentEvents(ctx context.Context, orderID string) ([]models.PaymentEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	events, exists := s.events[orderID]
+	if !exists {
+		return []models.PaymentEvent{}, nil
+	}
+
+	// Return a copy
+	eventsCopy := make([]models.PaymentEvent, len(events))
+	copy(eventsCopy, events)
+
+	return eventsCopy, nil
+}
+
+// AddOrderNote adds a note to an order, filling in its ID and creation time
+func (s *MemoryStore) AddOrderNote(ctx context.Context, note *models.OrderNote) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.orders[note.OrderID]; !exists {
+		return fmt.Errorf("order not found: %s", note.OrderID)
+	}
+
+	note.ID = newNoteID()
+	note.CreatedAt = time.Now()
+	s.notes[note.OrderID] = append(s.notes[note.OrderID], *note)
+	return nil
+}
+
+// GetOrderNotes returns an order's notes, newest first
+func (s *MemoryStore) GetOrderNotes(ctx context.Context, orderID string) ([]models.OrderNote, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stored := s.notes[orderID]
+	notes := make([]models.OrderNote, len(stored))
+	for i, note := range stored {
+		notes[len(stored)-1-i] = note
+	}
+	return notes, nil
+}
+
+// MarkEventProcessed records a Stripe webhook event as handled, reporting whether it already was
+func (s *MemoryStore) MarkEventProcessed(ctx context.Context, eventID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.processedEvents[eventID] {
+		return true, nil
+	}
+	s.processedEvents[eventID] = true
+	return false, nil
+}
+
+// UnmarkEventProcessed forgets a webhook event so a retry of it is handled again
+func (s *MemoryStore) UnmarkEventProcessed(ctx context.Context, eventID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.processedEvents, eventID)
+	return nil
+}
+
+// SaveWebhookEvent keeps a webhook event for replay, dropping events received more than retention
+// ago. A redelivered event keeps its first payload.
+func (s *MemoryStore) SaveWebhookEvent(ctx context.Context, event models.WebhookEvent, retention time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cutoff := time.Now().Add(-retention)
+	for id, stored := range s.webhookEvents {
+		if !stored.ReceivedAt.After(cutoff) {
+			delete(s.webhookEvents, id)
+		}
+	}
+	if _, exists := s.webhookEvents[event.ID]; !exists {
+		event.Payload = append([]byte(nil), event.Payload...)
+		s.webhookEvents[event.ID] = event
+	}
+	return nil
+}
+
+// GetWebhookEvent returns the stored webhook event with eventID, or nil
+func (s *MemoryStore) GetWebhookEvent(ctx context.Context, eventID string) (*models.WebhookEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	event, exists := s.webhookEvents[eventID]
+	if !exists {
+		return nil, nil
+	}
+	event.Payload = append([]byte(nil), event.Payload...)
+	return &event, nil
+}
+
+// GetIdempotentResponse returns the unexpired response stored for an idempotency key, or nil
+func (s *MemoryStore) GetIdempotentResponse(ctx context.Context, key string) (*IdempotentResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, exists := s.idempotencyKeys[key]
+	if !exists {
+		return nil, nil
+	}
+	if time.Now().After(entry.expiresAt) {
+		delete(s.idempotencyKeys, key)
+		return nil, nil
+	}
+
+	response := entry.response
+	response.Body = append([]byte(nil), entry.response.Body...)
+	return &response, nil
+}
+
+// SaveIdempotentResponse stores the response replayed for an idempotency key until ttl passes,
+// clearing out expired keys as it goes
+func (s *MemoryStore) SaveIdempotentResponse(ctx context.Context, key string, response IdempotentResponse, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for saved, entry := range s.idempotencyKeys {
+		if now.After(entry.expiresAt) {
+			delete(s.idempotencyKeys, saved)
+		}
+	}
+	response.Body = append([]byte(nil), response.Body...)
+	s.idempotencyKeys[key] = idempotencyEntry{response: response, expiresAt: now.Add(ttl)}
+	return nil
+}
+
+// ClaimOrderIdempotencyKey maps an idempotency key to orderID until ttl passes, clearing out expired
+// keys as it goes. If the key is already mapped it's left alone and the existing order ID is returned instead.
+func (s *MemoryStore) ClaimOrderIdempotencyKey(ctx context.Context, key, orderID string, ttl time.Duration) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for claimed, entry := range s.orderKeys {
+		if !now.Before(entry.expiresAt) {
+			delete(s.orderKeys, claimed)
+		}
+	}
+	if entry, exists := s.orderKeys[key]; exists {
+		return entry.orderID, nil
+	}
+	s.orderKeys[key] = orderKeyEntry{orderID: orderID, expiresAt: now.Add(ttl)}
+	return "", nil
+}
+
+// ReleaseOrderIdempotencyKey frees a key claimed for orderID so a retry can create the order
+func (s *MemoryStore) ReleaseOrderIdempotencyKey(ctx context.Context, key, orderID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry, exists := s.orderKeys[key]; exists && entry.orderID == orderID {
+		delete(s.orderKeys, key)
+	}
+	return nil
+}
+
+// GetStripeCustomerID returns the Stripe customer saved for an email, or "" if there is none
+func (s *MemoryStore) GetStripeCustomerID(ctx context.Context, email string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.stripeCustomers[email], nil
+}
+
+// SaveStripeCustomerID maps an email to the Stripe customer its orders are charged to
+func (s *MemoryStore) SaveStripeCustomerID(ctx context.Context, email, customerID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stripeCustomers[email] = customerID
+	return nil
+}
+
+// GetPaymentStats calculates payment statistics for every unarchived order, with amounts in USD
+func (s *MemoryStore) GetPaymentStats(ctx context.Context) (*models.PaymentStats, error) {
+	return s.GetPaymentStatsRange(ctx, time.Time{}, time.Time{}, false, "usd")
+}
+
+// GetPaymentStatsRange calculates payment statistics for orders created between from and to, inclusive.
+// A zero from or to leaves that end of the range open. Archived orders only count with includeArchived.
+// Amounts are in currency, apart from the per-currency breakdown.
+func (s *MemoryStore) GetPaymentStatsRange(ctx context.Context, from, to time.Time, includeArchived bool, currency string) (*models.PaymentStats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	thisMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+
+	totals := newStatsTotals(currency)
+	for _, order := range s.orders {
+		if !inStatsRange(order.CreatedAt, from, to) || (!includeArchived && order.ArchivedAt != nil) {
+			continue
+		}
+
+		row := statsRow{
+			status:   order.Status,
+			currency: order.Payment.Currency,
+			count:    1,
+			amount:   order.Payment.Amount,
+			fees:     order.Payment.StripeFee,
+			net:      order.Payment.NetAmount,
+		}
+
+		// Fall back to the gross amount until the balance transaction is known
+		if row.net == 0 {
+			row.net = row.amount
+		}
+		if order.CreatedAt.After(today) {
+			row.amountToday = row.amount
+		}
+		if order.CreatedAt.After(thisMonth) {
+			row.amountMonth = row.amount
+		}
+
+		totals.add(row)
+	}
+
+	stats := totals.stats()
+	stats.From, stats.To = statsRange(from, to)
+	for orderID, events := range s.events {
+		order, exists := s.orders[orderID]
+		if !exists || !inStatsRange(order.CreatedAt, from, to) || (!includeArchived && order.ArchivedAt != nil) {
+			continue
+		}
+		for _, event := range events {
+			if event.EventType == "downloaded" {
+				stats.DownloadedOrders++
+				break
+			}
+		}
+	}
+
+	return stats, nil
+}
+
+// GetRevenueByDay totals the revenue of paid and fulfilled orders in currency created between from and to
+// for each UTC day. Archived orders only count with includeArchived.
+func (s *MemoryStore) GetRevenueByDay(ctx context.Context, from, to time.Time, currency string, includeArchived bool) ([]models.DailyRevenue, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	days := make(map[string]*dayTotals)
+	for _, order := range s.orders {
+		if order.Status != models.OrderStatusPaid && order.Status != models.OrderStatusFulfilled {
+			continue
+		}
+		if !inStatsRange(order.CreatedAt, from, to) || !strings.EqualFold(orderCurrency(order), currency) {
+			continue
+		}
+		if !includeArchived && order.ArchivedAt != nil {
+			continue
+		}
+
+		date := order.CreatedAt.UTC().Format("2006-01-02")
+		totals, ok := days[date]
+		if !ok {
+			totals = &dayTotals{}
+			days[date] = totals
+		}
+		totals.revenue += order.Payment.Amount
+		totals.orders++
+	}
+
+	return dailySeries(from, to, currency, days), nil
+}
+
+// orderCurrency returns an order's currency, treating orders from before currencies were recorded as USD
+func orderCurrency(order *models.Order) string {
+	if order.Payment.Currency == "" {
+		return "usd"
+	}
+	return order.Payment.Currency
+}
+
+// CreateCoupon saves a new coupon with no uses
+func (s *MemoryStore) CreateCoupon(ctx context.Context, coupon *models.Coupon) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.coupons[coupon.Code]; exists {
+		return fmt.Errorf("%w: %s", ErrCouponExists, coupon.Code)
+	}
+
+	coupon.Uses = 0
+	coupon.CreatedAt = time.Now()
+	stored := *coupon
+	s.coupons[coupon.Code] = &stored
+	return nil
+}
+
+// ValidateCoupon checks that a coupon can be redeemed on an order in currency and counts the use, returning
+// its discount on subtotal. The check and the count happen together, so concurrent orders can't exceed MaxUses.
+func (s *MemoryStore) ValidateCoupon(ctx context.Context, code string, subtotal int64, currency string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	coupon, exists := s.coupons[code]
+	if !exists {
+		return 0, fmt.Errorf("%w: %s", ErrCouponNotFound, code)
+	}
+	if err := coupon.Redeemable(time.Now(), currency); err != nil {
+		return 0, err
+	}
+
+	coupon.Uses++
+	return coupon.Discount(subtotal), nil
+}
+
+// ReleaseCoupon gives back a use counted by ValidateCoupon for an order that wasn't created
+func (s *MemoryStore) ReleaseCoupon(ctx context.Context, code string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.releaseCoupon(code)
+	return nil
+}
+
+// releaseCoupon gives back one use of code. The caller must hold s.mu.
+func (s *MemoryStore) releaseCoupon(code string) {
+	if coupon, exists := s.coupons[code]; exists && coupon.Uses > 0 {
+		coupon.Uses--
+	}
+}
+
+// SaveSubscription creates or replaces a subscription by its Stripe ID. A replaced subscription
+// keeps its creation time.
+func (s *MemoryStore) SaveSubscription(ctx context.Context, subscription *models.Subscription) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if subscription.StripeSubscriptionID == "" {
+		return fmt.Errorf("subscription ID cannot be empty")
+	}
+
+	now := time.Now()
+	if existing, exists := s.subscriptions[subscription.StripeSubscriptionID]; exists {
+		subscription.CreatedAt = existing.CreatedAt
+	} else if subscription.CreatedAt.IsZero() {
+		subscription.CreatedAt = now
+	}
+	subscription.UpdatedAt = now
+
+	stored := *subscription
+	s.subscriptions[subscription.StripeSubscriptionID] = &stored
+	return nil
+}
+
+// GetSubscription returns the subscription with a Stripe subscription ID
+func (s *MemoryStore) GetSubscription(ctx context.Context, subscriptionID string) (*models.Subscription, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	subscription, exists := s.subscriptions[subscriptionID]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrSubscriptionNotFound, subscriptionID)
+	}
+	copied := *subscription
+	return &copied, nil
+}
+
+// GetCustomerSubscriptions returns a customer's subscriptions, newest first
+func (s *MemoryStore) GetCustomerSubscriptions(ctx context.Context, email string) ([]*models.Subscription, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	subscriptions := []*models.Subscription{}
+	for _, subscription := range s.subscriptions {
+		if subscription.CustomerEmail == email {
+			copied := *subscription
+			subscriptions = append(subscriptions, &copied)
+		}
+	}
+	sort.Slice(subscriptions, func(i, j int) bool {
+		if !subscriptions[i].CreatedAt.Equal(subscriptions[j].CreatedAt) {
+			return subscriptions[i].CreatedAt.After(subscriptions[j].CreatedAt)
+		}
+		return subscriptions[i].StripeSubscriptionID < subscriptions[j].StripeSubscriptionID
+	})
+	return subscriptions, nil
+}
+
+// AddSubscriptionEvent records a lifecycle event for a subscription
+func (s *MemoryStore) AddSubscriptionEvent(ctx context.Context, event models.SubscriptionEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if event.ID == "" {
+		event.ID = newEventID()
+	}
+	event.CreatedAt = time.Now()
+
+	s.subscriptionEvents[event.SubscriptionID] = append(s.subscriptionEvents[event.SubscriptionID], event)
+	return nil
+}
+
+// GetSubscriptionEvents returns a subscription's events, oldest first
+func (s *MemoryStore) GetSubscriptionEvents(ctx context.Context, subscriptionID string) ([]models.SubscriptionEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]models.SubscriptionEvent{}, s.subscriptionEvents[subscriptionID]...), nil
+}
+
+// CreateDispute records a new dispute
+func (s *MemoryStore) CreateDispute(ctx context.Context, dispute *models.Dispute) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if dispute.ID == "" {
+		return fmt.Errorf("dispute ID cannot be empty")
+	}
+	if _, exists := s.disputes[dispute.ID]; exists {
+		return fmt.Errorf("%w: %s", ErrDisputeExists, dispute.ID)
+	}
+
+	now := time.Now()
+	if dispute.CreatedAt.IsZero() {
+		dispute.CreatedAt = now
+	}
+	dispute.UpdatedAt = now
+
+	stored := *dispute
+	s.disputes[dispute.ID] = &stored
+	return nil
+}
+
+// UpdateDisputeStatus records a dispute's new status, such as won or lost once it closes
+func (s *MemoryStore) UpdateDisputeStatus(ctx context.Context, disputeID, status string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dispute, exists := s.disputes[disputeID]
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrDisputeNotFound, disputeID)
+	}
+	dispute.Status = status
+	dispute.UpdatedAt = time.Now()
+	return nil
+}
+
+// GetDisputes returns the recorded disputes, newest first; openOnly leaves out closed ones
+func (s *MemoryStore) GetDisputes(ctx context.Context, openOnly bool) ([]*models.Dispute, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	disputes := []*models.Dispute{}
+	for _, dispute := range s.disputes {
+		if openOnly && !dispute.Open() {
+			continue
+		}
+		copied := *dispute
+		disputes = append(disputes, &copied)
+	}
+	sort.Slice(disputes, func(i, j int) bool {
+		if !disputes[i].CreatedAt.Equal(disputes[j].CreatedAt) {
+			return disputes[i].CreatedAt.After(disputes[j].CreatedAt)
+		}
+		return disputes[i].ID < disputes[j].ID
+	})
+	return disputes, nil
+}
@@ -0,0 +1,59 @@
+// store/migrate.go
+package store
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/capactiyvirus/stripe-backend/models"
+)
+
+// MigrationResult reports what a migration copied
+type MigrationResult struct {
+	Orders int `json:"orders"`
+	Items  int `json:"items"`
+	Events int `json:"events"`
+}
+
+// MigrateInMemoryToPostgres copies every order, item, payment, and event from the
+// in-memory store into Postgres, keeping IDs and timestamps. Orders are upserted and
+// already-copied events are skipped, so the migration can be re-run safely.
+func MigrateInMemoryToPostgres(ctx context.Context, src *MemoryStore, dst *PostgresStore) (*MigrationResult, error) {
+	orders, events := src.snapshot()
+	result := &MigrationResult{}
+
+	for _, order := range orders {
+		if err := dst.UpsertOrder(ctx, order); err != nil {
+			return result, fmt.Errorf("failed to migrate order %s: %w", order.ID, err)
+		}
+		result.Orders++
+		result.Items += len(order.Items)
+
+		for _, event := range events[order.ID] {
+			if err := dst.UpsertPaymentEvent(ctx, event); err != nil {
+				return result, fmt.Errorf("failed to migrate event %s for order %s: %w", event.ID, order.ID, err)
+			}
+			result.Events++
+		}
+	}
+
+	return result, nil
+}
+
+// snapshot returns copies of all orders and their events
+func (s *MemoryStore) snapshot() ([]*models.Order, map[string][]models.PaymentEvent) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	orders := make([]*models.Order, 0, len(s.orders))
+	for _, order := range s.orders {
+		orders = append(orders, copyOrder(order))
+	}
+
+	events := make(map[string][]models.PaymentEvent, len(s.events))
+	for orderID, orderEvents := range s.events {
+		events[orderID] = append([]models.PaymentEvent(nil), orderEvents...)
+	}
+
+	return orders, events
+}
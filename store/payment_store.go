@@ -2,305 +2,101 @@
 package store
 
 import (
-	"fmt"
-	"sort"
-	"sync"
+	"context"
+	"errors"
 	"time"
 
 	"github.com/capactiyvirus/stripe-backend/models"
 )
 
-// PaymentStore handles storage operations for payments and orders
-type PaymentStore struct {
-	orders        map[string]*models.Order
-	events        map[string][]models.PaymentEvent
-	trackingIDs   map[string]string   // trackingID -> orderID
-	customerIndex map[string][]string // email -> []orderID
-	mu            sync.RWMutex
-}
-
-// NewPaymentStore creates a new payment store
-func NewPaymentStore() *PaymentStore {
-	return &PaymentStore{
-		orders:        make(map[string]*models.Order),
-		events:        make(map[string][]models.PaymentEvent),
-		trackingIDs:   make(map[string]string),
-		customerIndex: make(map[string][]string),
-	}
-}
-
-// CreateOrder creates a new order
-func (s *PaymentStore) CreateOrder(order *models.Order) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	if order.ID == "" {
-		return fmt.Errorf("order ID cannot be empty")
-	}
-
-	// Set timestamps
-	now := time.Now()
-	order.CreatedAt = now
-	order.UpdatedAt = now
-
-	// Store the order
-	s.orders[order.ID] = order
-
-	// Index by tracking ID
-	if order.TrackingID != "" {
-		s.trackingIDs[order.TrackingID] = order.ID
-	}
-
-	// Index by customer email
-	if order.CustomerInfo.Email != "" {
-		s.customerIndex[order.CustomerInfo.Email] = append(
-			s.customerIndex[order.CustomerInfo.Email],
-			order.ID,
-		)
-	}
-
-	return nil
-}
-
-// GetOrder retrieves an order by ID
-func (s *PaymentStore) GetOrder(orderID string) (*models.Order, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	order, exists := s.orders[orderID]
-	if !exists {
-		return nil, fmt.Errorf("order not found: %s", orderID)
-	}
-
-	// Return a copy to prevent external modifications
-	orderCopy := *order
-	return &orderCopy, nil
-}
-
-// GetOrderByTrackingID retrieves an order by tracking ID
-func (s *PaymentStore) GetOrderByTrackingID(trackingID string) (*models.Order, error) {
-	s.mu.RLock()
-	orderID, exists := s.trackingIDs[trackingID]
-	s.mu.RUnlock()
-
-	if !exists {
-		return nil, fmt.Errorf("order not found with tracking ID: %s", trackingID)
-	}
-
-	return s.GetOrder(orderID)
-}
-
-// UpdateOrder updates an existing order
-func (s *PaymentStore) UpdateOrder(order *models.Order) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	if _, exists := s.orders[order.ID]; !exists {
-		return fmt.Errorf("order not found: %s", order.ID)
-	}
-
-	order.UpdatedAt = time.Now()
-	s.orders[order.ID] = order
-
-	return nil
-}
-
-// UpdateOrderStatus updates the status of an order
-func (s *PaymentStore) UpdateOrderStatus(orderID string, status models.OrderStatus) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	order, exists := s.orders[orderID]
-	if !exists {
-		return fmt.Errorf("order not found: %s", orderID)
-	}
-
-	order.Status = status
-	order.UpdatedAt = time.Now()
-
-	// Set fulfilled timestamp if order is fulfilled
-	if status == models.OrderStatusFulfilled && order.FulfilledAt == nil {
-		now := time.Now()
-		order.FulfilledAt = &now
-	}
-
-	return nil
-}
-
-// UpdatePaymentStatus updates the payment status of an order
-func (s *PaymentStore) UpdatePaymentStatus(orderID string, status models.PaymentStatus) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	order, exists := s.orders[orderID]
-	if !exists {
-		return fmt.Errorf("order not found: %s", orderID)
-	}
-
-	order.Payment.Status = status
-	order.UpdatedAt = time.Now()
-
-	// Update processed timestamp
-	if status == models.PaymentStatusSucceeded && order.Payment.ProcessedAt == nil {
-		now := time.Now()
-		order.Payment.ProcessedAt = &now
-		// Also update order status to paid
-		order.Status = models.OrderStatusPaid
-	}
+// ErrOrderExists is returned when creating an order whose ID is already taken
+var ErrOrderExists = errors.New("order already exists")
 
-	return nil
-}
-
-// GetCustomerOrders retrieves all orders for a customer by email
-func (s *PaymentStore) GetCustomerOrders(email string) ([]*models.Order, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	orderIDs, exists := s.customerIndex[email]
-	if !exists {
-		return []*models.Order{}, nil
-	}
-
-	orders := make([]*models.Order, 0, len(orderIDs))
-	for _, orderID := range orderIDs {
-		if order, exists := s.orders[orderID]; exists {
-			orderCopy := *order
-			orders = append(orders, &orderCopy)
-		}
-	}
-
-	// Sort by creation date (newest first)
-	sort.Slice(orders, func(i, j int) bool {
-		return orders[i].CreatedAt.After(orders[j].CreatedAt)
-	})
-
-	return orders, nil
-}
-
-// GetAllOrders retrieves all orders with optional pagination
-func (s *PaymentStore) GetAllOrders(limit, offset int) ([]*models.OrderSummary, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	// Convert to slice for sorting
-	orderList := make([]*models.Order, 0, len(s.orders))
-	for _, order := range s.orders {
-		orderList = append(orderList, order)
-	}
-
-	// Sort by creation date (newest first)
-	sort.Slice(orderList, func(i, j int) bool {
-		return orderList[i].CreatedAt.After(orderList[j].CreatedAt)
-	})
-
-	// Apply pagination
-	start := offset
-	if start > len(orderList) {
-		start = len(orderList)
-	}
-
-	end := start + limit
-	if end > len(orderList) {
-		end = len(orderList)
-	}
-
-	// Convert to summaries
-	summaries := make([]*models.OrderSummary, 0, end-start)
-	for i := start; i < end; i++ {
-		order := orderList[i]
-		totalAmount := float64(order.Payment.Amount) / 100 // Convert from cents
-
-		summary := &models.OrderSummary{
-			ID:            order.ID,
-			TrackingID:    order.TrackingID,
-			CustomerEmail: order.CustomerInfo.Email,
-			TotalAmount:   totalAmount,
-			Status:        order.Status,
-			ItemCount:     len(order.Items),
-			CreatedAt:     order.CreatedAt,
-		}
-		summaries = append(summaries, summary)
-	}
-
-	return summaries, nil
-}
+var (
+	// ErrCouponExists is returned when creating a coupon whose code is already taken
+	ErrCouponExists = errors.New("coupon already exists")
+	// ErrCouponNotFound is returned for a coupon code that doesn't exist
+	ErrCouponNotFound = errors.New("coupon not found")
+)
 
-// AddPaymentEvent adds a payment event
-func (s *PaymentStore) AddPaymentEvent(event models.PaymentEvent) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// ErrSubscriptionNotFound is returned for a Stripe subscription ID that isn't tracked
+var ErrSubscriptionNotFound = errors.New("subscription not found")
 
-	if event.ID == "" {
-		event.ID = fmt.Sprintf("evt_%d", time.Now().UnixNano())
-	}
-	event.CreatedAt = time.Now()
+var (
+	// ErrDisputeExists is returned when creating a dispute whose Stripe ID is already recorded
+	ErrDisputeExists = errors.New("dispute already exists")
+	// ErrDisputeNotFound is returned for a Stripe dispute ID that isn't recorded
+	ErrDisputeNotFound = errors.New("dispute not found")
+)
 
-	s.events[event.OrderID] = append(s.events[event.OrderID], event)
-	return nil
+// IdempotentResponse is a stored response replayed for a repeated Idempotency-Key
+type IdempotentResponse struct {
+	StatusCode  int
+	ContentType string
+	Body        []byte
+	BodyHash    string // hex SHA-256 of the request body the response was for
 }
 
-// GetPaymentEvents retrieves payment events for an order
-func (s *PaymentStore) GetPaymentEvents(orderID string) ([]models.PaymentEvent, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	events, exists := s.events[orderID]
-	if !exists {
-		return []models.PaymentEvent{}, nil
-	}
-
-	// Return a copy
-	eventsCopy := make([]models.PaymentEvent, len(events))
-	copy(eventsCopy, events)
-
-	return eventsCopy, nil
+// PaymentStore handles storage operations for payments and orders.
+// MemoryStore and PostgresStore are interchangeable implementations. PostgresStore abandons a query
+// when its ctx is done; MemoryStore never blocks, so it ignores ctx.
+type PaymentStore interface {
+	CreateOrder(ctx context.Context, order *models.Order) error
+	GetOrder(ctx context.Context, orderID string) (*models.Order, error)
+	GetOrderByTrackingID(ctx context.Context, trackingID string) (*models.Order, error)
+	UpdateOrder(ctx context.Context, order *models.Order) error
+	UpdateOrderStatus(ctx context.Context, orderID string, status models.OrderStatus) error
+	MarkOrderFulfilled(ctx context.Context, orderID string) (fulfilledAt time.Time, alreadyFulfilled bool, err error)
+	ArchiveOrder(ctx context.Context, orderID string) (archivedAt time.Time, alreadyArchived bool, err error)
+	MarkOrderDisputed(ctx context.Context, orderID string) error
+	UpdatePaymentStatus(ctx context.Context, orderID string, status models.PaymentStatus) error
+	UpdatePaymentFees(ctx context.Context, orderID string, fee, net int64) error
+	UpdatePaymentMethod(ctx context.Context, orderID string, method models.PaymentMethod) error
+	UpdatePaymentCharges(ctx context.Context, orderID string, chargeIDs []string, amountCaptured int64) error
+	UpdateSavedPaymentMethod(ctx context.Context, orderID, customerID, paymentMethodID string) error
+	SetItemDownloadURL(ctx context.Context, orderID, productID, url string) error
+	UpdatePaymentRefund(ctx context.Context, orderID, refundID string, amountRefunded int64) error
+	GetCustomerOrders(ctx context.Context, email string) ([]*models.Order, error)
+	GetCustomerOrderSummaries(ctx context.Context, email string, limit, offset int) ([]*models.OrderSummary, error)
+	CountCustomerOrders(ctx context.Context, email string) (int, error)
+	GetAllOrders(ctx context.Context, limit, offset int, filter models.OrderFilter) ([]*models.OrderSummary, error)
+	CountOrders(ctx context.Context, filter models.OrderFilter) (int, error)
+	EachOrder(ctx context.Context, filter models.OrderFilter, fn func(order *models.Order) error) error
+	SearchOrders(ctx context.Context, query string, limit int) ([]*models.OrderSummary, error)
+	AddPaymentEvent(ctx context.Context, event models.PaymentEvent) error
+	GetPaymentEvents(ctx context.Context, orderID string) ([]models.PaymentEvent, error)
+	AddOrderNote(ctx context.Context, note *models.OrderNote) error
+	GetOrderNotes(ctx context.Context, orderID string) ([]models.OrderNote, error)
+	GetPaymentStats(ctx context.Context) (*models.PaymentStats, error)
+	GetPaymentStatsRange(ctx context.Context, from, to time.Time, includeArchived bool, currency string) (*models.PaymentStats, error)
+	GetRevenueByDay(ctx context.Context, from, to time.Time, currency string, includeArchived bool) ([]models.DailyRevenue, error)
+	FindOrderByPaymentIntentID(ctx context.Context, paymentIntentID string) (string, error)
+	FindOrderBySessionID(ctx context.Context, sessionID string) (string, error)
+	MarkEventProcessed(ctx context.Context, eventID string) (alreadyProcessed bool, err error)
+	UnmarkEventProcessed(ctx context.Context, eventID string) error
+	SaveWebhookEvent(ctx context.Context, event models.WebhookEvent, retention time.Duration) error
+	GetWebhookEvent(ctx context.Context, eventID string) (*models.WebhookEvent, error)
+	GetIdempotentResponse(ctx context.Context, key string) (*IdempotentResponse, error)
+	SaveIdempotentResponse(ctx context.Context, key string, response IdempotentResponse, ttl time.Duration) error
+	ClaimOrderIdempotencyKey(ctx context.Context, key, orderID string, ttl time.Duration) (existingOrderID string, err error)
+	ReleaseOrderIdempotencyKey(ctx context.Context, key, orderID string) error
+	GetStripeCustomerID(ctx context.Context, email string) (string, error)
+	SaveStripeCustomerID(ctx context.Context, email, customerID string) error
+	CreateCoupon(ctx context.Context, coupon *models.Coupon) error
+	ValidateCoupon(ctx context.Context, code string, subtotal int64, currency string) (discount int64, err error)
+	ReleaseCoupon(ctx context.Context, code string) error
+	SaveSubscription(ctx context.Context, subscription *models.Subscription) error
+	GetSubscription(ctx context.Context, subscriptionID string) (*models.Subscription, error)
+	GetCustomerSubscriptions(ctx context.Context, email string) ([]*models.Subscription, error)
+	AddSubscriptionEvent(ctx context.Context, event models.SubscriptionEvent) error
+	GetSubscriptionEvents(ctx context.Context, subscriptionID string) ([]models.SubscriptionEvent, error)
+	CreateDispute(ctx context.Context, dispute *models.Dispute) error
+	UpdateDisputeStatus(ctx context.Context, disputeID, status string) error
+	GetDisputes(ctx context.Context, openOnly bool) ([]*models.Dispute, error)
+	Ping(ctx context.Context) error
 }
 
-// GetPaymentStats calculates payment statistics
-func (s *PaymentStore) GetPaymentStats() (*models.PaymentStats, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	stats := &models.PaymentStats{}
-
-	now := time.Now()
-	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
-	thisMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
-
-	var totalRevenue float64
-	var revenueToday float64
-	var revenueThisMonth float64
-
-	for _, order := range s.orders {
-		stats.TotalOrders++
-
-		orderAmount := float64(order.Payment.Amount) / 100
-
-		switch order.Status {
-		case models.OrderStatusPending:
-			stats.PendingOrders++
-		case models.OrderStatusPaid, models.OrderStatusFulfilled:
-			stats.CompletedOrders++
-			totalRevenue += orderAmount
-
-			if order.CreatedAt.After(today) {
-				revenueToday += orderAmount
-			}
-			if order.CreatedAt.After(thisMonth) {
-				revenueThisMonth += orderAmount
-			}
-		case models.OrderStatusRefunded:
-			stats.RefundedOrders++
-		}
-	}
-
-	stats.TotalRevenue = totalRevenue
-	stats.RevenueToday = revenueToday
-	stats.RevenueThisMonth = revenueThisMonth
-
-	if stats.CompletedOrders > 0 {
-		stats.AverageOrderValue = totalRevenue / float64(stats.CompletedOrders)
-	}
-
-	return stats, nil
-}
+var (
+	_ PaymentStore = (*MemoryStore)(nil)
+	_ PaymentStore = (*PostgresStore)(nil)
+)
@@ -0,0 +1,1459 @@
+// store/postgres_store.go
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/capactiyvirus/stripe-backend/models"
+	"github.com/lib/pq"
+)
+
+// PostgresStore handles storage operations for payments and orders in PostgreSQL.
+// It expects the schema from db/init.
+type PostgresStore struct {
+	db *sql.DB
+}
+
+// NewPostgresStore connects to the database at databaseURL
+func NewPostgresStore(databaseURL string) (*PostgresStore, error) {
+	db, err := sql.Open("postgres", databaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+
+	return &PostgresStore{db: db}, nil
+}
+
+// Close closes the database connection pool
+func (s *PostgresStore) Close() error {
+	return s.db.Close()
+}
+
+// Ping checks that the database is reachable
+func (s *PostgresStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// orderColumns selects an order joined with its payment, in the order scanOrder expects
+const orderColumns = `
+	o.id, o.tracking_id, o.customer_email,
+	COALESCE(o.customer_name, ''), COALESCE(o.customer_phone, ''), COALESCE(host(o.customer_ip_address), ''),
+	o.customer_tax_exempt, COALESCE(o.customer_tax_exemption_id, ''),
+	COALESCE(o.stripe_customer_id, ''), COALESCE(o.saved_payment_method_id, ''), COALESCE(o.coupon_code, ''),
+	o.status, COALESCE(o.metadata, '{}'), o.created_at, o.updated_at, o.fulfilled_at, o.archived_at, o.disputed,
+	COALESCE(p.stripe_payment_intent_id, ''), COALESCE(p.stripe_session_id, ''),
+	COALESCE(p.amount, 0), COALESCE(p.currency, 'usd'), COALESCE(p.status::text, 'pending'), COALESCE(p.method::text, ''),
+	COALESCE(p.stripe_fee, 0), COALESCE(p.net_amount, 0), COALESCE(p.amount_captured, 0), COALESCE(p.charge_ids, '{}'),
+	COALESCE(p.stripe_refund_id, ''), COALESCE(p.amount_refunded, 0), p.processed_at, p.refunded_at,
+	COALESCE(p.discount_amount, 0)
+FROM orders o
+LEFT JOIN payments p ON p.order_id = o.id`
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanOrder scans a row selected with orderColumns; items are loaded separately
+func scanOrder(row rowScanner) (*models.Order, error) {
+	var order models.Order
+	var metadata []byte
+	var chargeIDs pq.StringArray
+	var fulfilledAt, archivedAt, processedAt, refundedAt sql.NullTime
+
+	err := row.Scan(
+		&order.ID, &order.TrackingID, &order.CustomerInfo.Email,
+		&order.CustomerInfo.Name, &order.CustomerInfo.Phone, &order.CustomerInfo.IPAddress,
+		&order.CustomerInfo.TaxExempt, &order.CustomerInfo.TaxExemptionID,
+		&order.CustomerInfo.StripeCustomerID, &order.CustomerInfo.SavedPaymentMethodID, &order.CouponCode,
+		&order.Status, &metadata, &order.CreatedAt, &order.UpdatedAt, &fulfilledAt, &archivedAt, &order.Disputed,
+		&order.Payment.StripePaymentIntentID, &order.Payment.StripeSessionID,
+		&order.Payment.Amount, &order.Payment.Currency, &order.Payment.Status, &order.Payment.Method,
+		&order.Payment.StripeFee, &order.Payment.NetAmount, &order.Payment.AmountCaptured, &chargeIDs,
+		&order.Payment.StripeRefundID, &order.Payment.AmountRefunded, &processedAt, &refundedAt,
+		&order.Payment.DiscountAmount,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(metadata, &order.Metadata); err != nil {
+		return nil, fmt.Errorf("invalid metadata for order %s: %w", order.ID, err)
+	}
+	if len(order.Metadata) == 0 {
+		order.Metadata = nil
+	}
+	if len(chargeIDs) > 0 {
+		order.Payment.ChargeIDs = chargeIDs
+	}
+	order.FulfilledAt = nullTimePtr(fulfilledAt)
+	order.ArchivedAt = nullTimePtr(archivedAt)
+	order.Payment.ProcessedAt = nullTimePtr(processedAt)
+	order.Payment.RefundedAt = nullTimePtr(refundedAt)
+
+	return &order, nil
+}
+
+// nullTimePtr converts a nullable timestamp to the pointer form used by the models
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// loadItems fills in the items for the given orders
+func (s *PostgresStore) loadItems(ctx context.Context, orders ...*models.Order) error {
+	if len(orders) == 0 {
+		return nil
+	}
+
+	byID := make(map[string]*models.Order, len(orders))
+	ids := make([]string, len(orders))
+	for i, order := range orders {
+		byID[order.ID] = order
+		ids[i] = order.ID
+		order.Items = []models.OrderItem{}
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT order_id, product_id, product_name, file_type, price, quantity,
+			COALESCE(image_url, ''), COALESCE(download_url, '')
+		FROM order_items
+		WHERE order_id = ANY($1)
+		ORDER BY order_id, position`, pq.Array(ids))
+	if err != nil {
+		return fmt.Errorf("failed to load order items: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var orderID string
+		var item models.OrderItem
+		if err := rows.Scan(&orderID, &item.ProductID, &item.ProductName, &item.FileType, &item.Price,
+			&item.Quantity, &item.ImageURL, &item.DownloadURL); err != nil {
+			return fmt.Errorf("failed to scan order item: %w", err)
+		}
+		byID[orderID].Items = append(byID[orderID].Items, item)
+	}
+
+	return rows.Err()
+}
+
+// queryOrders runs an orderColumns query and loads the items for every order found
+func (s *PostgresStore) queryOrders(ctx context.Context, query string, args ...interface{}) ([]*models.Order, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query orders: %w", err)
+	}
+	defer rows.Close()
+
+	orders := []*models.Order{}
+	for rows.Next() {
+		order, err := scanOrder(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan order: %w", err)
+		}
+		orders = append(orders, order)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := s.loadItems(ctx, orders...); err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
+
+// writeOrder inserts or replaces an order, its payment, and its items.
+// With upsert false, an existing order ID fails with ErrOrderExists.
+func writeOrder(ctx context.Context, tx *sql.Tx, order *models.Order, upsert bool) error {
+	metadata, err := json.Marshal(order.Metadata)
+	if err != nil {
+		return fmt.Errorf("invalid metadata: %w", err)
+	}
+	if order.Metadata == nil {
+		metadata = []byte("{}")
+	}
+
+	orderQuery := `
+		INSERT INTO orders (id, tracking_id, customer_email, customer_name, customer_phone, customer_ip_address,
+			customer_tax_exempt, customer_tax_exemption_id, stripe_customer_id, saved_payment_method_id,
+			status, metadata, created_at, updated_at, fulfilled_at, coupon_code, archived_at, disputed)
+		VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, ''), NULLIF($6, '')::inet, $7, NULLIF($8, ''),
+			NULLIF($9, ''), NULLIF($10, ''), $11, $12, $13, $14, $15, NULLIF($16, ''), $17, $18)`
+	if upsert {
+		orderQuery += `
+		ON CONFLICT (id) DO UPDATE SET
+			tracking_id = EXCLUDED.tracking_id,
+			customer_email = EXCLUDED.customer_email,
+			customer_name = EXCLUDED.customer_name,
+			customer_phone = EXCLUDED.customer_phone,
+			customer_ip_address = EXCLUDED.customer_ip_address,
+			customer_tax_exempt = EXCLUDED.customer_tax_exempt,
+			customer_tax_exemption_id = EXCLUDED.customer_tax_exemption_id,
+			stripe_customer_id = EXCLUDED.stripe_customer_id,
+			saved_payment_method_id = EXCLUDED.saved_payment_method_id,
+			status = EXCLUDED.status,
+			metadata = EXCLUDED.metadata,
+			created_at = EXCLUDED.created_at,
+			updated_at = EXCLUDED.updated_at,
+			fulfilled_at = EXCLUDED.fulfilled_at,
+			coupon_code = EXCLUDED.coupon_code,
+			archived_at = EXCLUDED.archived_at,
+			disputed = EXCLUDED.disputed`
+	}
+
+	_, err = tx.ExecContext(ctx, orderQuery,
+		order.ID, order.TrackingID, order.CustomerInfo.Email,
+		order.CustomerInfo.Name, order.CustomerInfo.Phone, order.CustomerInfo.IPAddress,
+		order.CustomerInfo.TaxExempt, order.CustomerInfo.TaxExemptionID,
+		order.CustomerInfo.StripeCustomerID, order.CustomerInfo.SavedPaymentMethodID,
+		string(order.Status), string(metadata), order.CreatedAt, order.UpdatedAt, order.FulfilledAt,
+		order.CouponCode, order.ArchivedAt, order.Disputed,
+	)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == "orders_pkey" {
+			return fmt.Errorf("%w: %s", ErrOrderExists, order.ID)
+		}
+		return fmt.Errorf("failed to write order: %w", err)
+	}
+
+	if err := writePayment(ctx, tx, order); err != nil {
+		return err
+	}
+	return writeItems(ctx, tx, order)
+}
+
+// writePayment inserts or replaces the payment row for an order
+func writePayment(ctx context.Context, tx *sql.Tx, order *models.Order) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO payments (order_id, stripe_payment_intent_id, stripe_session_id, amount, currency, status, method,
+			stripe_fee, net_amount, amount_captured, charge_ids, stripe_refund_id, amount_refunded,
+			processed_at, refunded_at, created_at, updated_at, discount_amount)
+		VALUES ($1, NULLIF($2, ''), NULLIF($3, ''), $4, $5, $6, NULLIF($7, '')::payment_method,
+			$8, $9, $10, COALESCE($11::text[], '{}'), NULLIF($12, ''), $13, $14, $15, $16, $17, $18)
+		ON CONFLICT (order_id) DO UPDATE SET
+			stripe_payment_intent_id = EXCLUDED.stripe_payment_intent_id,
+			stripe_session_id = EXCLUDED.stripe_session_id,
+			amount = EXCLUDED.amount,
+			currency = EXCLUDED.currency,
+			status = EXCLUDED.status,
+			method = EXCLUDED.method,
+			stripe_fee = EXCLUDED.stripe_fee,
+			net_amount = EXCLUDED.net_amount,
+			amount_captured = EXCLUDED.amount_captured,
+			charge_ids = EXCLUDED.charge_ids,
+			stripe_refund_id = EXCLUDED.stripe_refund_id,
+			amount_refunded = EXCLUDED.amount_refunded,
+			processed_at = EXCLUDED.processed_at,
+			refunded_at = EXCLUDED.refunded_at,
+			updated_at = EXCLUDED.updated_at,
+			discount_amount = EXCLUDED.discount_amount`,
+		order.ID, order.Payment.StripePaymentIntentID, order.Payment.StripeSessionID,
+		order.Payment.Amount, order.Payment.Currency, string(order.Payment.Status), string(order.Payment.Method),
+		order.Payment.StripeFee, order.Payment.NetAmount, order.Payment.AmountCaptured, pq.Array(order.Payment.ChargeIDs),
+		order.Payment.StripeRefundID, order.Payment.AmountRefunded, order.Payment.ProcessedAt, order.Payment.RefundedAt, order.CreatedAt, order.UpdatedAt,
+		order.Payment.DiscountAmount,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to write payment: %w", err)
+	}
+	return nil
+}
+
+// writeItems replaces the items for an order
+func writeItems(ctx context.Context, tx *sql.Tx, order *models.Order) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM order_items WHERE order_id = $1`, order.ID); err != nil {
+		return fmt.Errorf("failed to clear order items: %w", err)
+	}
+
+	for i, item := range order.Items {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO order_items (order_id, position, product_id, product_name, file_type, price, quantity,
+				image_url, download_url, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''), NULLIF($9, ''), $10)`,
+			order.ID, i, item.ProductID, item.ProductName, item.FileType, item.Price, item.Quantity,
+			item.ImageURL, item.DownloadURL, order.CreatedAt,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to write order item: %w", err)
+		}
+	}
+	return nil
+}
+
+// inTx runs fn in a transaction, committing if it succeeds
+func (s *PostgresStore) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// CreateOrder creates a new order
+func (s *PostgresStore) CreateOrder(ctx context.Context, order *models.Order) error {
+	if order.ID == "" {
+		return fmt.Errorf("order ID cannot be empty")
+	}
+
+	// Set timestamps
+	now := time.Now()
+	order.CreatedAt = now
+	order.UpdatedAt = now
+
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		return writeOrder(ctx, tx, order, false)
+	})
+}
+
+// UpsertOrder creates or replaces an order, keeping its ID and timestamps as given.
+// Running it repeatedly with the same order leaves the database unchanged.
+func (s *PostgresStore) UpsertOrder(ctx context.Context, order *models.Order) error {
+	if order.ID == "" {
+		return fmt.Errorf("order ID cannot be empty")
+	}
+	if order.CreatedAt.IsZero() {
+		order.CreatedAt = time.Now()
+	}
+	if order.UpdatedAt.IsZero() {
+		order.UpdatedAt = order.CreatedAt
+	}
+
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		// Stop the updated_at triggers from overwriting the timestamps being copied
+		if _, err := tx.ExecContext(ctx, `SET LOCAL app.preserve_timestamps = 'on'`); err != nil {
+			return fmt.Errorf("failed to preserve timestamps: %w", err)
+		}
+		return writeOrder(ctx, tx, order, true)
+	})
+}
+
+// GetOrder retrieves an order by ID
+func (s *PostgresStore) GetOrder(ctx context.Context, orderID string) (*models.Order, error) {
+	orders, err := s.queryOrders(ctx, `SELECT `+orderColumns+` WHERE o.id = $1`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if len(orders) == 0 {
+		return nil, fmt.Errorf("order not found: %s", orderID)
+	}
+	return orders[0], nil
+}
+
+// GetOrderByTrackingID retrieves an order by tracking ID
+func (s *PostgresStore) GetOrderByTrackingID(ctx context.Context, trackingID string) (*models.Order, error) {
+	orders, err := s.queryOrders(ctx, `SELECT `+orderColumns+` WHERE o.tracking_id = $1`, trackingID)
+	if err != nil {
+		return nil, err
+	}
+	if len(orders) == 0 {
+		return nil, fmt.Errorf("order not found with tracking ID: %s", trackingID)
+	}
+	return orders[0], nil
+}
+
+// FindOrderByPaymentIntentID returns the ID of the order paid with a Stripe payment intent
+func (s *PostgresStore) FindOrderByPaymentIntentID(ctx context.Context, paymentIntentID string) (string, error) {
+	return s.findOrderID(ctx, `SELECT order_id FROM payments WHERE stripe_payment_intent_id = $1 LIMIT 1`,
+		paymentIntentID, "order not found for payment intent: %s")
+}
+
+// FindOrderBySessionID returns the ID of the order paid through a Stripe checkout session
+func (s *PostgresStore) FindOrderBySessionID(ctx context.Context, sessionID string) (string, error) {
+	return s.findOrderID(ctx, `SELECT order_id FROM payments WHERE stripe_session_id = $1 LIMIT 1`,
+		sessionID, "order not found for checkout session: %s")
+}
+
+// findOrderID runs a query selecting a single order ID, formatting notFound with id when there's no match
+func (s *PostgresStore) findOrderID(ctx context.Context, query, id, notFound string) (string, error) {
+	var orderID string
+	err := s.db.QueryRowContext(ctx, query, id).Scan(&orderID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf(notFound, id)
+	}
+	if err != nil {
+		return "", err
+	}
+	return orderID, nil
+}
+
+// UpdateOrder updates an existing order
+func (s *PostgresStore) UpdateOrder(ctx context.Context, order *models.Order) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		if err := lockOrder(ctx, tx, order.ID); err != nil {
+			return err
+		}
+		order.UpdatedAt = time.Now()
+		return writeOrder(ctx, tx, order, true)
+	})
+}
+
+// paymentStatuses is an order's status and payment status as read by lockPaymentStatuses
+type paymentStatuses struct {
+	order     models.OrderStatus
+	payment   models.PaymentStatus
+	processed bool
+}
+
+// lockPaymentStatuses locks an order row for the rest of the transaction and reads its current statuses
+func lockPaymentStatuses(ctx context.Context, tx *sql.Tx, orderID string) (*paymentStatuses, error) {
+	var current paymentStatuses
+	err := tx.QueryRowContext(ctx, `
+		SELECT o.status, p.status, p.processed_at IS NOT NULL
+		FROM orders o
+		JOIN payments p ON p.order_id = o.id
+		WHERE o.id = $1
+		FOR UPDATE OF o`, orderID).Scan(&current.order, &current.payment, &current.processed)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("order not found: %s", orderID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock order: %w", err)
+	}
+	return &current, nil
+}
+
+// lockOrder locks an order row for the rest of the transaction, failing if it doesn't exist
+func lockOrder(ctx context.Context, tx *sql.Tx, orderID string) error {
+	var id string
+	err := tx.QueryRowContext(ctx, `SELECT id FROM orders WHERE id = $1 FOR UPDATE`, orderID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("order not found: %s", orderID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to lock order: %w", err)
+	}
+	return nil
+}
+
+// UpdateOrderStatus updates the status of an order, rejecting transitions models.CanTransition doesn't allow
+func (s *PostgresStore) UpdateOrderStatus(ctx context.Context, orderID string, status models.OrderStatus) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		current, err := lockPaymentStatuses(ctx, tx, orderID)
+		if err != nil {
+			return err
+		}
+		if err := models.CheckTransition(current.order, status); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		_, err = tx.ExecContext(ctx, `
+			UPDATE orders SET
+				status = $2::order_status,
+				updated_at = $3,
+				fulfilled_at = CASE WHEN $2::order_status = 'fulfilled' AND fulfilled_at IS NULL THEN $3 ELSE fulfilled_at END
+			WHERE id = $1`, orderID, string(status), now)
+		if err != nil {
+			return fmt.Errorf("failed to update order status: %w", err)
+		}
+
+		if current.order == status {
+			return nil
+		}
+		// A canceled order will never be paid, so its coupon use goes back
+		if status == models.OrderStatusCanceled {
+			_, err := tx.ExecContext(ctx, `
+				UPDATE coupons SET uses = uses - 1
+				WHERE code = (SELECT coupon_code FROM orders WHERE id = $1) AND uses > 0`, orderID)
+			if err != nil {
+				return fmt.Errorf("failed to release coupon: %w", err)
+			}
+		}
+		return insertPaymentEvent(ctx, tx, statusChangedEvent(orderID, "order_status", string(current.order), string(status), current.payment), false)
+	})
+}
+
+// MarkOrderFulfilled moves a paid order to fulfilled and returns its fulfillment time. An order that's
+// already fulfilled is left alone and its original fulfillment time returned with alreadyFulfilled set;
+// the row lock keeps concurrent callers from both fulfilling it.
+func (s *PostgresStore) MarkOrderFulfilled(ctx context.Context, orderID string) (time.Time, bool, error) {
+	var fulfilledAt time.Time
+	alreadyFulfilled := false
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		current, err := lockPaymentStatuses(ctx, tx, orderID)
+		if err != nil {
+			return err
+		}
+		if current.order == models.OrderStatusFulfilled {
+			var existing sql.NullTime
+			if err := tx.QueryRowContext(ctx, `SELECT fulfilled_at FROM orders WHERE id = $1`, orderID).Scan(&existing); err != nil {
+				return fmt.Errorf("failed to read fulfillment time: %w", err)
+			}
+			fulfilledAt = existing.Time
+			alreadyFulfilled = true
+			return nil
+		}
+		if err := models.CheckTransition(current.order, models.OrderStatusFulfilled); err != nil {
+			return err
+		}
+
+		fulfilledAt = time.Now()
+		_, err = tx.ExecContext(ctx, `UPDATE orders SET status = 'fulfilled', updated_at = $2, fulfilled_at = $2 WHERE id = $1`, orderID, fulfilledAt)
+		if err != nil {
+			return fmt.Errorf("failed to fulfill order: %w", err)
+		}
+		return insertPaymentEvent(ctx, tx, statusChangedEvent(orderID, "order_status", string(current.order), string(models.OrderStatusFulfilled), current.payment), false)
+	})
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return fulfilledAt, alreadyFulfilled, nil
+}
+
+// ArchiveOrder archives an order so listings and stats leave it out, returning when it was archived.
+// An order that's already archived keeps its original archive time, returned with alreadyArchived set.
+func (s *PostgresStore) ArchiveOrder(ctx context.Context, orderID string) (time.Time, bool, error) {
+	var archivedAt time.Time
+	var alreadyArchived bool
+	err := s.db.QueryRowContext(ctx, `
+		UPDATE orders o SET
+			archived_at = COALESCE(o.archived_at, $2),
+			updated_at = CASE WHEN o.archived_at IS NULL THEN $2 ELSE o.updated_at END
+		FROM (SELECT id, archived_at FROM orders WHERE id = $1 FOR UPDATE) previous
+		WHERE o.id = previous.id
+		RETURNING o.archived_at, previous.archived_at IS NOT NULL`, orderID, time.Now()).Scan(&archivedAt, &alreadyArchived)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, false, fmt.Errorf("order not found: %s", orderID)
+	}
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("failed to archive order: %w", err)
+	}
+	return archivedAt, alreadyArchived, nil
+}
+
+// MarkOrderDisputed flags an order as having a chargeback against its payment
+func (s *PostgresStore) MarkOrderDisputed(ctx context.Context, orderID string) error {
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE orders SET
+			disputed = true,
+			updated_at = CASE WHEN disputed THEN updated_at ELSE $2 END
+		WHERE id = $1`, orderID, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to mark order disputed: %w", err)
+	}
+	return requireRow(result, orderID)
+}
+
+// UpdatePaymentStatus updates the payment status of an order
+func (s *PostgresStore) UpdatePaymentStatus(ctx context.Context, orderID string, status models.PaymentStatus) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		current, err := lockPaymentStatuses(ctx, tx, orderID)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		if _, err := tx.ExecContext(ctx, `UPDATE payments SET status = $2, updated_at = $3 WHERE order_id = $1`, orderID, string(status), now); err != nil {
+			return fmt.Errorf("failed to update payment status: %w", err)
+		}
+		if current.payment != status {
+			if err := insertPaymentEvent(ctx, tx, statusChangedEvent(orderID, "payment_status", string(current.payment), string(status), status), false); err != nil {
+				return err
+			}
+		}
+
+		// Update processed timestamp, and mark the order paid the first time payment succeeds
+		if status == models.PaymentStatusSucceeded && !current.processed {
+			if _, err := tx.ExecContext(ctx, `UPDATE payments SET processed_at = $2 WHERE order_id = $1`, orderID, now); err != nil {
+				return fmt.Errorf("failed to update processed timestamp: %w", err)
+			}
+			// Orders already fulfilled, canceled, or refunded keep their status
+			if current.order != models.OrderStatusPaid && models.CanTransition(current.order, models.OrderStatusPaid) {
+				if _, err := tx.ExecContext(ctx, `UPDATE orders SET status = 'paid', updated_at = $2 WHERE id = $1`, orderID, now); err != nil {
+					return fmt.Errorf("failed to update order status: %w", err)
+				}
+				return insertPaymentEvent(ctx, tx, statusChangedEvent(orderID, "order_status", string(current.order), string(models.OrderStatusPaid), status), false)
+			}
+		}
+
+		return touchOrder(ctx, tx, orderID, now)
+	})
+}
+
+// UpdatePaymentFees records the Stripe processing fee and net amount for an order
+func (s *PostgresStore) UpdatePaymentFees(ctx context.Context, orderID string, fee, net int64) error {
+	return s.updatePayment(ctx, orderID, `UPDATE payments SET stripe_fee = $2, net_amount = $3, updated_at = $4 WHERE order_id = $1`, fee, net)
+}
+
+// UpdatePaymentMethod records how an order was paid
+func (s *PostgresStore) UpdatePaymentMethod(ctx context.Context, orderID string, method models.PaymentMethod) error {
+	return s.updatePayment(ctx, orderID, `UPDATE payments SET method = $2, updated_at = $3 WHERE order_id = $1`, string(method))
+}
+
+// UpdatePaymentCharges records the Stripe charges captured against an order's payment intent
+func (s *PostgresStore) UpdatePaymentCharges(ctx context.Context, orderID string, chargeIDs []string, amountCaptured int64) error {
+	return s.updatePayment(ctx, orderID, `UPDATE payments SET charge_ids = COALESCE($2::text[], '{}'), amount_captured = $3, updated_at = $4 WHERE order_id = $1`,
+		pq.Array(chargeIDs), amountCaptured)
+}
+
+// UpdatePaymentRefund records a Stripe refund issued for an order's payment and the total refunded so far
+func (s *PostgresStore) UpdatePaymentRefund(ctx context.Context, orderID, refundID string, amountRefunded int64) error {
+	return s.updatePayment(ctx, orderID, `
+		UPDATE payments SET stripe_refund_id = NULLIF($2, ''), amount_refunded = $3, refunded_at = $4, updated_at = $4
+		WHERE order_id = $1`, refundID, amountRefunded)
+}
+
+// UpdateSavedPaymentMethod records the Stripe customer and payment method saved for off-session charges
+func (s *PostgresStore) UpdateSavedPaymentMethod(ctx context.Context, orderID, customerID, paymentMethodID string) error {
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE orders SET stripe_customer_id = NULLIF($2, ''), saved_payment_method_id = NULLIF($3, ''), updated_at = $4
+		WHERE id = $1`, orderID, customerID, paymentMethodID, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to update saved payment method: %w", err)
+	}
+	return requireRow(result, orderID)
+}
+
+// SetItemDownloadURL sets the download URL of an order's items for a product
+func (s *PostgresStore) SetItemDownloadURL(ctx context.Context, orderID, productID, url string) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, `UPDATE order_items SET download_url = NULLIF($3, '') WHERE order_id = $1 AND product_id = $2`,
+			orderID, productID, url)
+		if err != nil {
+			return fmt.Errorf("failed to update item download URL: %w", err)
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if affected == 0 {
+			return fmt.Errorf("order %s has no item for product %s", orderID, productID)
+		}
+		return touchOrder(ctx, tx, orderID, time.Now())
+	})
+}
+
+// updatePayment runs an update against an order's payment row and bumps the order's updated_at.
+// The query takes the order ID as $1, args as $2.., and the update time last.
+func (s *PostgresStore) updatePayment(ctx context.Context, orderID, query string, args ...interface{}) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		now := time.Now()
+		params := append(append([]interface{}{orderID}, args...), now)
+
+		result, err := tx.ExecContext(ctx, query, params...)
+		if err != nil {
+			return fmt.Errorf("failed to update payment: %w", err)
+		}
+		if err := requireRow(result, orderID); err != nil {
+			return err
+		}
+		return touchOrder(ctx, tx, orderID, now)
+	})
+}
+
+// touchOrder sets an order's updated_at
+func touchOrder(ctx context.Context, tx *sql.Tx, orderID string, now time.Time) error {
+	result, err := tx.ExecContext(ctx, `UPDATE orders SET updated_at = $2 WHERE id = $1`, orderID, now)
+	if err != nil {
+		return fmt.Errorf("failed to update order: %w", err)
+	}
+	return requireRow(result, orderID)
+}
+
+// requireRow turns an update that matched nothing into a not-found error
+func requireRow(result sql.Result, orderID string) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return fmt.Errorf("order not found: %s", orderID)
+	}
+	return nil
+}
+
+// GetCustomerOrders retrieves all orders for a customer by email
+func (s *PostgresStore) GetCustomerOrders(ctx context.Context, email string) ([]*models.Order, error) {
+	return s.queryOrders(ctx, `SELECT `+orderColumns+` WHERE o.customer_email = $1 ORDER BY o.created_at DESC`, email)
+}
+
+// GetCustomerOrderSummaries retrieves a page of a customer's order summaries, newest first
+func (s *PostgresStore) GetCustomerOrderSummaries(ctx context.Context, email string, limit, offset int) ([]*models.OrderSummary, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT o.id, o.tracking_id, o.customer_email, COALESCE(p.amount, 0), COALESCE(p.currency, 'usd'), o.status,
+			(SELECT COUNT(*) FROM order_items oi WHERE oi.order_id = o.id), o.disputed, o.created_at
+		FROM orders o
+		LEFT JOIN payments p ON p.order_id = o.id
+		WHERE o.customer_email = $1
+		ORDER BY o.created_at DESC
+		LIMIT $2 OFFSET $3`, email, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query customer orders: %w", err)
+	}
+	return scanOrderSummaries(rows)
+}
+
+// CountCustomerOrders returns how many orders a customer has
+func (s *PostgresStore) CountCustomerOrders(ctx context.Context, email string) (int, error) {
+	var count int
+	if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM orders WHERE customer_email = $1`, email).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count customer orders: %w", err)
+	}
+	return count, nil
+}
+
+// GetAllOrders retrieves the orders matching filter with optional pagination
+func (s *PostgresStore) GetAllOrders(ctx context.Context, limit, offset int, filter models.OrderFilter) ([]*models.OrderSummary, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT o.id, o.tracking_id, o.customer_email, COALESCE(p.amount, 0), COALESCE(p.currency, 'usd'), o.status,
+			(SELECT COUNT(*) FROM order_items oi WHERE oi.order_id = o.id), o.disputed, o.created_at
+		FROM orders o
+		LEFT JOIN payments p ON p.order_id = o.id
+		WHERE `+orderFilterWhere+`
+		ORDER BY o.created_at DESC
+		LIMIT $5 OFFSET $6`, append(orderFilterArgs(filter), limit, offset)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query orders: %w", err)
+	}
+	return scanOrderSummaries(rows)
+}
+
+// EachOrder calls fn with every order matching filter, newest first, stopping at the first error fn returns.
+// Rows are read one at a time so large result sets aren't held in memory; items aren't loaded.
+func (s *PostgresStore) EachOrder(ctx context.Context, filter models.OrderFilter, fn func(order *models.Order) error) error {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+orderColumns+` WHERE `+orderFilterWhere+` ORDER BY o.created_at DESC`,
+		orderFilterArgs(filter)...)
+	if err != nil {
+		return fmt.Errorf("failed to query orders: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		order, err := scanOrder(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(order); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// SearchOrders returns up to limit orders, newest first, whose email, customer name, or
+// tracking ID contains query, ignoring case
+func (s *PostgresStore) SearchOrders(ctx context.Context, query string, limit int) ([]*models.OrderSummary, error) {
+	pattern := "%" + likeEscaper.Replace(query) + "%"
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT o.id, o.tracking_id, o.customer_email, COALESCE(p.amount, 0), COALESCE(p.currency, 'usd'), o.status,
+			(SELECT COUNT(*) FROM order_items oi WHERE oi.order_id = o.id), o.disputed, o.created_at
+		FROM orders o
+		LEFT JOIN payments p ON p.order_id = o.id
+		WHERE o.customer_email ILIKE $1 OR o.customer_name ILIKE $1 OR o.tracking_id ILIKE $1
+		ORDER BY o.created_at DESC
+		LIMIT $2`, pattern, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search orders: %w", err)
+	}
+	return scanOrderSummaries(rows)
+}
+
+// likeEscaper escapes LIKE wildcards so a search matches them literally
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// scanOrderSummaries reads the summary rows selected by GetAllOrders and SearchOrders
+func scanOrderSummaries(rows *sql.Rows) ([]*models.OrderSummary, error) {
+	defer rows.Close()
+
+	summaries := []*models.OrderSummary{}
+	for rows.Next() {
+		var summary models.OrderSummary
+		var amount int64
+		if err := rows.Scan(&summary.ID, &summary.TrackingID, &summary.CustomerEmail, &amount, &summary.Currency,
+			&summary.Status, &summary.ItemCount, &summary.Disputed, &summary.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan order summary: %w", err)
+		}
+		summary.TotalAmount = models.ToMajorUnits(float64(amount), summary.Currency)
+		summaries = append(summaries, &summary)
+	}
+
+	return summaries, rows.Err()
+}
+
+// CountOrders counts the orders matching filter
+func (s *PostgresStore) CountOrders(ctx context.Context, filter models.OrderFilter) (int, error) {
+	var count int
+	if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM orders o WHERE `+orderFilterWhere,
+		orderFilterArgs(filter)...).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count orders: %w", err)
+	}
+	return count, nil
+}
+
+// orderFilterWhere matches orders o against the first four query arguments, from orderFilterArgs
+const orderFilterWhere = `($1::order_status IS NULL OR o.status = $1)
+	AND ($2::timestamptz IS NULL OR o.created_at >= $2)
+	AND ($3::timestamptz IS NULL OR o.created_at <= $3)
+	AND ($4::boolean OR o.archived_at IS NULL)`
+
+// orderFilterArgs returns the query arguments for orderFilterWhere, with NULL for unset fields
+func orderFilterArgs(filter models.OrderFilter) []interface{} {
+	var status interface{}
+	if filter.Status != "" {
+		status = string(filter.Status)
+	}
+	return []interface{}{status, filter.From, filter.To, filter.IncludeArchived}
+}
+
+// AddPaymentEvent adds a payment event
+func (s *PostgresStore) AddPaymentEvent(ctx context.Context, event models.PaymentEvent) error {
+	if event.ID == "" {
+		event.ID = newEventID()
+	}
+	event.CreatedAt = time.Now()
+
+	return insertPaymentEvent(ctx, s.db, event, false)
+}
+
+// UpsertPaymentEvent stores an event keeping its ID and timestamp, ignoring events already stored
+func (s *PostgresStore) UpsertPaymentEvent(ctx context.Context, event models.PaymentEvent) error {
+	if event.ID == "" {
+		return fmt.Errorf("event ID cannot be empty")
+	}
+	return insertPaymentEvent(ctx, s.db, event, true)
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// insertPaymentEvent writes a single event row
+func insertPaymentEvent(ctx context.Context, db execer, event models.PaymentEvent, skipExisting bool) error {
+	data, err := json.Marshal(event.Data)
+	if err != nil {
+		return fmt.Errorf("invalid event data: %w", err)
+	}
+
+	query := `
+		INSERT INTO payment_events (id, order_id, event_type, status, data, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`
+	if skipExisting {
+		query += ` ON CONFLICT (id) DO NOTHING`
+	}
+
+	if _, err := db.ExecContext(ctx, query, event.ID, event.OrderID, event.EventType, string(event.Status), string(data), event.CreatedAt); err != nil {
+		return fmt.Errorf("failed to add payment event: %w", err)
+	}
+	return nil
+}
+
+// GetPaymentEvents retrieves payment events for an order
+func (s *PostgresStore) GetPaymentEvents(ctx context.Context, orderID string) ([]models.PaymentEvent, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, order_id, event_type, status, COALESCE(data, 'null'), created_at
+		FROM payment_events
+		WHERE order_id = $1
+		ORDER BY created_at, id`, orderID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query payment events: %w", err)
+	}
+	defer rows.Close()
+
+	events := []models.PaymentEvent{}
+	for rows.Next() {
+		var event models.PaymentEvent
+		var data []byte
+		if err := rows.Scan(&event.ID, &event.OrderID, &event.EventType, &event.Status, &data, &event.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan payment event: %w", err)
+		}
+		if err := json.Unmarshal(data, &event.Data); err != nil {
+			return nil, fmt.Errorf("invalid data for payment event %s: %w", event.ID, err)
+		}
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
+
+// AddOrderNote adds a note to an order, filling in its ID and creation time
+func (s *PostgresStore) AddOrderNote(ctx context.Context, note *models.OrderNote) error {
+	id, createdAt := newNoteID(), time.Now()
+	result, err := s.db.ExecContext(ctx, `
+		INSERT INTO order_notes (id, order_id, author, body, created_at)
+		SELECT $1, id, $3, $4, $5 FROM orders WHERE id = $2`,
+		id, note.OrderID, note.Author, note.Body, createdAt)
+	if err != nil {
+		return fmt.Errorf("failed to add order note: %w", err)
+	}
+	if err := requireRow(result, note.OrderID); err != nil {
+		return err
+	}
+
+	note.ID = id
+	note.CreatedAt = createdAt
+	return nil
+}
+
+// GetOrderNotes returns an order's notes, newest first
+func (s *PostgresStore) GetOrderNotes(ctx context.Context, orderID string) ([]models.OrderNote, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, order_id, author, body, created_at FROM order_notes
+		WHERE order_id = $1
+		ORDER BY created_at DESC, id DESC`, orderID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query order notes: %w", err)
+	}
+	defer rows.Close()
+
+	notes := []models.OrderNote{}
+	for rows.Next() {
+		var note models.OrderNote
+		if err := rows.Scan(&note.ID, &note.OrderID, &note.Author, &note.Body, &note.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan order note: %w", err)
+		}
+		notes = append(notes, note)
+	}
+	return notes, rows.Err()
+}
+
+// MarkEventProcessed records a Stripe webhook event as handled, reporting whether it already was
+func (s *PostgresStore) MarkEventProcessed(ctx context.Context, eventID string) (bool, error) {
+	result, err := s.db.ExecContext(ctx, `
+		INSERT INTO processed_webhook_events (event_id, processed_at) VALUES ($1, $2)
+		ON CONFLICT (event_id) DO NOTHING`, eventID, time.Now())
+	if err != nil {
+		return false, fmt.Errorf("failed to mark event processed: %w", err)
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to mark event processed: %w", err)
+	}
+	return inserted == 0, nil
+}
+
+// UnmarkEventProcessed forgets a webhook event so a retry of it is handled again
+func (s *PostgresStore) UnmarkEventProcessed(ctx context.Context, eventID string) error {
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM processed_webhook_events WHERE event_id = $1`, eventID); err != nil {
+		return fmt.Errorf("failed to unmark event processed: %w", err)
+	}
+	return nil
+}
+
+// SaveWebhookEvent keeps a webhook event for replay, clearing out events received more than
+// retention ago. A redelivered event keeps its first payload.
+func (s *PostgresStore) SaveWebhookEvent(ctx context.Context, event models.WebhookEvent, retention time.Duration) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM webhook_events WHERE received_at <= $1`, time.Now().Add(-retention)); err != nil {
+			return fmt.Errorf("failed to expire webhook events: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO webhook_events (event_id, type, payload, received_at) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (event_id) DO NOTHING`,
+			event.ID, event.Type, event.Payload, event.ReceivedAt); err != nil {
+			return fmt.Errorf("failed to save webhook event: %w", err)
+		}
+		return nil
+	})
+}
+
+// GetWebhookEvent returns the stored webhook event with eventID, or nil
+func (s *PostgresStore) GetWebhookEvent(ctx context.Context, eventID string) (*models.WebhookEvent, error) {
+	var event models.WebhookEvent
+	err := s.db.QueryRowContext(ctx, `
+		SELECT event_id, type, payload, received_at FROM webhook_events WHERE event_id = $1`, eventID,
+	).Scan(&event.ID, &event.Type, &event.Payload, &event.ReceivedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get webhook event: %w", err)
+	}
+	return &event, nil
+}
+
+// GetIdempotentResponse returns the unexpired response stored for an idempotency key, or nil
+func (s *PostgresStore) GetIdempotentResponse(ctx context.Context, key string) (*IdempotentResponse, error) {
+	var response IdempotentResponse
+	err := s.db.QueryRowContext(ctx, `
+		SELECT status_code, content_type, body, body_hash FROM idempotency_keys
+		WHERE key = $1 AND expires_at > $2`, key, time.Now(),
+	).Scan(&response.StatusCode, &response.ContentType, &response.Body, &response.BodyHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get idempotent response: %w", err)
+	}
+	return &response, nil
+}
+
+// SaveIdempotentResponse stores the response replayed for an idempotency key until ttl passes,
+// clearing out expired keys as it goes
+func (s *PostgresStore) SaveIdempotentResponse(ctx context.Context, key string, response IdempotentResponse, ttl time.Duration) error {
+	// A nil body would be sent as NULL
+	if response.Body == nil {
+		response.Body = []byte{}
+	}
+
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		now := time.Now()
+		if _, err := tx.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE expires_at <= $1`, now); err != nil {
+			return fmt.Errorf("failed to expire idempotency keys: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO idempotency_keys (key, status_code, content_type, body, body_hash, expires_at)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (key) DO UPDATE SET
+				status_code = EXCLUDED.status_code, content_type = EXCLUDED.content_type,
+				body = EXCLUDED.body, body_hash = EXCLUDED.body_hash, expires_at = EXCLUDED.expires_at`,
+			key, response.StatusCode, response.ContentType, response.Body, response.BodyHash, now.Add(ttl)); err != nil {
+			return fmt.Errorf("failed to save idempotent response: %w", err)
+		}
+		return nil
+	})
+}
+
+// ClaimOrderIdempotencyKey maps an idempotency key to orderID until ttl passes. If the key is already
+// mapped it's left alone and the existing order ID is returned instead.
+func (s *PostgresStore) ClaimOrderIdempotencyKey(ctx context.Context, key, orderID string, ttl time.Duration) (string, error) {
+	var existingOrderID string
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		now := time.Now()
+		if _, err := tx.ExecContext(ctx, `DELETE FROM order_idempotency_keys WHERE expires_at <= $1`, now); err != nil {
+			return fmt.Errorf("failed to expire order idempotency keys: %w", err)
+		}
+		result, err := tx.ExecContext(ctx, `
+			INSERT INTO order_idempotency_keys (key, order_id, expires_at) VALUES ($1, $2, $3)
+			ON CONFLICT (key) DO NOTHING`, key, orderID, now.Add(ttl))
+		if err != nil {
+			return fmt.Errorf("failed to claim order idempotency key: %w", err)
+		}
+		inserted, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to claim order idempotency key: %w", err)
+		}
+		if inserted > 0 {
+			return nil
+		}
+		if err := tx.QueryRowContext(ctx, `SELECT order_id FROM order_idempotency_keys WHERE key = $1`, key).Scan(&existingOrderID); err != nil {
+			return fmt.Errorf("failed to get order for idempotency key: %w", err)
+		}
+		return nil
+	})
+	return existingOrderID, err
+}
+
+// ReleaseOrderIdempotencyKey frees a key claimed for orderID so a retry can create the order
+func (s *PostgresStore) ReleaseOrderIdempotencyKey(ctx context.Context, key, orderID string) error {
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM order_idempotency_keys WHERE key = $1 AND order_id = $2`, key, orderID); err != nil {
+		return fmt.Errorf("failed to release order idempotency key: %w", err)
+	}
+	return nil
+}
+
+// GetStripeCustomerID returns the Stripe customer saved for an email, or "" if there is none
+func (s *PostgresStore) GetStripeCustomerID(ctx context.Context, email string) (string, error) {
+	var customerID string
+	err := s.db.QueryRowContext(ctx, `SELECT stripe_customer_id FROM stripe_customers WHERE email = $1`, email).Scan(&customerID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get Stripe customer: %w", err)
+	}
+	return customerID, nil
+}
+
+// SaveStripeCustomerID maps an email to the Stripe customer its orders are charged to
+func (s *PostgresStore) SaveStripeCustomerID(ctx context.Context, email, customerID string) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO stripe_customers (email, stripe_customer_id, updated_at) VALUES ($1, $2, $3)
+		ON CONFLICT (email) DO UPDATE SET stripe_customer_id = EXCLUDED.stripe_customer_id, updated_at = EXCLUDED.updated_at`,
+		email, customerID, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to save Stripe customer: %w", err)
+	}
+	return nil
+}
+
+// GetPaymentStats calculates payment statistics for every unarchived order, with amounts in USD
+func (s *PostgresStore) GetPaymentStats(ctx context.Context) (*models.PaymentStats, error) {
+	return s.GetPaymentStatsRange(ctx, time.Time{}, time.Time{}, false, "usd")
+}
+
+// statsRangeWhere matches orders o created between the first two query arguments, from statsRangeArgs
+const statsRangeWhere = `($1::timestamptz IS NULL OR o.created_at >= $1)
+	AND ($2::timestamptz IS NULL OR o.created_at <= $2)`
+
+// statsRangeArgs returns the query arguments for statsRangeWhere, with NULL for open ends
+func statsRangeArgs(from, to time.Time) []interface{} {
+	fromArg, toArg := statsRange(from, to)
+	return []interface{}{fromArg, toArg}
+}
+
+// statsArchivedWhere leaves out archived orders o unless the third query argument is true
+const statsArchivedWhere = `($3::boolean OR o.archived_at IS NULL)`
+
+// GetPaymentStatsRange calculates payment statistics for orders created between from and to, inclusive.
+// A zero from or to leaves that end of the range open. Archived orders only count with includeArchived.
+// Amounts are in currency, apart from the per-currency breakdown.
+func (s *PostgresStore) GetPaymentStatsRange(ctx context.Context, from, to time.Time, includeArchived bool, currency string) (*models.PaymentStats, error) {
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	thisMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT o.status, COALESCE(p.currency, 'usd'),
+			COUNT(*),
+			COALESCE(SUM(p.amount), 0),
+			COALESCE(SUM(p.stripe_fee), 0),
+			COALESCE(SUM(CASE WHEN p.net_amount <> 0 THEN p.net_amount ELSE p.amount END), 0),
+			COALESCE(SUM(p.amount) FILTER (WHERE o.created_at > $4), 0),
+			COALESCE(SUM(p.amount) FILTER (WHERE o.created_at > $5), 0)
+		FROM orders o
+		LEFT JOIN payments p ON p.order_id = o.id
+		WHERE `+statsRangeWhere+` AND `+statsArchivedWhere+`
+		GROUP BY o.status, COALESCE(p.currency, 'usd')`, append(statsRangeArgs(from, to), includeArchived, today, thisMonth)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query payment stats: %w", err)
+	}
+	defer rows.Close()
+
+	totals := newStatsTotals(currency)
+	for rows.Next() {
+		var row statsRow
+		if err := rows.Scan(&row.status, &row.currency, &row.count, &row.amount, &row.fees, &row.net,
+			&row.amountToday, &row.amountMonth); err != nil {
+			return nil, fmt.Errorf("failed to scan payment stats: %w", err)
+		}
+		totals.add(row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	stats := totals.stats()
+	stats.From, stats.To = statsRange(from, to)
+	if err := s.db.QueryRowContext(ctx, `
+		SELECT COUNT(DISTINCT e.order_id)
+		FROM payment_events e
+		JOIN orders o ON o.id = e.order_id
+		WHERE e.event_type = 'downloaded' AND `+statsRangeWhere+` AND `+statsArchivedWhere,
+		append(statsRangeArgs(from, to), includeArchived)...,
+	).Scan(&stats.DownloadedOrders); err != nil {
+		return nil, fmt.Errorf("failed to count downloaded orders: %w", err)
+	}
+
+	return stats, nil
+}
+
+// GetRevenueByDay totals the revenue of paid and fulfilled orders in currency created between from and to
+// for each UTC day. Archived orders only count with includeArchived.
+func (s *PostgresStore) GetRevenueByDay(ctx context.Context, from, to time.Time, currency string, includeArchived bool) ([]models.DailyRevenue, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT TO_CHAR(DATE_TRUNC('day', o.created_at AT TIME ZONE 'UTC'), 'YYYY-MM-DD'),
+			COALESCE(SUM(p.amount), 0),
+			COUNT(*)
+		FROM orders o
+		LEFT JOIN payments p ON p.order_id = o.id
+		WHERE o.status IN ('paid', 'fulfilled') AND `+statsRangeWhere+` AND `+statsArchivedWhere+`
+			AND COALESCE(p.currency, 'usd') = $4
+		GROUP BY 1`, append(statsRangeArgs(from, to), includeArchived, strings.ToLower(currency))...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query daily revenue: %w", err)
+	}
+	defer rows.Close()
+
+	days := make(map[string]*dayTotals)
+	for rows.Next() {
+		var date string
+		var totals dayTotals
+		if err := rows.Scan(&date, &totals.revenue, &totals.orders); err != nil {
+			return nil, fmt.Errorf("failed to scan daily revenue: %w", err)
+		}
+		days[date] = &totals
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return dailySeries(from, to, currency, days), nil
+}
+
+// CreateCoupon saves a new coupon with no uses
+func (s *PostgresStore) CreateCoupon(ctx context.Context, coupon *models.Coupon) error {
+	coupon.Uses = 0
+	coupon.CreatedAt = time.Now()
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO coupons (code, percent_off, amount_off, currency, expires_at, max_uses, uses, created_at)
+		VALUES ($1, $2, $3, NULLIF($4, ''), $5, $6, 0, $7)`,
+		coupon.Code, coupon.PercentOff, coupon.AmountOff, coupon.Currency, coupon.ExpiresAt, coupon.MaxUses, coupon.CreatedAt)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return fmt.Errorf("%w: %s", ErrCouponExists, coupon.Code)
+		}
+		return fmt.Errorf("failed to create coupon: %w", err)
+	}
+	return nil
+}
+
+// ValidateCoupon checks that a coupon can be redeemed on an order in currency and counts the use, returning
+// its discount on subtotal. The coupon row is locked while it's checked, so concurrent orders can't exceed MaxUses.
+func (s *PostgresStore) ValidateCoupon(ctx context.Context, code string, subtotal int64, currency string) (int64, error) {
+	var discount int64
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		var coupon models.Coupon
+		var expiresAt sql.NullTime
+		err := tx.QueryRowContext(ctx, `
+			SELECT code, percent_off, amount_off, COALESCE(currency, ''), expires_at, max_uses, uses, created_at
+			FROM coupons WHERE code = $1 FOR UPDATE`, code).Scan(
+			&coupon.Code, &coupon.PercentOff, &coupon.AmountOff, &coupon.Currency, &expiresAt, &coupon.MaxUses, &coupon.Uses, &coupon.CreatedAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("%w: %s", ErrCouponNotFound, code)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get coupon: %w", err)
+		}
+		coupon.ExpiresAt = nullTimePtr(expiresAt)
+
+		if err := coupon.Redeemable(time.Now(), currency); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE coupons SET uses = uses + 1 WHERE code = $1`, code); err != nil {
+			return fmt.Errorf("failed to count coupon use: %w", err)
+		}
+		discount = coupon.Discount(subtotal)
+		return nil
+	})
+	return discount, err
+}
+
+// ReleaseCoupon gives back a use counted by ValidateCoupon for an order that wasn't created
+func (s *PostgresStore) ReleaseCoupon(ctx context.Context, code string) error {
+	if _, err := s.db.ExecContext(ctx, `UPDATE coupons SET uses = uses - 1 WHERE code = $1 AND uses > 0`, code); err != nil {
+		return fmt.Errorf("failed to release coupon: %w", err)
+	}
+	return nil
+}
+
+// subscriptionColumns are the subscriptions columns scanned by scanSubscription, in order
+const subscriptionColumns = `stripe_subscription_id, stripe_customer_id, customer_email, status, current_period_end, canceled_at, created_at, updated_at, last_event_at`
+
+// scanSubscription reads a row selected with subscriptionColumns
+func scanSubscription(row rowScanner) (*models.Subscription, error) {
+	var subscription models.Subscription
+	var currentPeriodEnd, canceledAt, lastEventAt sql.NullTime
+	if err := row.Scan(&subscription.StripeSubscriptionID, &subscription.StripeCustomerID, &subscription.CustomerEmail,
+		&subscription.Status, &currentPeriodEnd, &canceledAt, &subscription.CreatedAt, &subscription.UpdatedAt, &lastEventAt); err != nil {
+		return nil, err
+	}
+	subscription.CurrentPeriodEnd = nullTimePtr(currentPeriodEnd)
+	subscription.CanceledAt = nullTimePtr(canceledAt)
+	subscription.LastEventAt = nullTimePtr(lastEventAt)
+	return &subscription, nil
+}
+
+// SaveSubscription creates or replaces a subscription by its Stripe ID. A replaced subscription
+// keeps its creation time.
+func (s *PostgresStore) SaveSubscription(ctx context.Context, subscription *models.Subscription) error {
+	if subscription.StripeSubscriptionID == "" {
+		return fmt.Errorf("subscription ID cannot be empty")
+	}
+
+	now := time.Now()
+	createdAt := subscription.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = now
+	}
+	err := s.db.QueryRowContext(ctx, `
+		INSERT INTO subscriptions (`+subscriptionColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (stripe_subscription_id) DO UPDATE SET
+			stripe_customer_id = EXCLUDED.stripe_customer_id,
+			customer_email = EXCLUDED.customer_email,
+			status = EXCLUDED.status,
+			current_period_end = EXCLUDED.current_period_end,
+			canceled_at = EXCLUDED.canceled_at,
+			updated_at = EXCLUDED.updated_at,
+			last_event_at = EXCLUDED.last_event_at
+		RETURNING created_at`,
+		subscription.StripeSubscriptionID, subscription.StripeCustomerID, subscription.CustomerEmail, string(subscription.Status),
+		subscription.CurrentPeriodEnd, subscription.CanceledAt, createdAt, now, subscription.LastEventAt).Scan(&subscription.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to save subscription: %w", err)
+	}
+	subscription.UpdatedAt = now
+	return nil
+}
+
+// GetSubscription returns the subscription with a Stripe subscription ID
+func (s *PostgresStore) GetSubscription(ctx context.Context, subscriptionID string) (*models.Subscription, error) {
+	subscription, err := scanSubscription(s.db.QueryRowContext(ctx,
+		`SELECT `+subscriptionColumns+` FROM subscriptions WHERE stripe_subscription_id = $1`, subscriptionID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %s", ErrSubscriptionNotFound, subscriptionID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get subscription: %w", err)
+	}
+	return subscription, nil
+}
+
+// GetCustomerSubscriptions returns a customer's subscriptions, newest first
+func (s *PostgresStore) GetCustomerSubscriptions(ctx context.Context, email string) ([]*models.Subscription, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+subscriptionColumns+` FROM subscriptions
+		WHERE customer_email = $1
+		ORDER BY created_at DESC, stripe_subscription_id`, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query subscriptions: %w", err)
+	}
+	defer rows.Close()
+
+	subscriptions := []*models.Subscription{}
+	for rows.Next() {
+		subscription, err := scanSubscription(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan subscription: %w", err)
+		}
+		subscriptions = append(subscriptions, subscription)
+	}
+	return subscriptions, rows.Err()
+}
+
+// AddSubscriptionEvent records a lifecycle event for a subscription
+func (s *PostgresStore) AddSubscriptionEvent(ctx context.Context, event models.SubscriptionEvent) error {
+	if event.ID == "" {
+		event.ID = newEventID()
+	}
+	event.CreatedAt = time.Now()
+
+	data, err := json.Marshal(event.Data)
+	if err != nil {
+		return fmt.Errorf("invalid event data: %w", err)
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO subscription_events (id, subscription_id, event_type, status, data, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		event.ID, event.SubscriptionID, event.EventType, string(event.Status), string(data), event.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to add subscription event: %w", err)
+	}
+	return nil
+}
+
+// GetSubscriptionEvents returns a subscription's events, oldest first
+func (s *PostgresStore) GetSubscriptionEvents(ctx context.Context, subscriptionID string) ([]models.SubscriptionEvent, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, subscription_id, event_type, status, COALESCE(data, 'null'), created_at
+		FROM subscription_events
+		WHERE subscription_id = $1
+		ORDER BY created_at, id`, subscriptionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query subscription events: %w", err)
+	}
+	defer rows.Close()
+
+	events := []models.SubscriptionEvent{}
+	for rows.Next() {
+		var event models.SubscriptionEvent
+		var data []byte
+		if err := rows.Scan(&event.ID, &event.SubscriptionID, &event.EventType, &event.Status, &data, &event.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan subscription event: %w", err)
+		}
+		if err := json.Unmarshal(data, &event.Data); err != nil {
+			return nil, fmt.Errorf("invalid data for subscription event %s: %w", event.ID, err)
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// disputeColumns are the disputes columns scanned by scanDispute, in order
+const disputeColumns = `id, charge_id, payment_intent_id, COALESCE(order_id, ''), reason, amount, currency, status, created_at, updated_at`
+
+// scanDispute reads a row selected with disputeColumns
+func scanDispute(row rowScanner) (*models.Dispute, error) {
+	var dispute models.Dispute
+	if err := row.Scan(&dispute.ID, &dispute.ChargeID, &dispute.PaymentIntentID, &dispute.OrderID, &dispute.Reason,
+		&dispute.Amount, &dispute.Currency, &dispute.Status, &dispute.CreatedAt, &dispute.UpdatedAt); err != nil {
+		return nil, err
+	}
+	return &dispute, nil
+}
+
+// CreateDispute records a new dispute
+func (s *PostgresStore) CreateDispute(ctx context.Context, dispute *models.Dispute) error {
+	if dispute.ID == "" {
+		return fmt.Errorf("dispute ID cannot be empty")
+	}
+
+	now := time.Now()
+	if dispute.CreatedAt.IsZero() {
+		dispute.CreatedAt = now
+	}
+	dispute.UpdatedAt = now
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO disputes (id, charge_id, payment_intent_id, order_id, reason, amount, currency, status, created_at, updated_at)
+		VALUES ($1, $2, $3, NULLIF($4, ''), $5, $6, $7, $8, $9, $10)`,
+		dispute.ID, dispute.ChargeID, dispute.PaymentIntentID, dispute.OrderID, dispute.Reason,
+		dispute.Amount, dispute.Currency, dispute.Status, dispute.CreatedAt, dispute.UpdatedAt)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return fmt.Errorf("%w: %s", ErrDisputeExists, dispute.ID)
+		}
+		return fmt.Errorf("failed to create dispute: %w", err)
+	}
+	return nil
+}
+
+// UpdateDisputeStatus records a dispute's new status, such as won or lost once it closes
+func (s *PostgresStore) UpdateDisputeStatus(ctx context.Context, disputeID, status string) error {
+	result, err := s.db.ExecContext(ctx, `UPDATE disputes SET status = $2, updated_at = $3 WHERE id = $1`,
+		disputeID, status, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to update dispute status: %w", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return fmt.Errorf("%w: %s", ErrDisputeNotFound, disputeID)
+	}
+	return nil
+}
+
+// GetDisputes returns the recorded disputes, newest first; openOnly leaves out closed ones
+func (s *PostgresStore) GetDisputes(ctx context.Context, openOnly bool) ([]*models.Dispute, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+disputeColumns+` FROM disputes
+		WHERE NOT $1::boolean OR status = ANY($2)
+		ORDER BY created_at DESC, id`, openOnly, pq.Array(models.OpenDisputeStatuses))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query disputes: %w", err)
+	}
+	defer rows.Close()
+
+	disputes := []*models.Dispute{}
+	for rows.Next() {
+		dispute, err := scanDispute(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan dispute: %w", err)
+		}
+		disputes = append(disputes, dispute)
+	}
+	return disputes, rows.Err()
+}
@@ -0,0 +1,183 @@
+// store/snapshot.go
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/capactiyvirus/stripe-backend/models"
+)
+
+// storeSnapshot is the on-disk form of the in-memory store
+type storeSnapshot struct {
+	Orders          []*models.Order                  `json:"orders"`
+	Events          map[string][]models.PaymentEvent `json:"events"`
+	Notes           map[string][]models.OrderNote    `json:"notes,omitempty"`
+	ProcessedEvents []string                         `json:"processed_events,omitempty"` // Stripe webhook event IDs
+	StripeCustomers map[string]string                `json:"stripe_customers,omitempty"` // email -> Stripe customer ID
+	Coupons         []*models.Coupon                 `json:"coupons,omitempty"`
+
+	Subscriptions      []*models.Subscription                `json:"subscriptions,omitempty"`
+	SubscriptionEvents map[string][]models.SubscriptionEvent `json:"subscription_events,omitempty"`
+	Disputes           []*models.Dispute                     `json:"disputes,omitempty"`
+}
+
+// SnapshotToFile writes the store's contents, from orders and their events to coupons,
+// subscriptions, and disputes, to path as JSON. The file is replaced atomically so a
+// crash mid-write leaves the previous snapshot intact.
+func (s *MemoryStore) SnapshotToFile(path string) error {
+	orders, events := s.snapshot()
+
+	s.mu.RLock()
+	notes := make(map[string][]models.OrderNote, len(s.notes))
+	for orderID, orderNotes := range s.notes {
+		notes[orderID] = append([]models.OrderNote(nil), orderNotes...)
+	}
+	processed := make([]string, 0, len(s.processedEvents))
+	for eventID := range s.processedEvents {
+		processed = append(processed, eventID)
+	}
+	customers := make(map[string]string, len(s.stripeCustomers))
+	for email, customerID := range s.stripeCustomers {
+		customers[email] = customerID
+	}
+	coupons := make([]*models.Coupon, 0, len(s.coupons))
+	for _, coupon := range s.coupons {
+		stored := *coupon
+		coupons = append(coupons, &stored)
+	}
+	subscriptions := make([]*models.Subscription, 0, len(s.subscriptions))
+	for _, subscription := range s.subscriptions {
+		stored := *subscription
+		subscriptions = append(subscriptions, &stored)
+	}
+	subscriptionEvents := make(map[string][]models.SubscriptionEvent, len(s.subscriptionEvents))
+	for subscriptionID, events := range s.subscriptionEvents {
+		subscriptionEvents[subscriptionID] = append([]models.SubscriptionEvent(nil), events...)
+	}
+	disputes := make([]*models.Dispute, 0, len(s.disputes))
+	for _, dispute := range s.disputes {
+		stored := *dispute
+		disputes = append(disputes, &stored)
+	}
+	s.mu.RUnlock()
+
+	data, err := json.Marshal(storeSnapshot{
+		Orders:          orders,
+		Events:          events,
+		Notes:           notes,
+		ProcessedEvents: processed,
+		StripeCustomers: customers,
+		Coupons:         coupons,
+
+		Subscriptions:      subscriptions,
+		SubscriptionEvents: subscriptionEvents,
+		Disputes:           disputes,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot: %w", err)
+	}
+
+	if err := writeFileAtomic(path, data); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+
+	return nil
+}
+
+// LoadFromFile replaces the store's contents with a snapshot written by SnapshotToFile.
+// A missing file loads nothing.
+func (s *MemoryStore) LoadFromFile(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot: %w", err)
+	}
+
+	var snapshot storeSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return fmt.Errorf("failed to decode snapshot: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.orders = make(map[string]*models.Order, len(snapshot.Orders))
+	s.events = make(map[string][]models.PaymentEvent, len(snapshot.Events))
+	s.notes = make(map[string][]models.OrderNote, len(snapshot.Notes))
+	s.trackingIDs = make(map[string]string, len(snapshot.Orders))
+	s.customerIndex = make(map[string][]string)
+	s.paymentIntentIndex = make(map[string]string, len(snapshot.Orders))
+	s.sessionIndex = make(map[string]string, len(snapshot.Orders))
+	s.processedEvents = make(map[string]bool, len(snapshot.ProcessedEvents))
+	s.stripeCustomers = make(map[string]string, len(snapshot.StripeCustomers))
+	s.coupons = make(map[string]*models.Coupon, len(snapshot.Coupons))
+	s.subscriptions = make(map[string]*models.Subscription, len(snapshot.Subscriptions))
+	s.subscriptionEvents = make(map[string][]models.SubscriptionEvent, len(snapshot.SubscriptionEvents))
+	s.disputes = make(map[string]*models.Dispute, len(snapshot.Disputes))
+
+	for _, order := range snapshot.Orders {
+		s.orders[order.ID] = order
+		if order.TrackingID != "" {
+			s.trackingIDs[order.TrackingID] = order.ID
+		}
+		if order.CustomerInfo.Email != "" {
+			s.customerIndex[order.CustomerInfo.Email] = append(s.customerIndex[order.CustomerInfo.Email], order.ID)
+		}
+		s.indexPayment(order)
+	}
+	for orderID, events := range snapshot.Events {
+		s.events[orderID] = events
+	}
+	for orderID, notes := range snapshot.Notes {
+		s.notes[orderID] = notes
+	}
+	for _, eventID := range snapshot.ProcessedEvents {
+		s.processedEvents[eventID] = true
+	}
+	for email, customerID := range snapshot.StripeCustomers {
+		s.stripeCustomers[email] = customerID
+	}
+	for _, coupon := range snapshot.Coupons {
+		// Amount-off coupons saved before coupons had a currency were in usd
+		if coupon.AmountOff > 0 && coupon.Currency == "" {
+			coupon.Currency = "usd"
+		}
+		s.coupons[coupon.Code] = coupon
+	}
+	for _, subscription := range snapshot.Subscriptions {
+		s.subscriptions[subscription.StripeSubscriptionID] = subscription
+	}
+	for subscriptionID, events := range snapshot.SubscriptionEvents {
+		s.subscriptionEvents[subscriptionID] = events
+	}
+	for _, dispute := range snapshot.Disputes {
+		s.disputes[dispute.ID] = dispute
+	}
+
+	return nil
+}
+
+// writeFileAtomic replaces path with data via a temporary file and rename,
+// so a crash mid-write leaves the previous file intact
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
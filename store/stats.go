@@ -0,0 +1,182 @@
+// store/stats.go
+package store
+
+import (
+	"strings"
+	"time"
+
+	"github.com/capactiyvirus/stripe-backend/models"
+)
+
+// inStatsRange reports whether an order created at t falls in an inclusive range, where a zero from or to leaves that end open
+func inStatsRange(t, from, to time.Time) bool {
+	return (from.IsZero() || !t.Before(from)) && (to.IsZero() || !t.After(to))
+}
+
+// statsRange returns the From and To reported for a range, nil for open ends
+func statsRange(from, to time.Time) (*time.Time, *time.Time) {
+	var fromPtr, toPtr *time.Time
+	if !from.IsZero() {
+		fromPtr = &from
+	}
+	if !to.IsZero() {
+		toPtr = &to
+	}
+	return fromPtr, toPtr
+}
+
+// dayTotals is a day's revenue in minor units and its number of paying orders
+type dayTotals struct {
+	revenue int64
+	orders  int
+}
+
+// dailySeries lists every UTC day from from to to, inclusive, with the totals in currency for days
+// that had paying orders and zeros for the rest, so charts get continuous points
+func dailySeries(from, to time.Time, currency string, days map[string]*dayTotals) []models.DailyRevenue {
+	series := []models.DailyRevenue{}
+	end := to.UTC().Truncate(24 * time.Hour)
+	for day := from.UTC().Truncate(24 * time.Hour); !day.After(end); day = day.AddDate(0, 0, 1) {
+		point := models.DailyRevenue{Date: day.Format("2006-01-02")}
+		if totals, ok := days[point.Date]; ok {
+			point.Revenue = models.ToMajorUnits(float64(totals.revenue), currency)
+			point.OrderCount = totals.orders
+		}
+		series = append(series, point)
+	}
+	return series
+}
+
+// statsTotals accumulates payment statistics in minor units (cents) so no float
+// drift builds up; amounts are only converted when building the response. The top-level
+// amounts only count orders in currency, so currencies are never added together.
+type statsTotals struct {
+	currency                                           string
+	orders, pending, completed, refunded               int
+	revenue, revenueToday, revenueThisMonth, fees, net int64
+	byStatus                                           map[models.OrderStatus]*statusTotals
+	byCurrency                                         map[string]*currencyTotals
+}
+
+type statusTotals struct {
+	count  int
+	amount int64
+}
+
+type currencyTotals struct {
+	orders, completed  int
+	revenue, fees, net int64
+}
+
+func newStatsTotals(currency string) *statsTotals {
+	return &statsTotals{
+		currency:   strings.ToLower(currency),
+		byStatus:   make(map[models.OrderStatus]*statusTotals),
+		byCurrency: make(map[string]*currencyTotals),
+	}
+}
+
+// statsRow is a group of orders sharing a status and currency, with amounts in minor units
+type statsRow struct {
+	status                                      models.OrderStatus
+	currency                                    string
+	count                                       int
+	amount, fees, net, amountToday, amountMonth int64
+}
+
+// add folds a group of orders into the totals
+func (t *statsTotals) add(row statsRow) {
+	currency := strings.ToLower(row.currency)
+	if currency == "" {
+		currency = "usd"
+	}
+
+	t.orders += row.count
+	inCurrency := currency == t.currency
+
+	status, ok := t.byStatus[row.status]
+	if !ok {
+		status = &statusTotals{}
+		t.byStatus[row.status] = status
+	}
+	status.count += row.count
+	if inCurrency {
+		status.amount += row.amount
+	}
+
+	cur, ok := t.byCurrency[currency]
+	if !ok {
+		cur = &currencyTotals{}
+		t.byCurrency[currency] = cur
+	}
+	cur.orders += row.count
+
+	switch row.status {
+	case models.OrderStatusPending:
+		t.pending += row.count
+	case models.OrderStatusPaid, models.OrderStatusFulfilled:
+		t.completed += row.count
+		if inCurrency {
+			t.revenue += row.amount
+			t.revenueToday += row.amountToday
+			t.revenueThisMonth += row.amountMonth
+			t.fees += row.fees
+			t.net += row.net
+		}
+
+		cur.completed += row.count
+		cur.revenue += row.amount
+		cur.fees += row.fees
+		cur.net += row.net
+	case models.OrderStatusRefunded:
+		t.refunded += row.count
+	}
+}
+
+// stats converts the totals into rounded display amounts. The top-level amounts are in the
+// totals' currency; Currencies has the figures for every currency.
+func (t *statsTotals) stats() *models.PaymentStats {
+	stats := &models.PaymentStats{
+		Currency:         t.currency,
+		TotalOrders:      t.orders,
+		PendingOrders:    t.pending,
+		CompletedOrders:  t.completed,
+		RefundedOrders:   t.refunded,
+		TotalRevenue:     models.ToMajorUnits(float64(t.revenue), t.currency),
+		RevenueToday:     models.ToMajorUnits(float64(t.revenueToday), t.currency),
+		RevenueThisMonth: models.ToMajorUnits(float64(t.revenueThisMonth), t.currency),
+		TotalFees:        models.ToMajorUnits(float64(t.fees), t.currency),
+		NetRevenue:       models.ToMajorUnits(float64(t.net), t.currency),
+		StatusBreakdown:  make(map[models.OrderStatus]models.StatusTotals, len(models.OrderStatuses)),
+		Currencies:       make(map[string]models.CurrencyStats, len(t.byCurrency)),
+	}
+	if cur, ok := t.byCurrency[t.currency]; ok && cur.completed > 0 {
+		stats.AverageOrderValue = models.ToMajorUnits(float64(t.revenue)/float64(cur.completed), t.currency)
+	}
+
+	for _, status := range models.OrderStatuses {
+		stats.StatusBreakdown[status] = models.StatusTotals{}
+	}
+	for status, totals := range t.byStatus {
+		stats.StatusBreakdown[status] = models.StatusTotals{
+			Count:  totals.count,
+			Amount: models.ToMajorUnits(float64(totals.amount), t.currency),
+		}
+	}
+
+	for currency, totals := range t.byCurrency {
+		cs := models.CurrencyStats{
+			TotalOrders:     totals.orders,
+			CompletedOrders: totals.completed,
+			TotalRevenue:    models.ToMajorUnits(float64(totals.revenue), currency),
+			TotalFees:       models.ToMajorUnits(float64(totals.fees), currency),
+			NetRevenue:      models.ToMajorUnits(float64(totals.net), currency),
+		}
+		if totals.completed > 0 {
+			cs.AverageOrderValue = models.ToMajorUnits(float64(totals.revenue)/float64(totals.completed), currency)
+		}
+		stats.Currencies[currency] = cs
+	}
+
+	return stats
+}
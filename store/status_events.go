@@ -0,0 +1,53 @@
+// store/status_events.go
+package store
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/capactiyvirus/stripe-backend/models"
+)
+
+// lastEventID is the most recently issued event ID's timestamp, so IDs stay unique when events are added in the same nanosecond
+var lastEventID atomic.Int64
+
+// newEventID returns a unique evt_ ID based on the current time
+func newEventID() string {
+	return newTimeID("evt")
+}
+
+// newNoteID returns a unique note_ ID based on the current time, so later notes sort after earlier ones
+func newNoteID() string {
+	return newTimeID("note")
+}
+
+// newTimeID returns a unique ID with prefix based on the current time
+func newTimeID(prefix string) string {
+	now := time.Now().UnixNano()
+	for {
+		last := lastEventID.Load()
+		if now <= last {
+			now = last + 1
+		}
+		if lastEventID.CompareAndSwap(last, now) {
+			return fmt.Sprintf("%s_%d", prefix, now)
+		}
+	}
+}
+
+// statusChangedEvent builds the status_changed event recording a change to an order's status or payment status
+func statusChangedEvent(orderID, field string, oldStatus, newStatus string, paymentStatus models.PaymentStatus) models.PaymentEvent {
+	return models.PaymentEvent{
+		ID:        newEventID(),
+		OrderID:   orderID,
+		EventType: models.EventTypeStatusChanged,
+		Status:    paymentStatus,
+		Data: map[string]interface{}{
+			"field":      field,
+			"old_status": oldStatus,
+			"new_status": newStatus,
+		},
+		CreatedAt: time.Now(),
+	}
+}
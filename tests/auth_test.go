@@ -0,0 +1,137 @@
+// tests/auth_test.go
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/capactiyvirus/stripe-backend/config"
+	"github.com/capactiyvirus/stripe-backend/handlers"
+	appmiddleware "github.com/capactiyvirus/stripe-backend/middleware"
+	"github.com/capactiyvirus/stripe-backend/models"
+	"github.com/capactiyvirus/stripe-backend/routes"
+	"github.com/capactiyvirus/stripe-backend/store"
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestAPIKeyAuth tests that only requests carrying a configured X-API-Key reach the handler
+func TestAPIKeyAuth(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+
+	tests := []struct {
+		name      string
+		validKeys []string
+		apiKey    string
+		want      int
+	}{
+		{name: "first key", validKeys: []string{"key-one", "key-two"}, apiKey: "key-one", want: http.StatusNoContent},
+		{name: "second key", validKeys: []string{"key-one", " key-two "}, apiKey: "key-two", want: http.StatusNoContent},
+		{name: "wrong key", validKeys: []string{"key-one"}, apiKey: "key-on", want: http.StatusUnauthorized},
+		{name: "missing key", validKeys: []string{"key-one"}, apiKey: "", want: http.StatusUnauthorized},
+		{name: "no keys configured", validKeys: nil, apiKey: "anything", want: http.StatusUnauthorized},
+		{name: "empty configured key", validKeys: []string{""}, apiKey: "", want: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/api/payments/all", nil)
+			if tt.apiKey != "" {
+				req.Header.Set("X-API-Key", tt.apiKey)
+			}
+			w := httptest.NewRecorder()
+			appmiddleware.APIKeyAuth(tt.validKeys)(ok).ServeHTTP(w, req)
+
+			assert.Equal(t, tt.want, w.Code)
+			if tt.want == http.StatusUnauthorized {
+				assert.JSONEq(t, `{"error": "Invalid or missing API key"}`, w.Body.String())
+			}
+		})
+	}
+}
+
+// TestExportedRoutersRequireAPIKey tests that the routers in the routes package put admin endpoints
+// behind ADMIN_API_KEYS like main's router does
+func TestExportedRoutersRequireAPIKey(t *testing.T) {
+	h := handlers.NewHandlers(&config.Config{Environment: "test", AdminAPIKeys: []string{"admin-key"}}, store.NewMemoryStore())
+	createPendingOrder(t, h, "routes-order-1", "pi_routes", 1000)
+
+	paymentRouter := chi.NewRouter()
+	routes.SetupPaymentRoutes(paymentRouter, h)
+
+	routers := map[string]http.Handler{
+		"SetupRoutes":        routes.SetupRoutes(h),
+		"SetupPaymentRoutes": paymentRouter,
+	}
+
+	adminRequests := []struct{ method, path string }{
+		{"GET", "/api/payments/all"},
+		{"GET", "/api/payments/stats"},
+		{"POST", "/api/payments/fulfill/routes-order-1"},
+		{"POST", "/api/payments/refund/routes-order-1"},
+		{"POST", "/api/payments/cancel/routes-order-1"},
+		{"POST", "/api/payments/webhook/replay/evt_1"},
+	}
+
+	for name, router := range routers {
+		t.Run(name, func(t *testing.T) {
+			for _, req := range adminRequests {
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, httptest.NewRequest(req.method, req.path, nil))
+				assert.Equal(t, http.StatusUnauthorized, w.Code, "%s %s", req.method, req.path)
+			}
+
+			req := httptest.NewRequest("GET", "/api/payments/all", nil)
+			req.Header.Set("X-API-Key", "admin-key")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusOK, w.Code)
+
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", "/api/payments/status/routes-order-1", nil))
+			assert.Equal(t, http.StatusOK, w.Code)
+		})
+	}
+}
+
+// TestIdempotencyReplaysOnlyToSameAPIKey tests that an admin response stored for an Idempotency-Key
+// isn't replayed to a caller without the same credentials
+func TestIdempotencyReplaysOnlyToSameAPIKey(t *testing.T) {
+	h := handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore())
+	admin := appmiddleware.APIKeyAuth([]string{"admin-key", "other-key"})(setupTestRouter(h))
+	router := appmiddleware.Idempotency(h.PaymentStore, time.Hour, config.DefaultIdempotencyMaxBodyBytes, h.Logger)(admin)
+
+	createPendingOrder(t, h, "auth-order-1", "pi_auth", 1000)
+	require.NoError(t, h.PaymentStore.UpdatePaymentStatus(context.Background(), "auth-order-1", models.PaymentStatusSucceeded))
+
+	fulfill := func(apiKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/payments/fulfill/auth-order-1", nil)
+		req.Header.Set("Idempotency-Key", "shared-key")
+		if apiKey != "" {
+			req.Header.Set("X-API-Key", apiKey)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	require.Equal(t, http.StatusOK, fulfill("admin-key").Code)
+
+	w := fulfill("")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Empty(t, w.Header().Get("Idempotent-Replayed"))
+
+	// Another valid key runs the handler itself, which sees the order is already fulfilled
+	w = fulfill("other-key")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"already_fulfilled":true`)
+	assert.Empty(t, w.Header().Get("Idempotent-Replayed"))
+
+	w = fulfill("admin-key")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "true", w.Header().Get("Idempotent-Replayed"))
+}
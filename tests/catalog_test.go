@@ -0,0 +1,374 @@
+// tests/catalog_test.go
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/capactiyvirus/stripe-backend/config"
+	"github.com/capactiyvirus/stripe-backend/handlers"
+	"github.com/capactiyvirus/stripe-backend/models"
+	"github.com/capactiyvirus/stripe-backend/services"
+	"github.com/capactiyvirus/stripe-backend/store"
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/stripe-go/v82"
+)
+
+// newCatalogTestHandlers creates handlers with an empty catalog file in a temp directory
+func newCatalogTestHandlers(t *testing.T) (*handlers.Handlers, string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "products.json")
+	catalog, err := store.NewProductCatalog(path)
+	require.NoError(t, err)
+
+	h := handlers.NewHandlers(&config.Config{Environment: "test", ProductCatalogPath: path}, store.NewMemoryStore())
+	h.Catalog = catalog
+	return h, path
+}
+
+// sendProduct sends a catalog product to the products API
+func sendProduct(t *testing.T, router chi.Router, method, target string, product interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+
+	body, err := json.Marshal(product)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(method, target, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// listCatalogProducts fetches the product listing
+func listCatalogProducts(t *testing.T, router chi.Router) []models.Product {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/products/", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var response struct {
+		Products []models.Product `json:"products"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	return response.Products
+}
+
+// TestCatalogProductLifecycle tests creating, updating, and deleting a catalog product
+func TestCatalogProductLifecycle(t *testing.T) {
+	h, path := newCatalogTestHandlers(t)
+	router := setupTestRouter(h)
+
+	assert.Empty(t, listCatalogProducts(t, router))
+
+	guide := models.Product{ID: "guide", Name: "Writing Guide", Price: 9.99, FileType: "PDF"}
+	w := sendProduct(t, router, "POST", "/api/products/", guide)
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	products := listCatalogProducts(t, router)
+	require.Len(t, products, 1)
+	assert.Equal(t, "Writing Guide", products[0].Name)
+
+	guide.Name = "Writing Guide (2nd edition)"
+	guide.Price = 12.50
+	w = sendProduct(t, router, "PUT", "/api/products/guide", guide)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	products = listCatalogProducts(t, router)
+	require.Len(t, products, 1)
+	assert.Equal(t, "Writing Guide (2nd edition)", products[0].Name)
+	assert.Equal(t, 12.50, products[0].Price)
+
+	// Changes are persisted to the catalog file
+	reloaded, err := store.NewProductCatalog(path)
+	require.NoError(t, err)
+	saved, err := reloaded.GetProduct("guide")
+	require.NoError(t, err)
+	assert.Equal(t, 12.50, saved.Price)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", "/api/products/guide", nil))
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	assert.Empty(t, listCatalogProducts(t, router))
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/products/guide", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+// TestCatalogProductValidation tests that duplicate IDs and non-positive prices are rejected
+func TestCatalogProductValidation(t *testing.T) {
+	h, _ := newCatalogTestHandlers(t)
+	router := setupTestRouter(h)
+
+	w := sendProduct(t, router, "POST", "/api/products/", models.Product{ID: "guide", Name: "Writing Guide", Price: 9.99})
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		product  models.Product
+		expected int
+	}{
+		{"duplicate ID", "POST", "/api/products/", models.Product{ID: "guide", Name: "Another Guide", Price: 5}, http.StatusConflict},
+		{"zero price", "POST", "/api/products/", models.Product{ID: "free", Name: "Freebie", Price: 0}, http.StatusBadRequest},
+		{"negative price", "PUT", "/api/products/guide", models.Product{ID: "guide", Name: "Writing Guide", Price: -1}, http.StatusBadRequest},
+		{"missing name", "POST", "/api/products/", models.Product{ID: "nameless", Price: 5}, http.StatusBadRequest},
+		{"unknown product", "PUT", "/api/products/missing", models.Product{ID: "missing", Name: "Missing", Price: 5}, http.StatusNotFound},
+		{"changed ID", "PUT", "/api/products/guide", models.Product{ID: "renamed", Name: "Writing Guide", Price: 5}, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := sendProduct(t, router, tt.method, tt.target, tt.product)
+			assert.Equal(t, tt.expected, w.Code)
+		})
+	}
+
+	products := listCatalogProducts(t, router)
+	require.Len(t, products, 1)
+	assert.Equal(t, 9.99, products[0].Price)
+}
+
+// TestStripeCatalogIsReadOnly tests that products can't be edited without a local catalog
+func TestStripeCatalogIsReadOnly(t *testing.T) {
+	h := handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore())
+	router := setupTestRouter(h)
+
+	w := sendProduct(t, router, "POST", "/api/products/", models.Product{ID: "guide", Name: "Writing Guide", Price: 9.99})
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", "/api/products/guide", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+// TestFulfillOrderStoresDownloadURLs tests that fulfillment saves download URLs from the request and the catalog
+func TestFulfillOrderStoresDownloadURLs(t *testing.T) {
+	h, _ := newCatalogTestHandlers(t)
+	require.NoError(t, h.Catalog.CreateProduct(&models.Product{
+		ID: "workbook", Name: "Workbook", Price: 500, Metadata: map[string]string{"download_url": "https://files.example.com/workbook.pdf"},
+	}))
+	router := setupTestRouter(h)
+
+	createPendingOrder(t, h, "download-urls-1", "pi_download_urls", 1500)
+	order, err := h.PaymentStore.GetOrder(context.Background(), "download-urls-1")
+	require.NoError(t, err)
+	order.Items = []models.OrderItem{
+		{ProductID: "commission", ProductName: "Custom Commission", FileType: "PDF", Price: 10, Quantity: 1},
+		{ProductID: "workbook", ProductName: "Workbook", FileType: "PDF", Price: 5, Quantity: 1},
+	}
+	order.Status = models.OrderStatusPaid
+	require.NoError(t, h.PaymentStore.UpdateOrder(context.Background(), order))
+
+	fulfill := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/api/payments/fulfill/download-urls-1", strings.NewReader(body)))
+		return w
+	}
+
+	assert.Equal(t, http.StatusBadRequest, fulfill(`{"download_urls": {"missing": "https://files.example.com/missing.pdf"}}`).Code)
+
+	w := fulfill(`{"download_urls": {"commission": "https://files.example.com/commission.pdf"}}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	order, err = h.PaymentStore.GetOrder(context.Background(), "download-urls-1")
+	require.NoError(t, err)
+	assert.Equal(t, models.OrderStatusFulfilled, order.Status)
+	assert.Equal(t, "https://files.example.com/commission.pdf", order.Items[0].DownloadURL)
+	assert.Equal(t, "https://files.example.com/workbook.pdf", order.Items[1].DownloadURL)
+}
+
+// TestCreateOrderUsesCatalogImages tests that order items show the catalog's product image
+// rather than one sent by the client
+func TestCreateOrderUsesCatalogImages(t *testing.T) {
+	stub := newStripeStub(t)
+	stub.stubPaymentIntents()
+
+	h, _ := newCatalogTestHandlers(t)
+	require.NoError(t, h.Catalog.CreateProduct(&models.Product{
+		ID: "1", Name: "Test Product", Price: 10, Images: []string{"/images/test-product.png"},
+	}))
+	router := setupTestRouter(h)
+
+	orderRequest := testOrderRequest("images@example.com", 10)
+	items := orderRequest["items"].([]map[string]interface{})
+	items[0]["image_url"] = "https://attacker.example.com/pixel.png"
+	items = append(items, map[string]interface{}{
+		"product_id": "uncataloged", "product_name": "Custom Commission", "price": 5, "image_url": "https://attacker.example.com/pixel.png",
+	})
+	orderRequest["items"] = items
+
+	w := postCreateOrder(t, router, orderRequest)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	var response handlers.CreateOrderResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	require.Len(t, response.Order.Items, 2)
+	assert.Equal(t, "/images/test-product.png", response.Order.Items[0].ImageURL)
+	assert.Empty(t, response.Order.Items[1].ImageURL)
+}
+
+// countingGateway counts the product calls that reach the payment gateway
+type countingGateway struct {
+	handlers.PaymentGateway
+	mu    sync.Mutex
+	lists int
+	gets  int
+}
+
+func (g *countingGateway) ListProducts(ctx context.Context, params *stripe.ProductListParams) ([]*stripe.Product, error) {
+	g.mu.Lock()
+	g.lists++
+	g.mu.Unlock()
+	return g.PaymentGateway.ListProducts(ctx, params)
+}
+
+func (g *countingGateway) GetProduct(ctx context.Context, id string, params *stripe.ProductParams) (*stripe.Product, error) {
+	g.mu.Lock()
+	g.gets++
+	g.mu.Unlock()
+	return g.PaymentGateway.GetProduct(ctx, id, params)
+}
+
+// TestProductCache tests that Stripe products are served from the cache until it expires or is refreshed
+func TestProductCache(t *testing.T) {
+	fake := handlers.NewFakeGateway()
+	fake.AddProduct(&stripe.Product{ID: "prod_planner", Name: "Planner", Active: true})
+	gateway := &countingGateway{PaymentGateway: fake}
+
+	h := handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore())
+	h.Gateway = gateway
+	h.ProductCache = services.NewProductCache(time.Minute)
+	router := setupTestRouter(h)
+
+	listProductsAt := func(target string) []interface{} {
+		t.Helper()
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var response map[string][]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return response["products"]
+	}
+	listProducts := func() []interface{} { return listProductsAt("/api/products/") }
+
+	// Concurrent reads of a warm cache share one Stripe call
+	require.Len(t, listProducts(), 1)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", "/api/products/", nil))
+			assert.Equal(t, http.StatusOK, w.Code)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, gateway.lists)
+
+	// Products from the list are cached for single lookups too
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/products/prod_planner", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 0, gateway.gets)
+
+	// A product added in Stripe shows up once the cache is refreshed
+	fake.AddProduct(&stripe.Product{ID: "prod_journal", Name: "Journal", Active: true})
+	assert.Len(t, listProducts(), 1)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/products/refresh", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, listProducts(), 2)
+	assert.Equal(t, 2, gateway.lists)
+
+	// Expired entries are reloaded on the next lookup
+	h.ProductCache.TTL = time.Millisecond
+	h.ProductCache.Invalidate()
+	listProducts()
+	time.Sleep(5 * time.Millisecond)
+	listProducts()
+	assert.Equal(t, 4, gateway.lists)
+
+	// Limits past Stripe's maximum share one cached list, and archived products are listed apart
+	h.ProductCache.TTL = time.Minute
+	fake.AddProduct(&stripe.Product{ID: "prod_retired", Name: "Retired", Active: false})
+	listProductsAt("/api/products/?limit=100")
+	listProductsAt("/api/products/?limit=1000000")
+	assert.Equal(t, 5, gateway.lists)
+	archived := listProductsAt("/api/products/?active=false")
+	require.Len(t, archived, 1)
+	assert.Equal(t, "prod_retired", archived[0].(map[string]interface{})["id"])
+	assert.Len(t, listProducts(), 2)
+}
+
+// TestStripeProductsIncludeDefaultPrice tests that Stripe products are listed and fetched with their
+// default price expanded, and that products without one still come back
+func TestStripeProductsIncludeDefaultPrice(t *testing.T) {
+	stub := newStripeStub(t)
+	priced := map[string]interface{}{
+		"id": "prod_planner", "object": "product", "name": "Planner", "active": true,
+		"default_price": map[string]interface{}{"id": "price_planner", "object": "price", "unit_amount": 1999, "currency": "usd"},
+	}
+	unpriced := map[string]interface{}{"id": "prod_draft", "object": "product", "name": "Draft", "active": true}
+	stub.On("GET", "/v1/products", func(req stubRequest) (int, interface{}) {
+		return http.StatusOK, map[string]interface{}{"object": "list", "data": []interface{}{priced, unpriced}, "has_more": false}
+	})
+	stub.On("GET", "/v1/products/prod_planner", func(req stubRequest) (int, interface{}) {
+		return http.StatusOK, priced
+	})
+
+	h := handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore())
+	router := setupTestRouter(h)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/products/", nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var list struct {
+		Products []map[string]interface{} `json:"products"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	require.Len(t, list.Products, 2)
+
+	assert.Equal(t, "Planner", list.Products[0]["name"])
+	assert.Equal(t, "price_planner", list.Products[0]["default_price"])
+	assert.Equal(t, 1999.0, list.Products[0]["unit_amount"])
+	assert.Equal(t, "usd", list.Products[0]["currency"])
+
+	assert.Equal(t, "Draft", list.Products[1]["name"])
+	assert.Nil(t, list.Products[1]["default_price"])
+	assert.Nil(t, list.Products[1]["unit_amount"])
+	assert.Nil(t, list.Products[1]["currency"])
+
+	requests := stub.Requests("GET", "/v1/products")
+	require.Len(t, requests, 1)
+	assert.Equal(t, "data.default_price", requests[0].Form.Get("expand[0]"))
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/products/prod_planner", nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var product map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &product))
+	assert.Equal(t, 1999.0, product["unit_amount"])
+	assert.Equal(t, "usd", product["currency"])
+
+	requests = stub.Requests("GET", "/v1/products/prod_planner")
+	require.Len(t, requests, 1)
+	assert.Equal(t, "default_price", requests[0].Form.Get("expand[0]"))
+}
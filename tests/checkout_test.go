@@ -0,0 +1,299 @@
+// tests/checkout_test.go
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/capactiyvirus/stripe-backend/config"
+	"github.com/capactiyvirus/stripe-backend/handlers"
+	"github.com/capactiyvirus/stripe-backend/models"
+	"github.com/capactiyvirus/stripe-backend/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stubCheckoutSessions registers a checkout session responder that hands out sequential IDs
+func (s *stripeStub) stubCheckoutSessions() {
+	created := 0
+	s.On("POST", "/v1/checkout/sessions", func(req stubRequest) (int, interface{}) {
+		created++
+		id := fmt.Sprintf("cs_stub_%d", created)
+		return http.StatusOK, map[string]interface{}{
+			"id":     id,
+			"object": "checkout.session",
+			"url":    "https://checkout.stripe.test/" + id,
+		}
+	})
+}
+
+// postCheckoutSession sends a CreateCheckoutSession request
+func postCheckoutSession(t *testing.T, router http.Handler, body map[string]interface{}) (*httptest.ResponseRecorder, handlers.CheckoutResponse) {
+	t.Helper()
+
+	jsonData, err := json.Marshal(body)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/payments/create-checkout", bytes.NewBuffer(jsonData)))
+
+	var response handlers.CheckoutResponse
+	if w.Code == http.StatusOK {
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	}
+	return w, response
+}
+
+// TestCreateCheckoutSessionLegacySingleItem tests that the original productName and amount shape still works
+func TestCreateCheckoutSessionLegacySingleItem(t *testing.T) {
+	stub := newStripeStub(t)
+	stub.stubCheckoutSessions()
+	router := setupTestRouter(handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore()))
+
+	w, response := postCheckoutSession(t, router, map[string]interface{}{"productName": "Writing Guide", "amount": 1999})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "cs_stub_1", response.ID)
+	assert.Empty(t, response.OrderID)
+
+	requests := stub.Requests("POST", "/v1/checkout/sessions")
+	require.Len(t, requests, 1)
+	form := requests[0].Form
+	assert.Equal(t, "Writing Guide", form.Get("line_items[0][price_data][product_data][name]"))
+	assert.Equal(t, "1999", form.Get("line_items[0][price_data][unit_amount]"))
+	assert.Equal(t, "usd", form.Get("line_items[0][price_data][currency]"))
+	assert.Equal(t, "1", form.Get("line_items[0][quantity]"))
+	assert.Empty(t, form.Get("line_items[1][quantity]"))
+}
+
+// TestCreateCheckoutSessionWithOrder tests that a cart becomes one line item per item and an order linked to the session
+func TestCreateCheckoutSessionWithOrder(t *testing.T) {
+	stub := newStripeStub(t)
+	stub.stubCheckoutSessions()
+	h := newWebhookTestHandlers()
+	router := setupTestRouter(h)
+
+	w, response := postCheckoutSession(t, router, map[string]interface{}{
+		"currency":      "EUR",
+		"create_order":  true,
+		"customer_info": map[string]interface{}{"email": "cart@example.com"},
+		"items": []map[string]interface{}{
+			{"product_id": "guide", "product_name": "Writing Guide", "file_type": "PDF", "price": "9.99", "quantity": 2},
+			{"product_id": "workbook", "product_name": "Workbook", "file_type": "PDF", "price": "5.00"},
+		},
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.NotEmpty(t, response.OrderID)
+
+	form := stub.Requests("POST", "/v1/checkout/sessions")[0].Form
+	assert.Equal(t, "Writing Guide", form.Get("line_items[0][price_data][product_data][name]"))
+	assert.Equal(t, "999", form.Get("line_items[0][price_data][unit_amount]"))
+	assert.Equal(t, "2", form.Get("line_items[0][quantity]"))
+	assert.Equal(t, "Workbook", form.Get("line_items[1][price_data][product_data][name]"))
+	assert.Equal(t, "500", form.Get("line_items[1][price_data][unit_amount]"))
+	assert.Equal(t, "1", form.Get("line_items[1][quantity]"))
+	assert.Equal(t, "eur", form.Get("line_items[1][price_data][currency]"))
+	assert.Equal(t, response.OrderID, form.Get("client_reference_id"))
+	assert.Equal(t, response.OrderID, form.Get("payment_intent_data[metadata][order_id]"))
+	assert.Equal(t, "cart@example.com", form.Get("customer_email"))
+
+	order, err := h.PaymentStore.GetOrder(context.Background(), response.OrderID)
+	require.NoError(t, err)
+	assert.Equal(t, response.TrackingID, order.TrackingID)
+	assert.Equal(t, models.OrderStatusPending, order.Status)
+	assert.Equal(t, "cs_stub_1", order.Payment.StripeSessionID)
+	assert.Equal(t, int64(2498), order.Payment.Amount)
+	assert.Equal(t, "eur", order.Payment.Currency)
+	require.Len(t, order.Items, 2)
+	assert.Equal(t, 2, order.Items[0].Quantity)
+
+	// The session's webhooks find the order
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newSignedWebhookRequest(t, "checkout.session.completed", map[string]interface{}{
+		"id":             "cs_stub_1",
+		"object":         "checkout.session",
+		"payment_intent": "pi_cart_1",
+	}))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	order, err = h.PaymentStore.GetOrder(context.Background(), response.OrderID)
+	require.NoError(t, err)
+	assert.Equal(t, "pi_cart_1", order.Payment.StripePaymentIntentID)
+}
+
+// TestCreateCheckoutSessionValidation tests that orders need an email and items need names
+func TestCreateCheckoutSessionValidation(t *testing.T) {
+	stub := newStripeStub(t)
+	stub.stubCheckoutSessions()
+	router := setupTestRouter(handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore()))
+
+	w, _ := postCheckoutSession(t, router, map[string]interface{}{
+		"create_order": true,
+		"items":        []map[string]interface{}{{"product_name": "Writing Guide", "price": "9.99"}},
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w, _ = postCheckoutSession(t, router, map[string]interface{}{
+		"items": []map[string]interface{}{{"price": "9.99"}},
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	assert.Empty(t, stub.Requests("POST", "/v1/checkout/sessions"))
+}
+
+// TestCheckoutOrderMatchesCreateOrder tests that checkout orders get the same tax exemption check and
+// Stripe customer as CreateOrder's, and that a session Stripe refuses cancels its order
+func TestCheckoutOrderMatchesCreateOrder(t *testing.T) {
+	stub := newStripeStub(t)
+	stub.stubCheckoutSessions()
+	stub.stubCustomers(map[string]string{"cus_existing": "returning@example.com"})
+	h := handlers.NewHandlers(&config.Config{Environment: "test", RequireTaxExemptionID: true}, store.NewMemoryStore())
+	router := setupTestRouter(h)
+
+	items := []map[string]interface{}{{"product_name": "Writing Guide", "price": "9.99"}}
+	w, _ := postCheckoutSession(t, router, map[string]interface{}{
+		"customer_info": map[string]interface{}{"email": "exempt@example.com", "tax_exempt": true},
+		"items":         items,
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Empty(t, stub.Requests("POST", "/v1/checkout/sessions"))
+
+	w, response := postCheckoutSession(t, router, map[string]interface{}{
+		"customer_info": map[string]interface{}{"email": "returning@example.com"},
+		"items":         items,
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	form := stub.Requests("POST", "/v1/checkout/sessions")[0].Form
+	assert.Equal(t, "cus_existing", form.Get("customer"))
+	assert.Empty(t, form.Get("customer_email"))
+	order, err := h.PaymentStore.GetOrder(context.Background(), response.OrderID)
+	require.NoError(t, err)
+	assert.Equal(t, "cus_existing", order.CustomerInfo.StripeCustomerID)
+
+	stub.On("POST", "/v1/checkout/sessions", func(req stubRequest) (int, interface{}) {
+		return http.StatusBadRequest, map[string]interface{}{
+			"error": map[string]interface{}{"type": "invalid_request_error", "message": "Invalid success_url"},
+		}
+	})
+	w, _ = postCheckoutSession(t, router, map[string]interface{}{
+		"customer_info": map[string]interface{}{"email": "refused@example.com"},
+		"items":         items,
+	})
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	orders, err := h.PaymentStore.GetCustomerOrders(context.Background(), "refused@example.com")
+	require.NoError(t, err)
+	require.Len(t, orders, 1)
+	assert.Equal(t, models.OrderStatusCanceled, orders[0].Status)
+}
+
+// TestCheckoutSessionOrderPaidByWebhook tests that a checkout order is paid and confirmed once when its session completes,
+// even though the payment intent's own webhook follows
+func TestCheckoutSessionOrderPaidByWebhook(t *testing.T) {
+	stub := newStripeStub(t)
+	stub.stubCheckoutSessions()
+	stubChargeList(stub, testCharge("ch_checkout_1", 999, 59))
+	smtp := newSMTPStub(t)
+
+	h := newWebhookTestHandlers()
+	h.EmailService = newTestEmailService(smtp)
+	router := setupTestRouter(h)
+
+	w, response := postCheckoutSession(t, router, map[string]interface{}{
+		"customer_info": map[string]interface{}{"email": "checkout@example.com"},
+		"items":         []map[string]interface{}{{"product_id": "guide", "product_name": "Writing Guide", "price": "9.99"}},
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.NotEmpty(t, response.OrderID)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newSignedWebhookRequest(t, "checkout.session.completed", map[string]interface{}{
+		"id":               response.ID,
+		"object":           "checkout.session",
+		"payment_intent":   "pi_checkout_1",
+		"payment_status":   "paid",
+		"amount_total":     999,
+		"customer_details": map[string]interface{}{"email": "checkout@example.com", "name": "Checkout Customer"},
+	}))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	order, err := h.PaymentStore.GetOrder(context.Background(), response.OrderID)
+	require.NoError(t, err)
+	assert.Equal(t, models.OrderStatusPaid, order.Status)
+	assert.Equal(t, models.PaymentStatusSucceeded, order.Payment.Status)
+	assert.Equal(t, "Checkout Customer", order.CustomerInfo.Name)
+
+	messages := smtp.Messages()
+	require.Len(t, messages, 1)
+	assert.Contains(t, messages[0], "checkout@example.com")
+
+	// The payment intent's webhook records the charge without paying or emailing again
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newSignedWebhookRequest(t, "payment_intent.succeeded", succeededIntent("pi_checkout_1", 999, 999)))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	order, err = h.PaymentStore.GetOrder(context.Background(), response.OrderID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ch_checkout_1"}, order.Payment.ChargeIDs)
+	assert.Len(t, smtp.Messages(), 1)
+
+	events := handlerEvents(t, h, response.OrderID)
+	var eventTypes []string
+	for _, event := range events {
+		eventTypes = append(eventTypes, event.EventType)
+	}
+	assert.Equal(t, []string{"order_created", "checkout_completed", "payment_succeeded"}, eventTypes)
+}
+
+// TestCancelCheckoutOrderExpiresSession tests that canceling a checkout order that has no payment intent yet
+// expires its session so the hosted page can't be paid, and that the order stays open if Stripe refuses
+func TestCancelCheckoutOrderExpiresSession(t *testing.T) {
+	stub := newStripeStub(t)
+	stub.stubCheckoutSessions()
+	stub.On("POST", "/v1/checkout/sessions/cs_stub_1/expire", func(req stubRequest) (int, interface{}) {
+		return http.StatusOK, map[string]interface{}{"id": "cs_stub_1", "object": "checkout.session", "status": "expired"}
+	})
+	stub.On("POST", "/v1/checkout/sessions/cs_stub_2/expire", func(req stubRequest) (int, interface{}) {
+		return http.StatusBadRequest, map[string]interface{}{
+			"error": map[string]interface{}{"type": "invalid_request_error", "message": "Only Checkout Sessions with a status in [\"open\"] can be expired."},
+		}
+	})
+	h := handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore())
+	router := setupTestRouter(h)
+
+	items := []map[string]interface{}{{"product_name": "Writing Guide", "price": "9.99"}}
+	checkoutOrder := func(email string) *models.Order {
+		w, response := postCheckoutSession(t, router, map[string]interface{}{
+			"customer_info": map[string]interface{}{"email": email},
+			"items":         items,
+		})
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		order, err := h.PaymentStore.GetOrder(context.Background(), response.OrderID)
+		require.NoError(t, err)
+		return order
+	}
+
+	// The customer cancels their open checkout
+	order := checkoutOrder("checkout-cancel@example.com")
+	body, err := json.Marshal(map[string]string{"tracking_id": order.TrackingID, "email": "checkout-cancel@example.com"})
+	require.NoError(t, err)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/payments/cancel", bytes.NewBuffer(body)))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Len(t, stub.Requests("POST", "/v1/checkout/sessions/cs_stub_1/expire"), 1)
+	order, err = h.PaymentStore.GetOrder(context.Background(), order.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.OrderStatusCanceled, order.Status)
+
+	// A session Stripe won't expire leaves the order as it was
+	order = checkoutOrder("checkout-paid@example.com")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/payments/cancel/"+order.ID, nil))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	order, err = h.PaymentStore.GetOrder(context.Background(), order.ID)
+	require.NoError(t, err)
+	assert.NotEqual(t, models.OrderStatusCanceled, order.Status)
+}
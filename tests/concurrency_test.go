@@ -0,0 +1,134 @@
+// tests/concurrency_test.go
+package tests
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/capactiyvirus/stripe-backend/models"
+	"github.com/capactiyvirus/stripe-backend/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMemoryStoreConcurrentAccess races writers against readers on the same orders. It only finds
+// data races when run with go test -race, but also checks that orders handed out by the store
+// don't share state with the copies it keeps.
+func TestMemoryStoreConcurrentAccess(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+
+	const numOrders = 5
+	orderIDs := make([]string, numOrders)
+	for i := range orderIDs {
+		orderIDs[i] = fmt.Sprintf("race-order-%d", i)
+		require.NoError(t, s.CreateOrder(ctx, &models.Order{
+			ID:           orderIDs[i],
+			TrackingID:   fmt.Sprintf("TRK-RACE-%d", i),
+			CustomerInfo: models.CustomerInfo{Email: "race@example.com"},
+			Items:        []models.OrderItem{{ProductID: "prod_race", Price: 10, Quantity: 1}},
+			Payment:      models.PaymentInfo{Amount: 1000, Currency: "usd", Status: models.PaymentStatusPending},
+			Status:       models.OrderStatusPending,
+			Metadata:     map[string]string{"source": "test"},
+		}))
+	}
+
+	const iterations = 200
+	var wg sync.WaitGroup
+	run := func(fn func(i int, orderID string)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				fn(i, orderIDs[i%numOrders])
+			}
+		}()
+	}
+
+	// Writers
+	run(func(i int, orderID string) {
+		status := models.PaymentStatusPending
+		if i%2 == 1 {
+			status = models.PaymentStatusFailed
+		}
+		assert.NoError(t, s.UpdatePaymentStatus(ctx, orderID, status))
+	})
+	run(func(i int, orderID string) {
+		assert.NoError(t, s.UpdateOrderStatus(ctx, orderID, models.OrderStatusPending))
+	})
+	run(func(i int, orderID string) {
+		assert.NoError(t, s.SetItemDownloadURL(ctx, orderID, "prod_race", fmt.Sprintf("https://files.example.com/%d", i)))
+		assert.NoError(t, s.UpdatePaymentCharges(ctx, orderID, []string{fmt.Sprintf("ch_%d", i)}, 1000))
+	})
+	run(func(i int, orderID string) {
+		// Handlers update an order by changing a copy and writing it back, then keep using the copy
+		order, err := s.GetOrder(ctx, orderID)
+		if !assert.NoError(t, err) {
+			return
+		}
+		order.Metadata = map[string]string{"source": "test", "attempt": fmt.Sprint(i)}
+		assert.NoError(t, s.UpdateOrder(ctx, order))
+		order.Metadata["after_update"] = "true"
+		order.Items[0].DownloadURL = "https://files.example.com/local"
+	})
+
+	// Readers, which also scribble on what they're given
+	run(func(i int, orderID string) {
+		order, err := s.GetOrder(ctx, orderID)
+		if !assert.NoError(t, err) {
+			return
+		}
+		_ = order.Payment.Status
+		_ = order.Metadata["attempt"]
+		_ = len(order.Payment.ChargeIDs)
+		order.Items[0].DownloadURL = ""
+		order.Metadata["reader"] = "true"
+	})
+	run(func(i int, orderID string) {
+		summaries, err := s.GetAllOrders(ctx, numOrders, 0, models.OrderFilter{})
+		assert.NoError(t, err)
+		assert.Len(t, summaries, numOrders)
+	})
+	run(func(i int, orderID string) {
+		assert.NoError(t, s.EachOrder(ctx, models.OrderFilter{}, func(order *models.Order) error {
+			_ = order.Items[0].DownloadURL
+			order.Metadata["each"] = "true"
+			return nil
+		}))
+		orders, err := s.GetCustomerOrders(ctx, "race@example.com")
+		assert.NoError(t, err)
+		assert.Len(t, orders, numOrders)
+	})
+	run(func(i int, orderID string) {
+		// Bulk reads that work on the store's own orders under its read lock
+		summaries, err := s.SearchOrders(ctx, "race", numOrders)
+		assert.NoError(t, err)
+		assert.Len(t, summaries, numOrders)
+		summaries, err = s.GetCustomerOrderSummaries(ctx, "race@example.com", numOrders, 0)
+		assert.NoError(t, err)
+		assert.Len(t, summaries, numOrders)
+		stats, err := s.GetPaymentStats(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, numOrders, stats.TotalOrders)
+		count, err := s.CountOrders(ctx, models.OrderFilter{})
+		assert.NoError(t, err)
+		assert.Equal(t, numOrders, count)
+		_, err = s.GetPaymentEvents(ctx, orderID)
+		assert.NoError(t, err)
+	})
+
+	wg.Wait()
+
+	// Nothing a caller did to its copies may have reached the store
+	for _, orderID := range orderIDs {
+		order, err := s.GetOrder(ctx, orderID)
+		require.NoError(t, err)
+		assert.NotContains(t, order.Metadata, "reader")
+		assert.NotContains(t, order.Metadata, "each")
+		assert.NotContains(t, order.Metadata, "after_update")
+		assert.NotEqual(t, "https://files.example.com/local", order.Items[0].DownloadURL)
+		assert.NotEmpty(t, order.Items[0].DownloadURL)
+	}
+}
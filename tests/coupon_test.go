@@ -0,0 +1,213 @@
+// tests/coupon_test.go
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/capactiyvirus/stripe-backend/config"
+	"github.com/capactiyvirus/stripe-backend/handlers"
+	"github.com/capactiyvirus/stripe-backend/models"
+	"github.com/capactiyvirus/stripe-backend/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// postCoupon creates a coupon through the admin endpoint
+func postCoupon(t *testing.T, router http.Handler, coupon map[string]interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+
+	jsonData, err := json.Marshal(coupon)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/payments/coupons", bytes.NewBuffer(jsonData)))
+	return w
+}
+
+// couponOrderRequest builds a $20.00 order request with a coupon code
+func couponOrderRequest(code string) map[string]interface{} {
+	orderRequest := testOrderRequest("coupon@example.com", 20.00)
+	orderRequest["coupon_code"] = code
+	return orderRequest
+}
+
+// TestCreateOrderAppliesCoupon tests that percent and fixed coupons come off the payment intent amount
+func TestCreateOrderAppliesCoupon(t *testing.T) {
+	stub := newStripeStub(t)
+	stub.stubPaymentIntents()
+
+	h := handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore())
+	router := setupTestRouter(h)
+
+	require.Equal(t, http.StatusCreated, postCoupon(t, router, map[string]interface{}{"code": "spring15", "percent_off": 15}).Code)
+	require.Equal(t, http.StatusCreated, postCoupon(t, router, map[string]interface{}{"code": "FIVEOFF", "amount_off": 500, "currency": "USD"}).Code)
+
+	tests := []struct {
+		code     string
+		discount int64
+	}{
+		{" Spring15 ", 300},
+		{"fiveoff", 500},
+	}
+	for i, tt := range tests {
+		w := postCreateOrder(t, router, couponOrderRequest(tt.code))
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+		var response handlers.CreateOrderResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, models.NormalizeCouponCode(tt.code), response.Order.CouponCode)
+		assert.Equal(t, tt.discount, response.Order.Payment.DiscountAmount)
+		assert.Equal(t, 2000-tt.discount, response.Order.Payment.Amount)
+
+		intent := stub.Requests("POST", "/v1/payment_intents")[i]
+		assert.Equal(t, strconv.FormatInt(response.Order.Payment.Amount, 10), intent.Form.Get("amount"))
+		assert.Equal(t, response.Order.CouponCode, intent.Form.Get("metadata[coupon_code]"))
+
+		events, err := h.PaymentStore.GetPaymentEvents(context.Background(), response.Order.ID)
+		require.NoError(t, err)
+		require.Len(t, events, 1)
+		assert.Equal(t, response.Order.CouponCode, events[0].Data.(map[string]interface{})["coupon_code"])
+	}
+}
+
+// TestCreateOrderRejectsUnusableCoupons tests that unknown, expired, used-up, and whole-order coupons are rejected
+// without creating a payment intent
+func TestCreateOrderRejectsUnusableCoupons(t *testing.T) {
+	stub := newStripeStub(t)
+	stub.stubPaymentIntents()
+
+	paymentStore := store.NewMemoryStore()
+	router := setupTestRouter(handlers.NewHandlers(&config.Config{Environment: "test"}, paymentStore))
+
+	expired := time.Now().Add(-time.Hour)
+	require.NoError(t, paymentStore.CreateCoupon(context.Background(), &models.Coupon{Code: "EXPIRED", PercentOff: 10, ExpiresAt: &expired}))
+	require.NoError(t, paymentStore.CreateCoupon(context.Background(), &models.Coupon{Code: "ONCE", PercentOff: 10, MaxUses: 1}))
+	require.NoError(t, paymentStore.CreateCoupon(context.Background(), &models.Coupon{Code: "FREE", PercentOff: 100}))
+
+	require.Equal(t, http.StatusCreated, postCreateOrder(t, router, couponOrderRequest("ONCE")).Code)
+
+	for _, code := range []string{"MISSING", "EXPIRED", "ONCE", "FREE"} {
+		w := postCreateOrder(t, router, couponOrderRequest(code))
+		assert.Equal(t, http.StatusBadRequest, w.Code, code)
+	}
+	assert.Len(t, stub.Requests("POST", "/v1/payment_intents"), 1)
+
+	// A rejected whole-order coupon gives its use back
+	_, err := paymentStore.ValidateCoupon(context.Background(), "FREE", 2000, "usd")
+	assert.NoError(t, err)
+}
+
+// TestCouponUseReleasedWhenOrderFails tests that a coupon use isn't spent on an order Stripe rejects
+func TestCouponUseReleasedWhenOrderFails(t *testing.T) {
+	newStripeStub(t) // No payment intent stub, so creating one fails
+
+	paymentStore := store.NewMemoryStore()
+	router := setupTestRouter(handlers.NewHandlers(&config.Config{Environment: "test"}, paymentStore))
+	require.NoError(t, paymentStore.CreateCoupon(context.Background(), &models.Coupon{Code: "ONCE", PercentOff: 10, MaxUses: 1}))
+
+	w := postCreateOrder(t, router, couponOrderRequest("ONCE"))
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+
+	_, err := paymentStore.ValidateCoupon(context.Background(), "ONCE", 2000, "usd")
+	assert.NoError(t, err)
+}
+
+// TestCouponUseReleasedWhenOrderCanceled tests that an order that's canceled before it's paid gives its
+// coupon use back, once however often it's canceled, and that a fatal hook failure doesn't give it back twice
+func TestCouponUseReleasedWhenOrderCanceled(t *testing.T) {
+	stub := newStripeStub(t)
+	stub.stubPaymentIntents()
+
+	paymentStore := store.NewMemoryStore()
+	h := handlers.NewHandlers(&config.Config{Environment: "test", HookErrorsFatal: true}, paymentStore)
+	router := setupTestRouter(h)
+	require.NoError(t, paymentStore.CreateCoupon(context.Background(), &models.Coupon{Code: "ONCE", PercentOff: 10, MaxUses: 1}))
+
+	w := postCreateOrder(t, router, couponOrderRequest("ONCE"))
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var response handlers.CreateOrderResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, http.StatusBadRequest, postCreateOrder(t, router, couponOrderRequest("ONCE")).Code)
+
+	require.NoError(t, paymentStore.UpdateOrderStatus(context.Background(), response.Order.ID, models.OrderStatusCanceled))
+	require.NoError(t, paymentStore.UpdateOrderStatus(context.Background(), response.Order.ID, models.OrderStatusCanceled))
+
+	h.RegisterHook(&recordingHook{err: errors.New("ERP unavailable")})
+	require.Equal(t, http.StatusInternalServerError, postCreateOrder(t, router, couponOrderRequest("ONCE")).Code)
+
+	_, err := paymentStore.ValidateCoupon(context.Background(), "ONCE", 2000, "usd")
+	require.NoError(t, err)
+	_, err = paymentStore.ValidateCoupon(context.Background(), "ONCE", 2000, "usd")
+	assert.ErrorIs(t, err, models.ErrCouponExhausted)
+}
+
+// TestCreateOrderRejectsCouponInOtherCurrency tests that an amount_off coupon only applies to orders in its currency
+func TestCreateOrderRejectsCouponInOtherCurrency(t *testing.T) {
+	stub := newStripeStub(t)
+	stub.stubPaymentIntents()
+
+	paymentStore := store.NewMemoryStore()
+	router := setupTestRouter(handlers.NewHandlers(&config.Config{Environment: "test"}, paymentStore))
+	require.NoError(t, paymentStore.CreateCoupon(context.Background(), &models.Coupon{Code: "FIVEOFF", AmountOff: 500, Currency: "usd"}))
+
+	orderRequest := couponOrderRequest("FIVEOFF")
+	orderRequest["currency"] = "jpy"
+	w := postCreateOrder(t, router, orderRequest)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), models.ErrCouponCurrency.Error())
+	assert.Empty(t, stub.Requests("POST", "/v1/payment_intents"))
+}
+
+// TestValidateCouponCountsUsesAtomically tests that concurrent redemptions never exceed MaxUses
+func TestValidateCouponCountsUsesAtomically(t *testing.T) {
+	paymentStore := store.NewMemoryStore()
+	require.NoError(t, paymentStore.CreateCoupon(context.Background(), &models.Coupon{Code: "LIMITED", AmountOff: 100, Currency: "usd", MaxUses: 5}))
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	redeemed := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := paymentStore.ValidateCoupon(context.Background(), "LIMITED", 1000, "usd"); err == nil {
+				mu.Lock()
+				redeemed++
+				mu.Unlock()
+			} else {
+				assert.ErrorIs(t, err, models.ErrCouponExhausted)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 5, redeemed)
+}
+
+// TestCreateCouponValidation tests that malformed and duplicate coupons are rejected
+func TestCreateCouponValidation(t *testing.T) {
+	router := setupTestRouter(handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore()))
+
+	require.Equal(t, http.StatusCreated, postCoupon(t, router, map[string]interface{}{"code": "TAKEN", "percent_off": 10}).Code)
+
+	for name, coupon := range map[string]map[string]interface{}{
+		"missing code":     {"percent_off": 10},
+		"no discount":      {"code": "NONE"},
+		"both discounts":   {"code": "BOTH", "percent_off": 10, "amount_off": 100},
+		"over 100 percent": {"code": "MUCH", "percent_off": 150},
+		"no currency":      {"code": "NOCUR", "amount_off": 100},
+		"bad currency":     {"code": "BADCUR", "amount_off": 100, "currency": "xyz"},
+		"percent currency": {"code": "PCTCUR", "percent_off": 10, "currency": "usd"},
+	} {
+		assert.Equal(t, http.StatusBadRequest, postCoupon(t, router, coupon).Code, name)
+	}
+	assert.Equal(t, http.StatusConflict, postCoupon(t, router, map[string]interface{}{"code": "taken", "amount_off": 100, "currency": "usd"}).Code)
+}
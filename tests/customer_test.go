@@ -0,0 +1,151 @@
+// tests/customer_test.go
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/capactiyvirus/stripe-backend/config"
+	"github.com/capactiyvirus/stripe-backend/handlers"
+	"github.com/capactiyvirus/stripe-backend/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stubCustomers registers create, retrieve, and list-by-email responders for Stripe customers,
+// backed by emails, a map of customer ID to email
+func (s *stripeStub) stubCustomers(emails map[string]string) {
+	var mu sync.Mutex
+
+	s.On("POST", "/v1/customers", func(req stubRequest) (int, interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		id := fmt.Sprintf("cus_stub_%d", len(emails)+1)
+		emails[id] = req.Form.Get("email")
+		return http.StatusOK, map[string]interface{}{"id": id, "object": "customer", "email": emails[id]}
+	})
+	s.On("GET", "/v1/customers/*", func(req stubRequest) (int, interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		id := strings.TrimPrefix(req.Path, "/v1/customers/")
+		email, ok := emails[id]
+		if !ok {
+			return http.StatusNotFound, map[string]interface{}{
+				"error": map[string]interface{}{"type": "invalid_request_error", "code": "resource_missing"},
+			}
+		}
+		return http.StatusOK, map[string]interface{}{"id": id, "object": "customer", "email": email}
+	})
+	s.On("GET", "/v1/customers", func(req stubRequest) (int, interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		data := []interface{}{}
+		for id, email := range emails {
+			if email == req.Form.Get("email") {
+				data = append(data, map[string]interface{}{"id": id, "object": "customer", "email": email})
+			}
+		}
+		return http.StatusOK, map[string]interface{}{"object": "list", "url": "/v1/customers", "data": data}
+	})
+}
+
+// createOrderForCustomer creates an order for email, returning its Stripe customer ID
+func createOrderForCustomer(t *testing.T, router http.Handler, email string) string {
+	t.Helper()
+
+	w := postCreateOrder(t, router, testOrderRequest(email, 9.99))
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	var response handlers.CreateOrderResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	return response.Order.CustomerInfo.StripeCustomerID
+}
+
+// TestCreateOrderReusesStripeCustomer tests that orders from the same email share one Stripe customer
+func TestCreateOrderReusesStripeCustomer(t *testing.T) {
+	stub := newStripeStub(t)
+	stub.stubPaymentIntents()
+	stub.stubCustomers(map[string]string{})
+
+	paymentStore := store.NewMemoryStore()
+	router := setupTestRouter(handlers.NewHandlers(&config.Config{Environment: "test"}, paymentStore))
+
+	customerID := createOrderForCustomer(t, router, "returning@example.com")
+	require.Equal(t, "cus_stub_1", customerID)
+	assert.Equal(t, "cus_stub_1", createOrderForCustomer(t, router, "Returning@Example.com"))
+
+	// The second order used the saved mapping without searching Stripe or creating a customer
+	created := stub.Requests("POST", "/v1/customers")
+	require.Len(t, created, 1)
+	key := created[0].Header.Get("Idempotency-Key")
+	assert.True(t, strings.HasPrefix(key, "customer-"), key)
+	assert.NotContains(t, key, "returning")
+	assert.Len(t, stub.Requests("GET", "/v1/customers"), 1)
+
+	intents := stub.Requests("POST", "/v1/payment_intents")
+	require.Len(t, intents, 2)
+	for _, intent := range intents {
+		assert.Equal(t, "cus_stub_1", intent.Form.Get("customer"))
+	}
+
+	saved, err := paymentStore.GetStripeCustomerID(context.Background(), "returning@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "cus_stub_1", saved)
+}
+
+// TestCreateOrderFindsExistingStripeCustomer tests that a customer Stripe already has for the email is reused
+func TestCreateOrderFindsExistingStripeCustomer(t *testing.T) {
+	stub := newStripeStub(t)
+	stub.stubPaymentIntents()
+	stub.stubCustomers(map[string]string{"cus_existing": "existing@example.com"})
+
+	router := setupTestRouter(handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore()))
+
+	assert.Equal(t, "cus_existing", createOrderForCustomer(t, router, "existing@example.com"))
+	assert.Empty(t, stub.Requests("POST", "/v1/customers"))
+}
+
+// TestCreateOrderAfterStripeCustomerEmailChanges tests that a customer whose email changed in Stripe
+// follows its new email instead of the old one
+func TestCreateOrderAfterStripeCustomerEmailChanges(t *testing.T) {
+	stub := newStripeStub(t)
+	stub.stubPaymentIntents()
+	emails := map[string]string{}
+	stub.stubCustomers(emails)
+
+	paymentStore := store.NewMemoryStore()
+	router := setupTestRouter(handlers.NewHandlers(&config.Config{Environment: "test"}, paymentStore))
+
+	require.Equal(t, "cus_stub_1", createOrderForCustomer(t, router, "old@example.com"))
+	emails["cus_stub_1"] = "new@example.com"
+
+	// The old address no longer belongs to the customer, so it gets a new one
+	assert.Equal(t, "cus_stub_2", createOrderForCustomer(t, router, "old@example.com"))
+	assert.Equal(t, "cus_stub_1", createOrderForCustomer(t, router, "new@example.com"))
+
+	saved, err := paymentStore.GetStripeCustomerID(context.Background(), "new@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "cus_stub_1", saved)
+}
+
+// TestCreateOrderWithoutStripeCustomer tests that a Stripe customer failure doesn't block the order
+func TestCreateOrderWithoutStripeCustomer(t *testing.T) {
+	stub := newStripeStub(t)
+	stub.stubPaymentIntents()
+
+	router := setupTestRouter(handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore()))
+
+	assert.Empty(t, createOrderForCustomer(t, router, "nocustomer@example.com"))
+
+	intents := stub.Requests("POST", "/v1/payment_intents")
+	require.Len(t, intents, 1)
+	assert.Empty(t, intents[0].Form.Get("customer"))
+}
@@ -0,0 +1,672 @@
+// tests/email_test.go
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/capactiyvirus/stripe-backend/config"
+	"github.com/capactiyvirus/stripe-backend/handlers"
+	"github.com/capactiyvirus/stripe-backend/models"
+	"github.com/capactiyvirus/stripe-backend/services"
+	"github.com/capactiyvirus/stripe-backend/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestEmailDispatcherRateLimit tests that a burst of emails is spread out to the configured rate
+func TestEmailDispatcherRateLimit(t *testing.T) {
+	const rate = 20.0 // emails per second
+	const burst = 5
+	interval := time.Duration(float64(time.Second) / rate)
+
+	dispatcher := services.NewEmailDispatcher(rate, burst)
+	dispatcher.Start()
+
+	var mu sync.Mutex
+	var sentAt []time.Time
+
+	for i := 0; i < burst; i++ {
+		err := dispatcher.Enqueue(func() error {
+			mu.Lock()
+			sentAt = append(sentAt, time.Now())
+			mu.Unlock()
+			return nil
+		})
+		require.NoError(t, err)
+	}
+
+	dispatcher.Stop()
+
+	require.Len(t, sentAt, burst)
+	for i := 1; i < len(sentAt); i++ {
+		gap := sentAt[i].Sub(sentAt[i-1])
+		assert.GreaterOrEqual(t, gap, interval-5*time.Millisecond, "email %d sent too soon after the previous one", i)
+	}
+	assert.GreaterOrEqual(t, sentAt[burst-1].Sub(sentAt[0]), time.Duration(burst-1)*interval-5*time.Millisecond)
+}
+
+// TestEmailDispatcherRejectsAfterStop tests that a stopped dispatcher doesn't accept emails
+func TestEmailDispatcherRejectsAfterStop(t *testing.T) {
+	dispatcher := services.NewEmailDispatcher(10, 1)
+	dispatcher.Start()
+	dispatcher.Stop()
+
+	err := dispatcher.Enqueue(func() error { return nil })
+	assert.Error(t, err)
+}
+
+// newTestEmailService creates an email service that delivers to the SMTP stub
+func newTestEmailService(stub *smtpStub) *services.EmailService {
+	return &services.EmailService{
+		SMTPHost:  stub.Host(),
+		SMTPPort:  stub.Port(),
+		FromEmail: "orders@example.com",
+		FromName:  "Test Store",
+	}
+}
+
+// emailedDownloadToken returns the token of the download link to linkURL in an email body
+func emailedDownloadToken(t *testing.T, body, linkURL string) string {
+	t.Helper()
+	match := regexp.MustCompile(regexp.QuoteMeta(linkURL) + `\?token=([0-9]+\.[0-9a-f]+)`).FindStringSubmatch(body)
+	require.NotNil(t, match, "no download link to %s", linkURL)
+	return match[1]
+}
+
+// newTestEmailOrder builds an order with a relative and an absolute product image
+func newTestEmailOrder() *models.Order {
+	return &models.Order{
+		ID:         "ORDemail1",
+		TrackingID: "TRKemail1",
+		CustomerInfo: models.CustomerInfo{
+			Email: "buyer@example.com",
+			Name:  "Buyer",
+		},
+		Items: []models.OrderItem{
+			{ProductID: "guide", ProductName: "Writing Guide", FileType: "PDF", Price: 9.99, Quantity: 1, ImageURL: "/images/guide.png"},
+			{ProductID: "workbook", ProductName: "Workbook", FileType: "PDF", Price: 5.00, Quantity: 1, ImageURL: "https://files.stripe.com/workbook.png"},
+		},
+		Payment:   models.PaymentInfo{Amount: 1499, Currency: "usd"},
+		CreatedAt: time.Now(),
+	}
+}
+
+// TestEmailRendersResolvedProductImages tests that relative thumbnails resolve against ASSET_BASE_URL
+func TestEmailRendersResolvedProductImages(t *testing.T) {
+	stub := newSMTPStub(t)
+	emailService := newTestEmailService(stub)
+	emailService.AssetBaseURL = "https://cdn.example.com/assets/"
+
+	order := newTestEmailOrder()
+	require.NoError(t, emailService.SendOrderConfirmation(order))
+	require.NoError(t, emailService.SendFulfillmentEmail(order, map[string]string{"guide": "https://example.com/dl/guide"}))
+
+	messages := stub.Messages()
+	require.Len(t, messages, 2)
+	for _, msg := range messages {
+		html := emailPart(t, msg, "text/html")
+		assert.Contains(t, html, `src="https://cdn.example.com/assets/images/guide.png"`)
+		assert.Contains(t, html, `src="https://files.stripe.com/workbook.png"`)
+	}
+}
+
+// TestPaymentConfirmationShowsTaxExemption tests that the receipt email marks tax-exempt orders
+func TestPaymentConfirmationShowsTaxExemption(t *testing.T) {
+	stub := newSMTPStub(t)
+	emailService := newTestEmailService(stub)
+
+	order := newTestEmailOrder()
+	order.CustomerInfo.TaxExempt = true
+	order.CustomerInfo.TaxExemptionID = "EX-12345"
+	require.NoError(t, emailService.SendPaymentConfirmation(order))
+
+	messages := stub.Messages()
+	require.Len(t, messages, 1)
+	assert.Contains(t, emailPart(t, messages[0], "text/html"), "Tax exempt (exemption ID: EX-12345)")
+}
+
+// TestEmailsFormatAmountsInOrderCurrency tests that prices and totals are shown with the order's
+// currency and its decimal places rather than as dollars
+func TestEmailsFormatAmountsInOrderCurrency(t *testing.T) {
+	stub := newSMTPStub(t)
+	emailService := newTestEmailService(stub)
+
+	order := newTestEmailOrder()
+	order.Items = order.Items[:1]
+	order.Items[0].Price = 1500
+	order.Payment = models.PaymentInfo{Amount: 1500, Currency: "jpy"}
+	require.NoError(t, emailService.SendOrderConfirmation(order))
+	require.NoError(t, emailService.SendPaymentConfirmation(order))
+	require.NoError(t, emailService.SendPaymentFailedNotification(order))
+	require.NoError(t, emailService.SendRefundNotification(order, 500, ""))
+
+	messages := stub.Messages()
+	require.Len(t, messages, 4)
+	for _, msg := range messages {
+		html := emailPart(t, msg, "text/html")
+		assert.NotContains(t, html, "$")
+		assert.NotContains(t, html, "15.00")
+	}
+	assert.Contains(t, emailPart(t, messages[0], "text/html"), "Price: 1500 JPY")
+	assert.Contains(t, emailPart(t, messages[0], "text/html"), "Total: 1500 JPY")
+	assert.Contains(t, emailPart(t, messages[1], "text/html"), "1500 JPY")
+	assert.Contains(t, emailPart(t, messages[2], "text/html"), "1500 JPY")
+	assert.Contains(t, emailPart(t, messages[3], "text/html"), "500 JPY")
+}
+
+// TestSendEmailRetriesTransientFailures tests that temporary SMTP failures are retried with backoff
+func TestSendEmailRetriesTransientFailures(t *testing.T) {
+	stub := newSMTPStub(t)
+	emailService := newTestEmailService(stub)
+	emailService.MaxRetries = 2
+	emailService.RetryBackoff = time.Millisecond
+
+	stub.FailRecipients("451 try again later", "421 service not available")
+	require.NoError(t, emailService.SendOrderConfirmation(newTestEmailOrder()))
+	assert.Equal(t, 3, stub.RecipientAttempts())
+	assert.Len(t, stub.Messages(), 1)
+
+	// Out of retries
+	stub.FailRecipients("451 try again later", "451 try again later", "451 try again later")
+	err := emailService.SendOrderConfirmation(newTestEmailOrder())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "after 3 attempt(s)")
+	assert.Equal(t, 6, stub.RecipientAttempts())
+	assert.Len(t, stub.Messages(), 1)
+}
+
+// TestSendEmailDoesNotRetryPermanentFailures tests that a rejected recipient fails on the first attempt
+func TestSendEmailDoesNotRetryPermanentFailures(t *testing.T) {
+	stub := newSMTPStub(t)
+	emailService := newTestEmailService(stub)
+	emailService.MaxRetries = 2
+	emailService.RetryBackoff = time.Millisecond
+
+	stub.FailRecipients("550 no such user")
+	err := emailService.SendOrderConfirmation(newTestEmailOrder())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "after 1 attempt(s)")
+	assert.Contains(t, err.Error(), "no such user")
+	assert.Equal(t, 1, stub.RecipientAttempts())
+	assert.Empty(t, stub.Messages())
+}
+
+// TestSendEmailTLSModes tests sending over implicit TLS and required STARTTLS, verifying the server
+// certificate unless TLSInsecure is set
+func TestSendEmailTLSModes(t *testing.T) {
+	for _, tc := range []struct {
+		mode     string
+		implicit bool
+	}{
+		{services.SMTPTLS, true},
+		{services.SMTPTLSStartTLS, false},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			stub := newTLSSMTPStub(t, tc.implicit)
+			emailService := newTestEmailService(stub)
+			emailService.TLSMode = tc.mode
+			emailService.RetryBackoff = time.Millisecond
+
+			// The stub's certificate isn't from a trusted CA
+			err := emailService.SendOrderConfirmation(newTestEmailOrder())
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "certificate")
+
+			emailService.TLSInsecure = true
+			require.NoError(t, emailService.SendOrderConfirmation(newTestEmailOrder()))
+			messages := stub.Messages()
+			require.Len(t, messages, 1)
+			assert.Contains(t, messages[0], "Subject: Order Confirmation")
+		})
+	}
+
+	// Without encryption, a server that requires STARTTLS refuses the mail
+	stub := newTLSSMTPStub(t, false)
+	emailService := newTestEmailService(stub)
+	emailService.TLSMode = services.SMTPTLSNone
+	err := emailService.SendOrderConfirmation(newTestEmailOrder())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "after 1 attempt(s)")
+	assert.Empty(t, stub.Messages())
+
+	// STARTTLS is required in starttls mode
+	emailService = newTestEmailService(newSMTPStub(t))
+	emailService.TLSMode = services.SMTPTLSStartTLS
+	err = emailService.SendOrderConfirmation(newTestEmailOrder())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "doesn't support STARTTLS")
+
+	emailService.TLSMode = "ssl"
+	err = emailService.SendOrderConfirmation(newTestEmailOrder())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown SMTP_TLS_MODE")
+}
+
+// TestEmailTemplateDirOverridesEmbeddedTemplates tests that templates in EMAIL_TEMPLATE_DIR replace
+// the embedded ones by name, and that missing files fall back to the embedded templates
+func TestEmailTemplateDirOverridesEmbeddedTemplates(t *testing.T) {
+	stub := newSMTPStub(t)
+	emailService := newTestEmailService(stub)
+	emailService.TemplateDir = t.TempDir()
+
+	path := filepath.Join(emailService.TemplateDir, "order_confirmation.html")
+	require.NoError(t, os.WriteFile(path, []byte(`<p>Custom copy for {{.Order.TrackingID}}</p>`), 0o644))
+
+	order := newTestEmailOrder()
+	require.NoError(t, emailService.SendOrderConfirmation(order))
+	require.NoError(t, emailService.SendPaymentConfirmation(order))
+
+	// Parsed templates are cached, so later edits aren't picked up
+	require.NoError(t, os.WriteFile(path, []byte(`<p>Edited</p>`), 0o644))
+	require.NoError(t, emailService.SendOrderConfirmation(order))
+
+	messages := stub.Messages()
+	require.Len(t, messages, 3)
+	assert.Contains(t, emailPart(t, messages[0], "text/html"), "Custom copy for TRKemail1")
+	assert.Contains(t, emailPart(t, messages[1], "text/html"), "Your payment has been successfully processed")
+	assert.NotContains(t, emailPart(t, messages[1], "text/html"), "Custom copy")
+	assert.Contains(t, emailPart(t, messages[2], "text/html"), "Custom copy for TRKemail1")
+}
+
+// TestEmailIncludesPlainTextAlternative tests that emails carry a plain-text part, rendered from a
+// text template when TemplateDir has one and derived from the HTML otherwise
+func TestEmailIncludesPlainTextAlternative(t *testing.T) {
+	stub := newSMTPStub(t)
+	emailService := newTestEmailService(stub)
+	emailService.TemplateDir = t.TempDir()
+
+	path := filepath.Join(emailService.TemplateDir, "refund_notification.txt")
+	require.NoError(t, os.WriteFile(path, []byte(`Refund for {{.Order.TrackingID}}: ${{printf "%.2f" (div .Order.Payment.Amount 100)}} & more`), 0o644))
+
+	order := newTestEmailOrder()
+	require.NoError(t, emailService.SendOrderConfirmation(order))
+	require.NoError(t, emailService.SendRefundNotification(order, order.Payment.Amount, ""))
+
+	messages := stub.Messages()
+	require.Len(t, messages, 2)
+
+	var boundaries []string
+	for _, raw := range messages {
+		msg, err := mail.ReadMessage(strings.NewReader(raw))
+		require.NoError(t, err)
+		assert.Equal(t, "1.0", msg.Header.Get("MIME-Version"))
+		mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+		require.NoError(t, err)
+		assert.Equal(t, "multipart/alternative", mediaType)
+		boundaries = append(boundaries, params["boundary"])
+	}
+	assert.NotEqual(t, boundaries[0], boundaries[1])
+
+	// No text template: derived from the HTML
+	text := emailPart(t, messages[0], "text/plain")
+	assert.Contains(t, text, "TRKemail1")
+	assert.NotContains(t, text, "<")
+	assert.NotContains(t, text, "font-family")
+	assert.Contains(t, emailPart(t, messages[0], "text/html"), "<!DOCTYPE html>")
+
+	// Text template, which isn't HTML-escaped
+	assert.Equal(t, "Refund for TRKemail1: $14.99 & more", emailPart(t, messages[1], "text/plain"))
+}
+
+// TestEmailTrackingURLIsSigned tests that emailed tracking links carry a token when a tracking secret is set
+func TestEmailTrackingURLIsSigned(t *testing.T) {
+	stub := newSMTPStub(t)
+	emailService := newTestEmailService(stub)
+	emailService.TrackingSecret = "tracking-secret"
+
+	order := newTestEmailOrder()
+	require.NoError(t, emailService.SendPaymentConfirmation(order))
+
+	messages := stub.Messages()
+	require.Len(t, messages, 1)
+	assert.Contains(t, emailPart(t, messages[0], "text/html"), "token="+services.GenerateTrackingToken("tracking-secret", order.TrackingID))
+}
+
+// TestEmailBranding tests that emails use the configured company, support address, and tracking page,
+// and the defaults when those aren't set
+func TestEmailBranding(t *testing.T) {
+	stub := newSMTPStub(t)
+	t.Setenv("SMTP_HOST", stub.Host())
+	t.Setenv("SMTP_PORT", stub.Port())
+	emailService := services.NewEmailService(&config.Config{
+		CompanyName:     "Inkwell Stationery",
+		SupportEmail:    "help@inkwell.example",
+		TrackingBaseURL: "https://inkwell.example/orders/track?lang=en",
+	})
+	require.NotNil(t, emailService.Dispatcher)
+	emailService.FromEmail = "orders@inkwell.example"
+
+	order := newTestEmailOrder()
+	require.NoError(t, emailService.SendOrderConfirmation(order))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	emailService.Dispatcher.Shutdown(ctx)
+	require.NoError(t, newTestEmailService(stub).SendOrderConfirmation(order))
+
+	messages := stub.Messages()
+	require.Len(t, messages, 2)
+	branded := emailPart(t, messages[0], "text/html")
+	assert.Contains(t, branded, "Inkwell Stationery")
+	assert.Contains(t, branded, "help@inkwell.example")
+	assert.Contains(t, branded, "https://inkwell.example/orders/track?id="+order.TrackingID+"&amp;lang=en")
+	assert.NotContains(t, branded, config.DefaultCompanyName)
+
+	unbranded := emailPart(t, messages[1], "text/html")
+	assert.Contains(t, unbranded, config.DefaultCompanyName)
+	assert.Contains(t, unbranded, config.DefaultSupportEmail)
+	assert.Contains(t, unbranded, config.DefaultTrackingBaseURL+"?id="+order.TrackingID)
+}
+
+// TestEmailServiceWithoutSMTPHost tests that no email dispatcher is started when SMTP_HOST isn't set
+func TestEmailServiceWithoutSMTPHost(t *testing.T) {
+	t.Setenv("SMTP_HOST", "")
+	assert.Nil(t, services.NewEmailService(&config.Config{}).Dispatcher)
+}
+
+// TestPaymentConfirmationAttachesReceiptPDF tests the MIME structure of a confirmation with the receipt attached
+func TestPaymentConfirmationAttachesReceiptPDF(t *testing.T) {
+	stub := newSMTPStub(t)
+	emailService := newTestEmailService(stub)
+	emailService.AttachReceiptPDF = true
+
+	order := newTestEmailOrder()
+	require.NoError(t, emailService.SendPaymentConfirmation(order))
+
+	messages := stub.Messages()
+	require.Len(t, messages, 1)
+
+	msg, err := mail.ReadMessage(strings.NewReader(messages[0]))
+	require.NoError(t, err)
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	require.Equal(t, "multipart/mixed", mediaType)
+
+	mixed := multipart.NewReader(msg.Body, params["boundary"])
+
+	// First the text/HTML alternative...
+	part, err := mixed.NextPart()
+	require.NoError(t, err)
+	mediaType, params, err = mime.ParseMediaType(part.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	require.Equal(t, "multipart/alternative", mediaType)
+
+	alternative := multipart.NewReader(part, params["boundary"])
+	var alternatives []string
+	for {
+		body, err := alternative.NextPart()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		mediaType, _, err := mime.ParseMediaType(body.Header.Get("Content-Type"))
+		require.NoError(t, err)
+		alternatives = append(alternatives, mediaType)
+
+		content, err := io.ReadAll(body)
+		require.NoError(t, err)
+		assert.Contains(t, string(content), order.TrackingID)
+	}
+	assert.Equal(t, []string{"text/plain", "text/html"}, alternatives)
+
+	// ...then the receipt
+	part, err = mixed.NextPart()
+	require.NoError(t, err)
+	assert.Equal(t, "application/pdf", strings.SplitN(part.Header.Get("Content-Type"), ";", 2)[0])
+	assert.Equal(t, "receipt-TRKemail1.pdf", part.FileName())
+	assert.Equal(t, "base64", part.Header.Get("Content-Transfer-Encoding"))
+
+	encoded, err := io.ReadAll(part)
+	require.NoError(t, err)
+	pdf, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(string(encoded), "\r\n", ""))
+	require.NoError(t, err)
+	assert.True(t, bytes.HasPrefix(pdf, []byte("%PDF-")))
+
+	_, err = mixed.NextPart()
+	assert.Equal(t, io.EOF, err)
+}
+
+// TestOrderConfirmationOnCreateFlag tests that the create-time email is only sent when EmailOnOrderCreate is enabled,
+// while the payment confirmation is always sent once payment succeeds
+func TestOrderConfirmationOnCreateFlag(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		t.Run(fmt.Sprintf("enabled=%t", enabled), func(t *testing.T) {
+			stripeAPI := newStripeStub(t)
+			stripeAPI.stubPaymentIntents()
+			stubChargeList(stripeAPI, testCharge("ch_email_flag", 999, 59))
+
+			smtp := newSMTPStub(t)
+
+			h := handlers.NewHandlers(&config.Config{
+				Environment:         "test",
+				StripeWebhookSecret: testWebhookSecret,
+				EmailOnOrderCreate:  enabled,
+			}, store.NewMemoryStore())
+			h.EmailService = newTestEmailService(smtp)
+			router := setupTestRouter(h)
+
+			w := postCreateOrder(t, router, testOrderRequest("flag@example.com", 9.99))
+			require.Equal(t, http.StatusCreated, w.Code)
+
+			var response handlers.CreateOrderResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+
+			if enabled {
+				require.Len(t, smtp.Messages(), 1)
+				assert.Contains(t, smtp.Messages()[0], "Subject: Order Confirmation")
+			} else {
+				assert.Empty(t, smtp.Messages())
+			}
+
+			paymentIntentID := response.Order.Payment.StripePaymentIntentID
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, newSignedWebhookRequest(t, "payment_intent.succeeded", succeededIntent(paymentIntentID, 999, 999)))
+			require.Equal(t, http.StatusOK, w.Code)
+
+			messages := smtp.Messages()
+			require.NotEmpty(t, messages)
+			assert.Contains(t, messages[len(messages)-1], "Subject: Payment Confirmed")
+		})
+	}
+}
+
+// TestRefundsSendNotificationWithRefundedAmount tests that API and dashboard refunds each email the customer
+// the amount refunded, not the order total, and the refunded card when Stripe reports it
+func TestRefundsSendNotificationWithRefundedAmount(t *testing.T) {
+	stripeAPI := newStripeStub(t)
+	stripeAPI.On("POST", "/v1/refunds", func(req stubRequest) (int, interface{}) {
+		amount, _ := strconv.ParseInt(req.Form.Get("amount"), 10, 64)
+		return http.StatusOK, map[string]interface{}{
+			"id":     "re_email_1",
+			"object": "refund",
+			"amount": amount,
+			"status": "succeeded",
+			"charge": map[string]interface{}{
+				"id":                     "ch_refund_email",
+				"object":                 "charge",
+				"payment_method_details": map[string]interface{}{"type": "card", "card": map[string]interface{}{"last4": "4242"}},
+			},
+		}
+	})
+	smtp := newSMTPStub(t)
+
+	h := newWebhookTestHandlers()
+	h.EmailService = newTestEmailService(smtp)
+	router := setupTestRouter(h)
+
+	createPendingOrder(t, h, "refund-email-1", "pi_refund_email", 2000)
+	require.NoError(t, h.PaymentStore.UpdatePaymentStatus(context.Background(), "refund-email-1", models.PaymentStatusSucceeded))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/payments/refund/refund-email-1", strings.NewReader(`{"amount": 500}`)))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	// The rest is refunded from the dashboard
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newSignedWebhookRequest(t, "charge.refunded", refundedCharge("ch_refund_email", "pi_refund_email", 2000, 2000, "re_email_2")))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, h.Shutdown(ctx))
+
+	assert.Equal(t, "charge", stripeAPI.Requests("POST", "/v1/refunds")[0].Form.Get("expand[0]"))
+
+	// The API refund's charge is expanded with its card; the dashboard payload has none
+	messages := smtp.Messages()
+	require.Len(t, messages, 2)
+	emails := map[string]string{}
+	for _, raw := range messages {
+		assert.Contains(t, raw, "Subject: Refund Processed")
+		html := emailPart(t, raw, "text/html")
+		assert.NotContains(t, html, "20.00 USD")
+		assert.NotContains(t, html, "****")
+		if strings.Contains(html, "Refund Amount:</strong> 5.00 USD") {
+			emails["api"] = html
+		} else if strings.Contains(html, "Refund Amount:</strong> 15.00 USD") {
+			emails["dashboard"] = html
+		}
+	}
+	require.Len(t, emails, 2)
+	assert.Contains(t, emails["api"], "Card ending in 4242")
+	assert.Contains(t, emails["dashboard"], "The card used for this order")
+}
+
+// TestEmailDispatcherShutdownDropsAfterDeadline tests that shutdown gives up on the queue once its context is done
+func TestEmailDispatcherShutdownDropsAfterDeadline(t *testing.T) {
+	dispatcher := services.NewEmailDispatcher(2, 10) // One email every 500ms
+	for i := 0; i < 4; i++ {
+		require.NoError(t, dispatcher.Enqueue(func() error { return nil }))
+	}
+	dispatcher.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	flushed, dropped := dispatcher.Shutdown(ctx)
+
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, 1, flushed)
+	assert.Equal(t, 3, dropped)
+}
+
+// TestEmailDispatcherShutdownSkipsStuckSend tests that Shutdown returns at the deadline while a send
+// hangs, counting that email as dropped
+func TestEmailDispatcherShutdownSkipsStuckSend(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	dispatcher := services.NewEmailDispatcher(0, 10)
+	started := make(chan struct{})
+	require.NoError(t, dispatcher.Enqueue(func() error {
+		close(started)
+		<-release
+		return nil
+	}))
+	require.NoError(t, dispatcher.Enqueue(func() error { return nil }))
+	dispatcher.Start()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	flushed, dropped := dispatcher.Shutdown(ctx)
+
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, 0, flushed)
+	assert.Equal(t, 2, dropped)
+}
+
+// TestEmailDispatcherShutdownCountsOnlySent tests that failed sends aren't reported as flushed
+func TestEmailDispatcherShutdownCountsOnlySent(t *testing.T) {
+	dispatcher := services.NewEmailDispatcher(0, 10)
+	require.NoError(t, dispatcher.Enqueue(func() error { return nil }))
+	require.NoError(t, dispatcher.Enqueue(func() error { return errors.New("relay refused") }))
+	require.NoError(t, dispatcher.Enqueue(func() error { return nil }))
+	dispatcher.Start()
+
+	flushed, dropped := dispatcher.Shutdown(context.Background())
+
+	assert.Equal(t, 2, flushed)
+	assert.Equal(t, 0, dropped)
+}
+
+// TestResendEmail tests resending an order's emails, with fresh download links for the fulfillment
+// email and resends of one order spaced out
+func TestResendEmail(t *testing.T) {
+	smtp := newSMTPStub(t)
+	h := handlers.NewHandlers(&config.Config{Environment: "test", EmailResendInterval: time.Hour}, store.NewMemoryStore())
+	h.EmailService = newTestEmailService(smtp)
+	h.EmailService.DownloadSecret = "resend-secret"
+	h.EmailService.DownloadBaseURL = "https://api.example.com"
+	router := setupTestRouter(h)
+
+	createPendingOrder(t, h, "resend-1", "pi_resend_1", 999)
+	order, err := h.PaymentStore.GetOrder(context.Background(), "resend-1")
+	require.NoError(t, err)
+	order.Items = []models.OrderItem{{ProductID: "guide", ProductName: "Writing Guide", Price: 9.99, Quantity: 1, DownloadURL: "https://files.example.com/guide.pdf"}}
+	require.NoError(t, h.PaymentStore.UpdateOrder(context.Background(), order))
+
+	resend := func(orderID, emailType string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/api/payments/"+orderID+"/resend-email", strings.NewReader(`{"type": "`+emailType+`"}`)))
+		return w
+	}
+
+	assert.Equal(t, http.StatusBadRequest, resend("resend-1", "receipt").Code)
+	assert.Equal(t, http.StatusNotFound, resend("missing", "confirmation").Code)
+	assert.Equal(t, http.StatusConflict, resend("resend-1", "fulfillment").Code)
+	assert.Empty(t, smtp.Messages())
+
+	require.Equal(t, http.StatusOK, resend("resend-1", "confirmation").Code)
+	require.Len(t, smtp.Messages(), 1)
+
+	// Another resend of the same order has to wait
+	w := resend("resend-1", "confirmation")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	assert.Len(t, smtp.Messages(), 1)
+
+	// Once fulfilled, the fulfillment email carries a signed download link
+	createPendingOrder(t, h, "resend-2", "pi_resend_2", 999)
+	order, err = h.PaymentStore.GetOrder(context.Background(), "resend-2")
+	require.NoError(t, err)
+	order.Items = []models.OrderItem{{ProductID: "guide", ProductName: "Writing Guide", Price: 9.99, Quantity: 1, DownloadURL: "https://files.example.com/guide.pdf"}}
+	require.NoError(t, h.PaymentStore.UpdateOrder(context.Background(), order))
+	require.NoError(t, h.PaymentStore.UpdatePaymentStatus(context.Background(), "resend-2", models.PaymentStatusSucceeded))
+	_, _, err = h.PaymentStore.MarkOrderFulfilled(context.Background(), "resend-2")
+	require.NoError(t, err)
+
+	w = resend("resend-2", "fulfillment")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	messages := smtp.Messages()
+	require.Len(t, messages, 2)
+	token := emailedDownloadToken(t, emailPart(t, messages[1], "text/html"), "https://api.example.com/api/payments/download/resend-2/guide")
+	assert.NoError(t, services.VerifyDownloadToken("resend-secret", "resend-2", "guide", token))
+
+	events := handlerEvents(t, h, "resend-2")
+	require.NotEmpty(t, events)
+	last := events[len(events)-1]
+	assert.Equal(t, "email_resent", last.EventType)
+	assert.Equal(t, "fulfillment", last.Data.(map[string]interface{})["type"])
+}
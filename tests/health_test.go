@@ -0,0 +1,78 @@
+// tests/health_test.go
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/capactiyvirus/stripe-backend/config"
+	"github.com/capactiyvirus/stripe-backend/handlers"
+	"github.com/capactiyvirus/stripe-backend/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// unreachableStore is a memory store whose ping fails, as a Postgres store does when the database is down
+type unreachableStore struct {
+	*store.MemoryStore
+}
+
+func (s unreachableStore) Ping(ctx context.Context) error {
+	return errors.New("connection refused")
+}
+
+// readiness requests /ready and decodes the response
+func readiness(t *testing.T, h *handlers.Handlers) (int, map[string]interface{}) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	setupTestRouter(h).ServeHTTP(w, httptest.NewRequest("GET", "/ready", nil))
+
+	var response map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	return w.Code, response
+}
+
+// TestReadinessCheck tests that /ready reports each component and fails when one is down, without its error
+func TestReadinessCheck(t *testing.T) {
+	code, response := readiness(t, handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore()))
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok", response["status"])
+	assert.Equal(t, map[string]interface{}{"store": "ok"}, response["checks"])
+
+	code, response = readiness(t, handlers.NewHandlers(&config.Config{Environment: "test"}, unreachableStore{store.NewMemoryStore()}))
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "unavailable", response["status"])
+	assert.Equal(t, map[string]interface{}{"store": "error"}, response["checks"])
+
+	// The liveness probe stays up regardless
+	w := httptest.NewRecorder()
+	setupTestRouter(handlers.NewHandlers(&config.Config{Environment: "test"}, unreachableStore{store.NewMemoryStore()})).ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+// TestReadinessCheckStripe tests that an invalid Stripe key fails readiness when the Stripe check is enabled,
+// without Stripe's message reaching the response
+func TestReadinessCheckStripe(t *testing.T) {
+	stub := newStripeStub(t)
+	stub.On("GET", "/v1/balance", func(req stubRequest) (int, interface{}) {
+		return http.StatusUnauthorized, map[string]interface{}{
+			"error": map[string]interface{}{
+				"type":    "invalid_request_error",
+				"message": "Invalid API Key provided: sk_test_****",
+			},
+		}
+	})
+
+	h := handlers.NewHandlers(&config.Config{Environment: "test", ReadyCheckStripe: true}, store.NewMemoryStore())
+	code, response := readiness(t, h)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	checks := response["checks"].(map[string]interface{})
+	assert.Equal(t, "ok", checks["store"])
+	assert.Equal(t, "error", checks["stripe"])
+	assert.Len(t, stub.Requests("GET", "/v1/balance"), 1)
+}
@@ -0,0 +1,90 @@
+// tests/hooks_test.go
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/capactiyvirus/stripe-backend/config"
+	"github.com/capactiyvirus/stripe-backend/handlers"
+	"github.com/capactiyvirus/stripe-backend/models"
+	"github.com/capactiyvirus/stripe-backend/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingHook records the orders it's called with and can enrich or reject created orders
+type recordingHook struct {
+	handlers.NoopOrderHook
+	created []models.Order
+	err     error
+}
+
+func (h *recordingHook) OnOrderCreated(order *models.Order) error {
+	h.created = append(h.created, *order)
+	if h.err != nil {
+		return h.err
+	}
+	if order.Metadata == nil {
+		order.Metadata = map[string]string{}
+	}
+	order.Metadata["erp_customer"] = "ERP-42"
+	return nil
+}
+
+// TestOrderCreatedHook tests that a registered hook fires with the order being created and can enrich it
+func TestOrderCreatedHook(t *testing.T) {
+	stub := newStripeStub(t)
+	stub.stubPaymentIntents()
+
+	h := handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore())
+	hook := &recordingHook{}
+	h.RegisterHook(hook)
+	router := setupTestRouter(h)
+
+	w := postCreateOrder(t, router, testOrderRequest("hooked@example.com", 9.99))
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	var response handlers.CreateOrderResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+
+	require.Len(t, hook.created, 1)
+	assert.Equal(t, response.Order.ID, hook.created[0].ID)
+	assert.Equal(t, response.Order.TrackingID, hook.created[0].TrackingID)
+	assert.Equal(t, "hooked@example.com", hook.created[0].CustomerInfo.Email)
+	assert.Equal(t, int64(999), hook.created[0].Payment.Amount)
+
+	order, err := h.PaymentStore.GetOrder(context.Background(), response.Order.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "ERP-42", order.Metadata["erp_customer"])
+}
+
+// TestOrderHookErrors tests that hook errors are only logged by default, and when fatal cancel the order
+// before it's sent to Stripe without showing the hook's error to the client
+func TestOrderHookErrors(t *testing.T) {
+	for _, fatal := range []bool{false, true} {
+		stub := newStripeStub(t)
+		stub.stubPaymentIntents()
+
+		h := handlers.NewHandlers(&config.Config{Environment: "test", HookErrorsFatal: fatal}, store.NewMemoryStore())
+		h.RegisterHook(&recordingHook{err: errors.New("ERP unavailable")})
+		router := setupTestRouter(h)
+
+		w := postCreateOrder(t, router, testOrderRequest("hook-error@example.com", 9.99))
+		if !fatal {
+			assert.Equal(t, http.StatusCreated, w.Code)
+			continue
+		}
+
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		assert.NotContains(t, w.Body.String(), "ERP unavailable")
+		assert.Empty(t, stub.Requests("POST", "/v1/payment_intents"))
+		orders, err := h.PaymentStore.GetCustomerOrders(context.Background(), "hook-error@example.com")
+		require.NoError(t, err)
+		require.Len(t, orders, 1)
+		assert.Equal(t, models.OrderStatusCanceled, orders[0].Status)
+	}
+}
@@ -0,0 +1,156 @@
+// tests/idempotency_test.go
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/capactiyvirus/stripe-backend/config"
+	"github.com/capactiyvirus/stripe-backend/handlers"
+	appmiddleware "github.com/capactiyvirus/stripe-backend/middleware"
+	"github.com/capactiyvirus/stripe-backend/models"
+	"github.com/capactiyvirus/stripe-backend/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestIdempotencyKeyReplaysFulfill tests that a fulfill request repeated with the same Idempotency-Key
+// gets the first response back without fulfilling the order again
+func TestIdempotencyKeyReplaysFulfill(t *testing.T) {
+	h := handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore())
+	router := appmiddleware.Idempotency(h.PaymentStore, time.Hour, config.DefaultIdempotencyMaxBodyBytes, h.Logger)(setupTestRouter(h))
+
+	createPendingOrder(t, h, "idem-order-1", "pi_idem", 1000)
+	require.NoError(t, h.PaymentStore.UpdatePaymentStatus(context.Background(), "idem-order-1", models.PaymentStatusSucceeded))
+
+	fulfill := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/payments/fulfill/idem-order-1", nil)
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	first := fulfill("fulfill-key-1")
+	require.Equal(t, http.StatusOK, first.Code, first.Body.String())
+	assert.Empty(t, first.Header().Get("Idempotent-Replayed"))
+
+	second := fulfill("fulfill-key-1")
+	require.Equal(t, http.StatusOK, second.Code)
+	assert.Equal(t, "true", second.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, first.Body.String(), second.Body.String())
+	assert.Equal(t, first.Header().Get("Content-Type"), second.Header().Get("Content-Type"))
+
+	events := handlerEvents(t, h, "idem-order-1")
+	assert.Len(t, events, 1)
+
+	// Without the key, or with a new one, the handler runs and sees the order is already fulfilled
+	for _, key := range []string{"", "fulfill-key-2"} {
+		w := fulfill(key)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, w.Header().Get("Idempotent-Replayed"))
+		assert.Contains(t, w.Body.String(), `"already_fulfilled":true`)
+	}
+	assert.Len(t, handlerEvents(t, h, "idem-order-1"), 1)
+}
+
+// TestIdempotencyKeyRejectsDifferentBody tests that reusing an Idempotency-Key with another body
+// gets a 422 rather than the first request's response
+func TestIdempotencyKeyRejectsDifferentBody(t *testing.T) {
+	h := handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore())
+	router := appmiddleware.Idempotency(h.PaymentStore, time.Hour, config.DefaultIdempotencyMaxBodyBytes, h.Logger)(setupTestRouter(h))
+
+	createPendingOrder(t, h, "idem-order-2", "pi_idem_2", 1000)
+
+	addNote := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/payments/idem-order-2/notes", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", "note-key-1")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	first := addNote(`{"body": "First note"}`)
+	require.Less(t, first.Code, http.StatusInternalServerError, first.Body.String())
+
+	replayed := addNote(`{"body": "First note"}`)
+	assert.Equal(t, "true", replayed.Header().Get("Idempotent-Replayed"))
+
+	other := addNote(`{"body": "Second note"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, other.Code)
+	assert.Empty(t, other.Header().Get("Idempotent-Replayed"))
+}
+
+// TestIdempotencyKeyLimitsBody tests that an Idempotency-Key request with a body over the limit gets a 413
+// without reaching the handler
+func TestIdempotencyKeyLimitsBody(t *testing.T) {
+	h := handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore())
+	router := appmiddleware.Idempotency(h.PaymentStore, time.Hour, 64, h.Logger)(setupTestRouter(h))
+
+	createPendingOrder(t, h, "idem-order-3", "pi_idem_3", 1000)
+
+	req := httptest.NewRequest("POST", "/api/payments/idem-order-3/notes", strings.NewReader(`{"body": "`+strings.Repeat("x", 100)+`"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", "note-key-large")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	notes, err := h.PaymentStore.GetOrderNotes(context.Background(), "idem-order-3")
+	require.NoError(t, err)
+	assert.Empty(t, notes)
+}
+
+// TestIdempotentResponsesExpire tests that a stored response stops being replayed after its TTL
+func TestIdempotentResponsesExpire(t *testing.T) {
+	mem := store.NewMemoryStore()
+
+	require.NoError(t, mem.SaveIdempotentResponse(context.Background(), "key-live", store.IdempotentResponse{StatusCode: http.StatusOK, Body: []byte(`{}`)}, time.Hour))
+	require.NoError(t, mem.SaveIdempotentResponse(context.Background(), "key-expired", store.IdempotentResponse{StatusCode: http.StatusOK}, -time.Second))
+
+	response, err := mem.GetIdempotentResponse(context.Background(), "key-live")
+	require.NoError(t, err)
+	require.NotNil(t, response)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, `{}`, string(response.Body))
+
+	response, err = mem.GetIdempotentResponse(context.Background(), "key-expired")
+	require.NoError(t, err)
+	assert.Nil(t, response)
+}
+
+// TestOrderIdempotencyKeysExpire tests that a CreateOrder key maps to its first order until it expires,
+// and that releasing it only frees the claimant's key
+func TestOrderIdempotencyKeysExpire(t *testing.T) {
+	mem := store.NewMemoryStore()
+
+	existing, err := mem.ClaimOrderIdempotencyKey(context.Background(), "key-live", "order-1", time.Hour)
+	require.NoError(t, err)
+	assert.Empty(t, existing)
+	existing, err = mem.ClaimOrderIdempotencyKey(context.Background(), "key-live", "order-2", time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, "order-1", existing)
+
+	require.NoError(t, mem.ReleaseOrderIdempotencyKey(context.Background(), "key-live", "order-2"))
+	existing, err = mem.ClaimOrderIdempotencyKey(context.Background(), "key-live", "order-3", time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, "order-1", existing)
+
+	require.NoError(t, mem.ReleaseOrderIdempotencyKey(context.Background(), "key-live", "order-1"))
+	existing, err = mem.ClaimOrderIdempotencyKey(context.Background(), "key-live", "order-4", time.Hour)
+	require.NoError(t, err)
+	assert.Empty(t, existing)
+
+	_, err = mem.ClaimOrderIdempotencyKey(context.Background(), "key-expired", "order-5", -time.Second)
+	require.NoError(t, err)
+	existing, err = mem.ClaimOrderIdempotencyKey(context.Background(), "key-expired", "order-6", time.Hour)
+	require.NoError(t, err)
+	assert.Empty(t, existing)
+}
@@ -0,0 +1,71 @@
+// tests/integration_test.go
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/capactiyvirus/stripe-backend/handlers"
+	"github.com/capactiyvirus/stripe-backend/models"
+	"github.com/capactiyvirus/stripe-backend/webhooktest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestWebhookEndToEnd creates an order over HTTP, posts a signed payment_intent.succeeded
+// to the webhook endpoint, and checks the order is reported as paid
+func TestWebhookEndToEnd(t *testing.T) {
+	stub := newStripeStub(t)
+	stub.stubPaymentIntents()
+	stubChargeList(stub, testCharge("ch_e2e", 2500, 103))
+
+	h := newWebhookTestHandlers()
+	server := httptest.NewServer(setupTestRouter(h))
+	defer server.Close()
+
+	body, err := json.Marshal(testOrderRequest("e2e@example.com", 25.00))
+	require.NoError(t, err)
+	resp, err := http.Post(server.URL+"/api/payments/create-order", "application/json", bytes.NewReader(body))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	var created handlers.CreateOrderResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+	paymentIntentID := created.Order.Payment.StripePaymentIntentID
+	require.NotEmpty(t, paymentIntentID)
+
+	webhookResp, err := webhooktest.Post(nil, server.URL+"/api/payments/webhook", testWebhookSecret,
+		"payment_intent.succeeded", succeededIntent(paymentIntentID, 2500, 2500))
+	require.NoError(t, err)
+	webhookResp.Body.Close()
+	require.Equal(t, http.StatusOK, webhookResp.StatusCode)
+
+	orderResp, err := http.Get(server.URL + "/api/payments/order/" + created.Order.ID)
+	require.NoError(t, err)
+	defer orderResp.Body.Close()
+	require.Equal(t, http.StatusOK, orderResp.StatusCode)
+
+	var order models.Order
+	require.NoError(t, json.NewDecoder(orderResp.Body).Decode(&order))
+	assert.Equal(t, models.OrderStatusPaid, order.Status)
+	assert.Equal(t, models.PaymentStatusSucceeded, order.Payment.Status)
+	assert.Equal(t, int64(103), order.Payment.StripeFee)
+}
+
+// TestWebhookRejectsWrongSecret tests that events signed with another secret are refused
+func TestWebhookRejectsWrongSecret(t *testing.T) {
+	h := newWebhookTestHandlers()
+	router := setupTestRouter(h)
+
+	req, err := webhooktest.NewRequest("/api/payments/webhook", "whsec_other_secret",
+		"payment_intent.succeeded", succeededIntent("pi_wrong_secret", 1000, 1000))
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
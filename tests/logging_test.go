@@ -0,0 +1,116 @@
+// tests/logging_test.go
+package tests
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/capactiyvirus/stripe-backend/logging"
+	"github.com/capactiyvirus/stripe-backend/middleware"
+	chimiddleware "github.com/go-chi/chi/v5/middleware"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// logRecords decodes the JSON lines written by a logging.New logger
+func logRecords(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+
+	var records []map[string]interface{}
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		var record map[string]interface{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &record), scanner.Text())
+		records = append(records, record)
+	}
+	return records
+}
+
+// TestLoggerHonorsLogLevel tests that records below LOG_LEVEL are dropped
+func TestLoggerHonorsLogLevel(t *testing.T) {
+	tests := []struct {
+		level    string
+		expected []string
+	}{
+		{"debug", []string{"DEBUG", "INFO", "WARN", "ERROR"}},
+		{"info", []string{"INFO", "WARN", "ERROR"}},
+		{"warn", []string{"WARN", "ERROR"}},
+		{"error", []string{"ERROR"}},
+		{"", []string{"INFO", "WARN", "ERROR"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.level, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := logging.New(&buf, tt.level)
+			logger.Debug("debug")
+			logger.Info("info")
+			logger.Warn("warn")
+			logger.Error("error")
+
+			var levels []string
+			for _, record := range logRecords(t, &buf) {
+				levels = append(levels, record["level"].(string))
+			}
+			assert.Equal(t, tt.expected, levels)
+		})
+	}
+}
+
+// TestRequestLoggerLogsStructuredFields tests that each request logs its method, path, status, and duration
+func TestRequestLoggerLogsStructuredFields(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logging.New(&buf, "info")
+
+	handler := chimiddleware.RequestID(middleware.RequestLogger(logger)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/payments/orders?x=1", nil))
+	require.Equal(t, http.StatusTeapot, w.Code)
+
+	records := logRecords(t, &buf)
+	require.Len(t, records, 1)
+	record := records[0]
+	assert.Equal(t, "Request completed", record["msg"])
+	assert.Equal(t, "POST", record["method"])
+	assert.Equal(t, "/api/payments/orders", record["path"])
+	assert.Equal(t, float64(http.StatusTeapot), record["status"])
+	assert.Contains(t, record, "duration_ms")
+	assert.NotEmpty(t, record["request_id"])
+}
+
+// TestWebhookLogsCarryOrderFields tests that webhook logs identify the event, payment intent, and order
+func TestWebhookLogsCarryOrderFields(t *testing.T) {
+	stub := newStripeStub(t)
+	stubChargeList(stub, testCharge("ch_log_1", 1000, 59))
+
+	var buf bytes.Buffer
+	h := newWebhookTestHandlers()
+	h.Logger = logging.New(&buf, "info")
+	router := setupTestRouter(h)
+
+	createPendingOrder(t, h, "log-order-1", "pi_log_test", 1000)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, newSignedWebhookRequest(t, "payment_intent.succeeded", succeededIntent("pi_log_test", 1000, 1000)))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var paid map[string]interface{}
+	for _, record := range logRecords(t, &buf) {
+		if record["msg"] == "Order is paid" {
+			paid = record
+		}
+	}
+	require.NotNil(t, paid, "expected an \"Order is paid\" log")
+	assert.Equal(t, slog.LevelInfo.String(), paid["level"])
+	assert.Equal(t, "payment_intent.succeeded", paid["event_type"])
+	assert.Equal(t, "pi_log_test", paid["payment_intent_id"])
+	assert.Equal(t, "log-order-1", paid["order_id"])
+}
@@ -0,0 +1,127 @@
+// tests/metrics_test.go
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/capactiyvirus/stripe-backend/handlers"
+	appmiddleware "github.com/capactiyvirus/stripe-backend/middleware"
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// routeSampleCounts returns the histogram sample count per route label
+func routeSampleCounts(t *testing.T, reg *prometheus.Registry) map[string]uint64 {
+	t.Helper()
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+
+	counts := make(map[string]uint64)
+	for _, family := range families {
+		if family.GetName() != "http_request_duration_seconds" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "route" {
+					counts[label.GetValue()] += metric.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+	}
+	return counts
+}
+
+// TestRouteMetricsUsesRoutePattern tests that latency is labeled by route template, not concrete path
+func TestRouteMetricsUsesRoutePattern(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	metrics := appmiddleware.NewRouteMetrics(reg)
+
+	r := chi.NewRouter()
+	r.Use(metrics.Handler)
+	r.Get("/health", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+	r.Route("/api/payments", func(r chi.Router) {
+		r.Get("/order/{orderID}", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		})
+	})
+
+	for _, path := range []string{"/api/payments/order/ORD123", "/api/payments/order/ORD456", "/health"} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	}
+
+	counts := routeSampleCounts(t, reg)
+	assert.Equal(t, uint64(2), counts["/api/payments/order/{orderID}"])
+	assert.NotContains(t, counts, "/api/payments/order/ORD123")
+	assert.NotContains(t, counts, "/health")
+}
+
+// gatheredMetrics returns each counter's value, and each histogram's sample count, keyed by
+// metric name and its first label value (e.g. "webhooks_received_total{payment_intent.succeeded}")
+func gatheredMetrics(t *testing.T, reg *prometheus.Registry) map[string]float64 {
+	t.Helper()
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+
+	values := make(map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			key := family.GetName()
+			if labels := metric.GetLabel(); len(labels) > 0 {
+				key += "{" + labels[0].GetValue() + "}"
+			}
+			if histogram := metric.GetHistogram(); histogram != nil {
+				values[key] = float64(histogram.GetSampleCount())
+			} else {
+				values[key] = metric.GetCounter().GetValue()
+			}
+		}
+	}
+	return values
+}
+
+// TestPaymentMetrics tests that orders, payment outcomes, and webhook deliveries are counted
+func TestPaymentMetrics(t *testing.T) {
+	stub := newStripeStub(t)
+	stub.stubPaymentIntents()
+	stubChargeList(stub, testCharge("ch_metrics_1", 1000, 59))
+
+	reg := prometheus.NewRegistry()
+	h := newWebhookTestHandlers()
+	h.Metrics = handlers.NewMetrics(reg)
+	router := setupTestRouter(h)
+
+	w := postCreateOrder(t, router, testOrderRequest("metrics@example.com", 9.99))
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	createPendingOrder(t, h, "metrics-paid", "pi_metrics_paid", 1000)
+	createPendingOrder(t, h, "metrics-failed", "pi_metrics_failed", 1000)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newSignedWebhookRequest(t, "payment_intent.succeeded", succeededIntent("pi_metrics_paid", 1000, 1000)))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newSignedWebhookRequest(t, "payment_intent.payment_failed", map[string]interface{}{
+		"id":     "pi_metrics_failed",
+		"object": "payment_intent",
+		"status": "requires_payment_method",
+	}))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	assert.Equal(t, map[string]float64{
+		"orders_created_total":                                   1,
+		"order_amount{usd}":                                      1,
+		"payments_succeeded_total":                               1,
+		"payments_failed_total":                                  1,
+		"webhooks_received_total{payment_intent.succeeded}":      1,
+		"webhooks_received_total{payment_intent.payment_failed}": 1,
+	}, gatheredMetrics(t, reg))
+}
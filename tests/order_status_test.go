@@ -0,0 +1,295 @@
+// tests/order_status_test.go
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/capactiyvirus/stripe-backend/config"
+	"github.com/capactiyvirus/stripe-backend/handlers"
+	"github.com/capactiyvirus/stripe-backend/models"
+	"github.com/capactiyvirus/stripe-backend/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// allowedTransitions is every legal order status change other than keeping the current status
+var allowedTransitions = map[models.OrderStatus][]models.OrderStatus{
+	models.OrderStatusCreated:   {models.OrderStatusPending, models.OrderStatusPaid, models.OrderStatusCanceled},
+	models.OrderStatusPending:   {models.OrderStatusPaid, models.OrderStatusCanceled},
+	models.OrderStatusPaid:      {models.OrderStatusFulfilled, models.OrderStatusRefunded},
+	models.OrderStatusFulfilled: {models.OrderStatusRefunded},
+}
+
+// forbiddenTransitions returns every status change CanTransition must reject
+func forbiddenTransitions() [][2]models.OrderStatus {
+	var forbidden [][2]models.OrderStatus
+	for _, from := range models.OrderStatuses {
+		for _, to := range models.OrderStatuses {
+			allowed := from == to
+			for _, next := range allowedTransitions[from] {
+				allowed = allowed || next == to
+			}
+			if !allowed {
+				forbidden = append(forbidden, [2]models.OrderStatus{from, to})
+			}
+		}
+	}
+	return forbidden
+}
+
+// TestCanTransition tests the order status state machine
+func TestCanTransition(t *testing.T) {
+	for from, targets := range allowedTransitions {
+		for _, to := range targets {
+			assert.True(t, models.CanTransition(from, to), "%s to %s", from, to)
+		}
+	}
+	for _, status := range models.OrderStatuses {
+		assert.True(t, models.CanTransition(status, status), status)
+	}
+
+	forbidden := forbiddenTransitions()
+	require.NotEmpty(t, forbidden)
+	for _, transition := range forbidden {
+		assert.False(t, models.CanTransition(transition[0], transition[1]), "%s to %s", transition[0], transition[1])
+	}
+}
+
+// TestUpdateOrderStatusRejectsInvalidTransitions tests that the store refuses every forbidden transition
+func TestUpdateOrderStatusRejectsInvalidTransitions(t *testing.T) {
+	s := store.NewMemoryStore()
+
+	for _, transition := range forbiddenTransitions() {
+		from, to := transition[0], transition[1]
+		orderID := "transition-" + string(from) + "-" + string(to)
+		require.NoError(t, s.CreateOrder(context.Background(), &models.Order{
+			ID:      orderID,
+			Payment: models.PaymentInfo{Amount: 1000, Currency: "usd", Status: models.PaymentStatusPending},
+			Status:  from,
+		}))
+
+		err := s.UpdateOrderStatus(context.Background(), orderID, to)
+		assert.ErrorIs(t, err, models.ErrInvalidStatusTransition, "%s to %s", from, to)
+
+		order, err := s.GetOrder(context.Background(), orderID)
+		require.NoError(t, err)
+		assert.Equal(t, from, order.Status)
+	}
+}
+
+// TestPaymentSucceededKeepsRefundedOrderStatus tests that a late payment update doesn't reopen a refunded order
+func TestPaymentSucceededKeepsRefundedOrderStatus(t *testing.T) {
+	s := store.NewMemoryStore()
+	require.NoError(t, s.CreateOrder(context.Background(), &models.Order{
+		ID:      "late-payment-1",
+		Payment: models.PaymentInfo{Amount: 1000, Currency: "usd", Status: models.PaymentStatusRefunded},
+		Status:  models.OrderStatusRefunded,
+	}))
+
+	require.NoError(t, s.UpdatePaymentStatus(context.Background(), "late-payment-1", models.PaymentStatusSucceeded))
+
+	order, err := s.GetOrder(context.Background(), "late-payment-1")
+	require.NoError(t, err)
+	assert.Equal(t, models.OrderStatusRefunded, order.Status)
+}
+
+// TestFulfillAndRefundRejectInvalidTransitions tests that fulfilling or refunding an order in the wrong status is a conflict
+func TestFulfillAndRefundRejectInvalidTransitions(t *testing.T) {
+	stub := newStripeStub(t)
+	h := handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore())
+	router := setupTestRouter(h)
+
+	post := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", path, nil))
+		return w
+	}
+
+	// An unpaid order can be neither fulfilled nor refunded
+	createPendingOrder(t, h, "conflict-pending", "pi_conflict_pending", 1000)
+	assert.Equal(t, http.StatusConflict, post("/api/payments/fulfill/conflict-pending").Code)
+	assert.Equal(t, http.StatusConflict, post("/api/payments/refund/conflict-pending").Code)
+
+	// A refunded order can't be fulfilled
+	createPendingOrder(t, h, "conflict-refunded", "pi_conflict_refunded", 1000)
+	require.NoError(t, h.PaymentStore.UpdatePaymentStatus(context.Background(), "conflict-refunded", models.PaymentStatusSucceeded))
+	require.NoError(t, h.PaymentStore.UpdateOrderStatus(context.Background(), "conflict-refunded", models.OrderStatusRefunded))
+	assert.Equal(t, http.StatusConflict, post("/api/payments/fulfill/conflict-refunded").Code)
+
+	// A canceled order can't be refunded
+	createPendingOrder(t, h, "conflict-canceled", "pi_conflict_canceled", 1000)
+	require.NoError(t, h.PaymentStore.UpdateOrderStatus(context.Background(), "conflict-canceled", models.OrderStatusCanceled))
+	w := post("/api/payments/refund/conflict-canceled")
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), "canceled")
+
+	assert.Empty(t, stub.Requests("POST", "/v1/refunds"))
+}
+
+// TestFulfillOrderIsIdempotent tests that fulfilling an order again succeeds without a second fulfillment
+// or a second fulfillment email
+func TestFulfillOrderIsIdempotent(t *testing.T) {
+	smtp := newSMTPStub(t)
+	h := handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore())
+	h.EmailService = newTestEmailService(smtp)
+	router := setupTestRouter(h)
+
+	fulfill := func(orderID string) map[string]interface{} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/api/payments/fulfill/"+orderID, nil))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var response map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return response
+	}
+	fulfillments := func(orderID string) int {
+		count := 0
+		for _, event := range handlerEvents(t, h, orderID) {
+			if event.EventType == "order_fulfilled" {
+				count++
+			}
+		}
+		return count
+	}
+
+	createPendingOrder(t, h, "fulfill-twice", "pi_fulfill_twice", 1000)
+	require.NoError(t, h.PaymentStore.UpdatePaymentStatus(context.Background(), "fulfill-twice", models.PaymentStatusSucceeded))
+
+	first := fulfill("fulfill-twice")
+	assert.Equal(t, false, first["already_fulfilled"])
+	second := fulfill("fulfill-twice")
+	assert.Equal(t, true, second["already_fulfilled"])
+	assert.Equal(t, first["fulfilled_at"], second["fulfilled_at"])
+	assert.Equal(t, 1, fulfillments("fulfill-twice"))
+
+	// Shutdown waits for the fulfillment email sent in the background
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, h.Shutdown(ctx))
+	messages := smtp.Messages()
+	require.Len(t, messages, 1)
+	assert.Contains(t, messages[0], "Subject: Your Order is Ready for Download")
+
+	// Concurrent calls to the store can't both fulfill the order
+	createPendingOrder(t, h, "fulfill-race", "pi_fulfill_race", 1000)
+	require.NoError(t, h.PaymentStore.UpdatePaymentStatus(context.Background(), "fulfill-race", models.PaymentStatusSucceeded))
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	fulfilled := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, alreadyFulfilled, err := h.PaymentStore.MarkOrderFulfilled(context.Background(), "fulfill-race")
+			assert.NoError(t, err)
+			if !alreadyFulfilled {
+				mu.Lock()
+				fulfilled++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, fulfilled)
+}
+
+// TestFulfillBatch tests that a batch fulfills its paid orders and reports the rest without aborting
+func TestFulfillBatch(t *testing.T) {
+	smtp := newSMTPStub(t)
+	h := handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore())
+	h.EmailService = newTestEmailService(smtp)
+	router := setupTestRouter(h)
+
+	for _, id := range []string{"batch-paid-1", "batch-paid-2", "batch-pending"} {
+		createPendingOrder(t, h, id, "pi_"+id, 1000)
+	}
+	require.NoError(t, h.PaymentStore.UpdatePaymentStatus(context.Background(), "batch-paid-1", models.PaymentStatusSucceeded))
+	require.NoError(t, h.PaymentStore.UpdatePaymentStatus(context.Background(), "batch-paid-2", models.PaymentStatusSucceeded))
+
+	fulfillBatch := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/api/payments/fulfill-batch", strings.NewReader(body)))
+		return w
+	}
+
+	assert.Equal(t, http.StatusBadRequest, fulfillBatch(`{"order_ids": []}`).Code)
+
+	w := fulfillBatch(`{"order_ids": ["batch-paid-1", "batch-pending", "batch-missing", "batch-paid-2"]}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var response struct {
+		Results   map[string]handlers.FulfillBatchResult `json:"results"`
+		Fulfilled int                                    `json:"fulfilled"`
+		Failed    int                                    `json:"failed"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, 2, response.Fulfilled)
+	assert.Equal(t, 2, response.Failed)
+
+	for _, id := range []string{"batch-paid-1", "batch-paid-2"} {
+		result := response.Results[id]
+		assert.True(t, result.Success, id)
+		assert.NotNil(t, result.FulfilledAt, id)
+
+		order, err := h.PaymentStore.GetOrder(context.Background(), id)
+		require.NoError(t, err)
+		assert.Equal(t, models.OrderStatusFulfilled, order.Status)
+		events := handlerEvents(t, h, id)
+		assert.Equal(t, "order_fulfilled", events[len(events)-1].EventType)
+	}
+	assert.False(t, response.Results["batch-pending"].Success)
+	assert.Contains(t, response.Results["batch-pending"].Error, "paid")
+	assert.Equal(t, "Order not found", response.Results["batch-missing"].Error)
+
+	order, err := h.PaymentStore.GetOrder(context.Background(), "batch-pending")
+	require.NoError(t, err)
+	assert.Equal(t, models.OrderStatusPending, order.Status)
+
+	// Shutdown waits for the fulfillment emails sent in the background
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, h.Shutdown(ctx))
+	assert.Len(t, smtp.Messages(), 2)
+}
+
+// TestStatusChangesAddEvents tests that the store records every status change, and only actual changes
+func TestStatusChangesAddEvents(t *testing.T) {
+	s := store.NewMemoryStore()
+	require.NoError(t, s.CreateOrder(context.Background(), &models.Order{
+		ID:      "status-events-1",
+		Payment: models.PaymentInfo{Amount: 1000, Currency: "usd", Status: models.PaymentStatusPending},
+		Status:  models.OrderStatusPending,
+	}))
+
+	// Succeeding the payment also marks the order paid
+	require.NoError(t, s.UpdatePaymentStatus(context.Background(), "status-events-1", models.PaymentStatusSucceeded))
+	require.NoError(t, s.UpdatePaymentStatus(context.Background(), "status-events-1", models.PaymentStatusSucceeded))
+	require.NoError(t, s.UpdateOrderStatus(context.Background(), "status-events-1", models.OrderStatusPaid))
+	require.NoError(t, s.UpdateOrderStatus(context.Background(), "status-events-1", models.OrderStatusFulfilled))
+	require.Error(t, s.UpdateOrderStatus(context.Background(), "status-events-1", models.OrderStatusPending))
+
+	events, err := s.GetPaymentEvents(context.Background(), "status-events-1")
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+
+	expected := []map[string]interface{}{
+		{"field": "payment_status", "old_status": "pending", "new_status": "succeeded"},
+		{"field": "order_status", "old_status": "pending", "new_status": "paid"},
+		{"field": "order_status", "old_status": "paid", "new_status": "fulfilled"},
+	}
+	ids := map[string]bool{}
+	for i, event := range events {
+		assert.Equal(t, models.EventTypeStatusChanged, event.EventType)
+		assert.Equal(t, models.PaymentStatusSucceeded, event.Status)
+		assert.Equal(t, expected[i], event.Data)
+		ids[event.ID] = true
+	}
+	assert.Len(t, ids, 3, "event IDs must be unique")
+}
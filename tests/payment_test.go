@@ -3,22 +3,32 @@ package tests
 
 import (
 	"bytes"
+	"context"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
-	"os"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	//"github.com/capactiyvirus/stripe-backend/"
 	"github.com/capactiyvirus/stripe-backend/config"
 	"github.com/capactiyvirus/stripe-backend/handlers"
+	appmiddleware "github.com/capactiyvirus/stripe-backend/middleware"
 	"github.com/capactiyvirus/stripe-backend/models"
+	"github.com/capactiyvirus/stripe-backend/services"
+	"github.com/capactiyvirus/stripe-backend/store"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/stripe/stripe-go/v82"
 )
 
 // setupTestRouter creates a test router
@@ -29,38 +39,78 @@ func setupTestRouter(h *handlers.Handlers) chi.Router {
 
 	// Health check endpoint
 	r.Get("/health", h.HealthCheck)
+	r.Get("/ready", h.ReadinessCheck)
 
 	// API routes
 	r.Route("/api", func(r chi.Router) {
 		r.Route("/payments", func(r chi.Router) {
 			r.Post("/create-order", h.CreateOrder)
+			r.Post("/create-checkout", h.CreateCheckoutSession)
 			r.Get("/status/{orderID}", h.GetPaymentStatus)
+			r.Get("/by-intent/{paymentIntentID}", h.GetOrderByPaymentIntentID)
 			r.Get("/order/{orderID}", h.GetOrderDetails)
+			r.Get("/{orderID}/receipt.pdf", h.GetOrderReceipt)
 			r.Get("/track/{trackingID}", h.TrackPayment)
 			r.Get("/customer/{email}", h.GetCustomerPayments)
 			r.Get("/all", h.GetAllPayments)
+			r.Get("/export.csv", h.ExportOrdersCSV)
 			r.Get("/stats", h.GetPaymentStats)
+			r.Get("/stats/daily", h.GetDailyRevenue)
+			r.Get("/search", h.SearchOrders)
+			r.Post("/coupons", h.CreateCoupon)
+			r.Get("/disputes", h.GetDisputes)
+			r.Get("/by-stripe/{stripeID}", h.GetOrderByStripeID)
 			r.Post("/fulfill/{orderID}", h.FulfillOrder)
+			r.Post("/fulfill-batch", h.FulfillOrders)
 			r.Post("/refund/{orderID}", h.RefundOrder)
+			r.Post("/cancel", h.CancelOrderByCustomer)
+			r.Post("/cancel/{orderID}", h.CancelOrder)
+			r.Post("/{orderID}/resend-email", h.ResendEmail)
+			r.Post("/{orderID}/notes", h.AddOrderNote)
+			r.Get("/{orderID}/notes", h.GetOrderNotes)
+			r.Post("/{orderID}/archive", h.ArchiveOrder)
+			r.Post("/{orderID}/sync", h.SyncOrder)
+			r.Get("/download/{orderID}/{productID}", h.DownloadProduct)
+			r.Post("/webhook", h.HandleStripeWebhook)
+			r.Post("/webhook/replay/{eventID}", h.ReplayWebhookEvent)
+		})
+		r.Route("/subscriptions", func(r chi.Router) {
+			r.Get("/{email}", h.GetCustomerSubscriptions)
+		})
+		r.Route("/products", func(r chi.Router) {
+			r.Get("/", h.ListProducts)
+			r.Get("/{id}", h.GetProduct)
+			r.Post("/", h.CreateProduct)
+			r.Put("/{id}", h.UpdateProduct)
+			r.Delete("/{id}", h.DeleteProduct)
+			r.Post("/refresh", h.RefreshProducts)
 		})
 	})
 
 	return r
 }
 
-// TestCreateOrder tests order creation
-func TestCreateOrder(t *testing.T) {
-	// Setup test server
-	testKey := os.Getenv("STRIPE_SECRET_KEY")
-	if testKey == "" {
-		t.Skip("STRIPE_SECRET_KEY not set")
-	}
+// handlerEvents returns an order's events other than the status_changed events the store adds itself
+func handlerEvents(t *testing.T, h *handlers.Handlers, orderID string) []models.PaymentEvent {
+	t.Helper()
 
-	cfg := &config.Config{
-		StripeSecretKey: "STRIPE_SECRET_KEY",
-		Environment:     "test",
+	events, err := h.PaymentStore.GetPaymentEvents(context.Background(), orderID)
+	require.NoError(t, err)
+
+	filtered := []models.PaymentEvent{}
+	for _, event := range events {
+		if event.EventType != models.EventTypeStatusChanged {
+			filtered = append(filtered, event)
+		}
 	}
-	h := handlers.NewHandlers(cfg)
+	return filtered
+}
+
+// TestCreateOrder tests order creation
+func TestCreateOrder(t *testing.T) {
+	cfg := &config.Config{Environment: "test"}
+	h := handlers.NewHandlers(cfg, store.NewMemoryStore())
+	h.Gateway = handlers.NewFakeGateway()
 	router := setupTestRouter(h)
 
 	// Test data
@@ -82,7 +132,6 @@ func TestCreateOrder(t *testing.T) {
 			"source": "test",
 		},
 	}
-	fmt.Printf("Stripe @@@@@@@@@@@@@@@@@@@@@@@@@@@@@ %s \n", testKey)
 	// Convert to JSON
 	jsonData, err := json.Marshal(orderRequest)
 	require.NoError(t, err)
@@ -109,22 +158,15 @@ func TestCreateOrder(t *testing.T) {
 	order := response["order"].(map[string]interface{})
 	assert.Equal(t, "test@example.com", order["customer_info"].(map[string]interface{})["email"])
 	assert.NotEmpty(t, order["tracking_id"])
-	assert.Equal(t, "created", order["status"])
+	assert.Equal(t, "pending", order["status"]) // Pending once the payment intent is attached
+	assert.Equal(t, "pi_fake_1_secret_fake", response["client_secret"])
 }
 
 // TestTrackPayment tests payment tracking
 func TestTrackPayment(t *testing.T) {
-
-	testKey := os.Getenv("STRIPE_SECRET_KEY")
-	if testKey == "" {
-		t.Skip("STRIPE_SECRET_KEY not set")
-	}
-	// Setup
-	cfg := &config.Config{
-		StripeSecretKey: testKey,
-		Environment:     "test",
-	}
-	h := handlers.NewHandlers(cfg)
+	cfg := &config.Config{Environment: "test"}
+	h := handlers.NewHandlers(cfg, store.NewMemoryStore())
+	h.Gateway = handlers.NewFakeGateway()
 	router := setupTestRouter(h)
 
 	// Create order first
@@ -153,7 +195,7 @@ func TestTrackPayment(t *testing.T) {
 	}
 
 	// Add order to store manually for testing
-	err := h.PaymentStore.CreateOrder(order)
+	err := h.PaymentStore.CreateOrder(context.Background(), order)
 	require.NoError(t, err)
 
 	// Now test tracking
@@ -174,17 +216,107 @@ func TestTrackPayment(t *testing.T) {
 	assert.Equal(t, "TRK123456789", trackedOrder["tracking_id"])
 }
 
-// TestPaymentStatusUpdate tests payment status updates
-func TestPaymentStatusUpdate(t *testing.T) {
-	testKey := os.Getenv("STRIPE_SECRET_KEY")
-	if testKey == "" {
-		t.Skip("STRIPE_SECRET_KEY not set")
+// TestTrackPaymentSignedToken tests that tracking requires a valid signed token when a secret is configured,
+// while the order ID endpoint is unaffected
+func TestTrackPaymentSignedToken(t *testing.T) {
+	const secret = "tracking-secret"
+	h := handlers.NewHandlers(&config.Config{Environment: "test", TrackingTokenSecret: secret}, store.NewMemoryStore())
+	router := setupTestRouter(h)
+
+	order := &models.Order{
+		ID:           "signed-order-1",
+		TrackingID:   "TRKSIGNED1",
+		CustomerInfo: models.CustomerInfo{Email: "signed@example.com"},
+		Payment:      models.PaymentInfo{Amount: 999, Currency: "usd", Status: models.PaymentStatusPending},
+		Status:       models.OrderStatusPending,
 	}
-	cfg := &config.Config{
-		StripeSecretKey: testKey,
-		Environment:     "test",
+	require.NoError(t, h.PaymentStore.CreateOrder(context.Background(), order))
+
+	token := services.GenerateTrackingToken(secret, "TRKSIGNED1")
+	tampered := []byte(token)
+	tampered[0] ^= 1
+
+	tests := []struct {
+		name     string
+		target   string
+		expected int
+	}{
+		{"valid token", "/api/payments/track/TRKSIGNED1?token=" + token, http.StatusOK},
+		{"tampered token", "/api/payments/track/TRKSIGNED1?token=" + string(tampered), http.StatusForbidden},
+		{"token for another tracking ID", "/api/payments/track/TRKSIGNED1?token=" + services.GenerateTrackingToken(secret, "TRKSIGNED2"), http.StatusForbidden},
+		{"missing token", "/api/payments/track/TRKSIGNED1", http.StatusForbidden},
+		{"order ID path", "/api/payments/order/signed-order-1", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", tt.target, nil))
+			assert.Equal(t, tt.expected, w.Code)
+		})
+	}
+}
+
+// TestDownloadProductRecordsDownload tests that a signed download link redirects to the file until it
+// expires, records a downloaded event, and counts the order in the download stat
+func TestDownloadProductRecordsDownload(t *testing.T) {
+	const secret = "download-secret"
+	h := handlers.NewHandlers(&config.Config{Environment: "test", TrackingTokenSecret: "tracking-secret", DownloadTokenSecret: secret}, store.NewMemoryStore())
+	router := setupTestRouter(h)
+
+	order := &models.Order{
+		ID:           "download-order-1",
+		TrackingID:   "TRKdownload-order-1",
+		CustomerInfo: models.CustomerInfo{Email: "download@example.com"},
+		Items: []models.OrderItem{
+			{ProductID: "guide", ProductName: "Writing Guide", FileType: "PDF", Price: 9.99, Quantity: 1, DownloadURL: "https://files.example.com/guide.pdf"},
+		},
+		Payment: models.PaymentInfo{StripePaymentIntentID: "pi_download", Amount: 999, Currency: "usd", Status: models.PaymentStatusSucceeded},
+		Status:  models.OrderStatusFulfilled,
+	}
+	require.NoError(t, h.PaymentStore.CreateOrder(context.Background(), order))
+
+	download := func(productID, token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/api/payments/download/download-order-1/"+productID+"?token="+token, nil))
+		return w
 	}
-	h := handlers.NewHandlers(cfg)
+
+	expires := time.Now().Add(time.Hour)
+	assert.Equal(t, http.StatusForbidden, download("guide", "not-a-token").Code)
+	assert.Equal(t, http.StatusForbidden, download("guide", services.GenerateDownloadToken("tracking-secret", "download-order-1", "guide", expires)).Code)
+	assert.Equal(t, http.StatusGone, download("guide", services.GenerateDownloadToken(secret, "download-order-1", "guide", time.Now().Add(-time.Minute))).Code)
+	assert.Equal(t, http.StatusNotFound, download("workbook", services.GenerateDownloadToken(secret, "download-order-1", "workbook", expires)).Code)
+
+	stats, err := h.PaymentStore.GetPaymentStats(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 0, stats.DownloadedOrders)
+
+	w := download("guide", services.GenerateDownloadToken(secret, "download-order-1", "guide", expires))
+	require.Equal(t, http.StatusFound, w.Code, w.Body.String())
+	assert.Equal(t, "https://files.example.com/guide.pdf", w.Header().Get("Location"))
+
+	events, err := h.PaymentStore.GetPaymentEvents(context.Background(), "download-order-1")
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, "downloaded", events[0].EventType)
+	data := events[0].Data.(map[string]interface{})
+	assert.Equal(t, "guide", data["product_id"])
+	assert.NotNil(t, data["downloaded_at"])
+
+	// A second download of the same order doesn't count it twice
+	require.Equal(t, http.StatusFound, download("guide", services.GenerateDownloadToken(secret, "download-order-1", "guide", expires)).Code)
+
+	stats, err = h.PaymentStore.GetPaymentStats(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, stats.DownloadedOrders)
+}
+
+// TestPaymentStatusUpdate tests payment status updates
+func TestPaymentStatusUpdate(t *testing.T) {
+	cfg := &config.Config{Environment: "test"}
+	h := handlers.NewHandlers(cfg, store.NewMemoryStore())
+	h.Gateway = handlers.NewFakeGateway()
 
 	// Create test order
 	order := &models.Order{
@@ -201,15 +333,15 @@ func TestPaymentStatusUpdate(t *testing.T) {
 		Status: models.OrderStatusPending,
 	}
 
-	err := h.PaymentStore.CreateOrder(order)
+	err := h.PaymentStore.CreateOrder(context.Background(), order)
 	require.NoError(t, err)
 
 	// Test status update
-	err = h.PaymentStore.UpdatePaymentStatus("test-order-456", models.PaymentStatusSucceeded)
+	err = h.PaymentStore.UpdatePaymentStatus(context.Background(), "test-order-456", models.PaymentStatusSucceeded)
 	require.NoError(t, err)
 
 	// Verify update
-	updatedOrder, err := h.PaymentStore.GetOrder("test-order-456")
+	updatedOrder, err := h.PaymentStore.GetOrder(context.Background(), "test-order-456")
 	require.NoError(t, err)
 
 	assert.Equal(t, models.PaymentStatusSucceeded, updatedOrder.Payment.Status)
@@ -218,15 +350,9 @@ func TestPaymentStatusUpdate(t *testing.T) {
 
 // TestGetPaymentStats tests payment statistics
 func TestGetPaymentStats(t *testing.T) {
-	testKey := os.Getenv("STRIPE_SECRET_KEY")
-	if testKey == "" {
-		t.Skip("STRIPE_SECRET_KEY not set")
-	}
-	cfg := &config.Config{
-		StripeSecretKey: testKey,
-		Environment:     "test",
-	}
-	h := handlers.NewHandlers(cfg)
+	cfg := &config.Config{Environment: "test"}
+	h := handlers.NewHandlers(cfg, store.NewMemoryStore())
+	h.Gateway = handlers.NewFakeGateway()
 	router := setupTestRouter(h)
 
 	// Create some test orders with different statuses
@@ -256,7 +382,7 @@ func TestGetPaymentStats(t *testing.T) {
 
 	// Add orders to store
 	for _, order := range orders {
-		err := h.PaymentStore.CreateOrder(order)
+		err := h.PaymentStore.CreateOrder(context.Background(), order)
 		require.NoError(t, err)
 	}
 
@@ -278,17 +404,281 @@ func TestGetPaymentStats(t *testing.T) {
 	assert.Equal(t, 15.0, stats.AverageOrderValue) // $30.00 / 2 orders
 }
 
-// BenchmarkCreateOrder benchmarks order creation performance
-func BenchmarkCreateOrder(b *testing.B) {
-	testKey := os.Getenv("STRIPE_SECRET_KEY")
-	if testKey == "" {
-		b.Skip("STRIPE_SECRET_KEY not set")
+// TestGetPaymentStatsStatusBreakdown tests per-status counts and amounts in payment statistics
+func TestGetPaymentStatsStatusBreakdown(t *testing.T) {
+	h := handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore())
+	router := setupTestRouter(h)
+
+	seed := []struct {
+		status models.OrderStatus
+		amount int64
+	}{
+		{models.OrderStatusPending, 1000},
+		{models.OrderStatusPending, 500},
+		{models.OrderStatusPaid, 2000},
+		{models.OrderStatusFulfilled, 1500},
+		{models.OrderStatusCanceled, 750},
+		{models.OrderStatusRefunded, 1200},
 	}
-	cfg := &config.Config{
-		StripeSecretKey: testKey,
-		Environment:     "test",
+	for i, s := range seed {
+		order := &models.Order{
+			ID:           fmt.Sprintf("breakdown-order-%d", i),
+			TrackingID:   fmt.Sprintf("TRKBD%d", i),
+			CustomerInfo: models.CustomerInfo{Email: "breakdown@example.com"},
+			Payment:      models.PaymentInfo{Amount: s.amount, Currency: "usd"},
+			Status:       s.status,
+		}
+		require.NoError(t, h.PaymentStore.CreateOrder(context.Background(), order))
+	}
+
+	req := httptest.NewRequest("GET", "/api/payments/stats", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var stats models.PaymentStats
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+
+	assert.Equal(t, map[models.OrderStatus]models.StatusTotals{
+		models.OrderStatusCreated:   {Count: 0, Amount: 0},
+		models.OrderStatusPending:   {Count: 2, Amount: 15},
+		models.OrderStatusPaid:      {Count: 1, Amount: 20},
+		models.OrderStatusFulfilled: {Count: 1, Amount: 15},
+		models.OrderStatusCanceled:  {Count: 1, Amount: 7.5},
+		models.OrderStatusRefunded:  {Count: 1, Amount: 12},
+	}, stats.StatusBreakdown)
+}
+
+// TestGetPaymentStatsExactAmounts tests that stats are summed in cents and reported per currency without float drift
+func TestGetPaymentStatsExactAmounts(t *testing.T) {
+	h := handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore())
+	router := setupTestRouter(h)
+
+	seed := []struct {
+		amount   int64
+		currency string
+	}{
+		{10, "usd"},
+		{10, "usd"},
+		{10, "usd"},
+		{1500, "jpy"},
+		{1000, "jpy"},
+	}
+	for i, s := range seed {
+		order := &models.Order{
+			ID:           fmt.Sprintf("exact-order-%d", i),
+			TrackingID:   fmt.Sprintf("TRKEX%d", i),
+			CustomerInfo: models.CustomerInfo{Email: "exact@example.com"},
+			Payment:      models.PaymentInfo{Amount: s.amount, Currency: s.currency},
+			Status:       models.OrderStatusPaid,
+		}
+		require.NoError(t, h.PaymentStore.CreateOrder(context.Background(), order))
+	}
+
+	req := httptest.NewRequest("GET", "/api/payments/stats", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var stats models.PaymentStats
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+
+	// Summing 0.1 three times as floats gives 0.30000000000000004
+	assert.Equal(t, models.CurrencyStats{
+		TotalOrders:       3,
+		CompletedOrders:   3,
+		TotalRevenue:      0.3,
+		AverageOrderValue: 0.1,
+		NetRevenue:        0.3,
+	}, stats.Currencies["usd"])
+	assert.Equal(t, models.CurrencyStats{
+		TotalOrders:       2,
+		CompletedOrders:   2,
+		TotalRevenue:      2500,
+		AverageOrderValue: 1250,
+		NetRevenue:        2500,
+	}, stats.Currencies["jpy"])
+
+	// The top-level amounts are in one currency instead of adding yen to dollars
+	assert.Equal(t, "usd", stats.Currency)
+	assert.Equal(t, 5, stats.CompletedOrders)
+	assert.Equal(t, 0.3, stats.TotalRevenue)
+	assert.Equal(t, 0.1, stats.AverageOrderValue)
+	assert.Equal(t, 0.3, stats.StatusBreakdown[models.OrderStatusPaid].Amount)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/payments/stats?currency=jpy", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+	assert.Equal(t, "jpy", stats.Currency)
+	assert.Equal(t, float64(2500), stats.TotalRevenue)
+	assert.Equal(t, float64(1250), stats.AverageOrderValue)
+	assert.Equal(t, float64(2500), stats.StatusBreakdown[models.OrderStatusPaid].Amount)
+}
+
+// TestGetPaymentStatsDateRange tests that stats can be scoped to orders created in a date range
+func TestGetPaymentStatsDateRange(t *testing.T) {
+	h := handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore())
+	router := setupTestRouter(h)
+
+	now := time.Now().UTC()
+	for i, seed := range []struct {
+		amount  int64
+		status  models.OrderStatus
+		created time.Time
+	}{
+		{1000, models.OrderStatusPaid, now.AddDate(0, 0, -30)},
+		{2000, models.OrderStatusPaid, now.AddDate(0, 0, -5)},
+		{4000, models.OrderStatusFulfilled, now.AddDate(0, 0, -2)},
+		{8000, models.OrderStatusPending, now.AddDate(0, 0, -1)},
+	} {
+		order := &models.Order{
+			ID:           fmt.Sprintf("range-order-%d", i),
+			TrackingID:   fmt.Sprintf("TRKRANGE%d", i),
+			CustomerInfo: models.CustomerInfo{Email: "range@example.com"},
+			Payment:      models.PaymentInfo{Amount: seed.amount, Currency: "usd"},
+			Status:       seed.status,
+		}
+		require.NoError(t, h.PaymentStore.CreateOrder(context.Background(), order))
+		order.CreatedAt = seed.created
+		require.NoError(t, h.PaymentStore.UpdateOrder(context.Background(), order))
+	}
+
+	getStats := func(query string) (int, models.PaymentStats) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/api/payments/stats"+query, nil))
+		var stats models.PaymentStats
+		if w.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+		}
+		return w.Code, stats
+	}
+
+	code, stats := getStats("")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 4, stats.TotalOrders)
+	assert.Equal(t, 70.0, stats.TotalRevenue)
+	assert.Nil(t, stats.From)
+	assert.Nil(t, stats.To)
+
+	weekAgo := now.AddDate(0, 0, -7).Format(time.RFC3339)
+	dayAgo := now.Add(-36 * time.Hour).Format(time.RFC3339)
+	code, stats = getStats("?from=" + weekAgo + "&to=" + dayAgo)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 2, stats.TotalOrders)
+	assert.Equal(t, 2, stats.CompletedOrders)
+	assert.Equal(t, 0, stats.PendingOrders)
+	assert.Equal(t, 60.0, stats.TotalRevenue)
+	assert.Equal(t, 30.0, stats.AverageOrderValue)
+	require.NotNil(t, stats.From)
+	assert.Equal(t, weekAgo, stats.From.Format(time.RFC3339))
+	require.NotNil(t, stats.To)
+	assert.Equal(t, dayAgo, stats.To.Format(time.RFC3339))
+
+	code, stats = getStats("?from=" + weekAgo)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 3, stats.TotalOrders)
+	assert.Equal(t, 1, stats.PendingOrders)
+
+	code, _ = getStats("?from=" + dayAgo + "&to=" + weekAgo)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = getStats("?from=last-week")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+// TestGetDailyRevenue tests per-day revenue buckets in one currency, with zero-order days filled in
+func TestGetDailyRevenue(t *testing.T) {
+	h := handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore())
+	router := setupTestRouter(h)
+
+	day := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	for i, seed := range []struct {
+		amount   int64
+		currency string
+		status   models.OrderStatus
+		created  time.Time
+	}{
+		{1000, "usd", models.OrderStatusPaid, day.Add(9 * time.Hour)},
+		{2500, "usd", models.OrderStatusFulfilled, day.Add(23 * time.Hour)},
+		{4000, "usd", models.OrderStatusPaid, day.AddDate(0, 0, 3).Add(time.Hour)},
+		{8000, "usd", models.OrderStatusPending, day.AddDate(0, 0, 3).Add(2 * time.Hour)},
+		{9900, "usd", models.OrderStatusPaid, day.AddDate(0, 0, 10)},
+		{1500, "jpy", models.OrderStatusPaid, day.Add(10 * time.Hour)},
+	} {
+		order := &models.Order{
+			ID:           fmt.Sprintf("daily-order-%d", i),
+			TrackingID:   fmt.Sprintf("TRKDAILY%d", i),
+			CustomerInfo: models.CustomerInfo{Email: "daily@example.com"},
+			Payment:      models.PaymentInfo{Amount: seed.amount, Currency: seed.currency},
+			Status:       seed.status,
+		}
+		require.NoError(t, h.PaymentStore.CreateOrder(context.Background(), order))
+		order.CreatedAt = seed.created
+		require.NoError(t, h.PaymentStore.UpdateOrder(context.Background(), order))
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/payments/stats/daily?from=2024-06-01T00:00:00Z&to=2024-06-04T23:59:59Z", nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var response struct {
+		Currency string                `json:"currency"`
+		Days     []models.DailyRevenue `json:"days"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, "usd", response.Currency)
+	assert.Equal(t, []models.DailyRevenue{
+		{Date: "2024-06-01", Revenue: 35, OrderCount: 2},
+		{Date: "2024-06-02"},
+		{Date: "2024-06-03"},
+		{Date: "2024-06-04", Revenue: 40, OrderCount: 1},
+	}, response.Days)
+
+	// Other currencies are charted on their own
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/payments/stats/daily?from=2024-06-01T00:00:00Z&to=2024-06-02T23:59:59Z&currency=JPY", nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, "jpy", response.Currency)
+	assert.Equal(t, []models.DailyRevenue{
+		{Date: "2024-06-01", Revenue: 1500, OrderCount: 1},
+		{Date: "2024-06-02"},
+	}, response.Days)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/payments/stats/daily?currency=xyz", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Archived orders are left out unless asked for, as in /stats
+	_, _, err := h.PaymentStore.ArchiveOrder(context.Background(), "daily-order-0")
+	require.NoError(t, err)
+	for query, revenue := range map[string]float64{"": 25, "&include_archived=true": 35} {
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/api/payments/stats/daily?from=2024-06-01T00:00:00Z&to=2024-06-01T23:59:59Z"+query, nil))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		require.Len(t, response.Days, 1)
+		assert.Equal(t, revenue, response.Days[0].Revenue, query)
 	}
-	h := handlers.NewHandlers(cfg)
+
+	// Without a range, the last 30 days are returned
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/payments/stats/daily", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	require.Len(t, response.Days, 30)
+	assert.Equal(t, time.Now().UTC().Format("2006-01-02"), response.Days[29].Date)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/payments/stats/daily?from=2020-01-01T00:00:00Z&to=2024-01-01T00:00:00Z", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+// BenchmarkCreateOrder benchmarks order creation performance
+func BenchmarkCreateOrder(b *testing.B) {
+	cfg := &config.Config{Environment: "test", DefaultCurrency: config.DefaultCurrency}
+	h := handlers.NewHandlers(cfg, store.NewMemoryStore())
+	h.Gateway = handlers.NewFakeGateway()
 
 	order := &models.Order{
 		ID:         "benchmark-order",
@@ -308,7 +698,7 @@ func BenchmarkCreateOrder(b *testing.B) {
 		},
 		Payment: models.PaymentInfo{
 			Amount:   999,
-			Currency: "usd",
+			Currency: cfg.DefaultCurrency,
 			Status:   models.PaymentStatusPending,
 		},
 		Status: models.OrderStatusCreated,
@@ -318,26 +708,199 @@ func BenchmarkCreateOrder(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		order.ID = fmt.Sprintf("benchmark-order-%d", i)
 		order.TrackingID = fmt.Sprintf("TRKBENCH%d", i)
-		_ = h.PaymentStore.CreateOrder(order)
+		_ = h.PaymentStore.CreateOrder(context.Background(), order)
 	}
 }
 
-// Integration test for full payment flow
-func TestFullPaymentFlow(t *testing.T) {
-	testKey := os.Getenv("STRIPE_SECRET_KEY")
-	if testKey == "" {
-		t.Skip("STRIPE_SECRET_KEY not set")
+// TestGetAllPaymentsFilters tests filtering the admin order listing by status and creation date
+func TestGetAllPaymentsFilters(t *testing.T) {
+	h := handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore())
+	router := setupTestRouter(h)
+
+	now := time.Now().UTC()
+	seed := []struct {
+		id      string
+		status  models.OrderStatus
+		created time.Time
+	}{
+		{"filter-old-refunded", models.OrderStatusRefunded, now.AddDate(0, 0, -30)},
+		{"filter-week-refunded", models.OrderStatusRefunded, now.AddDate(0, 0, -3)},
+		{"filter-week-paid", models.OrderStatusPaid, now.AddDate(0, 0, -2)},
 	}
-	if testing.Short() {
-		t.Skip("Skipping integration test in short mode")
+	for _, o := range seed {
+		createPendingOrder(t, h, o.id, "pi_"+o.id, 1000)
+		order, err := h.PaymentStore.GetOrder(context.Background(), o.id)
+		require.NoError(t, err)
+		order.Status = o.status
+		order.CreatedAt = o.created
+		require.NoError(t, h.PaymentStore.UpdateOrder(context.Background(), order))
+	}
+
+	list := func(query string) (int, []string) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/api/payments/all?"+query, nil))
+		if w.Code != http.StatusOK {
+			return w.Code, nil
+		}
+		var response struct {
+			Orders []models.OrderSummary `json:"orders"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		ids := []string{}
+		for _, order := range response.Orders {
+			ids = append(ids, order.ID)
+		}
+		return w.Code, ids
+	}
+
+	weekAgo := url.QueryEscape(now.AddDate(0, 0, -7).Format(time.RFC3339))
+	dayAgo := url.QueryEscape(now.AddDate(0, 0, -1).Format(time.RFC3339))
+
+	_, ids := list("status=refunded")
+	assert.Equal(t, []string{"filter-week-refunded", "filter-old-refunded"}, ids)
+	_, ids = list("from=" + weekAgo)
+	assert.Equal(t, []string{"filter-week-paid", "filter-week-refunded"}, ids)
+	_, ids = list("status=refunded&from=" + weekAgo + "&to=" + dayAgo)
+	assert.Equal(t, []string{"filter-week-refunded"}, ids)
+	_, ids = list("to=" + weekAgo)
+	assert.Equal(t, []string{"filter-old-refunded"}, ids)
+
+	code, _ := list("from=" + dayAgo + "&to=" + weekAgo)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = list("from=yesterday")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = list("status=lost")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// The total counts every match, not just the page
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/payments/all?status=refunded&limit=1&offset=1", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var page struct {
+		Orders []models.OrderSummary `json:"orders"`
+		Total  int                   `json:"total"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	assert.Equal(t, 2, page.Total)
+	require.Len(t, page.Orders, 1)
+	assert.Equal(t, "filter-old-refunded", page.Orders[0].ID)
+
+	total, err := h.PaymentStore.CountOrders(context.Background(), models.OrderFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, 3, total)
+}
+
+func TestExportOrdersCSV(t *testing.T) {
+	h := handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore())
+	router := setupTestRouter(h)
+
+	created := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	fulfilled := created.Add(time.Hour)
+	for i, seed := range []struct {
+		amount      int64
+		currency    string
+		status      models.OrderStatus
+		fulfilledAt *time.Time
+	}{
+		{1999, "usd", models.OrderStatusFulfilled, &fulfilled},
+		{500, "jpy", models.OrderStatusPaid, nil},
+		{750, "usd", models.OrderStatusPending, nil},
+	} {
+		order := &models.Order{
+			ID:           fmt.Sprintf("export-order-%d", i),
+			TrackingID:   fmt.Sprintf("TRKEXPORT%d", i),
+			CustomerInfo: models.CustomerInfo{Email: "export@example.com"},
+			Payment:      models.PaymentInfo{Amount: seed.amount, Currency: seed.currency},
+			Status:       seed.status,
+		}
+		require.NoError(t, h.PaymentStore.CreateOrder(context.Background(), order))
+		order.CreatedAt = created.AddDate(0, 0, i)
+		order.FulfilledAt = seed.fulfilledAt
+		require.NoError(t, h.PaymentStore.UpdateOrder(context.Background(), order))
+	}
+
+	export := func(query string) (*httptest.ResponseRecorder, [][]string) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/api/payments/export.csv?"+query, nil))
+		if w.Code != http.StatusOK {
+			return w, nil
+		}
+		rows, err := csv.NewReader(w.Body).ReadAll()
+		require.NoError(t, err)
+		return w, rows
+	}
+
+	w, rows := export("")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/csv; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.True(t, strings.HasPrefix(w.Header().Get("Content-Disposition"), "attachment;"))
+	assert.Equal(t, [][]string{
+		{"order_id", "tracking_id", "customer_email", "status", "amount", "currency", "created_at", "fulfilled_at"},
+		{"export-order-2", "TRKEXPORT2", "export@example.com", "pending", "7.50", "usd", "2024-06-03T12:00:00Z", ""},
+		{"export-order-1", "TRKEXPORT1", "export@example.com", "paid", "500", "jpy", "2024-06-02T12:00:00Z", ""},
+		{"export-order-0", "TRKEXPORT0", "export@example.com", "fulfilled", "19.99", "usd", "2024-06-01T12:00:00Z", "2024-06-01T13:00:00Z"},
+	}, rows)
+
+	_, rows = export("status=paid")
+	require.Len(t, rows, 2)
+	assert.Equal(t, "export-order-1", rows[1][0])
+
+	_, rows = export("from=2024-06-02T00:00:00Z&to=2024-06-02T23:59:59Z")
+	require.Len(t, rows, 2)
+	assert.Equal(t, "export-order-1", rows[1][0])
+
+	// No matches still downloads the header row
+	_, rows = export("status=refunded")
+	assert.Len(t, rows, 1)
+
+	w, _ = export("status=lost")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+// TestExportOrdersCSVEscapesFormulas tests that cells a spreadsheet would run as formulas are exported as text
+func TestExportOrdersCSVEscapesFormulas(t *testing.T) {
+	h := handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore())
+	router := setupTestRouter(h)
+
+	for i, email := range []string{"=HYPERLINK(\"http://evil.example\")", "+1@example.com", "-cmd@example.com", "@SUM(A1)", "plain@example.com"} {
+		require.NoError(t, h.PaymentStore.CreateOrder(context.Background(), &models.Order{
+			ID:           fmt.Sprintf("formula-order-%d", i),
+			TrackingID:   fmt.Sprintf("TRKFORMULA%d", i),
+			CustomerInfo: models.CustomerInfo{Email: email},
+			Payment:      models.PaymentInfo{Amount: 100, Currency: "usd"},
+			Status:       models.OrderStatusPaid,
+		}))
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/payments/export.csv", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	rows, err := csv.NewReader(w.Body).ReadAll()
+	require.NoError(t, err)
+
+	emails := map[string]string{}
+	for _, row := range rows[1:] {
+		emails[row[0]] = row[2]
 	}
+	assert.Equal(t, map[string]string{
+		"formula-order-0": "'=HYPERLINK(\"http://evil.example\")",
+		"formula-order-1": "'+1@example.com",
+		"formula-order-2": "'-cmd@example.com",
+		"formula-order-3": "'@SUM(A1)",
+		"formula-order-4": "plain@example.com",
+	}, emails)
+}
 
+// Integration test for full payment flow
+func TestFullPaymentFlow(t *testing.T) {
 	cfg := &config.Config{
-		StripeSecretKey: testKey,
-		Environment:     "test",
+		StripeMode:  config.StripeModeFake,
+		Environment: "test",
 	}
-	h := handlers.NewHandlers(cfg)
+	h := handlers.NewHandlers(cfg, store.NewMemoryStore())
 	router := setupTestRouter(h)
+	fake, ok := h.Gateway.(*handlers.FakeGateway)
+	require.True(t, ok, "STRIPE_MODE=fake should use FakeGateway")
 
 	// Step 1: Create order
 	orderRequest := map[string]interface{}{
@@ -365,13 +928,19 @@ func TestFullPaymentFlow(t *testing.T) {
 	require.Equal(t, http.StatusCreated, w.Code)
 
 	var createResponse map[string]interface{}
-	err := json.Unmarshal(w.Body.Bytes(), &createResponse)
-	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &createResponse))
 
 	order := createResponse["order"].(map[string]interface{})
 	orderID := order["id"].(string)
 	trackingID := order["tracking_id"].(string)
 
+	// The fake numbers its objects, so the first order always gets the same intent
+	assert.Equal(t, "pi_fake_1_secret_fake", createResponse["client_secret"])
+	stored, err := h.PaymentStore.GetOrder(context.Background(), orderID)
+	require.NoError(t, err)
+	assert.Equal(t, "pi_fake_1", stored.Payment.StripePaymentIntentID)
+	assert.Equal(t, "cus_fake_1", stored.CustomerInfo.StripeCustomerID)
+
 	// Step 2: Check initial status
 	req = httptest.NewRequest("GET", "/api/payments/status/"+orderID, nil)
 	w = httptest.NewRecorder()
@@ -387,7 +956,8 @@ func TestFullPaymentFlow(t *testing.T) {
 	assert.Equal(t, "pending", statusResponse["order_status"])
 
 	// Step 3: Simulate payment success (normally done by webhook)
-	err = h.PaymentStore.UpdatePaymentStatus(orderID, models.PaymentStatusSucceeded)
+	require.NoError(t, fake.SetPaymentIntentStatus("pi_fake_1", stripe.PaymentIntentStatusSucceeded))
+	err = h.PaymentStore.UpdatePaymentStatus(context.Background(), orderID, models.PaymentStatusSucceeded)
 	require.NoError(t, err)
 
 	// Step 4: Check updated status
@@ -402,6 +972,9 @@ func TestFullPaymentFlow(t *testing.T) {
 
 	assert.Equal(t, "succeeded", statusResponse["payment_status"])
 	assert.Equal(t, "paid", statusResponse["order_status"])
+	stored, err = h.PaymentStore.GetOrder(context.Background(), orderID)
+	require.NoError(t, err)
+	assert.Equal(t, models.PaymentMethodCard, stored.Payment.Method)
 
 	// Step 5: Track payment
 	req = httptest.NewRequest("GET", "/api/payments/track/"+trackingID, nil)
@@ -441,19 +1014,13 @@ func TestFullPaymentFlow(t *testing.T) {
 
 // Load test helper
 func TestLoadTest(t *testing.T) {
-	testKey := os.Getenv("STRIPE_SECRET_KEY")
-	if testKey == "" {
-		t.Skip("STRIPE_SECRET_KEY not set")
-	}
 	if testing.Short() {
 		t.Skip("Skipping load test in short mode")
 	}
 
-	cfg := &config.Config{
-		StripeSecretKey: testKey,
-		Environment:     "test",
-	}
-	h := handlers.NewHandlers(cfg)
+	cfg := &config.Config{Environment: "test", DefaultCurrency: config.DefaultCurrency}
+	h := handlers.NewHandlers(cfg, store.NewMemoryStore())
+	h.Gateway = handlers.NewFakeGateway()
 
 	// Simulate concurrent order creation
 	numGoroutines := 10
@@ -469,19 +1036,19 @@ func TestLoadTest(t *testing.T) {
 			for j := 0; j < ordersPerGoroutine; j++ {
 				order := &models.Order{
 					ID:         fmt.Sprintf("load-test-%d-%d", goroutineID, j),
-					TrackingID: fmt.Sprintf("TRK%d%d", goroutineID, j),
+					TrackingID: fmt.Sprintf("TRK-%d-%d", goroutineID, j), // Separators keep 1/23 and 12/3 apart
 					CustomerInfo: models.CustomerInfo{
 						Email: fmt.Sprintf("load-test-%d-%d@example.com", goroutineID, j),
 					},
 					Payment: models.PaymentInfo{
 						Amount:   1000,
-						Currency: "usd",
+						Currency: cfg.DefaultCurrency,
 						Status:   models.PaymentStatusPending,
 					},
 					Status: models.OrderStatusCreated,
 				}
 
-				err := h.PaymentStore.CreateOrder(order)
+				err := h.PaymentStore.CreateOrder(context.Background(), order)
 				results <- err
 			}
 		}(i)
@@ -507,4 +1074,1636 @@ func TestLoadTest(t *testing.T) {
 
 	assert.Empty(t, errors, "Load test should not produce errors")
 	assert.Greater(t, ordersPerSecond, 100.0, "Should handle at least 100 orders per second")
+
+	// Every write must have landed, each under its own tracking ID
+	count, err := h.PaymentStore.CountOrders(context.Background(), models.OrderFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, totalOrders, count)
+	for i := 0; i < numGoroutines; i++ {
+		for j := 0; j < ordersPerGoroutine; j++ {
+			order, err := h.PaymentStore.GetOrderByTrackingID(context.Background(), fmt.Sprintf("TRK-%d-%d", i, j))
+			require.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf("load-test-%d-%d", i, j), order.ID)
+		}
+	}
+}
+
+// TestCustomerCancelPendingOrder tests a customer canceling their unpaid order
+func TestCustomerCancelPendingOrder(t *testing.T) {
+	stub := newStripeStub(t)
+	stub.On("POST", "/v1/payment_intents/pi_cancel_test/cancel", func(req stubRequest) (int, interface{}) {
+		return http.StatusOK, map[string]interface{}{
+			"id":     "pi_cancel_test",
+			"object": "payment_intent",
+			"status": "canceled",
+		}
+	})
+
+	cfg := &config.Config{Environment: "test"}
+	h := handlers.NewHandlers(cfg, store.NewMemoryStore())
+	router := setupTestRouter(h)
+
+	createPendingOrder(t, h, "cancel-order-1", "pi_cancel_test", 1500)
+
+	// A mismatched email must not cancel the order
+	body, _ := json.Marshal(map[string]string{"tracking_id": "TRKcancel-order-1", "email": "someone@else.com"})
+	req := httptest.NewRequest("POST", "/api/payments/cancel", bytes.NewBuffer(body))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	body, _ = json.Marshal(map[string]string{"tracking_id": "TRKcancel-order-1", "email": "Cancel-Order-1@example.com"})
+	req = httptest.NewRequest("POST", "/api/payments/cancel", bytes.NewBuffer(body))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	cancelCalls := stub.Requests("POST", "/v1/payment_intents/pi_cancel_test/cancel")
+	require.Len(t, cancelCalls, 1)
+	assert.Equal(t, "requested_by_customer", cancelCalls[0].Form.Get("cancellation_reason"))
+
+	order, err := h.PaymentStore.GetOrder(context.Background(), "cancel-order-1")
+	require.NoError(t, err)
+	assert.Equal(t, models.OrderStatusCanceled, order.Status)
+	assert.Equal(t, models.PaymentStatusCanceled, order.Payment.Status)
+
+	events := handlerEvents(t, h, "cancel-order-1")
+	require.Len(t, events, 1)
+	assert.Equal(t, "order_canceled", events[0].EventType)
+	assert.Equal(t, "customer", events[0].Data.(map[string]interface{})["actor"])
+}
+
+// TestCustomerCancelPaidOrderRejected tests that paid orders can't be canceled by customers
+func TestCustomerCancelPaidOrderRejected(t *testing.T) {
+	cfg := &config.Config{Environment: "test"}
+	h := handlers.NewHandlers(cfg, store.NewMemoryStore())
+	router := setupTestRouter(h)
+
+	createPendingOrder(t, h, "cancel-order-2", "pi_cancel_paid", 1500)
+	require.NoError(t, h.PaymentStore.UpdatePaymentStatus(context.Background(), "cancel-order-2", models.PaymentStatusSucceeded))
+
+	body, _ := json.Marshal(map[string]string{"tracking_id": "TRKcancel-order-2", "email": "cancel-order-2@example.com"})
+	req := httptest.NewRequest("POST", "/api/payments/cancel", bytes.NewBuffer(body))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "refund")
+}
+
+// TestCancelUnpaidOrder tests that an admin can cancel a pending order and its payment intent,
+// but not an order that has been paid
+func TestCancelUnpaidOrder(t *testing.T) {
+	stub := newStripeStub(t)
+	stub.On("POST", "/v1/payment_intents/pi_admin_cancel/cancel", func(req stubRequest) (int, interface{}) {
+		return http.StatusOK, map[string]interface{}{
+			"id":     "pi_admin_cancel",
+			"object": "payment_intent",
+			"status": "canceled",
+		}
+	})
+
+	h := handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore())
+	router := setupTestRouter(h)
+
+	createPendingOrder(t, h, "admin-cancel-1", "pi_admin_cancel", 1500)
+	createPendingOrder(t, h, "admin-cancel-2", "pi_admin_cancel_paid", 1500)
+	require.NoError(t, h.PaymentStore.UpdatePaymentStatus(context.Background(), "admin-cancel-2", models.PaymentStatusSucceeded))
+
+	cancel := func(orderID string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/api/payments/cancel/"+orderID, nil))
+		return w
+	}
+
+	w := cancel("admin-cancel-1")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	cancelCalls := stub.Requests("POST", "/v1/payment_intents/pi_admin_cancel/cancel")
+	require.Len(t, cancelCalls, 1)
+	assert.Equal(t, "abandoned", cancelCalls[0].Form.Get("cancellation_reason"))
+
+	order, err := h.PaymentStore.GetOrder(context.Background(), "admin-cancel-1")
+	require.NoError(t, err)
+	assert.Equal(t, models.OrderStatusCanceled, order.Status)
+	assert.Equal(t, models.PaymentStatusCanceled, order.Payment.Status)
+
+	events := handlerEvents(t, h, "admin-cancel-1")
+	require.Len(t, events, 1)
+	assert.Equal(t, "order_canceled", events[0].EventType)
+	assert.Equal(t, "admin", events[0].Data.(map[string]interface{})["actor"])
+
+	// Already canceled, paid, and unknown orders are left alone
+	assert.Equal(t, http.StatusBadRequest, cancel("admin-cancel-1").Code)
+	assert.Equal(t, http.StatusBadRequest, cancel("admin-cancel-2").Code)
+	assert.Equal(t, http.StatusNotFound, cancel("admin-cancel-missing").Code)
+	assert.Len(t, stub.Requests("POST", "/v1/payment_intents/pi_admin_cancel_paid/cancel"), 0)
+}
+
+// TestRefundOrderIssuesStripeRefund tests that refunds go through Stripe and record the refund ID
+func TestRefundOrderIssuesStripeRefund(t *testing.T) {
+	stub := newStripeStub(t)
+	stub.On("POST", "/v1/refunds", func(req stubRequest) (int, interface{}) {
+		return http.StatusOK, map[string]interface{}{
+			"id":             "re_refund_test",
+			"object":         "refund",
+			"amount":         1500,
+			"payment_intent": req.Form.Get("payment_intent"),
+			"status":         "succeeded",
+		}
+	})
+
+	h := handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore())
+	router := setupTestRouter(h)
+
+	createPendingOrder(t, h, "refund-order-1", "pi_refund_test", 1500)
+	require.NoError(t, h.PaymentStore.UpdatePaymentStatus(context.Background(), "refund-order-1", models.PaymentStatusSucceeded))
+	require.NoError(t, h.PaymentStore.UpdateOrderStatus(context.Background(), "refund-order-1", models.OrderStatusPaid))
+
+	req := httptest.NewRequest("POST", "/api/payments/refund/refund-order-1", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	refunds := stub.Requests("POST", "/v1/refunds")
+	require.Len(t, refunds, 1)
+	assert.Equal(t, "pi_refund_test", refunds[0].Form.Get("payment_intent"))
+
+	order, err := h.PaymentStore.GetOrder(context.Background(), "refund-order-1")
+	require.NoError(t, err)
+	assert.Equal(t, models.OrderStatusRefunded, order.Status)
+	assert.Equal(t, models.PaymentStatusRefunded, order.Payment.Status)
+	assert.Equal(t, "re_refund_test", order.Payment.StripeRefundID)
+
+	events := handlerEvents(t, h, "refund-order-1")
+	require.Len(t, events, 1)
+	assert.Equal(t, "order_refunded", events[0].EventType)
+	assert.Equal(t, "re_refund_test", events[0].Data.(map[string]interface{})["stripe_refund_id"])
+}
+
+// TestPartialRefunds tests refunding part of a payment, rejecting more than what's left, then refunding the rest
+func TestPartialRefunds(t *testing.T) {
+	stub := newStripeStub(t)
+	refunds := 0
+	stub.On("POST", "/v1/refunds", func(req stubRequest) (int, interface{}) {
+		refunds++
+		amount, _ := strconv.ParseInt(req.Form.Get("amount"), 10, 64)
+		return http.StatusOK, map[string]interface{}{
+			"id":             fmt.Sprintf("re_partial_%d", refunds),
+			"object":         "refund",
+			"amount":         amount,
+			"payment_intent": req.Form.Get("payment_intent"),
+			"status":         "succeeded",
+		}
+	})
+
+	h := handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore())
+	router := setupTestRouter(h)
+
+	createPendingOrder(t, h, "partial-refund-1", "pi_partial_refund", 1500)
+	require.NoError(t, h.PaymentStore.UpdatePaymentStatus(context.Background(), "partial-refund-1", models.PaymentStatusSucceeded))
+	require.NoError(t, h.PaymentStore.UpdateOrderStatus(context.Background(), "partial-refund-1", models.OrderStatusFulfilled))
+
+	postRefund := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/payments/refund/partial-refund-1", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := postRefund(`{"amount": 500, "reason": "requested_by_customer"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	calls := stub.Requests("POST", "/v1/refunds")
+	require.Len(t, calls, 1)
+	assert.Equal(t, "500", calls[0].Form.Get("amount"))
+	assert.Equal(t, "requested_by_customer", calls[0].Form.Get("reason"))
+
+	order, err := h.PaymentStore.GetOrder(context.Background(), "partial-refund-1")
+	require.NoError(t, err)
+	assert.Equal(t, models.OrderStatusFulfilled, order.Status)
+	assert.Equal(t, models.PaymentStatusPartiallyRefunded, order.Payment.Status)
+	assert.Equal(t, int64(500), order.Payment.AmountRefunded)
+	assert.Equal(t, "re_partial_1", order.Payment.StripeRefundID)
+
+	// Only 1000 cents are left to refund
+	assert.Equal(t, http.StatusBadRequest, postRefund(`{"amount": 1200}`).Code)
+	assert.Equal(t, http.StatusBadRequest, postRefund(`{"amount": 100, "reason": "changed_mind"}`).Code)
+	assert.Len(t, stub.Requests("POST", "/v1/refunds"), 1)
+
+	// No amount refunds the remainder
+	w = postRefund(``)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	calls = stub.Requests("POST", "/v1/refunds")
+	require.Len(t, calls, 2)
+	assert.Equal(t, "1000", calls[1].Form.Get("amount"))
+
+	order, err = h.PaymentStore.GetOrder(context.Background(), "partial-refund-1")
+	require.NoError(t, err)
+	assert.Equal(t, models.OrderStatusRefunded, order.Status)
+	assert.Equal(t, models.PaymentStatusRefunded, order.Payment.Status)
+	assert.Equal(t, int64(1500), order.Payment.AmountRefunded)
+
+	events := handlerEvents(t, h, "partial-refund-1")
+	require.Len(t, events, 2)
+	assert.Equal(t, "order_partially_refunded", events[0].EventType)
+	assert.Equal(t, "order_refunded", events[1].EventType)
+
+	assert.Equal(t, http.StatusBadRequest, postRefund(``).Code)
+}
+
+// TestRefundOrderMaxAge tests that refunding an order paid longer ago than MAX_REFUND_AGE is blocked
+// unless overridden with the refund override token
+func TestRefundOrderMaxAge(t *testing.T) {
+	stub := newStripeStub(t)
+	stub.On("POST", "/v1/refunds", func(req stubRequest) (int, interface{}) {
+		return http.StatusOK, map[string]interface{}{
+			"id":             "re_old_order",
+			"object":         "refund",
+			"amount":         1000,
+			"payment_intent": req.Form.Get("payment_intent"),
+			"status":         "succeeded",
+		}
+	})
+
+	h := handlers.NewHandlers(&config.Config{
+		Environment:         "test",
+		MaxRefundAge:        180 * 24 * time.Hour,
+		RefundOverrideToken: "override-secret",
+	}, store.NewMemoryStore())
+	router := setupTestRouter(h)
+
+	createPendingOrder(t, h, "old-order-1", "pi_old_order", 1000)
+	order, err := h.PaymentStore.GetOrder(context.Background(), "old-order-1")
+	require.NoError(t, err)
+	paidAt := time.Now().AddDate(0, 0, -200)
+	order.Status = models.OrderStatusFulfilled
+	order.Payment.Status = models.PaymentStatusSucceeded
+	order.Payment.ProcessedAt = &paidAt
+	require.NoError(t, h.PaymentStore.UpdateOrder(context.Background(), order))
+
+	postRefund := func(body, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/payments/refund/old-order-1", strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("X-Refund-Override-Token", token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := postRefund(``, "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "180 days")
+	assert.Equal(t, http.StatusForbidden, postRefund(`{"override_max_age": true}`, "").Code)
+	assert.Equal(t, http.StatusForbidden, postRefund(`{"override_max_age": true}`, "wrong-token").Code)
+	assert.Empty(t, stub.Requests("POST", "/v1/refunds"))
+
+	w = postRefund(`{"override_max_age": true}`, "override-secret")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Len(t, stub.Requests("POST", "/v1/refunds"), 1)
+
+	order, err = h.PaymentStore.GetOrder(context.Background(), "old-order-1")
+	require.NoError(t, err)
+	assert.Equal(t, models.OrderStatusRefunded, order.Status)
+}
+
+// TestRefundOrderStripeError tests that a failed Stripe refund leaves the order untouched
+func TestRefundOrderStripeError(t *testing.T) {
+	stub := newStripeStub(t)
+	stub.On("POST", "/v1/refunds", func(req stubRequest) (int, interface{}) {
+		return http.StatusBadRequest, map[string]interface{}{
+			"error": map[string]interface{}{
+				"type":    "invalid_request_error",
+				"code":    "charge_already_refunded",
+				"message": "Charge ch_refunded has already been refunded.",
+			},
+		}
+	})
+
+	h := handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore())
+	router := setupTestRouter(h)
+
+	createPendingOrder(t, h, "refund-order-2", "pi_refund_fail", 1500)
+	require.NoError(t, h.PaymentStore.UpdatePaymentStatus(context.Background(), "refund-order-2", models.PaymentStatusSucceeded))
+	require.NoError(t, h.PaymentStore.UpdateOrderStatus(context.Background(), "refund-order-2", models.OrderStatusPaid))
+
+	req := httptest.NewRequest("POST", "/api/payments/refund/refund-order-2", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.Contains(t, w.Body.String(), "has already been refunded")
+
+	order, err := h.PaymentStore.GetOrder(context.Background(), "refund-order-2")
+	require.NoError(t, err)
+	assert.Equal(t, models.OrderStatusPaid, order.Status)
+	assert.Equal(t, models.PaymentStatusSucceeded, order.Payment.Status)
+	assert.Empty(t, order.Payment.StripeRefundID)
+
+	events := handlerEvents(t, h, "refund-order-2")
+	assert.Empty(t, events)
+}
+
+// refundFailingStore is a store that can't record refunds
+type refundFailingStore struct {
+	*store.MemoryStore
+}
+
+func (refundFailingStore) UpdatePaymentRefund(ctx context.Context, orderID, refundID string, amountRefunded int64) error {
+	return errors.New("database unavailable")
+}
+
+// TestRefundOrderNotRecorded tests that a refund Stripe made but the store couldn't record fails the
+// request with the refund ID and leaves a refund_not_recorded event to reconcile it from
+func TestRefundOrderNotRecorded(t *testing.T) {
+	stub := newStripeStub(t)
+	stub.On("POST", "/v1/refunds", func(req stubRequest) (int, interface{}) {
+		return http.StatusOK, map[string]interface{}{"id": "re_unrecorded", "object": "refund", "amount": 1500, "status": "succeeded"}
+	})
+
+	h := handlers.NewHandlers(&config.Config{Environment: "test"}, refundFailingStore{store.NewMemoryStore()})
+	router := setupTestRouter(h)
+
+	createPendingOrder(t, h, "refund-unrecorded", "pi_refund_unrecorded", 1500)
+	require.NoError(t, h.PaymentStore.UpdatePaymentStatus(context.Background(), "refund-unrecorded", models.PaymentStatusSucceeded))
+	require.NoError(t, h.PaymentStore.UpdateOrderStatus(context.Background(), "refund-unrecorded", models.OrderStatusPaid))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/payments/refund/refund-unrecorded", nil))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Contains(t, w.Body.String(), "re_unrecorded")
+	assert.NotContains(t, w.Body.String(), "database unavailable")
+
+	events := handlerEvents(t, h, "refund-unrecorded")
+	require.Len(t, events, 1)
+	assert.Equal(t, "refund_not_recorded", events[0].EventType)
+	data := events[0].Data.(map[string]interface{})
+	assert.Equal(t, "re_unrecorded", data["stripe_refund_id"])
+	assert.Equal(t, "database unavailable", data["error"])
+
+	order, err := h.PaymentStore.GetOrder(context.Background(), "refund-unrecorded")
+	require.NoError(t, err)
+	assert.Equal(t, models.OrderStatusPaid, order.Status)
+}
+
+// TestEmptyListsEncodeAsArrays tests that empty results encode as [] rather than null with both stores
+func TestEmptyListsEncodeAsArrays(t *testing.T) {
+	stores := map[string]func(t *testing.T) store.PaymentStore{
+		"memory":   func(t *testing.T) store.PaymentStore { return store.NewMemoryStore() },
+		"postgres": func(t *testing.T) store.PaymentStore { return newTestPostgresStore(t) },
+	}
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			h := handlers.NewHandlers(&config.Config{Environment: "test"}, newStore(t))
+			router := setupTestRouter(h)
+
+			for _, target := range []string{
+				"/api/payments/customer/nobody@example.com",
+				"/api/payments/all?offset=1000",
+			} {
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+				require.Equal(t, http.StatusOK, w.Code, target)
+				assert.Contains(t, w.Body.String(), `"orders":[]`, target)
+			}
+
+			events, err := h.PaymentStore.GetPaymentEvents(context.Background(), "missing-order")
+			require.NoError(t, err)
+			encoded, err := json.Marshal(events)
+			require.NoError(t, err)
+			assert.Equal(t, "[]", string(encoded))
+		})
+	}
+}
+
+// TestTrackOrderWithoutItemsOrEvents tests that an order's empty items and events encode as []
+func TestTrackOrderWithoutItemsOrEvents(t *testing.T) {
+	h := handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore())
+	router := setupTestRouter(h)
+
+	createPendingOrder(t, h, "empty-order-1", "pi_empty", 1000)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/payments/track/TRKempty-order-1", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"items":[]`)
+	assert.Contains(t, w.Body.String(), `"events":[]`)
+}
+
+// postCreateOrder posts an order creation request and returns the recorder
+func postCreateOrder(t *testing.T, router http.Handler, orderRequest map[string]interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+
+	jsonData, err := json.Marshal(orderRequest)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("POST", "/api/payments/create-order", bytes.NewBuffer(jsonData))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// testOrderRequest builds a single-item order request
+func testOrderRequest(email string, price float64) map[string]interface{} {
+	return map[string]interface{}{
+		"customer_info": map[string]interface{}{
+			"email": email,
+			"name":  "Test Customer",
+		},
+		"items": []map[string]interface{}{
+			{
+				"product_id":   "1",
+				"product_name": "Test Product",
+				"file_type":    "PDF",
+				"price":        price,
+				"quantity":     1,
+			},
+		},
+	}
+}
+
+// TestCreateOrderWithClientIDIsIdempotent tests that repeating a client-generated ID returns the same order
+func TestCreateOrderWithClientIDIsIdempotent(t *testing.T) {
+	stub := newStripeStub(t)
+	stub.stubPaymentIntents()
+
+	h := handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore())
+	router := setupTestRouter(h)
+
+	orderRequest := testOrderRequest("idempotent@example.com", 9.99)
+	orderRequest["id"] = "3f2b8c1e-6a4d-4f0e-9b7a-2c5d8e1f0a3b"
+
+	first := postCreateOrder(t, router, orderRequest)
+	require.Equal(t, http.StatusCreated, first.Code)
+
+	second := postCreateOrder(t, router, orderRequest)
+	require.Equal(t, http.StatusOK, second.Code)
+
+	var firstResponse, secondResponse handlers.CreateOrderResponse
+	require.NoError(t, json.Unmarshal(first.Body.Bytes(), &firstResponse))
+	require.NoError(t, json.Unmarshal(second.Body.Bytes(), &secondResponse))
+
+	assert.Equal(t, "3f2b8c1e-6a4d-4f0e-9b7a-2c5d8e1f0a3b", firstResponse.Order.ID)
+	assert.Equal(t, firstResponse.Order.ID, secondResponse.Order.ID)
+	assert.Equal(t, firstResponse.ClientSecret, secondResponse.ClientSecret)
+	assert.Len(t, stub.Requests("POST", "/v1/payment_intents"), 1)
+
+	orders, err := h.PaymentStore.GetAllOrders(context.Background(), 10, 0, models.OrderFilter{})
+	require.NoError(t, err)
+	assert.Len(t, orders, 1)
+}
+
+// TestCreateOrderWithClientIDRejectsOtherOrders tests that reusing a client-generated ID for another
+// customer or other items gets a 409 rather than the stored order
+func TestCreateOrderWithClientIDRejectsOtherOrders(t *testing.T) {
+	stub := newStripeStub(t)
+	stub.stubPaymentIntents()
+
+	h := handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore())
+	router := setupTestRouter(h)
+
+	const orderID = "7c9e6679-7425-40de-944b-e07fc1f90ae7"
+	orderRequest := testOrderRequest("owner@example.com", 9.99)
+	orderRequest["id"] = orderID
+	require.Equal(t, http.StatusCreated, postCreateOrder(t, router, orderRequest).Code)
+
+	otherCustomer := testOrderRequest("someone-else@example.com", 9.99)
+	otherCustomer["id"] = orderID
+	w := postCreateOrder(t, router, otherCustomer)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.NotContains(t, w.Body.String(), "owner@example.com")
+	assert.NotContains(t, w.Body.String(), "client_secret")
+
+	otherPrice := testOrderRequest("owner@example.com", 19.99)
+	otherPrice["id"] = orderID
+	assert.Equal(t, http.StatusConflict, postCreateOrder(t, router, otherPrice).Code)
+
+	assert.Equal(t, http.StatusOK, postCreateOrder(t, router, orderRequest).Code)
+}
+
+// TestCreateOrderWithClientIDRetriesPayment tests that repeating a client-generated ID after the payment
+// intent failed to be created creates it, rather than returning the order without a client secret
+func TestCreateOrderWithClientIDRetriesPayment(t *testing.T) {
+	stub := newStripeStub(t)
+	stub.On("POST", "/v1/payment_intents", func(req stubRequest) (int, interface{}) {
+		return http.StatusBadRequest, map[string]interface{}{
+			"error": map[string]interface{}{"type": "invalid_request_error", "message": "Temporarily unavailable."},
+		}
+	})
+
+	h := handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore())
+	router := setupTestRouter(h)
+
+	orderRequest := testOrderRequest("retry@example.com", 9.99)
+	orderRequest["id"] = "9b2e4a7c-1d3f-4e5a-8b6c-0d1e2f3a4b5c"
+	require.Equal(t, http.StatusInternalServerError, postCreateOrder(t, router, orderRequest).Code)
+
+	stub.stubPaymentIntents()
+	w := postCreateOrder(t, router, orderRequest)
+	require.Equal(t, http.StatusOK, w.Code)
+	var response handlers.CreateOrderResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.NotEmpty(t, response.ClientSecret)
+	assert.Equal(t, models.OrderStatusPending, response.Order.Status)
+
+	requests := stub.Requests("POST", "/v1/payment_intents")
+	require.Len(t, requests, 2)
+	assert.Equal(t, "order-9b2e4a7c-1d3f-4e5a-8b6c-0d1e2f3a4b5c", requests[1].Header.Get("Idempotency-Key"))
+}
+
+// TestCreateOrderIdempotencyKeyHeader tests that repeating an Idempotency-Key returns the same order
+// and payment intent, that a failed attempt frees the key for a retry, and that the key can't be
+// reused for a different order
+func TestCreateOrderIdempotencyKeyHeader(t *testing.T) {
+	stub := newStripeStub(t)
+	stub.On("POST", "/v1/payment_intents", func(req stubRequest) (int, interface{}) {
+		return http.StatusBadRequest, map[string]interface{}{
+			"error": map[string]interface{}{
+				"type":    "invalid_request_error",
+				"message": "Temporarily unavailable.",
+			},
+		}
+	})
+
+	h := handlers.NewHandlers(&config.Config{Environment: "test", IdempotencyTTL: time.Hour}, store.NewMemoryStore())
+	router := setupTestRouter(h)
+
+	postWithKey := func(key string, orderRequest map[string]interface{}) *httptest.ResponseRecorder {
+		jsonData, err := json.Marshal(orderRequest)
+		require.NoError(t, err)
+		req := httptest.NewRequest("POST", "/api/payments/create-order", bytes.NewBuffer(jsonData))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", key)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	post := func(key string) *httptest.ResponseRecorder {
+		return postWithKey(key, testOrderRequest("double-click@example.com", 9.99))
+	}
+
+	// Stripe fails, so the key isn't kept
+	require.Equal(t, http.StatusInternalServerError, post("checkout-1").Code)
+	stub.stubPaymentIntents()
+
+	first := post("checkout-1")
+	require.Equal(t, http.StatusCreated, first.Code)
+	second := post("checkout-1")
+	require.Equal(t, http.StatusOK, second.Code)
+
+	var firstResponse, secondResponse handlers.CreateOrderResponse
+	require.NoError(t, json.Unmarshal(first.Body.Bytes(), &firstResponse))
+	require.NoError(t, json.Unmarshal(second.Body.Bytes(), &secondResponse))
+	assert.Equal(t, firstResponse.Order.ID, secondResponse.Order.ID)
+	assert.Equal(t, firstResponse.ClientSecret, secondResponse.ClientSecret)
+	assert.NotEmpty(t, secondResponse.ClientSecret)
+
+	// Stripe's key follows the order, so the retry's new order doesn't collide with the failed attempt's
+	requests := stub.Requests("POST", "/v1/payment_intents")
+	require.Len(t, requests, 2)
+	assert.Equal(t, "order-"+firstResponse.Order.ID, requests[1].Header.Get("Idempotency-Key"))
+	assert.NotEqual(t, requests[0].Header.Get("Idempotency-Key"), requests[1].Header.Get("Idempotency-Key"))
+
+	// The key can't be replayed for another customer's checkout
+	w := postWithKey("checkout-1", testOrderRequest("someone-else@example.com", 9.99))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.NotContains(t, w.Body.String(), "double-click@example.com")
+
+	// A different key is a different checkout
+	third := post("checkout-2")
+	require.Equal(t, http.StatusCreated, third.Code)
+	var thirdResponse handlers.CreateOrderResponse
+	require.NoError(t, json.Unmarshal(third.Body.Bytes(), &thirdResponse))
+	assert.NotEqual(t, firstResponse.Order.ID, thirdResponse.Order.ID)
+}
+
+// TestCreateOrderRecordsClientIP tests that orders keep the forwarded client address rather than one
+// sent in the body, and that the order_created event carries it
+func TestCreateOrderRecordsClientIP(t *testing.T) {
+	stub := newStripeStub(t)
+	stub.stubPaymentIntents()
+
+	h := handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore())
+	router := middleware.RealIP(setupTestRouter(h))
+
+	orderRequest := testOrderRequest("ip@example.com", 9.99)
+	orderRequest["customer_info"].(map[string]interface{})["ip_address"] = "198.51.100.99"
+	jsonData, err := json.Marshal(orderRequest)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("POST", "/api/payments/create-order", bytes.NewBuffer(jsonData))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Forwarded-For", "203.0.113.7, 10.0.0.1")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	var response handlers.CreateOrderResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, "203.0.113.7", response.Order.CustomerInfo.IPAddress)
+
+	events, err := h.PaymentStore.GetPaymentEvents(context.Background(), response.Order.ID)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, "203.0.113.7", events[0].Data.(map[string]interface{})["ip_address"])
+
+	// Without a proxy header the connection's address is used, minus the port
+	w = postCreateOrder(t, router, testOrderRequest("ip@example.com", 9.99))
+	require.Equal(t, http.StatusCreated, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, "192.0.2.1", response.Order.CustomerInfo.IPAddress)
+}
+
+// TestCreateOrderRejectsMalformedClientID tests that non-UUID client IDs are rejected
+func TestCreateOrderRejectsMalformedClientID(t *testing.T) {
+	h := handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore())
+	router := setupTestRouter(h)
+
+	orderRequest := testOrderRequest("malformed@example.com", 9.99)
+	orderRequest["id"] = "not-a-uuid"
+
+	w := postCreateOrder(t, router, orderRequest)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+// TestValidateEmail tests that addresses with display names and plus-addressing parse to the bare address with a lowercase domain
+func TestValidateEmail(t *testing.T) {
+	for input, expected := range map[string]string{
+		"jane@example.com":                "jane@example.com",
+		"  Jane@Example.COM ":             "Jane@example.com",
+		"Jane Doe <Jane.Doe@Example.com>": "Jane.Doe@example.com",
+		`"Doe, Jane" <jane@example.com>`:  "jane@example.com",
+		"jane+planners@Example.com":       "jane+planners@example.com",
+	} {
+		normalized, err := models.ValidateEmail(input)
+		require.NoError(t, err, input)
+		assert.Equal(t, expected, normalized, input)
+	}
+
+	for _, input := range []string{"", "notanemail", "jane@", "@example.com", "jane@example.com, joe@example.com", "Jane <jane@example.com"} {
+		_, err := models.ValidateEmail(input)
+		assert.Error(t, err, input)
+	}
+}
+
+// TestCreateOrderValidatesEmail tests that orders are stored with a normalized address, and invalid ones rejected
+func TestCreateOrderValidatesEmail(t *testing.T) {
+	stub := newStripeStub(t)
+	stub.stubPaymentIntents()
+
+	h := handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore())
+	router := setupTestRouter(h)
+
+	w := postCreateOrder(t, router, testOrderRequest("notanemail", 9.99))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "Invalid customer email")
+
+	for _, email := range []string{"Jane Doe <Jane+Planners@Example.COM>", "Jane+Planners@example.com"} {
+		w = postCreateOrder(t, router, testOrderRequest(email, 9.99))
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+		var response handlers.CreateOrderResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, "Jane+Planners@example.com", response.Order.CustomerInfo.Email)
+	}
+
+	// Both orders show up in the history, whichever casing of the domain is looked up
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/payments/customer/"+url.PathEscape("Jane+Planners@EXAMPLE.com"), nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var history struct {
+		Orders []models.OrderSummary `json:"orders"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &history))
+	assert.Len(t, history.Orders, 2)
+}
+
+// TestGetOrderByStripeID tests admin lookup by payment intent and checkout session IDs
+func TestGetOrderByStripeID(t *testing.T) {
+	h := handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore())
+	router := setupTestRouter(h)
+
+	createPendingOrder(t, h, "stripe-lookup-1", "pi_lookup_test", 1000)
+
+	sessionOrder := &models.Order{
+		ID:           "stripe-lookup-2",
+		TrackingID:   "TRKstripe-lookup-2",
+		CustomerInfo: models.CustomerInfo{Email: "session@example.com"},
+		Payment:      models.PaymentInfo{StripeSessionID: "cs_lookup_test", Amount: 500, Currency: "usd", Status: models.PaymentStatusPending},
+		Status:       models.OrderStatusPending,
+	}
+	require.NoError(t, h.PaymentStore.CreateOrder(context.Background(), sessionOrder))
+
+	tests := map[string]string{
+		"pi_lookup_test": "stripe-lookup-1",
+		"cs_lookup_test": "stripe-lookup-2",
+	}
+	for stripeID, expectedOrderID := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/api/payments/by-stripe/"+stripeID, nil))
+		require.Equal(t, http.StatusOK, w.Code, stripeID)
+
+		var order models.Order
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &order))
+		assert.Equal(t, expectedOrderID, order.ID)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/payments/by-stripe/pi_missing", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+// TestGetOrderByPaymentIntentID tests the public payment status lookup by payment intent ID
+func TestGetOrderByPaymentIntentID(t *testing.T) {
+	stub := newStripeStub(t)
+	stub.On("GET", "/v1/payment_intents/*", func(req stubRequest) (int, interface{}) {
+		return http.StatusOK, map[string]interface{}{"id": "pi_by_intent", "object": "payment_intent", "status": "succeeded"}
+	})
+
+	h := handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore())
+	router := setupTestRouter(h)
+
+	createPendingOrder(t, h, "by-intent-1", "pi_by_intent", 1000)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/payments/by-intent/pi_by_intent", nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var response map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, "by-intent-1", response["order_id"])
+	assert.Equal(t, "TRKby-intent-1", response["tracking_id"])
+	assert.Equal(t, "succeeded", response["payment_status"])
+	assert.Equal(t, "paid", response["order_status"])
+	assert.NotContains(t, response, "customer_info")
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/payments/by-intent/pi_missing", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+// TestGetCustomerPaymentsReturnsSummaries tests that the customer history is a page of summaries without payment details
+func TestGetCustomerPaymentsReturnsSummaries(t *testing.T) {
+	h := handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore())
+	router := setupTestRouter(h)
+
+	created := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		order := &models.Order{
+			ID:           fmt.Sprintf("history-order-%d", i),
+			TrackingID:   fmt.Sprintf("TRKHISTORY%d", i),
+			CustomerInfo: models.CustomerInfo{Email: "history@example.com"},
+			Items:        []models.OrderItem{{ProductID: "guide", Quantity: 1, Price: 10}},
+			Payment:      models.PaymentInfo{StripePaymentIntentID: fmt.Sprintf("pi_history_%d", i), Amount: 1000, Currency: "usd"},
+			Status:       models.OrderStatusPending,
+		}
+		require.NoError(t, h.PaymentStore.CreateOrder(context.Background(), order))
+		order.CreatedAt = created.AddDate(0, 0, i)
+		require.NoError(t, h.PaymentStore.UpdateOrder(context.Background(), order))
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/payments/customer/history@example.com?limit=2&offset=1", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), "pi_history")
+
+	var response struct {
+		Orders      []models.OrderSummary `json:"orders"`
+		TotalOrders int                   `json:"total_orders"`
+		Limit       int                   `json:"limit"`
+		Offset      int                   `json:"offset"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	require.Len(t, response.Orders, 2)
+	assert.Equal(t, 3, response.TotalOrders)
+	assert.Equal(t, "history-order-1", response.Orders[0].ID)
+	assert.Equal(t, "TRKHISTORY1", response.Orders[0].TrackingID)
+	assert.Equal(t, 1, response.Orders[0].ItemCount)
+	assert.Equal(t, "history-order-0", response.Orders[1].ID)
+	assert.Equal(t, 2, response.Limit)
+	assert.Equal(t, 1, response.Offset)
+}
+
+// TestSearchOrders tests admin search by partial email, name, or tracking ID, newest first
+func TestSearchOrders(t *testing.T) {
+	h := handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore())
+	router := setupTestRouter(h)
+
+	base := time.Now().Add(-time.Hour)
+	for i, order := range []*models.Order{
+		{ID: "search-1", TrackingID: "TRKSEARCH1", CustomerInfo: models.CustomerInfo{Email: "alice@example.com", Name: "Alice Smith"}},
+		{ID: "search-2", TrackingID: "TRKSEARCH2", CustomerInfo: models.CustomerInfo{Email: "bob@shop.test", Name: "Bob Jones"}},
+		{ID: "search-3", TrackingID: "TRKOTHER3", CustomerInfo: models.CustomerInfo{Email: "carol@example.com", Name: "Carol Smithers"}},
+	} {
+		require.NoError(t, h.PaymentStore.CreateOrder(context.Background(), order))
+		order.CreatedAt = base.Add(time.Duration(i) * time.Minute)
+		require.NoError(t, h.PaymentStore.UpdateOrder(context.Background(), order))
+	}
+
+	search := func(query string) []string {
+		t.Helper()
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/api/payments/search?"+query, nil))
+		require.Equal(t, http.StatusOK, w.Code, query)
+
+		var response struct {
+			Orders []models.OrderSummary `json:"orders"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		ids := []string{}
+		for _, order := range response.Orders {
+			ids = append(ids, order.ID)
+		}
+		return ids
+	}
+
+	assert.Equal(t, []string{"search-3", "search-1"}, search("q=EXAMPLE.com"))
+	assert.Equal(t, []string{"search-3", "search-1"}, search("q=smith"))
+	assert.Equal(t, []string{"search-2", "search-1"}, search("q=trksearch"))
+	assert.Equal(t, []string{"search-3"}, search("q=smith&limit=1"))
+	assert.Empty(t, search("q=nobody"))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/payments/search?q=+", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+// TestMemoryStoreStripeIDIndexes tests that payment intent and session lookups follow IDs assigned
+// or replaced after creation and survive a snapshot reload
+func TestMemoryStoreStripeIDIndexes(t *testing.T) {
+	mem := store.NewMemoryStore()
+
+	order := &models.Order{
+		ID:           "index-order-1",
+		TrackingID:   "TRKindex-order-1",
+		CustomerInfo: models.CustomerInfo{Email: "index@example.com"},
+		Payment:      models.PaymentInfo{StripeSessionID: "cs_index", Amount: 500, Currency: "usd", Status: models.PaymentStatusPending},
+		Status:       models.OrderStatusPending,
+	}
+	require.NoError(t, mem.CreateOrder(context.Background(), order))
+
+	_, err := mem.FindOrderByPaymentIntentID(context.Background(), "pi_index_1")
+	assert.Error(t, err)
+
+	// Checkout assigns the payment intent once the customer pays
+	order, err = mem.GetOrder(context.Background(), "index-order-1")
+	require.NoError(t, err)
+	order.Payment.StripePaymentIntentID = "pi_index_1"
+	require.NoError(t, mem.UpdateOrder(context.Background(), order))
+
+	orderID, err := mem.FindOrderByPaymentIntentID(context.Background(), "pi_index_1")
+	require.NoError(t, err)
+	assert.Equal(t, "index-order-1", orderID)
+
+	// A replacement intent drops the old one
+	order, err = mem.GetOrder(context.Background(), "index-order-1")
+	require.NoError(t, err)
+	order.Payment.StripePaymentIntentID = "pi_index_2"
+	require.NoError(t, mem.UpdateOrder(context.Background(), order))
+
+	_, err = mem.FindOrderByPaymentIntentID(context.Background(), "pi_index_1")
+	assert.Error(t, err)
+
+	path := filepath.Join(t.TempDir(), "orders.json")
+	require.NoError(t, mem.SnapshotToFile(path))
+
+	reloaded := store.NewMemoryStore()
+	require.NoError(t, reloaded.LoadFromFile(path))
+
+	for _, lookup := range []func(context.Context, string) (string, error){reloaded.FindOrderByPaymentIntentID, mem.FindOrderByPaymentIntentID} {
+		orderID, err := lookup(context.Background(), "pi_index_2")
+		require.NoError(t, err)
+		assert.Equal(t, "index-order-1", orderID)
+	}
+	orderID, err = reloaded.FindOrderBySessionID(context.Background(), "cs_index")
+	require.NoError(t, err)
+	assert.Equal(t, "index-order-1", orderID)
+}
+
+// TestCreateTaxExemptOrder tests that a tax-exempt order is charged the untaxed subtotal and records the exemption
+func TestCreateTaxExemptOrder(t *testing.T) {
+	stub := newStripeStub(t)
+	stub.stubPaymentIntents()
+
+	h := handlers.NewHandlers(&config.Config{Environment: "test", RequireTaxExemptionID: true}, store.NewMemoryStore())
+	router := setupTestRouter(h)
+
+	orderRequest := testOrderRequest("exempt@example.com", 25.00)
+	customerInfo := orderRequest["customer_info"].(map[string]interface{})
+	customerInfo["tax_exempt"] = true
+	customerInfo["tax_exemption_id"] = "EX-12345"
+
+	w := postCreateOrder(t, router, orderRequest)
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	var response handlers.CreateOrderResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, int64(2500), response.Order.Payment.Amount) // No tax added to the subtotal
+
+	order, err := h.PaymentStore.GetOrder(context.Background(), response.Order.ID)
+	require.NoError(t, err)
+	assert.True(t, order.CustomerInfo.TaxExempt)
+	assert.Equal(t, "EX-12345", order.CustomerInfo.TaxExemptionID)
+
+	intents := stub.Requests("POST", "/v1/payment_intents")
+	require.Len(t, intents, 1)
+	assert.Equal(t, "2500", intents[0].Form.Get("amount"))
+	assert.Equal(t, "true", intents[0].Form.Get("metadata[tax_exempt]"))
+	assert.Equal(t, "EX-12345", intents[0].Form.Get("metadata[tax_exemption_id]"))
+
+	events, err := h.PaymentStore.GetPaymentEvents(context.Background(), order.ID)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	eventData, ok := events[0].Data.(map[string]interface{})
+	require.True(t, ok)
+	assert.Equal(t, true, eventData["tax_exempt"])
+	assert.Equal(t, "EX-12345", eventData["tax_exemption_id"])
+}
+
+// TestCreateTaxExemptOrderRequiresExemptionID tests that exemption claims without an ID are rejected when required
+func TestCreateTaxExemptOrderRequiresExemptionID(t *testing.T) {
+	h := handlers.NewHandlers(&config.Config{Environment: "test", RequireTaxExemptionID: true}, store.NewMemoryStore())
+	router := setupTestRouter(h)
+
+	orderRequest := testOrderRequest("exempt-missing@example.com", 25.00)
+	orderRequest["customer_info"].(map[string]interface{})["tax_exempt"] = true
+
+	w := postCreateOrder(t, router, orderRequest)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+// TestOrderConditionalRequests tests ETag and If-None-Match support on the order and status endpoints
+func TestOrderConditionalRequests(t *testing.T) {
+	h := handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore())
+	router := setupTestRouter(h)
+
+	order := &models.Order{
+		ID:           "etag-order-1",
+		TrackingID:   "TRKETAG1",
+		CustomerInfo: models.CustomerInfo{Email: "etag@example.com"},
+		Payment:      models.PaymentInfo{Amount: 1000, Currency: "usd", Status: models.PaymentStatusPending},
+		Status:       models.OrderStatusPending,
+	}
+	require.NoError(t, h.PaymentStore.CreateOrder(context.Background(), order))
+
+	get := func(path, etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, path := range []string{"/api/payments/order/etag-order-1", "/api/payments/status/etag-order-1"} {
+		first := get(path, "")
+		require.Equal(t, http.StatusOK, first.Code, path)
+		etag := first.Header().Get("ETag")
+		require.NotEmpty(t, etag, path)
+
+		unchanged := get(path, etag)
+		assert.Equal(t, http.StatusNotModified, unchanged.Code, path)
+		assert.Empty(t, unchanged.Body.String(), path)
+	}
+
+	etag := get("/api/payments/order/etag-order-1", "").Header().Get("ETag")
+	require.NoError(t, h.PaymentStore.UpdateOrderStatus(context.Background(), "etag-order-1", models.OrderStatusPaid))
+
+	changed := get("/api/payments/order/etag-order-1", etag)
+	assert.Equal(t, http.StatusOK, changed.Code)
+	assert.NotEqual(t, etag, changed.Header().Get("ETag"))
+}
+
+// TestOrderItemPriceParsing tests exact parsing of string prices alongside legacy float prices
+func TestOrderItemPriceParsing(t *testing.T) {
+	tests := []struct {
+		price   string
+		cents   int64
+		wantErr bool
+	}{
+		{price: `"19.99"`, cents: 1999},
+		{price: `"0.1"`, cents: 10},
+		{price: `"5"`, cents: 500},
+		{price: `19.99`, cents: 1999}, // Legacy float that float64 math would round down to 1998
+		{price: `"12.abc"`, wantErr: true},
+		{price: `"1.999"`, wantErr: true},
+		{price: `"-5.00"`, wantErr: true},
+		{price: `""`, wantErr: true},
+		{price: `-1`, wantErr: true},
+		{price: `1e9`, wantErr: true},
+		{price: `1.999`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		var item handlers.OrderItemRequest
+		err := json.Unmarshal([]byte(`{"product_id": "1", "price": `+tt.price+`}`), &item)
+		if tt.wantErr {
+			assert.Error(t, err, tt.price)
+			continue
+		}
+		require.NoError(t, err, tt.price)
+		assert.Equal(t, tt.cents, item.Price.Cents(), tt.price)
+	}
+}
+
+// TestCreateOrderWithStringPrices tests that string prices are charged in exact cents
+func TestCreateOrderWithStringPrices(t *testing.T) {
+	stub := newStripeStub(t)
+	stub.stubPaymentIntents()
+
+	h := handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore())
+	router := setupTestRouter(h)
+
+	orderRequest := testOrderRequest("decimal@example.com", 0)
+	orderRequest["items"] = []map[string]interface{}{
+		{"product_id": "1", "product_name": "Guide", "file_type": "PDF", "price": "19.99", "quantity": 3},
+		{"product_id": "2", "product_name": "Sticker", "file_type": "PNG", "price": "0.1", "quantity": 1},
+	}
+
+	w := postCreateOrder(t, router, orderRequest)
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	var response handlers.CreateOrderResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, int64(6007), response.Order.Payment.Amount)
+	assert.Equal(t, 19.99, response.Order.Items[0].Price)
+
+	orderRequest["items"] = []map[string]interface{}{
+		{"product_id": "1", "product_name": "Guide", "file_type": "PDF", "price": "12.abc", "quantity": 1},
+	}
+	w = postCreateOrder(t, router, orderRequest)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+// TestCreateOrderLegacyFloatPricesDontDrift tests that float prices times a quantity are charged in exact cents
+func TestCreateOrderLegacyFloatPricesDontDrift(t *testing.T) {
+	stub := newStripeStub(t)
+	stub.stubPaymentIntents()
+
+	h := handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore())
+	router := setupTestRouter(h)
+
+	tests := []struct {
+		price    float64
+		quantity int
+		amount   int64
+	}{
+		{price: 9.99, quantity: 3, amount: 2997},
+		{price: 0.1, quantity: 3, amount: 30},
+		{price: 19.99, quantity: 7, amount: 13993}, // int64(19.99 * 100 * 7) truncates to 13992
+		{price: 1.15, quantity: 1, amount: 115},    // int64(1.15 * 100) truncates to 114
+		{price: 0.29, quantity: 100, amount: 2900}, // int64(0.29 * 100 * 100) truncates to 2899
+		{price: 0.57, quantity: 2, amount: 114},    // int64(0.57 * 100 * 2) truncates to 113
+	}
+	for _, tt := range tests {
+		orderRequest := testOrderRequest("drift@example.com", 0)
+		orderRequest["items"] = []map[string]interface{}{
+			{"product_id": "1", "product_name": "Guide", "file_type": "PDF", "price": tt.price, "quantity": tt.quantity},
+		}
+
+		w := postCreateOrder(t, router, orderRequest)
+		require.Equal(t, http.StatusCreated, w.Code)
+
+		var response handlers.CreateOrderResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, tt.amount, response.Order.Payment.Amount, "%v x %d", tt.price, tt.quantity)
+	}
+}
+
+// TestCreateOrderCurrencies tests that orders are charged in the requested currency's smallest unit
+// and that unsupported currencies are rejected before reaching Stripe
+func TestCreateOrderCurrencies(t *testing.T) {
+	stub := newStripeStub(t)
+	stub.stubPaymentIntents()
+
+	h := handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore())
+	router := setupTestRouter(h)
+
+	tests := []struct {
+		currency string
+		price    string
+		amount   int64
+	}{
+		{currency: "", price: "19.99", amount: 1999},
+		{currency: "EUR", price: "19.99", amount: 1999},
+		{currency: "jpy", price: "1500", amount: 1500},
+		{currency: "jpy", price: "1500.6", amount: 1501},
+	}
+	for _, tt := range tests {
+		orderRequest := testOrderRequest("currency@example.com", 0)
+		orderRequest["items"] = []map[string]interface{}{
+			{"product_id": "1", "product_name": "Guide", "file_type": "PDF", "price": tt.price, "quantity": 1},
+		}
+		if tt.currency != "" {
+			orderRequest["currency"] = tt.currency
+		}
+
+		w := postCreateOrder(t, router, orderRequest)
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+		var response handlers.CreateOrderResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		expectedCurrency := strings.ToLower(tt.currency)
+		if expectedCurrency == "" {
+			expectedCurrency = config.DefaultCurrency
+		}
+		assert.Equal(t, tt.amount, response.Order.Payment.Amount, tt.currency+" "+tt.price)
+		assert.Equal(t, expectedCurrency, response.Order.Payment.Currency)
+
+		requests := stub.Requests("POST", "/v1/payment_intents")
+		assert.Equal(t, expectedCurrency, requests[len(requests)-1].Form.Get("currency"))
+	}
+
+	orderRequest := testOrderRequest("currency@example.com", 9.99)
+	orderRequest["currency"] = "xyz"
+	w := postCreateOrder(t, router, orderRequest)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), `unsupported currency \"xyz\"`)
+
+	// The legacy payment intent endpoint validates too
+	req := httptest.NewRequest("POST", "/api/payments/create-intent", strings.NewReader(`{"amount": 1000, "currency": "xyz"}`))
+	w = httptest.NewRecorder()
+	h.CreatePaymentIntent(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Len(t, stub.Requests("POST", "/v1/payment_intents"), len(tests))
+}
+
+// TestDefaultCurrency tests that requests without a currency use DEFAULT_CURRENCY, charged in its smallest unit
+func TestDefaultCurrency(t *testing.T) {
+	stub := newStripeStub(t)
+	stub.stubPaymentIntents()
+
+	h := handlers.NewHandlers(&config.Config{Environment: "test", DefaultCurrency: "jpy"}, store.NewMemoryStore())
+	router := setupTestRouter(h)
+
+	w := postCreateOrder(t, router, testOrderRequest("default-currency@example.com", 1500))
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var response handlers.CreateOrderResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, "jpy", response.Order.Payment.Currency)
+	assert.Equal(t, int64(1500), response.Order.Payment.Amount)
+
+	// A currency in the request still wins
+	orderRequest := testOrderRequest("default-currency@example.com", 9.99)
+	orderRequest["currency"] = "eur"
+	w = postCreateOrder(t, router, orderRequest)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	req := httptest.NewRequest("POST", "/api/payments/create-intent", strings.NewReader(`{"amount": 1500}`))
+	w = httptest.NewRecorder()
+	h.CreatePaymentIntent(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	requests := stub.Requests("POST", "/v1/payment_intents")
+	require.Len(t, requests, 3)
+	assert.Equal(t, "jpy", requests[0].Form.Get("currency"))
+	assert.Equal(t, "1500", requests[0].Form.Get("amount"))
+	assert.Equal(t, "eur", requests[1].Form.Get("currency"))
+	assert.Equal(t, "999", requests[1].Form.Get("amount"))
+	assert.Equal(t, "jpy", requests[2].Form.Get("currency"))
+}
+
+// TestOrderNotes tests that admins can annotate an order and read the notes back newest first,
+// each attributed to the API key that added it
+func TestOrderNotes(t *testing.T) {
+	h := handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore())
+	router := appmiddleware.APIKeyAuth([]string{"support-key", "other-key"})(setupTestRouter(h))
+
+	createPendingOrder(t, h, "notes-order-1", "pi_notes", 1000)
+
+	addNote := func(orderID, apiKey, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/payments/"+orderID+"/notes", strings.NewReader(body))
+		req.Header.Set("X-API-Key", apiKey)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := addNote("notes-order-1", "support-key", `{"body": "Customer emailed about wrong file"}`)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var note models.OrderNote
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &note))
+	assert.NotEmpty(t, note.ID)
+	assert.Equal(t, appmiddleware.KeyID("support-key"), note.Author)
+	assert.NotContains(t, note.Author, "support-key")
+
+	require.Equal(t, http.StatusCreated, addNote("notes-order-1", "other-key", `{"body": "Sent the right file"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, addNote("notes-order-1", "support-key", `{"body": "  "}`).Code)
+	assert.Equal(t, http.StatusNotFound, addNote("missing-order", "support-key", `{"body": "Hello"}`).Code)
+
+	req := httptest.NewRequest("GET", "/api/payments/notes-order-1/notes", nil)
+	req.Header.Set("X-API-Key", "support-key")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	var response struct {
+		Notes []models.OrderNote `json:"notes"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	require.Len(t, response.Notes, 2)
+	assert.Equal(t, "Sent the right file", response.Notes[0].Body)
+	assert.Equal(t, appmiddleware.KeyID("other-key"), response.Notes[0].Author)
+	assert.Equal(t, "Customer emailed about wrong file", response.Notes[1].Body)
+
+	req = httptest.NewRequest("GET", "/api/payments/notes-order-1/notes", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+// TestArchiveOrder tests that archived orders are left out of the order listing and stats unless
+// include_archived=true, while still being fetchable by ID
+func TestArchiveOrder(t *testing.T) {
+	h := handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore())
+	router := setupTestRouter(h)
+
+	createPendingOrder(t, h, "archive-order-1", "pi_archive_1", 1000)
+	createPendingOrder(t, h, "archive-order-2", "pi_archive_2", 2000)
+
+	archive := func(orderID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/payments/"+orderID+"/archive", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		return w
+	}
+
+	w := archive("archive-order-1")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var archived struct {
+		ArchivedAt      time.Time `json:"archived_at"`
+		AlreadyArchived bool      `json:"already_archived"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &archived))
+	assert.False(t, archived.AlreadyArchived)
+	assert.False(t, archived.ArchivedAt.IsZero())
+
+	w = archive("archive-order-1")
+	require.Equal(t, http.StatusOK, w.Code)
+	var again struct {
+		ArchivedAt      time.Time `json:"archived_at"`
+		AlreadyArchived bool      `json:"already_archived"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &again))
+	assert.True(t, again.AlreadyArchived)
+	assert.True(t, again.ArchivedAt.Equal(archived.ArchivedAt))
+	assert.Equal(t, http.StatusNotFound, archive("missing-order").Code)
+
+	var listing struct {
+		Orders []models.OrderSummary `json:"orders"`
+		Total  int                   `json:"total"`
+	}
+	require.NoError(t, json.Unmarshal(get("/api/payments/all").Body.Bytes(), &listing))
+	require.Len(t, listing.Orders, 1)
+	assert.Equal(t, "archive-order-2", listing.Orders[0].ID)
+	assert.Equal(t, 1, listing.Total)
+	require.NoError(t, json.Unmarshal(get("/api/payments/all?include_archived=true").Body.Bytes(), &listing))
+	assert.Len(t, listing.Orders, 2)
+	assert.Equal(t, 2, listing.Total)
+
+	var stats models.PaymentStats
+	require.NoError(t, json.Unmarshal(get("/api/payments/stats").Body.Bytes(), &stats))
+	assert.Equal(t, 1, stats.TotalOrders)
+	require.NoError(t, json.Unmarshal(get("/api/payments/stats?include_archived=true").Body.Bytes(), &stats))
+	assert.Equal(t, 2, stats.TotalOrders)
+
+	var details models.Order
+	require.NoError(t, json.Unmarshal(get("/api/payments/order/archive-order-1").Body.Bytes(), &details))
+	require.NotNil(t, details.ArchivedAt)
+
+	events := handlerEvents(t, h, "archive-order-1")
+	archivedEvents := 0
+	for _, event := range events {
+		if event.EventType == "order_archived" {
+			archivedEvents++
+		}
+	}
+	assert.Equal(t, 1, archivedEvents)
+}
+
+// TestSyncOrder tests that syncing an order records a payment and later refunds from Stripe that no
+// webhook reported as the webhooks would have, and that orders without a payment intent are left alone
+func TestSyncOrder(t *testing.T) {
+	fake := handlers.NewFakeGateway()
+	h := handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore())
+	h.Gateway = fake
+	router := setupTestRouter(h)
+
+	w := postCreateOrder(t, router, testOrderRequest("sync@example.com", 10.00))
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var created handlers.CreateOrderResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	orderID, paymentIntentID := created.Order.ID, created.Order.Payment.StripePaymentIntentID
+
+	type syncResponse struct {
+		Order   models.Order           `json:"order"`
+		Synced  bool                   `json:"synced"`
+		Changes map[string]interface{} `json:"changes"`
+	}
+	syncOrder := func(orderID string) (int, syncResponse) {
+		req := httptest.NewRequest("POST", "/api/payments/"+orderID+"/sync", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var response syncResponse
+		if w.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		}
+		return w.Code, response
+	}
+
+	// Nothing has happened in Stripe yet
+	code, synced := syncOrder(orderID)
+	require.Equal(t, http.StatusOK, code)
+	assert.True(t, synced.Synced)
+	assert.Empty(t, synced.Changes)
+	assert.Equal(t, models.OrderStatusPending, synced.Order.Status)
+
+	// The payment went through but its webhook was missed
+	require.NoError(t, fake.SetPaymentIntentStatus(paymentIntentID, stripe.PaymentIntentStatusSucceeded))
+	code, synced = syncOrder(orderID)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, models.OrderStatusPaid, synced.Order.Status)
+	assert.Equal(t, models.PaymentStatusSucceeded, synced.Order.Payment.Status)
+	assert.Equal(t, int64(1000), synced.Order.Payment.AmountCaptured)
+	assert.Len(t, synced.Order.Payment.ChargeIDs, 1)
+	assert.Contains(t, synced.Changes, "order_status")
+
+	// So were the refunds issued from the dashboard
+	_, err := fake.CreateRefund(context.Background(), &stripe.RefundParams{PaymentIntent: stripe.String(paymentIntentID), Amount: stripe.Int64(400)})
+	require.NoError(t, err)
+	code, synced = syncOrder(orderID)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, models.OrderStatusPaid, synced.Order.Status)
+	assert.Equal(t, models.PaymentStatusPartiallyRefunded, synced.Order.Payment.Status)
+	assert.Equal(t, int64(400), synced.Order.Payment.AmountRefunded)
+
+	_, err = fake.CreateRefund(context.Background(), &stripe.RefundParams{PaymentIntent: stripe.String(paymentIntentID)})
+	require.NoError(t, err)
+	code, synced = syncOrder(orderID)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, models.OrderStatusRefunded, synced.Order.Status)
+	assert.Equal(t, models.PaymentStatusRefunded, synced.Order.Payment.Status)
+	assert.Equal(t, int64(1000), synced.Order.Payment.AmountRefunded)
+
+	syncEvents := 0
+	for _, event := range handlerEvents(t, h, orderID) {
+		if event.EventType == "synced_from_stripe" {
+			syncEvents++
+		}
+	}
+	assert.Equal(t, 4, syncEvents)
+
+	// A payment refunded in full before anything reported it is recorded as paid, then refunded
+	w = postCreateOrder(t, router, testOrderRequest("sync-refunded@example.com", 10.00))
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	require.NoError(t, fake.SetPaymentIntentStatus(created.Order.Payment.StripePaymentIntentID, stripe.PaymentIntentStatusSucceeded))
+	_, err = fake.CreateRefund(context.Background(), &stripe.RefundParams{PaymentIntent: stripe.String(created.Order.Payment.StripePaymentIntentID)})
+	require.NoError(t, err)
+	code, synced = syncOrder(created.Order.ID)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, models.OrderStatusRefunded, synced.Order.Status)
+	assert.Equal(t, models.PaymentStatusRefunded, synced.Order.Payment.Status)
+
+	for _, id := range []string{orderID, created.Order.ID} {
+		succeeded := 0
+		for _, event := range handlerEvents(t, h, id) {
+			if event.EventType == "payment_succeeded" {
+				succeeded++
+			}
+		}
+		assert.Equal(t, 1, succeeded, id)
+	}
+
+	createPendingOrder(t, h, "sync-no-intent", "", 1000)
+	code, synced = syncOrder("sync-no-intent")
+	require.Equal(t, http.StatusOK, code)
+	assert.False(t, synced.Synced)
+	assert.Equal(t, models.OrderStatusPending, synced.Order.Status)
+
+	code, _ = syncOrder("missing-order")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+// TestGetOrderReceipt tests that paid orders get a receipt PDF download and unpaid ones a 400
+func TestGetOrderReceipt(t *testing.T) {
+	h := handlers.NewHandlers(&config.Config{Environment: "test", CompanyName: "Receipt Co"}, store.NewMemoryStore())
+	router := setupTestRouter(h)
+
+	createPendingOrder(t, h, "receipt-order-1", "pi_receipt_1", 1999)
+	receipt := func(orderID string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/api/payments/"+orderID+"/receipt.pdf", nil))
+		return w
+	}
+
+	w := receipt("receipt-order-1")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "hasn't been paid")
+	assert.Equal(t, http.StatusNotFound, receipt("missing-order").Code)
+
+	require.NoError(t, h.PaymentStore.UpdatePaymentMethod(context.Background(), "receipt-order-1", models.PaymentMethodApplePay))
+	require.NoError(t, h.PaymentStore.UpdateOrderStatus(context.Background(), "receipt-order-1", models.OrderStatusPaid))
+	w = receipt("receipt-order-1")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "application/pdf", w.Header().Get("Content-Type"))
+	assert.Equal(t, `attachment; filename="receipt-TRKreceipt-order-1.pdf"`, w.Header().Get("Content-Disposition"))
+	assert.True(t, bytes.HasPrefix(w.Body.Bytes(), []byte("%PDF-")))
+}
+
+// TestStripeCallsUseRequestContext tests that a Stripe call made for a request is abandoned once the
+// request's context is done
+func TestStripeCallsUseRequestContext(t *testing.T) {
+	stub := newStripeStub(t)
+	stub.On("GET", "/v1/payment_intents/pi_ctx", func(req stubRequest) (int, interface{}) {
+		return http.StatusOK, succeededIntent("pi_ctx", 1000, 1000)
+	})
+
+	h := handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore())
+	router := chi.NewRouter()
+	router.Get("/verify/{id}", h.VerifyPayment)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest("GET", "/verify/pi_ctx", nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Empty(t, stub.Requests("GET", "/v1/payment_intents/pi_ctx"))
+
+	req = httptest.NewRequest("GET", "/verify/pi_ctx", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+}
+
+// TestCreateOrderPassesMetadataToStripe tests that caller metadata reaches the payment intent without
+// setting the built-in or reserved keys, and that metadata over Stripe's limits is rejected
+func TestCreateOrderPassesMetadataToStripe(t *testing.T) {
+	h := handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore())
+	fake := handlers.NewFakeGateway()
+	h.Gateway = fake
+	router := setupTestRouter(h)
+
+	paymentIntentMetadata := func(w *httptest.ResponseRecorder) map[string]string {
+		t.Helper()
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		var response handlers.CreateOrderResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		pi, err := fake.GetPaymentIntent(context.Background(), response.Order.Payment.StripePaymentIntentID, nil)
+		require.NoError(t, err)
+		return pi.Metadata
+	}
+
+	orderRequest := testOrderRequest("metadata@example.com", 9.99)
+	orderRequest["metadata"] = map[string]string{
+		"utm_source": "newsletter", "order_id": "spoofed", "tax_exempt": "true", "tax_exemption_id": "EX-1", "coupon_code": "FREE",
+	}
+	metadata := paymentIntentMetadata(postCreateOrder(t, router, orderRequest))
+	assert.Equal(t, "newsletter", metadata["utm_source"])
+	assert.NotEqual(t, "spoofed", metadata["order_id"])
+	// Keys the API sets for some orders are reserved on the others too
+	assert.NotContains(t, metadata, "tax_exempt")
+	assert.NotContains(t, metadata, "tax_exemption_id")
+	assert.NotContains(t, metadata, "coupon_code")
+	assert.Equal(t, "metadata@example.com", metadata["customer_email"])
+	assert.NotEmpty(t, metadata["tracking_id"])
+
+	// 50 caller keys plus the built-in ones are cut back to Stripe's 50
+	full := make(map[string]string)
+	for i := 0; i < 50; i++ {
+		full[fmt.Sprintf("key_%02d", i)] = "value"
+	}
+	orderRequest["metadata"] = full
+	metadata = paymentIntentMetadata(postCreateOrder(t, router, orderRequest))
+	assert.Len(t, metadata, 50)
+	assert.Equal(t, "value", metadata["key_00"])
+	assert.NotContains(t, metadata, "key_49")
+	assert.Contains(t, metadata, "order_id")
+
+	tooMany := make(map[string]string)
+	for i := 0; i < 51; i++ {
+		tooMany[fmt.Sprintf("key_%02d", i)] = "value"
+	}
+	for name, invalid := range map[string]map[string]string{
+		"too many keys": tooMany,
+		"long key":      {strings.Repeat("k", 41): "value"},
+		"long value":    {"note": strings.Repeat("v", 501)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			orderRequest["metadata"] = invalid
+			w := postCreateOrder(t, router, orderRequest)
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+			assert.Contains(t, w.Body.String(), "Invalid metadata")
+		})
+	}
+}
+
+// TestCreateOrderVerifiesPrices tests that with VERIFY_PRICES item prices must match Stripe's and
+// the order total comes from Stripe
+func TestCreateOrderVerifiesPrices(t *testing.T) {
+	fake := handlers.NewFakeGateway()
+	fake.AddProduct(&stripe.Product{ID: "prod_planner", Name: "Planner", Active: true, DefaultPrice: &stripe.Price{ID: "price_planner", UnitAmount: 10000, Currency: stripe.CurrencyUSD}})
+	fake.AddProduct(&stripe.Product{ID: "prod_unpriced", Name: "Unpriced", Active: true})
+
+	h := handlers.NewHandlers(&config.Config{Environment: "test", VerifyPrices: true}, store.NewMemoryStore())
+	h.Gateway = fake
+	router := setupTestRouter(h)
+
+	orderFor := func(productID string, price interface{}) map[string]interface{} {
+		item := map[string]interface{}{"product_id": productID, "product_name": "Planner", "file_type": "PDF", "quantity": 2}
+		if price != nil {
+			item["price"] = price
+		}
+		return map[string]interface{}{
+			"customer_info": map[string]string{"email": "verify@example.com"},
+			"items":         []map[string]interface{}{item},
+		}
+	}
+	orderAmount := func(w *httptest.ResponseRecorder) int64 {
+		t.Helper()
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		var response handlers.CreateOrderResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return response.Order.Payment.Amount
+	}
+
+	assert.Equal(t, int64(20000), orderAmount(postCreateOrder(t, router, orderFor("prod_planner", "100.00"))))
+	assert.Equal(t, int64(20000), orderAmount(postCreateOrder(t, router, orderFor("prod_planner", nil))))
+
+	for name, orderRequest := range map[string]map[string]interface{}{
+		"underpriced":   orderFor("prod_planner", "1.00"),
+		"unknown":       orderFor("prod_missing", "100.00"),
+		"no price":      orderFor("prod_unpriced", "100.00"),
+		"no product ID": orderFor("", "100.00"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := postCreateOrder(t, router, orderRequest)
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+			assert.Contains(t, w.Body.String(), "Invalid item price")
+		})
+	}
+
+	// Ad-hoc items are accepted as sent while verification is off
+	h.Config.VerifyPrices = false
+	assert.Equal(t, int64(200), orderAmount(postCreateOrder(t, router, orderFor("prod_planner", "1.00"))))
+}
+
+// TestCreateOrderAmountLimits tests that totals above MAX_ORDER_AMOUNT_CENTS, zero or negative totals,
+// and quantities or totals that would overflow are rejected before a payment intent is created
+func TestCreateOrderAmountLimits(t *testing.T) {
+	fake := handlers.NewFakeGateway()
+	h := handlers.NewHandlers(&config.Config{Environment: "test", MaxOrderAmount: 10000}, store.NewMemoryStore())
+	h.Gateway = fake
+	router := setupTestRouter(h)
+
+	orderFor := func(price interface{}, quantity int) map[string]interface{} {
+		orderRequest := testOrderRequest("limits@example.com", 0)
+		item := orderRequest["items"].([]map[string]interface{})[0]
+		item["price"] = price
+		item["quantity"] = quantity
+		return orderRequest
+	}
+
+	tests := []struct {
+		name     string
+		price    interface{}
+		quantity int
+		expected int
+		message  string
+	}{
+		{"at the limit", "100.00", 1, http.StatusCreated, ""},
+		{"one cent over", "100.01", 1, http.StatusBadRequest, "exceeds the maximum of 10000"},
+		{"over through quantity", "50.01", 2, http.StatusBadRequest, "exceeds the maximum of 10000"},
+		{"far over", "10000000.00", 1, http.StatusBadRequest, "exceeds the maximum of 10000"},
+		{"free", "0", 1, http.StatusBadRequest, "Order total must be greater than zero"},
+		{"negative", -5.0, 1, http.StatusBadRequest, "invalid price -5"},
+		{"too many", "1.00", 1001, http.StatusBadRequest, "quantity 1001 exceeds the maximum of 1000"},
+		// 4611686018427387905 * 400 cents wraps around to 400 in int64
+		{"wrapping quantity", "4.00", 4611686018427387905, http.StatusBadRequest, "exceeds the maximum of 1000"},
+		{"total too large for int64", "99999999999999999.00", 1000, http.StatusBadRequest, "order total is too large"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := postCreateOrder(t, router, orderFor(tt.price, tt.quantity))
+			assert.Equal(t, tt.expected, w.Code, w.Body.String())
+			assert.Contains(t, w.Body.String(), tt.message)
+		})
+	}
+
+	// Only the order within the limit reached Stripe
+	_, err := fake.GetPaymentIntent(context.Background(), "pi_fake_1", nil)
+	assert.NoError(t, err)
+	_, err = fake.GetPaymentIntent(context.Background(), "pi_fake_2", nil)
+	assert.Error(t, err)
 }
@@ -0,0 +1,716 @@
+// tests/postgres_test.go
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/capactiyvirus/stripe-backend/models"
+	"github.com/capactiyvirus/stripe-backend/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestPostgresStore connects to TEST_DATABASE_URL, a database initialized with db/init,
+// and clears any existing orders
+func newTestPostgresStore(t *testing.T) *store.PostgresStore {
+	t.Helper()
+
+	databaseURL := os.Getenv("TEST_DATABASE_URL")
+	if databaseURL == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+
+	pg, err := store.NewPostgresStore(databaseURL)
+	require.NoError(t, err)
+	t.Cleanup(func() { pg.Close() })
+
+	orders, err := pg.GetAllOrders(context.Background(), 100000, 0, models.OrderFilter{IncludeArchived: true})
+	require.NoError(t, err)
+	require.Empty(t, orders, "TEST_DATABASE_URL must point to an empty database")
+
+	return pg
+}
+
+// normalizeOrder rounds timestamps to the microsecond precision Postgres stores
+func normalizeOrder(order *models.Order) *models.Order {
+	normalized := *order
+	round := func(t time.Time) time.Time { return t.Round(time.Microsecond).UTC() }
+	roundPtr := func(t *time.Time) *time.Time {
+		if t == nil {
+			return nil
+		}
+		rounded := round(*t)
+		return &rounded
+	}
+
+	normalized.CreatedAt = round(order.CreatedAt)
+	normalized.UpdatedAt = round(order.UpdatedAt)
+	normalized.FulfilledAt = roundPtr(order.FulfilledAt)
+	normalized.ArchivedAt = roundPtr(order.ArchivedAt)
+	normalized.Payment.ProcessedAt = roundPtr(order.Payment.ProcessedAt)
+	normalized.Payment.RefundedAt = roundPtr(order.Payment.RefundedAt)
+	return &normalized
+}
+
+// TestMigrateInMemoryToPostgres tests that a populated in-memory store migrates to equivalent Postgres data
+func TestMigrateInMemoryToPostgres(t *testing.T) {
+	pg := newTestPostgresStore(t)
+	mem := store.NewMemoryStore()
+
+	orders := []*models.Order{
+		{
+			ID:         "migrate-order-1",
+			TrackingID: "TRKMIG1",
+			CustomerInfo: models.CustomerInfo{
+				Email:     "migrate1@example.com",
+				Name:      "Migrating Customer",
+				IPAddress: "192.0.2.10",
+			},
+			Items: []models.OrderItem{
+				{ProductID: "guide", ProductName: "Writing Guide", FileType: "PDF", Price: 9.99, Quantity: 1, ImageURL: "/images/guide.png"},
+				{ProductID: "workbook", ProductName: "Workbook", FileType: "PDF", Price: 5.00, Quantity: 2},
+			},
+			Payment: models.PaymentInfo{
+				StripePaymentIntentID: "pi_migrate_1",
+				Amount:                1999,
+				Currency:              "usd",
+				Status:                models.PaymentStatusPending,
+			},
+			Status:   models.OrderStatusPending,
+			Metadata: map[string]string{"source": "website"},
+		},
+		{
+			ID:           "migrate-order-2",
+			TrackingID:   "TRKMIG2",
+			CustomerInfo: models.CustomerInfo{Email: "migrate2@example.com"},
+			Items: []models.OrderItem{
+				{ProductID: "guide", ProductName: "Writing Guide", FileType: "PDF", Price: 9.99, Quantity: 1},
+			},
+			Payment: models.PaymentInfo{
+				StripePaymentIntentID: "pi_migrate_2",
+				StripeSessionID:       "cs_migrate_2",
+				Amount:                999,
+				Currency:              "usd",
+				Status:                models.PaymentStatusPending,
+			},
+			Status: models.OrderStatusPending,
+		},
+	}
+	for _, order := range orders {
+		require.NoError(t, mem.CreateOrder(context.Background(), order))
+	}
+
+	require.NoError(t, mem.UpdatePaymentCharges(context.Background(), "migrate-order-2", []string{"ch_migrate_2"}, 999))
+	require.NoError(t, mem.UpdatePaymentFees(context.Background(), "migrate-order-2", 59, 940))
+	require.NoError(t, mem.UpdatePaymentStatus(context.Background(), "migrate-order-2", models.PaymentStatusSucceeded))
+	require.NoError(t, mem.UpdateOrderStatus(context.Background(), "migrate-order-2", models.OrderStatusFulfilled))
+	require.NoError(t, mem.AddPaymentEvent(context.Background(), models.PaymentEvent{
+		OrderID:   "migrate-order-1",
+		EventType: "order_created",
+		Status:    models.PaymentStatusPending,
+		Data:      map[string]interface{}{"payment_intent_id": "pi_migrate_1"},
+	}))
+	require.NoError(t, mem.AddPaymentEvent(context.Background(), models.PaymentEvent{
+		OrderID:   "migrate-order-2",
+		EventType: "payment_succeeded",
+		Status:    models.PaymentStatusSucceeded,
+		Data:      map[string]interface{}{"amount_captured": 999, "charge_ids": []string{"ch_migrate_2"}},
+	}))
+
+	result, err := store.MigrateInMemoryToPostgres(context.Background(), mem, pg)
+	require.NoError(t, err)
+	// Two added events plus three status_changed events for migrate-order-2
+	assert.Equal(t, &store.MigrationResult{Orders: 2, Items: 3, Events: 5}, result)
+
+	// Re-running the migration must not duplicate anything
+	_, err = store.MigrateInMemoryToPostgres(context.Background(), mem, pg)
+	require.NoError(t, err)
+
+	for _, order := range orders {
+		expected, err := mem.GetOrder(context.Background(), order.ID)
+		require.NoError(t, err)
+		actual, err := pg.GetOrder(context.Background(), order.ID)
+		require.NoError(t, err)
+		assert.Equal(t, normalizeOrder(expected), normalizeOrder(actual), order.ID)
+
+		expectedEvents, err := mem.GetPaymentEvents(context.Background(), order.ID)
+		require.NoError(t, err)
+		actualEvents, err := pg.GetPaymentEvents(context.Background(), order.ID)
+		require.NoError(t, err)
+		require.Len(t, actualEvents, len(expectedEvents), order.ID)
+		for i := range expectedEvents {
+			assert.Equal(t, expectedEvents[i].ID, actualEvents[i].ID)
+			assert.Equal(t, expectedEvents[i].EventType, actualEvents[i].EventType)
+			assert.Equal(t, expectedEvents[i].Status, actualEvents[i].Status)
+			assert.True(t, expectedEvents[i].CreatedAt.Round(time.Microsecond).Equal(actualEvents[i].CreatedAt))
+
+			expectedData, _ := json.Marshal(expectedEvents[i].Data)
+			actualData, _ := json.Marshal(actualEvents[i].Data)
+			assert.JSONEq(t, string(expectedData), string(actualData))
+		}
+	}
+
+	summaries, err := pg.GetAllOrders(context.Background(), 10, 0, models.OrderFilter{})
+	require.NoError(t, err)
+	assert.Len(t, summaries, 2)
+
+	summaries, err = pg.GetAllOrders(context.Background(), 10, 0, models.OrderFilter{Status: models.OrderStatusFulfilled})
+	require.NoError(t, err)
+	require.Len(t, summaries, 1)
+	assert.Equal(t, "migrate-order-2", summaries[0].ID)
+	total, err := pg.CountOrders(context.Background(), models.OrderFilter{Status: models.OrderStatusPending})
+	require.NoError(t, err)
+	assert.Equal(t, 1, total)
+
+	stats, err := pg.GetPaymentStats(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 2, stats.TotalOrders)
+	assert.Equal(t, models.StatusTotals{Count: 1, Amount: 19.99}, stats.StatusBreakdown[models.OrderStatusPending])
+	assert.Equal(t, models.StatusTotals{Count: 1, Amount: 9.99}, stats.StatusBreakdown[models.OrderStatusFulfilled])
+	assert.Equal(t, 9.40, stats.NetRevenue)
+
+	orderID, err := pg.FindOrderByPaymentIntentID(context.Background(), "pi_migrate_1")
+	require.NoError(t, err)
+	assert.Equal(t, "migrate-order-1", orderID)
+	orderID, err = pg.FindOrderBySessionID(context.Background(), "cs_migrate_2")
+	require.NoError(t, err)
+	assert.Equal(t, "migrate-order-2", orderID)
+	_, err = pg.FindOrderBySessionID(context.Background(), "cs_missing")
+	assert.Error(t, err)
+}
+
+// TestPostgresSearchOrders tests that search matches case-insensitively and treats LIKE wildcards literally
+func TestPostgresSearchOrders(t *testing.T) {
+	pg := newTestPostgresStore(t)
+
+	for _, order := range []*models.Order{
+		{ID: "pg-search-1", TrackingID: "TRKPGS1", CustomerInfo: models.CustomerInfo{Email: "dana_lee@example.com", Name: "Dana Lee"}},
+		{ID: "pg-search-2", TrackingID: "TRKPGS2", CustomerInfo: models.CustomerInfo{Email: "danaxlee@example.com", Name: "Dana X"}},
+	} {
+		order.Payment = models.PaymentInfo{Amount: 999, Currency: "usd", Status: models.PaymentStatusPending}
+		order.Status = models.OrderStatusPending
+		require.NoError(t, pg.CreateOrder(context.Background(), order))
+	}
+
+	results, err := pg.SearchOrders(context.Background(), "DANA", 10)
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	assert.Equal(t, "pg-search-2", results[0].ID)
+
+	results, err = pg.SearchOrders(context.Background(), "dana_", 10)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, "pg-search-1", results[0].ID)
+
+	results, err = pg.SearchOrders(context.Background(), "trkpgs", 1)
+	require.NoError(t, err)
+	assert.Len(t, results, 1)
+}
+
+// TestPostgresCoupons tests coupon redemption limits and that an order keeps its applied coupon
+func TestPostgresCoupons(t *testing.T) {
+	pg := newTestPostgresStore(t)
+
+	code := fmt.Sprintf("PG%d", time.Now().UnixNano())
+	require.NoError(t, pg.CreateCoupon(context.Background(), &models.Coupon{Code: code, PercentOff: 25, MaxUses: 1}))
+	assert.ErrorIs(t, pg.CreateCoupon(context.Background(), &models.Coupon{Code: code, PercentOff: 10}), store.ErrCouponExists)
+
+	discount, err := pg.ValidateCoupon(context.Background(), code, 2000, "usd")
+	require.NoError(t, err)
+	assert.Equal(t, int64(500), discount)
+	_, err = pg.ValidateCoupon(context.Background(), code, 2000, "usd")
+	assert.ErrorIs(t, err, models.ErrCouponExhausted)
+
+	require.NoError(t, pg.ReleaseCoupon(context.Background(), code))
+	_, err = pg.ValidateCoupon(context.Background(), code, 2000, "usd")
+	assert.NoError(t, err)
+
+	_, err = pg.ValidateCoupon(context.Background(), "PGMISSING", 2000, "usd")
+	assert.ErrorIs(t, err, store.ErrCouponNotFound)
+
+	order := &models.Order{
+		ID:           "pg-coupon-1",
+		TrackingID:   "TRKPGC1",
+		CustomerInfo: models.CustomerInfo{Email: "coupon@example.com"},
+		Payment:      models.PaymentInfo{Amount: 1500, DiscountAmount: 500, Currency: "usd", Status: models.PaymentStatusPending},
+		Status:       models.OrderStatusPending,
+		CouponCode:   code,
+	}
+	require.NoError(t, pg.CreateOrder(context.Background(), order))
+
+	stored, err := pg.GetOrder(context.Background(), order.ID)
+	require.NoError(t, err)
+	assert.Equal(t, code, stored.CouponCode)
+	assert.Equal(t, int64(500), stored.Payment.DiscountAmount)
+
+	// Canceling the unpaid order gives its use back
+	require.NoError(t, pg.UpdateOrderStatus(context.Background(), order.ID, models.OrderStatusCanceled))
+	_, err = pg.ValidateCoupon(context.Background(), code, 2000, "usd")
+	assert.NoError(t, err)
+
+	amountCode := code + "AMT"
+	require.NoError(t, pg.CreateCoupon(context.Background(), &models.Coupon{Code: amountCode, AmountOff: 500, Currency: "usd"}))
+	_, err = pg.ValidateCoupon(context.Background(), amountCode, 2000, "eur")
+	assert.ErrorIs(t, err, models.ErrCouponCurrency)
+}
+
+// TestPostgresDisputes tests that disputes are recorded once, leave the open list when closed, and
+// flag their order
+func TestPostgresDisputes(t *testing.T) {
+	pg := newTestPostgresStore(t)
+
+	order := &models.Order{
+		ID:           "pg-dispute-1",
+		TrackingID:   "TRKPGD1",
+		CustomerInfo: models.CustomerInfo{Email: "dispute@example.com"},
+		Payment:      models.PaymentInfo{StripePaymentIntentID: "pi_pg_dispute", Amount: 1500, Currency: "usd", Status: models.PaymentStatusSucceeded},
+		Status:       models.OrderStatusPaid,
+	}
+	require.NoError(t, pg.CreateOrder(context.Background(), order))
+	require.NoError(t, pg.MarkOrderDisputed(context.Background(), order.ID))
+	assert.Error(t, pg.MarkOrderDisputed(context.Background(), "pg-dispute-missing"))
+
+	stored, err := pg.GetOrder(context.Background(), order.ID)
+	require.NoError(t, err)
+	assert.True(t, stored.Disputed)
+	summaries, err := pg.GetAllOrders(context.Background(), 10, 0, models.OrderFilter{})
+	require.NoError(t, err)
+	require.Len(t, summaries, 1)
+	assert.True(t, summaries[0].Disputed)
+
+	dispute := &models.Dispute{
+		ID:              "dp_pg_1",
+		ChargeID:        "ch_pg_dispute",
+		PaymentIntentID: "pi_pg_dispute",
+		OrderID:         order.ID,
+		Reason:          "fraudulent",
+		Amount:          1500,
+		Currency:        "usd",
+		Status:          "needs_response",
+	}
+	require.NoError(t, pg.CreateDispute(context.Background(), dispute))
+	assert.ErrorIs(t, pg.CreateDispute(context.Background(), dispute), store.ErrDisputeExists)
+	require.NoError(t, pg.CreateDispute(context.Background(), &models.Dispute{ID: "dp_pg_unmatched", Status: "warning_needs_response"}))
+
+	open, err := pg.GetDisputes(context.Background(), true)
+	require.NoError(t, err)
+	require.Len(t, open, 2)
+
+	require.NoError(t, pg.UpdateDisputeStatus(context.Background(), "dp_pg_1", "lost"))
+	assert.ErrorIs(t, pg.UpdateDisputeStatus(context.Background(), "dp_pg_missing", "won"), store.ErrDisputeNotFound)
+
+	open, err = pg.GetDisputes(context.Background(), true)
+	require.NoError(t, err)
+	require.Len(t, open, 1)
+	assert.Equal(t, "dp_pg_unmatched", open[0].ID)
+	assert.Empty(t, open[0].OrderID)
+
+	all, err := pg.GetDisputes(context.Background(), false)
+	require.NoError(t, err)
+	require.Len(t, all, 2)
+}
+
+// TestPostgresOrderNotes tests that notes are stored per order and listed newest first
+func TestPostgresOrderNotes(t *testing.T) {
+	pg := newTestPostgresStore(t)
+
+	require.NoError(t, pg.CreateOrder(context.Background(), &models.Order{
+		ID:           "pg-notes-1",
+		TrackingID:   "TRKPGN1",
+		CustomerInfo: models.CustomerInfo{Email: "notes@example.com"},
+		Payment:      models.PaymentInfo{Amount: 1000, Currency: "usd", Status: models.PaymentStatusPending},
+		Status:       models.OrderStatusPending,
+	}))
+
+	first := &models.OrderNote{OrderID: "pg-notes-1", Author: "key_first", Body: "First"}
+	require.NoError(t, pg.AddOrderNote(context.Background(), first))
+	assert.NotEmpty(t, first.ID)
+	require.NoError(t, pg.AddOrderNote(context.Background(), &models.OrderNote{OrderID: "pg-notes-1", Author: "key_second", Body: "Second"}))
+	assert.Error(t, pg.AddOrderNote(context.Background(), &models.OrderNote{OrderID: "pg-notes-missing", Body: "Lost"}))
+
+	notes, err := pg.GetOrderNotes(context.Background(), "pg-notes-1")
+	require.NoError(t, err)
+	require.Len(t, notes, 2)
+	assert.Equal(t, "Second", notes[0].Body)
+	assert.Equal(t, "key_first", notes[1].Author)
+}
+
+// TestPostgresArchiveOrder tests that archived orders drop out of listings and stats but can still be fetched
+func TestPostgresArchiveOrder(t *testing.T) {
+	pg := newTestPostgresStore(t)
+
+	for _, id := range []string{"pg-archive-1", "pg-archive-2"} {
+		require.NoError(t, pg.CreateOrder(context.Background(), &models.Order{
+			ID:           id,
+			TrackingID:   "TRK" + id,
+			CustomerInfo: models.CustomerInfo{Email: "archive@example.com"},
+			Payment:      models.PaymentInfo{Amount: 1000, Currency: "usd", Status: models.PaymentStatusPending},
+			Status:       models.OrderStatusPending,
+		}))
+	}
+
+	archivedAt, alreadyArchived, err := pg.ArchiveOrder(context.Background(), "pg-archive-1")
+	require.NoError(t, err)
+	assert.False(t, alreadyArchived)
+	again, alreadyArchived, err := pg.ArchiveOrder(context.Background(), "pg-archive-1")
+	require.NoError(t, err)
+	assert.True(t, alreadyArchived)
+	assert.True(t, again.Equal(archivedAt))
+	_, _, err = pg.ArchiveOrder(context.Background(), "pg-archive-missing")
+	assert.Error(t, err)
+
+	order, err := pg.GetOrder(context.Background(), "pg-archive-1")
+	require.NoError(t, err)
+	require.NotNil(t, order.ArchivedAt)
+
+	summaries, err := pg.GetAllOrders(context.Background(), 10, 0, models.OrderFilter{})
+	require.NoError(t, err)
+	require.Len(t, summaries, 1)
+	assert.Equal(t, "pg-archive-2", summaries[0].ID)
+	total, err := pg.CountOrders(context.Background(), models.OrderFilter{IncludeArchived: true})
+	require.NoError(t, err)
+	assert.Equal(t, 2, total)
+
+	stats, err := pg.GetPaymentStats(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, stats.TotalOrders)
+	stats, err = pg.GetPaymentStatsRange(context.Background(), time.Time{}, time.Time{}, true, "usd")
+	require.NoError(t, err)
+	assert.Equal(t, 2, stats.TotalOrders)
+}
+
+// TestPostgresHonorsContext tests that queries aren't run once the caller's context is done
+func TestPostgresHonorsContext(t *testing.T) {
+	pg := newTestPostgresStore(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := pg.GetOrder(ctx, "pg-context-1")
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Error(t, pg.CreateOrder(ctx, &models.Order{
+		ID:           "pg-context-1",
+		TrackingID:   "TRKPGC1",
+		CustomerInfo: models.CustomerInfo{Email: "context@example.com"},
+		Payment:      models.PaymentInfo{Amount: 1000, Currency: "usd", Status: models.PaymentStatusPending},
+		Status:       models.OrderStatusPending,
+	}))
+
+	_, err = pg.GetOrder(context.Background(), "pg-context-1")
+	assert.Error(t, err)
+}
+
+// TestPostgresRejectsInvalidTransitions tests that status changes follow models.CanTransition
+func TestPostgresRejectsInvalidTransitions(t *testing.T) {
+	pg := newTestPostgresStore(t)
+
+	order := &models.Order{
+		ID:           "pg-transition-1",
+		TrackingID:   "TRKPGT1",
+		CustomerInfo: models.CustomerInfo{Email: "transition@example.com"},
+		Payment:      models.PaymentInfo{Amount: 1000, Currency: "usd", Status: models.PaymentStatusPending},
+		Status:       models.OrderStatusCreated,
+	}
+	require.NoError(t, pg.CreateOrder(context.Background(), order))
+
+	assert.ErrorIs(t, pg.UpdateOrderStatus(context.Background(), order.ID, models.OrderStatusFulfilled), models.ErrInvalidStatusTransition)
+	require.NoError(t, pg.UpdateOrderStatus(context.Background(), order.ID, models.OrderStatusPending))
+	require.NoError(t, pg.UpdatePaymentStatus(context.Background(), order.ID, models.PaymentStatusSucceeded))
+	require.NoError(t, pg.UpdateOrderStatus(context.Background(), order.ID, models.OrderStatusRefunded))
+	assert.ErrorIs(t, pg.UpdateOrderStatus(context.Background(), order.ID, models.OrderStatusPaid), models.ErrInvalidStatusTransition)
+
+	stored, err := pg.GetOrder(context.Background(), order.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.OrderStatusRefunded, stored.Status)
+}
+
+// TestPostgresMarkOrderFulfilled tests that only the first fulfillment of an order changes it
+func TestPostgresMarkOrderFulfilled(t *testing.T) {
+	pg := newTestPostgresStore(t)
+
+	order := &models.Order{
+		ID:           "pg-fulfill-1",
+		TrackingID:   "TRKPGF1",
+		CustomerInfo: models.CustomerInfo{Email: "fulfill@example.com"},
+		Payment:      models.PaymentInfo{Amount: 1000, Currency: "usd", Status: models.PaymentStatusPending},
+		Status:       models.OrderStatusPending,
+	}
+	require.NoError(t, pg.CreateOrder(context.Background(), order))
+
+	_, _, err := pg.MarkOrderFulfilled(context.Background(), order.ID)
+	assert.ErrorIs(t, err, models.ErrInvalidStatusTransition)
+	require.NoError(t, pg.UpdatePaymentStatus(context.Background(), order.ID, models.PaymentStatusSucceeded))
+
+	fulfilledAt, alreadyFulfilled, err := pg.MarkOrderFulfilled(context.Background(), order.ID)
+	require.NoError(t, err)
+	assert.False(t, alreadyFulfilled)
+
+	again, alreadyFulfilled, err := pg.MarkOrderFulfilled(context.Background(), order.ID)
+	require.NoError(t, err)
+	assert.True(t, alreadyFulfilled)
+	assert.WithinDuration(t, fulfilledAt, again, time.Millisecond)
+
+	stored, err := pg.GetOrder(context.Background(), order.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.OrderStatusFulfilled, stored.Status)
+}
+
+// TestPostgresStatusChangesAddEvents tests that status changes are recorded as status_changed events
+func TestPostgresStatusChangesAddEvents(t *testing.T) {
+	pg := newTestPostgresStore(t)
+
+	order := &models.Order{
+		ID:           "pg-status-events-1",
+		TrackingID:   "TRKPGSE1",
+		CustomerInfo: models.CustomerInfo{Email: "status-events@example.com"},
+		Payment:      models.PaymentInfo{Amount: 1000, Currency: "usd", Status: models.PaymentStatusPending},
+		Status:       models.OrderStatusPending,
+	}
+	require.NoError(t, pg.CreateOrder(context.Background(), order))
+
+	require.NoError(t, pg.UpdatePaymentStatus(context.Background(), order.ID, models.PaymentStatusSucceeded))
+	require.NoError(t, pg.UpdatePaymentStatus(context.Background(), order.ID, models.PaymentStatusSucceeded))
+	require.NoError(t, pg.UpdateOrderStatus(context.Background(), order.ID, models.OrderStatusFulfilled))
+
+	events, err := pg.GetPaymentEvents(context.Background(), order.ID)
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+	for _, event := range events {
+		assert.Equal(t, models.EventTypeStatusChanged, event.EventType)
+	}
+	assert.Equal(t, map[string]interface{}{"field": "payment_status", "old_status": "pending", "new_status": "succeeded"}, events[0].Data)
+	assert.Equal(t, map[string]interface{}{"field": "order_status", "old_status": "pending", "new_status": "paid"}, events[1].Data)
+	assert.Equal(t, map[string]interface{}{"field": "order_status", "old_status": "paid", "new_status": "fulfilled"}, events[2].Data)
+}
+
+// TestPostgresItemDownloadURLs tests that item download URLs survive a round trip
+func TestPostgresItemDownloadURLs(t *testing.T) {
+	pg := newTestPostgresStore(t)
+
+	order := &models.Order{
+		ID:           "pg-download-1",
+		TrackingID:   "TRKPGD1",
+		CustomerInfo: models.CustomerInfo{Email: "download@example.com"},
+		Items: []models.OrderItem{
+			{ProductID: "guide", ProductName: "Writing Guide", FileType: "PDF", Price: 9.99, Quantity: 1, DownloadURL: "https://files.example.com/guide.pdf"},
+			{ProductID: "workbook", ProductName: "Workbook", FileType: "PDF", Price: 5.00, Quantity: 1},
+		},
+		Payment: models.PaymentInfo{Amount: 1499, Currency: "usd", Status: models.PaymentStatusPending},
+		Status:  models.OrderStatusPending,
+	}
+	require.NoError(t, pg.CreateOrder(context.Background(), order))
+
+	require.NoError(t, pg.SetItemDownloadURL(context.Background(), order.ID, "workbook", "https://files.example.com/workbook.pdf"))
+	assert.Error(t, pg.SetItemDownloadURL(context.Background(), order.ID, "missing", "https://files.example.com/missing.pdf"))
+
+	stored, err := pg.GetOrder(context.Background(), order.ID)
+	require.NoError(t, err)
+	require.Len(t, stored.Items, 2)
+	assert.Equal(t, "https://files.example.com/guide.pdf", stored.Items[0].DownloadURL)
+	assert.Equal(t, "https://files.example.com/workbook.pdf", stored.Items[1].DownloadURL)
+}
+
+// TestPostgresPaymentStatsRange tests that stats only count orders created in the range
+func TestPostgresPaymentStatsRange(t *testing.T) {
+	pg := newTestPostgresStore(t)
+
+	now := time.Now()
+	for i, created := range []time.Time{now.AddDate(0, 0, -30), now.AddDate(0, 0, -3)} {
+		order := &models.Order{
+			ID:           fmt.Sprintf("pg-range-%d", i),
+			TrackingID:   fmt.Sprintf("TRKPGR%d", i),
+			CustomerInfo: models.CustomerInfo{Email: "range@example.com"},
+			Payment:      models.PaymentInfo{Amount: 1000 * int64(i+1), Currency: "usd", Status: models.PaymentStatusSucceeded},
+			Status:       models.OrderStatusPaid,
+			CreatedAt:    created,
+			UpdatedAt:    created,
+		}
+		require.NoError(t, pg.UpsertOrder(context.Background(), order))
+	}
+
+	stats, err := pg.GetPaymentStatsRange(context.Background(), now.AddDate(0, 0, -7), time.Time{}, false, "usd")
+	require.NoError(t, err)
+	assert.Equal(t, 1, stats.TotalOrders)
+	assert.Equal(t, 20.0, stats.TotalRevenue)
+	require.NotNil(t, stats.From)
+	assert.Nil(t, stats.To)
+
+	stats, err = pg.GetPaymentStats(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 2, stats.TotalOrders)
+	assert.Equal(t, 30.0, stats.TotalRevenue)
+}
+
+// TestPostgresRevenueByDay tests that daily revenue groups paid orders by UTC day and fills empty days,
+// counting only the requested currency and, unless asked, unarchived orders
+func TestPostgresRevenueByDay(t *testing.T) {
+	pg := newTestPostgresStore(t)
+
+	day := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	for i, created := range []time.Time{day.Add(time.Hour), day.Add(22 * time.Hour), day.AddDate(0, 0, 2)} {
+		order := &models.Order{
+			ID:           fmt.Sprintf("pg-daily-%d", i),
+			TrackingID:   fmt.Sprintf("TRKPGDY%d", i),
+			CustomerInfo: models.CustomerInfo{Email: "daily@example.com"},
+			Payment:      models.PaymentInfo{Amount: 1000, Currency: "usd", Status: models.PaymentStatusSucceeded},
+			Status:       models.OrderStatusPaid,
+			CreatedAt:    created,
+			UpdatedAt:    created,
+		}
+		require.NoError(t, pg.UpsertOrder(context.Background(), order))
+	}
+
+	days, err := pg.GetRevenueByDay(context.Background(), day, day.AddDate(0, 0, 2).Add(time.Hour), "usd", false)
+	require.NoError(t, err)
+	assert.Equal(t, []models.DailyRevenue{
+		{Date: "2024-06-01", Revenue: 20, OrderCount: 2},
+		{Date: "2024-06-02"},
+		{Date: "2024-06-03", Revenue: 10, OrderCount: 1},
+	}, days)
+
+	jpy := &models.Order{
+		ID:           "pg-daily-jpy",
+		TrackingID:   "TRKPGDYJPY",
+		CustomerInfo: models.CustomerInfo{Email: "daily@example.com"},
+		Payment:      models.PaymentInfo{Amount: 1500, Currency: "jpy", Status: models.PaymentStatusSucceeded},
+		Status:       models.OrderStatusPaid,
+		CreatedAt:    day.Add(2 * time.Hour),
+		UpdatedAt:    day.Add(2 * time.Hour),
+	}
+	require.NoError(t, pg.UpsertOrder(context.Background(), jpy))
+	_, _, err = pg.ArchiveOrder(context.Background(), "pg-daily-0")
+	require.NoError(t, err)
+
+	days, err = pg.GetRevenueByDay(context.Background(), day, day.Add(time.Hour*23), "usd", false)
+	require.NoError(t, err)
+	assert.Equal(t, []models.DailyRevenue{{Date: "2024-06-01", Revenue: 10, OrderCount: 1}}, days)
+	days, err = pg.GetRevenueByDay(context.Background(), day, day.Add(time.Hour*23), "usd", true)
+	require.NoError(t, err)
+	assert.Equal(t, []models.DailyRevenue{{Date: "2024-06-01", Revenue: 20, OrderCount: 2}}, days)
+	days, err = pg.GetRevenueByDay(context.Background(), day, day.Add(time.Hour*23), "jpy", false)
+	require.NoError(t, err)
+	assert.Equal(t, []models.DailyRevenue{{Date: "2024-06-01", Revenue: 1500, OrderCount: 1}}, days)
+}
+
+func TestPostgresEachOrder(t *testing.T) {
+	pg := newTestPostgresStore(t)
+
+	created := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	for i, status := range []models.OrderStatus{models.OrderStatusPaid, models.OrderStatusPending, models.OrderStatusPaid} {
+		order := &models.Order{
+			ID:           fmt.Sprintf("pg-each-%d", i),
+			TrackingID:   fmt.Sprintf("TRKPGEACH%d", i),
+			CustomerInfo: models.CustomerInfo{Email: "each@example.com"},
+			Payment:      models.PaymentInfo{Amount: 1000, Currency: "usd"},
+			Status:       status,
+			CreatedAt:    created.AddDate(0, 0, i),
+			UpdatedAt:    created.AddDate(0, 0, i),
+		}
+		require.NoError(t, pg.UpsertOrder(context.Background(), order))
+	}
+
+	var ids []string
+	require.NoError(t, pg.EachOrder(context.Background(), models.OrderFilter{Status: models.OrderStatusPaid}, func(order *models.Order) error {
+		ids = append(ids, order.ID)
+		return nil
+	}))
+	assert.Equal(t, []string{"pg-each-2", "pg-each-0"}, ids)
+
+	// An error from the callback stops the iteration
+	stop := errors.New("stop")
+	calls := 0
+	err := pg.EachOrder(context.Background(), models.OrderFilter{}, func(order *models.Order) error {
+		calls++
+		return stop
+	})
+	assert.ErrorIs(t, err, stop)
+	assert.Equal(t, 1, calls)
+}
+
+func TestPostgresCustomerOrderSummaries(t *testing.T) {
+	pg := newTestPostgresStore(t)
+
+	created := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	for i, email := range []string{"history@example.com", "history@example.com", "other@example.com", "history@example.com"} {
+		order := &models.Order{
+			ID:           fmt.Sprintf("pg-history-%d", i),
+			TrackingID:   fmt.Sprintf("TRKPGHIST%d", i),
+			CustomerInfo: models.CustomerInfo{Email: email},
+			Payment:      models.PaymentInfo{Amount: 1000, Currency: "usd"},
+			Status:       models.OrderStatusPaid,
+			CreatedAt:    created.AddDate(0, 0, i),
+			UpdatedAt:    created.AddDate(0, 0, i),
+		}
+		require.NoError(t, pg.UpsertOrder(context.Background(), order))
+	}
+
+	summaries, err := pg.GetCustomerOrderSummaries(context.Background(), "history@example.com", 2, 1)
+	require.NoError(t, err)
+	require.Len(t, summaries, 2)
+	assert.Equal(t, "pg-history-1", summaries[0].ID)
+	assert.Equal(t, "TRKPGHIST1", summaries[0].TrackingID)
+	assert.Equal(t, "pg-history-0", summaries[1].ID)
+
+	total, err := pg.CountCustomerOrders(context.Background(), "history@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, 3, total)
+
+	summaries, err = pg.GetCustomerOrderSummaries(context.Background(), "nobody@example.com", 50, 0)
+	require.NoError(t, err)
+	assert.Empty(t, summaries)
+}
+
+// TestPostgresSubscriptions tests that subscriptions are upserted keeping their creation time, and
+// that their events are stored
+func TestPostgresSubscriptions(t *testing.T) {
+	pg := newTestPostgresStore(t)
+
+	periodEnd := time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)
+	lastEventAt := time.Date(2024, 6, 2, 0, 0, 0, 0, time.UTC)
+	subscription := &models.Subscription{
+		StripeSubscriptionID: "sub_pg_member",
+		StripeCustomerID:     "cus_pg_member",
+		CustomerEmail:        "pg-member@example.com",
+		Status:               models.SubscriptionStatusActive,
+		CurrentPeriodEnd:     &periodEnd,
+		LastEventAt:          &lastEventAt,
+	}
+	require.NoError(t, pg.SaveSubscription(context.Background(), subscription))
+	createdAt := subscription.CreatedAt
+
+	subscription.Status = models.SubscriptionStatusCanceled
+	subscription.CreatedAt = time.Time{}
+	require.NoError(t, pg.SaveSubscription(context.Background(), subscription))
+	assert.True(t, subscription.CreatedAt.Equal(createdAt.Round(time.Microsecond)))
+
+	saved, err := pg.GetSubscription(context.Background(), "sub_pg_member")
+	require.NoError(t, err)
+	assert.Equal(t, models.SubscriptionStatusCanceled, saved.Status)
+	require.NotNil(t, saved.CurrentPeriodEnd)
+	assert.True(t, saved.CurrentPeriodEnd.Equal(periodEnd))
+	require.NotNil(t, saved.LastEventAt)
+	assert.True(t, saved.LastEventAt.Equal(lastEventAt))
+
+	subscriptions, err := pg.GetCustomerSubscriptions(context.Background(), "pg-member@example.com")
+	require.NoError(t, err)
+	require.Len(t, subscriptions, 1)
+
+	_, err = pg.GetSubscription(context.Background(), "sub_pg_missing")
+	assert.ErrorIs(t, err, store.ErrSubscriptionNotFound)
+
+	require.NoError(t, pg.AddSubscriptionEvent(context.Background(), models.SubscriptionEvent{
+		SubscriptionID: "sub_pg_member",
+		EventType:      "subscription_canceled",
+		Status:         models.SubscriptionStatusCanceled,
+		Data:           map[string]interface{}{"previous_status": "active"},
+	}))
+	events, err := pg.GetSubscriptionEvents(context.Background(), "sub_pg_member")
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, "active", events[0].Data.(map[string]interface{})["previous_status"])
+}
@@ -0,0 +1,90 @@
+// tests/ratelimit_test.go
+package tests
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	appmiddleware "github.com/capactiyvirus/stripe-backend/middleware"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestRateLimitPerClientIP tests that each IP gets its own burst before being told to retry later
+func TestRateLimitPerClientIP(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+	limited := appmiddleware.RateLimit(0.5, 2, "/api/payments/webhook")(ok)
+
+	request := func(remoteAddr, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		limited.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusNoContent, request("192.0.2.1:1111", "/api/payments/track/TRK1").Code)
+	assert.Equal(t, http.StatusNoContent, request("192.0.2.1:2222", "/api/payments/track/TRK2").Code)
+
+	w := request("192.0.2.1:3333", "/api/payments/track/TRK3")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "2", w.Header().Get("Retry-After")) // One token at 0.5 per second
+	assert.JSONEq(t, `{"error": "Rate limit exceeded"}`, w.Body.String())
+
+	// Other clients and exempt paths aren't affected
+	assert.Equal(t, http.StatusNoContent, request("192.0.2.2:1111", "/api/payments/track/TRK1").Code)
+	assert.Equal(t, http.StatusNoContent, request("192.0.2.1:4444", "/api/payments/webhook").Code)
+}
+
+// TestRateLimitDisabled tests that a zero rate lets every request through
+func TestRateLimitDisabled(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+	limited := appmiddleware.RateLimit(0, 1)(ok)
+
+	for i := 0; i < 5; i++ {
+		w := httptest.NewRecorder()
+		limited.ServeHTTP(w, httptest.NewRequest("POST", "/api/payments/create-order", nil))
+		assert.Equal(t, http.StatusNoContent, w.Code)
+	}
+}
+
+// TestRealIPTrustsOnlyConfiguredProxies tests that forwarded client IPs are only believed from
+// trusted proxies, so a client can't pick its own rate limit bucket
+func TestRealIPTrustsOnlyConfiguredProxies(t *testing.T) {
+	_, proxies, err := net.ParseCIDR("10.0.0.0/8")
+	require.NoError(t, err)
+	var seen string
+	handler := appmiddleware.RealIP([]*net.IPNet{proxies})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.RemoteAddr
+	}))
+
+	request := func(remoteAddr string, headers map[string]string) string {
+		req := httptest.NewRequest("GET", "/api/payments/track/TRK1", nil)
+		req.RemoteAddr = remoteAddr
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		return seen
+	}
+
+	// A client talking to the server directly can't claim another address
+	assert.Equal(t, "192.0.2.1:1111", request("192.0.2.1:1111", map[string]string{"X-Forwarded-For": "198.51.100.7"}))
+	assert.Equal(t, "192.0.2.1:1111", request("192.0.2.1:1111", map[string]string{"True-Client-IP": "198.51.100.7"}))
+
+	// Behind a trusted proxy, the address the proxy saw wins over any the client prepended
+	assert.Equal(t, "198.51.100.7", request("10.0.0.5:1111", map[string]string{"X-Forwarded-For": "203.0.113.9, 198.51.100.7"}))
+	assert.Equal(t, "198.51.100.7", request("10.0.0.5:1111", map[string]string{"X-Forwarded-For": "198.51.100.7, 10.0.0.6"}))
+	assert.Equal(t, "198.51.100.7", request("10.0.0.5:1111", map[string]string{"X-Real-IP": "198.51.100.7"}))
+	assert.Equal(t, "10.0.0.5:1111", request("10.0.0.5:1111", map[string]string{"True-Client-IP": "198.51.100.7"}))
+
+	// Without trusted proxies the headers are ignored altogether
+	untrusted := appmiddleware.RealIP(nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { seen = r.RemoteAddr }))
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.5:1111"
+	req.Header.Set("X-Forwarded-For", "198.51.100.7")
+	untrusted.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "10.0.0.5:1111", seen)
+}
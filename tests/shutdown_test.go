@@ -0,0 +1,136 @@
+// tests/shutdown_test.go
+package tests
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/capactiyvirus/stripe-backend/config"
+	"github.com/capactiyvirus/stripe-backend/handlers"
+	"github.com/capactiyvirus/stripe-backend/models"
+	"github.com/capactiyvirus/stripe-backend/services"
+	"github.com/capactiyvirus/stripe-backend/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestShutdownDrainsEmailQueueAndSavesSnapshot tests that shutdown sends queued emails and persists the store
+func TestShutdownDrainsEmailQueueAndSavesSnapshot(t *testing.T) {
+	smtp := newSMTPStub(t)
+	snapshotPath := filepath.Join(t.TempDir(), "store.json")
+
+	h := handlers.NewHandlers(&config.Config{Environment: "test", StoreSnapshotPath: snapshotPath}, store.NewMemoryStore())
+	h.EmailService = newTestEmailService(smtp)
+	h.EmailService.Dispatcher = services.NewEmailDispatcher(50, 10)
+
+	// Queue emails before the worker starts so they're all pending at shutdown
+	const pending = 5
+	for i := 0; i < pending; i++ {
+		order := newTestEmailOrder()
+		order.ID = fmt.Sprintf("shutdown-order-%d", i)
+		order.TrackingID = fmt.Sprintf("TRKSHUT%d", i)
+		require.NoError(t, h.PaymentStore.CreateOrder(context.Background(), order))
+		require.NoError(t, h.EmailService.SendOrderConfirmation(order))
+	}
+	h.EmailService.Dispatcher.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, h.Shutdown(ctx))
+
+	assert.Len(t, smtp.Messages(), pending)
+
+	restored := store.NewMemoryStore()
+	require.NoError(t, restored.LoadFromFile(snapshotPath))
+	loaded, err := restored.CountOrders(context.Background(), models.OrderFilter{IncludeArchived: true})
+	require.NoError(t, err)
+	assert.Equal(t, pending, loaded)
+
+	order, err := restored.GetOrderByTrackingID(context.Background(), "TRKSHUT3")
+	require.NoError(t, err)
+	assert.Equal(t, "shutdown-order-3", order.ID)
+}
+
+// TestShutdownWaitsForBackgroundTasks tests that shutdown lets background tasks finish, including the
+// emails they queue, and gives up on tasks still running when its context ends
+func TestShutdownWaitsForBackgroundTasks(t *testing.T) {
+	smtp := newSMTPStub(t)
+
+	h := handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore())
+	h.EmailService = newTestEmailService(smtp)
+	h.EmailService.Dispatcher = services.NewEmailDispatcher(50, 10)
+	h.EmailService.Dispatcher.Start()
+
+	const tasks = 3
+	for i := 0; i < tasks; i++ {
+		order := newTestEmailOrder()
+		order.ID = fmt.Sprintf("background-order-%d", i)
+		h.RunInBackground(func() {
+			time.Sleep(50 * time.Millisecond)
+			assert.NoError(t, h.EmailService.SendOrderConfirmation(order))
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, h.Shutdown(ctx))
+	assert.Len(t, smtp.Messages(), tasks)
+
+	// A stuck task doesn't hold up shutdown past its deadline
+	stuck := handlers.NewHandlers(&config.Config{Environment: "test"}, store.NewMemoryStore())
+	release := make(chan struct{})
+	defer close(release)
+	stuck.RunInBackground(func() { <-release })
+
+	shortCtx, shortCancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer shortCancel()
+	start := time.Now()
+	require.NoError(t, stuck.Shutdown(shortCtx))
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+// TestSnapshotKeepsProcessedWebhookEvents tests that webhook idempotency survives a restart from the snapshot,
+// and that a missing snapshot on first boot loads an empty store
+func TestSnapshotKeepsProcessedWebhookEvents(t *testing.T) {
+	snapshotPath := filepath.Join(t.TempDir(), "store.json")
+
+	mem := store.NewMemoryStore()
+	require.NoError(t, mem.LoadFromFile(snapshotPath))
+	loaded, err := mem.CountOrders(context.Background(), models.OrderFilter{IncludeArchived: true})
+	require.NoError(t, err)
+	assert.Equal(t, 0, loaded)
+
+	alreadyProcessed, err := mem.MarkEventProcessed(context.Background(), "evt_snapshot_1")
+	require.NoError(t, err)
+	require.False(t, alreadyProcessed)
+	require.NoError(t, mem.SnapshotToFile(snapshotPath))
+
+	restored := store.NewMemoryStore()
+	require.NoError(t, restored.LoadFromFile(snapshotPath))
+
+	alreadyProcessed, err = restored.MarkEventProcessed(context.Background(), "evt_snapshot_1")
+	require.NoError(t, err)
+	assert.True(t, alreadyProcessed)
+	alreadyProcessed, err = restored.MarkEventProcessed(context.Background(), "evt_snapshot_2")
+	require.NoError(t, err)
+	assert.False(t, alreadyProcessed)
+}
+
+// TestSnapshotKeepsStripeCustomers tests that email to Stripe customer mappings survive a restart from the snapshot
+func TestSnapshotKeepsStripeCustomers(t *testing.T) {
+	snapshotPath := filepath.Join(t.TempDir(), "store.json")
+
+	mem := store.NewMemoryStore()
+	require.NoError(t, mem.SaveStripeCustomerID(context.Background(), "snapshot@example.com", "cus_snapshot"))
+	require.NoError(t, mem.SnapshotToFile(snapshotPath))
+
+	restored := store.NewMemoryStore()
+	require.NoError(t, restored.LoadFromFile(snapshotPath))
+
+	customerID, err := restored.GetStripeCustomerID(context.Background(), "snapshot@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "cus_snapshot", customerID)
+}
@@ -0,0 +1,232 @@
+// tests/smtp_stub_test.go
+package tests
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http/httptest"
+	"net/mail"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// smtpStub is a minimal SMTP server that captures delivered messages
+type smtpStub struct {
+	listener net.Listener
+	mu       sync.Mutex
+	messages []string
+	rcptFail []string // replies for upcoming RCPT commands, used before accepting any
+	rcpts    int
+
+	tlsConfig *tls.Config // Offered through STARTTLS when startTLS is set
+	startTLS  bool        // Mail is refused until the client issues STARTTLS
+}
+
+// newSMTPStub starts an SMTP stub on a random local port
+func newSMTPStub(t *testing.T) *smtpStub {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start SMTP stub: %v", err)
+	}
+
+	stub := &smtpStub{listener: listener}
+	go stub.serve()
+	t.Cleanup(func() { listener.Close() })
+
+	return stub
+}
+
+// newTLSSMTPStub starts an SMTP stub with a self-signed certificate for 127.0.0.1 that either
+// requires STARTTLS or, with implicit set, only accepts TLS connections
+func newTLSSMTPStub(t *testing.T, implicit bool) *smtpStub {
+	t.Helper()
+
+	// httptest's certificate is issued for 127.0.0.1 by a CA clients don't trust
+	certServer := httptest.NewUnstartedServer(nil)
+	certServer.StartTLS()
+	tlsConfig := &tls.Config{Certificates: certServer.TLS.Certificates}
+	certServer.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start SMTP stub: %v", err)
+	}
+
+	stub := &smtpStub{listener: listener, tlsConfig: tlsConfig, startTLS: !implicit}
+	if implicit {
+		stub.listener = tls.NewListener(listener, tlsConfig)
+	}
+	go stub.serve()
+	t.Cleanup(func() { listener.Close() })
+
+	return stub
+}
+
+// Host returns the stub's host
+func (s *smtpStub) Host() string {
+	host, _, _ := net.SplitHostPort(s.listener.Addr().String())
+	return host
+}
+
+// Port returns the stub's port
+func (s *smtpStub) Port() string {
+	_, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	return port
+}
+
+// FailRecipients makes the next RCPT commands fail with the given replies, in order
+func (s *smtpStub) FailRecipients(replies ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rcptFail = append(s.rcptFail, replies...)
+}
+
+// RecipientAttempts returns how many RCPT commands the stub has received
+func (s *smtpStub) RecipientAttempts() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rcpts
+}
+
+// Messages returns the raw messages received so far
+func (s *smtpStub) Messages() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.messages...)
+}
+
+func (s *smtpStub) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *smtpStub) handle(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+	secured := false
+
+	reply("220 stub ESMTP")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		command := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			reply("250-stub")
+			if s.startTLS && !secured {
+				reply("250-STARTTLS")
+			}
+			reply("250 AUTH PLAIN")
+		case strings.HasPrefix(command, "STARTTLS") && s.startTLS:
+			reply("220 ready to start TLS")
+			conn = tls.Server(conn, s.tlsConfig)
+			reader = bufio.NewReader(conn)
+			secured = true
+		case strings.HasPrefix(command, "MAIL") && s.startTLS && !secured:
+			reply("530 must issue a STARTTLS command first")
+		case strings.HasPrefix(command, "AUTH"):
+			reply("235 authenticated")
+		case strings.HasPrefix(command, "RCPT"):
+			s.mu.Lock()
+			s.rcpts++
+			response := "250 OK"
+			if len(s.rcptFail) > 0 {
+				response, s.rcptFail = s.rcptFail[0], s.rcptFail[1:]
+			}
+			s.mu.Unlock()
+			reply(response)
+		case strings.HasPrefix(command, "DATA"):
+			reply("354 end with <CRLF>.<CRLF>")
+
+			var data strings.Builder
+			for {
+				dataLine, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if dataLine == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(dataLine, "."))
+			}
+
+			s.mu.Lock()
+			s.messages = append(s.messages, data.String())
+			s.mu.Unlock()
+			reply("250 OK")
+		case strings.HasPrefix(command, "QUIT"):
+			reply("221 bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+// emailPart returns the decoded body of the first part of a raw message with the given media type,
+// searching nested multiparts
+func emailPart(t *testing.T, raw, mediaType string) string {
+	t.Helper()
+
+	msg, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatalf("failed to parse email: %v", err)
+	}
+
+	body, found := findEmailPart(t, msg.Header.Get("Content-Type"), msg.Body, mediaType)
+	if !found {
+		t.Fatalf("email has no %s part", mediaType)
+	}
+	return body
+}
+
+func findEmailPart(t *testing.T, contentType string, body io.Reader, mediaType string) (string, bool) {
+	partType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		t.Fatalf("invalid Content-Type %q: %v", contentType, err)
+	}
+
+	if partType == mediaType {
+		content, err := io.ReadAll(body)
+		if err != nil {
+			t.Fatalf("failed to read %s part: %v", mediaType, err)
+		}
+		return string(content), true
+	}
+	if !strings.HasPrefix(partType, "multipart/") {
+		return "", false
+	}
+
+	// multipart.Reader decodes quoted-printable parts
+	reader := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return "", false
+		}
+		if err != nil {
+			t.Fatalf("failed to read multipart email: %v", err)
+		}
+		if content, found := findEmailPart(t, part.Header.Get("Content-Type"), part, mediaType); found {
+			return content, true
+		}
+	}
+}
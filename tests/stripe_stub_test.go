@@ -0,0 +1,146 @@
+// tests/stripe_stub_test.go
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stripe/stripe-go/v82"
+)
+
+// stubRequest records a request received by the Stripe stub
+type stubRequest struct {
+	Method string
+	Path   string
+	Form   url.Values
+	Header http.Header
+}
+
+// stubResponder builds the status code and JSON body for a stubbed Stripe call
+type stubResponder func(req stubRequest) (int, interface{})
+
+// stripeStub is a fake Stripe API server so handlers can be tested without network access
+type stripeStub struct {
+	server   *httptest.Server
+	mu       sync.Mutex
+	requests []stubRequest
+	routes   map[string]stubResponder
+}
+
+// newStripeStub starts a Stripe stub and points the stripe-go API backend at it
+func newStripeStub(t *testing.T) *stripeStub {
+	t.Helper()
+
+	stub := &stripeStub{routes: make(map[string]stubResponder)}
+	stub.server = httptest.NewServer(http.HandlerFunc(stub.serveHTTP))
+
+	noRetries := int64(0)
+	stripe.Key = "sk_test_stub"
+	stripe.SetBackend(stripe.APIBackend, stripe.GetBackendWithConfig(stripe.APIBackend, &stripe.BackendConfig{
+		URL:               stripe.String(stub.server.URL),
+		MaxNetworkRetries: &noRetries,
+		LeveledLogger:     &stripe.LeveledLogger{Level: stripe.LevelNull},
+	}))
+
+	t.Cleanup(func() {
+		stripe.SetBackend(stripe.APIBackend, nil)
+		stub.server.Close()
+	})
+
+	return stub
+}
+
+// On registers a responder for a method and path such as "POST", "/v1/payment_intents".
+// A trailing "*" matches any path with that prefix.
+func (s *stripeStub) On(method, path string, responder stubResponder) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.routes[method+" "+path] = responder
+}
+
+// Requests returns the recorded requests for a method and path
+func (s *stripeStub) Requests(method, path string) []stubRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var matched []stubRequest
+	for _, req := range s.requests {
+		if req.Method == method && req.Path == path {
+			matched = append(matched, req)
+		}
+	}
+	return matched
+}
+
+func (s *stripeStub) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	req := stubRequest{Method: r.Method, Path: r.URL.Path, Form: r.Form, Header: r.Header}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, req)
+	responder, ok := s.routes[r.Method+" "+r.URL.Path]
+	if !ok {
+		for route, candidate := range s.routes {
+			if strings.HasSuffix(route, "*") && strings.HasPrefix(r.Method+" "+r.URL.Path, strings.TrimSuffix(route, "*")) {
+				responder, ok = candidate, true
+				break
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	status, body := http.StatusNotFound, interface{}(map[string]interface{}{
+		"error": map[string]interface{}{
+			"type":    "invalid_request_error",
+			"message": fmt.Sprintf("No stub for %s %s", r.Method, r.URL.Path),
+		},
+	})
+	if ok {
+		status, body = responder(req)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// stubPaymentIntents registers create and retrieve responders for payment intents
+// that hand out sequential IDs and matching client secrets
+func (s *stripeStub) stubPaymentIntents() {
+	var mu sync.Mutex
+	created := 0
+
+	s.On("POST", "/v1/payment_intents", func(req stubRequest) (int, interface{}) {
+		mu.Lock()
+		created++
+		id := fmt.Sprintf("pi_stub_%d", created)
+		mu.Unlock()
+
+		amount, _ := strconv.ParseInt(req.Form.Get("amount"), 10, 64)
+		return http.StatusOK, map[string]interface{}{
+			"id":            id,
+			"object":        "payment_intent",
+			"amount":        amount,
+			"currency":      req.Form.Get("currency"),
+			"client_secret": id + "_secret",
+			"status":        "requires_payment_method",
+		}
+	})
+	s.On("GET", "/v1/payment_intents/*", func(req stubRequest) (int, interface{}) {
+		id := strings.TrimPrefix(req.Path, "/v1/payment_intents/")
+		return http.StatusOK, map[string]interface{}{
+			"id":            id,
+			"object":        "payment_intent",
+			"client_secret": id + "_secret",
+			"status":        "requires_payment_method",
+		}
+	})
+}
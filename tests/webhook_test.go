@@ -0,0 +1,1290 @@
+// tests/webhook_test.go
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/capactiyvirus/stripe-backend/config"
+	"github.com/capactiyvirus/stripe-backend/handlers"
+	"github.com/capactiyvirus/stripe-backend/models"
+	"github.com/capactiyvirus/stripe-backend/services"
+	"github.com/capactiyvirus/stripe-backend/store"
+	"github.com/capactiyvirus/stripe-backend/webhooktest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/stripe-go/v82"
+)
+
+const testWebhookSecret = "whsec_test_secret"
+
+// newWebhookTestHandlers creates handlers configured with the test webhook secret
+func newWebhookTestHandlers() *handlers.Handlers {
+	cfg := &config.Config{
+		StripeWebhookSecret: testWebhookSecret,
+		Environment:         "test",
+	}
+	return handlers.NewHandlers(cfg, store.NewMemoryStore())
+}
+
+// newSignedWebhookRequest builds a webhook request signed with the test secret
+func newSignedWebhookRequest(t *testing.T, eventType string, object map[string]interface{}) *http.Request {
+	t.Helper()
+
+	req, err := webhooktest.NewRequest("/api/payments/webhook", testWebhookSecret, eventType, object)
+	require.NoError(t, err)
+	return req
+}
+
+// createPendingOrder adds a pending order linked to a payment intent
+func createPendingOrder(t *testing.T, h *handlers.Handlers, orderID, paymentIntentID string, amount int64) {
+	t.Helper()
+
+	order := &models.Order{
+		ID:         orderID,
+		TrackingID: "TRK" + orderID,
+		CustomerInfo: models.CustomerInfo{
+			Email: orderID + "@example.com",
+		},
+		Payment: models.PaymentInfo{
+			StripePaymentIntentID: paymentIntentID,
+			Amount:                amount,
+			Currency:              "usd",
+			Status:                models.PaymentStatusPending,
+		},
+		Status: models.OrderStatusPending,
+	}
+	require.NoError(t, h.PaymentStore.CreateOrder(context.Background(), order))
+}
+
+// stubChargeList makes the Stripe stub return the given charges for any charge list call
+func stubChargeList(stub *stripeStub, charges ...map[string]interface{}) {
+	data := make([]interface{}, len(charges))
+	for i, ch := range charges {
+		data[i] = ch
+	}
+	stub.On("GET", "/v1/charges", func(req stubRequest) (int, interface{}) {
+		return http.StatusOK, map[string]interface{}{
+			"object":   "list",
+			"url":      "/v1/charges",
+			"has_more": false,
+			"data":     data,
+		}
+	})
+}
+
+// testCharge builds a captured charge with its balance transaction expanded
+func testCharge(id string, amount, fee int64) map[string]interface{} {
+	return map[string]interface{}{
+		"id":              id,
+		"object":          "charge",
+		"amount":          amount,
+		"amount_captured": amount,
+		"captured":        true,
+		"status":          "succeeded",
+		"balance_transaction": map[string]interface{}{
+			"id":     "txn_" + id,
+			"object": "balance_transaction",
+			"amount": amount,
+			"fee":    fee,
+			"net":    amount - fee,
+		},
+	}
+}
+
+// TestWebhookSecretRotation tests that events signed with any of several comma-separated secrets are accepted,
+// and that empty entries in the list are ignored
+func TestWebhookSecretRotation(t *testing.T) {
+	h := handlers.NewHandlers(&config.Config{
+		StripeWebhookSecret: "whsec_old, ,whsec_new,",
+		Environment:         "test",
+	}, store.NewMemoryStore())
+	router := setupTestRouter(h)
+
+	deliver := func(secret string) int {
+		req, err := webhooktest.NewRequest("/api/payments/webhook", secret, "customer.created", map[string]interface{}{"id": "cus_rotation", "object": "customer"})
+		require.NoError(t, err)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, deliver("whsec_old"))
+	assert.Equal(t, http.StatusOK, deliver("whsec_new"))
+	assert.Equal(t, http.StatusUnauthorized, deliver("whsec_other"))
+	assert.Equal(t, http.StatusUnauthorized, deliver(""), "empty entries must not become a signing key")
+}
+
+// TestWebhookSignatureStatusCodes tests that a missing signature, a signature that doesn't verify,
+// and a verified but unreadable payload each get their own status code
+func TestWebhookSignatureStatusCodes(t *testing.T) {
+	h := newWebhookTestHandlers()
+	router := setupTestRouter(h)
+
+	payload, err := webhooktest.NewEvent("customer.created", map[string]interface{}{"id": "cus_signature", "object": "customer"})
+	require.NoError(t, err)
+
+	deliver := func(body []byte, signature string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/payments/webhook", bytes.NewReader(body))
+		if signature != "" {
+			req.Header.Set("Stripe-Signature", signature)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	tests := []struct {
+		name      string
+		body      []byte
+		signature string
+		expected  int
+		message   string
+	}{
+		{"missing signature", payload, "", http.StatusBadRequest, "Missing Stripe-Signature header"},
+		{"blank signature", payload, "   ", http.StatusBadRequest, "Missing Stripe-Signature header"},
+		{"wrong secret", payload, webhooktest.Sign(payload, "whsec_wrong"), http.StatusUnauthorized, "signature verification failed"},
+		{"malformed signature", payload, "not-a-signature", http.StatusUnauthorized, "signature verification failed"},
+		{"tampered payload", append(payload[:len(payload):len(payload)], ' '), webhooktest.Sign(payload, testWebhookSecret), http.StatusUnauthorized, "signature verification failed"},
+		{"unreadable payload", []byte("not json"), webhooktest.Sign([]byte("not json"), testWebhookSecret), http.StatusBadRequest, "Invalid webhook payload"},
+		{"valid signature", payload, webhooktest.Sign(payload, testWebhookSecret), http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := deliver(tt.body, tt.signature)
+			assert.Equal(t, tt.expected, w.Code, w.Body.String())
+			assert.Contains(t, w.Body.String(), tt.message)
+		})
+	}
+}
+
+// TestWebhookBodySizeLimit tests that oversized payloads get a 413 rather than a signature failure
+func TestWebhookBodySizeLimit(t *testing.T) {
+	// Over the old 64 KB limit but under the default
+	payload, err := webhooktest.NewEvent("customer.created", map[string]interface{}{
+		"id":          "cus_large",
+		"object":      "customer",
+		"description": strings.Repeat("x", 100<<10),
+	})
+	require.NoError(t, err)
+
+	deliver := func(h *handlers.Handlers) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/payments/webhook", bytes.NewReader(payload))
+		req.Header.Set("Stripe-Signature", webhooktest.Sign(payload, testWebhookSecret))
+		w := httptest.NewRecorder()
+		setupTestRouter(h).ServeHTTP(w, req)
+		return w
+	}
+
+	w := deliver(newWebhookTestHandlers())
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	h := newWebhookTestHandlers()
+	h.Config.WebhookMaxBodyBytes = 64 << 10
+	w = deliver(h)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Contains(t, w.Body.String(), "larger than 65536 bytes")
+	assert.NotContains(t, w.Body.String(), "signature")
+}
+
+// TestPaymentSucceededRecordsStripeFees tests fee capture from the balance transaction
+func TestPaymentSucceededRecordsStripeFees(t *testing.T) {
+	stub := newStripeStub(t)
+	stubChargeList(stub, testCharge("ch_fee_test", 1000, 59))
+
+	h := newWebhookTestHandlers()
+	router := setupTestRouter(h)
+
+	createPendingOrder(t, h, "fee-order-1", "pi_fee_test", 1000)
+
+	req := newSignedWebhookRequest(t, "payment_intent.succeeded", map[string]interface{}{
+		"id":              "pi_fee_test",
+		"object":          "payment_intent",
+		"amount":          1000,
+		"amount_received": 1000,
+		"currency":        "usd",
+		"status":          "succeeded",
+		"latest_charge":   "ch_fee_test",
+	})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+
+	order, err := h.PaymentStore.GetOrder(context.Background(), "fee-order-1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(59), order.Payment.StripeFee)
+	assert.Equal(t, int64(941), order.Payment.NetAmount)
+
+	stats, err := h.PaymentStore.GetPaymentStats(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 10.0, stats.TotalRevenue)
+	assert.InDelta(t, 0.59, stats.TotalFees, 0.0001)
+	assert.InDelta(t, 9.41, stats.NetRevenue, 0.0001)
+}
+
+// succeededIntent builds a succeeded payment intent payload
+func succeededIntent(id string, amount, received int64) map[string]interface{} {
+	return map[string]interface{}{
+		"id":              id,
+		"object":          "payment_intent",
+		"amount":          amount,
+		"amount_received": received,
+		"currency":        "usd",
+		"status":          "succeeded",
+	}
+}
+
+// TestPaymentSucceededWithPartialCharges tests that partially captured intents don't mark the order paid
+func TestPaymentSucceededWithPartialCharges(t *testing.T) {
+	stub := newStripeStub(t)
+	stubChargeList(stub, testCharge("ch_part_1", 400, 20), testCharge("ch_part_2", 300, 15))
+
+	h := newWebhookTestHandlers()
+	router := setupTestRouter(h)
+
+	createPendingOrder(t, h, "partial-order-1", "pi_partial_test", 1000)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, newSignedWebhookRequest(t, "payment_intent.succeeded", succeededIntent("pi_partial_test", 1000, 700)))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	order, err := h.PaymentStore.GetOrder(context.Background(), "partial-order-1")
+	require.NoError(t, err)
+	assert.Equal(t, models.PaymentStatusPartiallyPaid, order.Payment.Status)
+	assert.Equal(t, models.OrderStatusPending, order.Status)
+	assert.Equal(t, int64(700), order.Payment.AmountCaptured)
+	assert.Equal(t, []string{"ch_part_1", "ch_part_2"}, order.Payment.ChargeIDs)
+
+	events := handlerEvents(t, h, "partial-order-1")
+	require.Len(t, events, 1)
+	assert.Equal(t, "payment_partially_paid", events[0].EventType)
+}
+
+// TestPaymentSucceededWithMultipleChargesCoveringTotal tests that split charges summing to the total mark the order paid
+func TestPaymentSucceededWithMultipleChargesCoveringTotal(t *testing.T) {
+	stub := newStripeStub(t)
+	stubChargeList(stub, testCharge("ch_split_1", 600, 30), testCharge("ch_split_2", 400, 20))
+
+	h := newWebhookTestHandlers()
+	router := setupTestRouter(h)
+
+	createPendingOrder(t, h, "split-order-1", "pi_split_test", 1000)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, newSignedWebhookRequest(t, "payment_intent.succeeded", succeededIntent("pi_split_test", 1000, 1000)))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	order, err := h.PaymentStore.GetOrder(context.Background(), "split-order-1")
+	require.NoError(t, err)
+	assert.Equal(t, models.PaymentStatusSucceeded, order.Payment.Status)
+	assert.Equal(t, models.OrderStatusPaid, order.Status)
+	assert.Equal(t, int64(1000), order.Payment.AmountCaptured)
+	assert.Equal(t, int64(50), order.Payment.StripeFee)
+	assert.Len(t, order.Payment.ChargeIDs, 2)
+}
+
+// TestPaymentSucceededOnCanceledOrder tests that a payment for an order canceled in the meantime leaves
+// the order canceled, records the payment, and tells the admin it needs a refund
+func TestPaymentSucceededOnCanceledOrder(t *testing.T) {
+	stub := newStripeStub(t)
+	stubChargeList(stub, testCharge("ch_late_1", 1000, 50))
+	smtp := newSMTPStub(t)
+
+	h := newWebhookTestHandlers()
+	h.Config.AdminEmail = "admin@example.com"
+	h.EmailService = newTestEmailService(smtp)
+	router := setupTestRouter(h)
+
+	createPendingOrder(t, h, "canceled-paid-1", "pi_canceled_paid", 1000)
+	require.NoError(t, h.PaymentStore.UpdateOrderStatus(context.Background(), "canceled-paid-1", models.OrderStatusCanceled))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, newSignedWebhookRequest(t, "payment_intent.succeeded", succeededIntent("pi_canceled_paid", 1000, 1000)))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	order, err := h.PaymentStore.GetOrder(context.Background(), "canceled-paid-1")
+	require.NoError(t, err)
+	assert.Equal(t, models.OrderStatusCanceled, order.Status)
+	assert.Equal(t, models.PaymentStatusSucceeded, order.Payment.Status)
+
+	events := handlerEvents(t, h, "canceled-paid-1")
+	require.Len(t, events, 1)
+	assert.Equal(t, "payment_succeeded_on_canceled_order", events[0].EventType)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, h.Shutdown(ctx))
+
+	messages := smtp.Messages()
+	require.Len(t, messages, 1)
+	assert.Contains(t, messages[0], "To: admin@example.com")
+	assert.Contains(t, messages[0], "Subject: Canceled Order Paid - TRKcanceled-paid-1")
+	assert.Contains(t, emailPart(t, messages[0], "text/html"), "10.00 USD")
+}
+
+// TestCheckoutPaymentOnCanceledOrder tests that a checkout payment for an order canceled in the meantime
+// is handled like a late payment intent: the order stays canceled and the admin is told it needs a refund
+func TestCheckoutPaymentOnCanceledOrder(t *testing.T) {
+	tests := []struct {
+		eventType string
+		events    []string
+	}{
+		{"checkout.session.completed", []string{"checkout_completed", "payment_succeeded_on_canceled_order"}},
+		{"checkout.session.async_payment_succeeded", []string{"payment_succeeded_on_canceled_order"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.eventType, func(t *testing.T) {
+			smtp := newSMTPStub(t)
+
+			h := newWebhookTestHandlers()
+			h.Config.AdminEmail = "admin@example.com"
+			h.EmailService = newTestEmailService(smtp)
+			router := setupTestRouter(h)
+
+			createPendingOrder(t, h, "checkout-canceled-1", "", 2500)
+			order, err := h.PaymentStore.GetOrder(context.Background(), "checkout-canceled-1")
+			require.NoError(t, err)
+			order.Payment.StripeSessionID = "cs_canceled"
+			require.NoError(t, h.PaymentStore.UpdateOrder(context.Background(), order))
+			require.NoError(t, h.PaymentStore.UpdateOrderStatus(context.Background(), "checkout-canceled-1", models.OrderStatusCanceled))
+
+			session := checkoutCompletedSession("cs_canceled", "pi_checkout_canceled", "checkout-canceled-1@example.com")
+			session["payment_status"] = "paid"
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, newSignedWebhookRequest(t, tt.eventType, session))
+			require.Equal(t, http.StatusOK, w.Code)
+
+			order, err = h.PaymentStore.GetOrder(context.Background(), "checkout-canceled-1")
+			require.NoError(t, err)
+			assert.Equal(t, models.OrderStatusCanceled, order.Status)
+			assert.Equal(t, models.PaymentStatusSucceeded, order.Payment.Status)
+
+			var eventTypes []string
+			for _, event := range handlerEvents(t, h, "checkout-canceled-1") {
+				eventTypes = append(eventTypes, event.EventType)
+			}
+			assert.Equal(t, tt.events, eventTypes)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			require.NoError(t, h.Shutdown(ctx))
+
+			messages := smtp.Messages()
+			require.Len(t, messages, 1)
+			assert.Contains(t, messages[0], "To: admin@example.com")
+			assert.Contains(t, messages[0], "Subject: Canceled Order Paid - TRKcheckout-canceled-1")
+		})
+	}
+}
+
+// checkoutCompletedSession builds a completed checkout session linked to a payment intent
+func checkoutCompletedSession(sessionID, paymentIntentID, email string) map[string]interface{} {
+	return map[string]interface{}{
+		"id":             sessionID,
+		"object":         "checkout.session",
+		"payment_intent": paymentIntentID,
+		"customer_details": map[string]interface{}{
+			"email": email,
+			"name":  "Concurrent Customer",
+		},
+	}
+}
+
+// TestConcurrentWebhooksForSameOrder tests that events for one order are processed serially
+// while events for other orders are not held up. Run with -race to also catch unsynchronized access.
+func TestConcurrentWebhooksForSameOrder(t *testing.T) {
+	stub := newStripeStub(t)
+
+	// Hold the succeeded handler inside its charge lookup until released
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	var once, releaseOnce sync.Once
+	releaseCharges := func() { releaseOnce.Do(func() { close(release) }) }
+	t.Cleanup(releaseCharges)
+	stub.On("GET", "/v1/charges", func(req stubRequest) (int, interface{}) {
+		once.Do(func() { close(entered) })
+		<-release
+		return http.StatusOK, map[string]interface{}{
+			"object":   "list",
+			"url":      "/v1/charges",
+			"has_more": false,
+			"data":     []interface{}{testCharge("ch_concurrent", 1000, 59)},
+		}
+	})
+
+	h := newWebhookTestHandlers()
+	router := setupTestRouter(h)
+
+	createPendingOrder(t, h, "concurrent-order-1", "pi_concurrent_1", 1000)
+	createPendingOrder(t, h, "concurrent-order-2", "pi_concurrent_2", 1000)
+
+	serve := func(req *http.Request) <-chan int {
+		done := make(chan int, 1)
+		go func() {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			done <- w.Code
+		}()
+		return done
+	}
+
+	succeeded := serve(newSignedWebhookRequest(t, "payment_intent.succeeded", succeededIntent("pi_concurrent_1", 1000, 1000)))
+	<-entered
+
+	sameOrder := serve(newSignedWebhookRequest(t, "checkout.session.completed",
+		checkoutCompletedSession("cs_concurrent_1", "pi_concurrent_1", "concurrent-order-1@example.com")))
+	otherOrder := serve(newSignedWebhookRequest(t, "checkout.session.completed",
+		checkoutCompletedSession("cs_concurrent_2", "pi_concurrent_2", "concurrent-order-2@example.com")))
+
+	// A different order isn't blocked by the in-flight event
+	select {
+	case code := <-otherOrder:
+		assert.Equal(t, http.StatusOK, code)
+	case <-time.After(2 * time.Second):
+		t.Fatal("webhook for another order was blocked")
+	}
+
+	// The same order waits for the in-flight event to finish
+	select {
+	case <-sameOrder:
+		t.Fatal("webhook for the same order ran concurrently")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	releaseCharges()
+	assert.Equal(t, http.StatusOK, <-succeeded)
+	assert.Equal(t, http.StatusOK, <-sameOrder)
+
+	order, err := h.PaymentStore.GetOrder(context.Background(), "concurrent-order-1")
+	require.NoError(t, err)
+	assert.Equal(t, models.OrderStatusPaid, order.Status)
+	assert.Equal(t, models.PaymentStatusSucceeded, order.Payment.Status)
+	assert.Equal(t, "cs_concurrent_1", order.Payment.StripeSessionID)
+	assert.Equal(t, "Concurrent Customer", order.CustomerInfo.Name)
+	assert.Equal(t, int64(59), order.Payment.StripeFee)
+
+	events := handlerEvents(t, h, "concurrent-order-1")
+	require.Len(t, events, 2)
+	assert.Equal(t, "payment_succeeded", events[0].EventType)
+	assert.Equal(t, "checkout_completed", events[1].EventType)
+}
+
+// TestPaymentSucceededBeforeOrderExists tests that a succeeded event arriving before its order is
+// rejected so Stripe retries it, and that the retry reconciles the order
+func TestPaymentSucceededBeforeOrderExists(t *testing.T) {
+	stub := newStripeStub(t)
+	stubChargeList(stub, testCharge("ch_early", 1000, 59))
+
+	h := newWebhookTestHandlers()
+	router := setupTestRouter(h)
+
+	paymentIntent := succeededIntent("pi_early", 1000, 1000)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, newSignedWebhookRequest(t, "payment_intent.succeeded", paymentIntent))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	// The order is saved after the first delivery; Stripe's retry then finds it
+	createPendingOrder(t, h, "early-order-1", "pi_early", 1000)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newSignedWebhookRequest(t, "payment_intent.succeeded", paymentIntent))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	order, err := h.PaymentStore.GetOrder(context.Background(), "early-order-1")
+	require.NoError(t, err)
+	assert.Equal(t, models.OrderStatusPaid, order.Status)
+	assert.Equal(t, models.PaymentStatusSucceeded, order.Payment.Status)
+	assert.Equal(t, int64(59), order.Payment.StripeFee)
+}
+
+// TestWebhookRetriesAreProcessedOnce tests that a redelivered event is acknowledged without being handled
+// again, while a deferred event is handled when Stripe retries it
+func TestWebhookRetriesAreProcessedOnce(t *testing.T) {
+	stub := newStripeStub(t)
+	stubChargeList(stub, testCharge("ch_retry", 1000, 59))
+
+	h := newWebhookTestHandlers()
+	router := setupTestRouter(h)
+
+	payload, err := webhooktest.NewEvent("payment_intent.succeeded", succeededIntent("pi_retry", 1000, 1000))
+	require.NoError(t, err)
+
+	deliver := func() int {
+		req := httptest.NewRequest("POST", "/api/payments/webhook", bytes.NewReader(payload))
+		req.Header.Set("Stripe-Signature", webhooktest.Sign(payload, testWebhookSecret))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Deferred until the order exists, then handled on the retry
+	assert.Equal(t, http.StatusInternalServerError, deliver())
+	createPendingOrder(t, h, "retry-order-1", "pi_retry", 1000)
+	require.Equal(t, http.StatusOK, deliver())
+	require.Equal(t, http.StatusOK, deliver())
+
+	events := handlerEvents(t, h, "retry-order-1")
+	require.Len(t, events, 1)
+	assert.Equal(t, "payment_succeeded", events[0].EventType)
+	assert.Len(t, stub.Requests("GET", "/v1/charges"), 1)
+}
+
+// TestReplayWebhookEvent tests that a stored event can be handled again once it's fixable, and that an
+// already processed event is only handled again when forced
+func TestReplayWebhookEvent(t *testing.T) {
+	stub := newStripeStub(t)
+	stubChargeList(stub, testCharge("ch_replay", 1000, 59))
+
+	h := newWebhookTestHandlers()
+	h.Config.WebhookEventRetention = time.Hour
+	router := setupTestRouter(h)
+
+	payload, err := webhooktest.NewEvent("payment_intent.succeeded", succeededIntent("pi_replay", 1000, 1000))
+	require.NoError(t, err)
+	var event struct {
+		ID string `json:"id"`
+	}
+	require.NoError(t, json.Unmarshal(payload, &event))
+
+	replay := func(eventID, query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/api/payments/webhook/replay/"+eventID+query, nil))
+		return w
+	}
+	payments := func() int {
+		count := 0
+		for _, e := range handlerEvents(t, h, "replay-order-1") {
+			if e.EventType == "payment_succeeded" {
+				count++
+			}
+		}
+		return count
+	}
+
+	// The event arrives before its order exists, so it isn't processed but is kept
+	req := httptest.NewRequest("POST", "/api/payments/webhook", bytes.NewReader(payload))
+	req.Header.Set("Stripe-Signature", webhooktest.Sign(payload, testWebhookSecret))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+
+	stored, err := h.PaymentStore.GetWebhookEvent(context.Background(), event.ID)
+	require.NoError(t, err)
+	require.NotNil(t, stored)
+	assert.Equal(t, "payment_intent.succeeded", stored.Type)
+	assert.JSONEq(t, string(payload), string(stored.Payload))
+
+	assert.Equal(t, http.StatusNotFound, replay("evt_missing", "").Code)
+
+	createPendingOrder(t, h, "replay-order-1", "pi_replay", 1000)
+	w = replay(event.ID, "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	order, err := h.PaymentStore.GetOrder(context.Background(), "replay-order-1")
+	require.NoError(t, err)
+	assert.Equal(t, models.OrderStatusPaid, order.Status)
+	assert.Equal(t, 1, payments())
+
+	// Now processed, the event is only handled again when forced, and handling it again is harmless
+	assert.Equal(t, http.StatusConflict, replay(event.ID, "").Code)
+	w = replay(event.ID, "?force=true")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var response map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, true, response["forced"])
+	assert.Equal(t, 1, payments())
+}
+
+// TestPaymentPartiallyFunded tests that a partially funded intent records the funded amount and leaves the order pending
+func TestPaymentPartiallyFunded(t *testing.T) {
+	h := newWebhookTestHandlers()
+	router := setupTestRouter(h)
+
+	createPendingOrder(t, h, "funded-order-1", "pi_funded", 5000)
+
+	req := newSignedWebhookRequest(t, "payment_intent.partially_funded", map[string]interface{}{
+		"id":       "pi_funded",
+		"object":   "payment_intent",
+		"amount":   5000,
+		"currency": "usd",
+		"status":   "requires_action",
+		"next_action": map[string]interface{}{
+			"type": "display_bank_transfer_instructions",
+			"display_bank_transfer_instructions": map[string]interface{}{
+				"amount_remaining": 2000,
+				"currency":         "usd",
+			},
+		},
+	})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	order, err := h.PaymentStore.GetOrder(context.Background(), "funded-order-1")
+	require.NoError(t, err)
+	assert.Equal(t, models.OrderStatusPending, order.Status)
+	assert.Equal(t, models.PaymentStatusPending, order.Payment.Status)
+
+	events, err := h.PaymentStore.GetPaymentEvents(context.Background(), "funded-order-1")
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, "payment_partially_funded", events[0].EventType)
+
+	data := events[0].Data.(map[string]interface{})
+	assert.Equal(t, int64(3000), data["amount_funded"])
+	assert.Equal(t, int64(2000), data["amount_remaining"])
+}
+
+// TestSavePaymentMethodForOffSessionCharges tests that save_payment_method sets setup_future_usage
+// and the saved payment method is recorded from the succeeded webhook
+func TestSavePaymentMethodForOffSessionCharges(t *testing.T) {
+	stub := newStripeStub(t)
+	stub.stubPaymentIntents()
+	stubChargeList(stub, testCharge("ch_saved_pm", 999, 59))
+
+	h := newWebhookTestHandlers()
+	router := setupTestRouter(h)
+
+	orderRequest := testOrderRequest("installments@example.com", 9.99)
+	orderRequest["save_payment_method"] = true
+
+	w := postCreateOrder(t, router, orderRequest)
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	intents := stub.Requests("POST", "/v1/payment_intents")
+	require.Len(t, intents, 1)
+	assert.Equal(t, "off_session", intents[0].Form.Get("setup_future_usage"))
+
+	var response handlers.CreateOrderResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+
+	paymentIntent := succeededIntent(response.Order.Payment.StripePaymentIntentID, 999, 999)
+	paymentIntent["setup_future_usage"] = "off_session"
+	paymentIntent["payment_method"] = "pm_saved_test"
+	paymentIntent["customer"] = "cus_saved_test"
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newSignedWebhookRequest(t, "payment_intent.succeeded", paymentIntent))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	order, err := h.PaymentStore.GetOrder(context.Background(), response.Order.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.OrderStatusPaid, order.Status)
+	assert.Equal(t, "pm_saved_test", order.CustomerInfo.SavedPaymentMethodID)
+	assert.Equal(t, "cus_saved_test", order.CustomerInfo.StripeCustomerID)
+}
+
+// TestCreateOrderWithoutSavePaymentMethod tests that setup_future_usage is only sent when requested
+func TestCreateOrderWithoutSavePaymentMethod(t *testing.T) {
+	stub := newStripeStub(t)
+	stub.stubPaymentIntents()
+
+	h := newWebhookTestHandlers()
+	router := setupTestRouter(h)
+
+	w := postCreateOrder(t, router, testOrderRequest("one-off@example.com", 9.99))
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	intents := stub.Requests("POST", "/v1/payment_intents")
+	require.Len(t, intents, 1)
+	assert.Empty(t, intents[0].Form.Get("setup_future_usage"))
+}
+
+// TestAutomaticPaymentMethods tests that ENABLE_AUTOMATIC_PAYMENT_METHODS turns on automatic payment methods,
+// and that a wallet payment is recorded as Apple Pay or Google Pay
+func TestAutomaticPaymentMethods(t *testing.T) {
+	stub := newStripeStub(t)
+	stub.stubPaymentIntents()
+
+	h := newWebhookTestHandlers()
+	router := setupTestRouter(h)
+
+	w := postCreateOrder(t, router, testOrderRequest("cards-only@example.com", 9.99))
+	require.Equal(t, http.StatusCreated, w.Code)
+	h.Config.AutomaticPaymentMethods = true
+	w = postCreateOrder(t, router, testOrderRequest("wallets@example.com", 9.99))
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	intents := stub.Requests("POST", "/v1/payment_intents")
+	require.Len(t, intents, 2)
+	assert.Empty(t, intents[0].Form.Get("automatic_payment_methods[enabled]"))
+	assert.Equal(t, "true", intents[1].Form.Get("automatic_payment_methods[enabled]"))
+
+	tests := []struct {
+		wallet string
+		method models.PaymentMethod
+	}{
+		{"apple_pay", models.PaymentMethodApplePay},
+		{"google_pay", models.PaymentMethodGooglePay},
+		{"", models.PaymentMethodCard},
+	}
+	for _, tt := range tests {
+		orderID := "wallet-order-" + string(tt.method)
+		createPendingOrder(t, h, orderID, "pi_"+orderID, 999)
+
+		details := map[string]interface{}{"type": "card", "card": map[string]interface{}{"last4": "4242"}}
+		if tt.wallet != "" {
+			details["card"].(map[string]interface{})["wallet"] = map[string]interface{}{"type": tt.wallet}
+		}
+		charge := testCharge("ch_"+orderID, 999, 59)
+		charge["payment_method_details"] = details
+		stubChargeList(stub, charge)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, newSignedWebhookRequest(t, "payment_intent.succeeded", succeededIntent("pi_"+orderID, 999, 999)))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		order, err := h.PaymentStore.GetOrder(context.Background(), orderID)
+		require.NoError(t, err)
+		assert.Equal(t, tt.method, order.Payment.Method)
+		events := handlerEvents(t, h, orderID)
+		require.NotEmpty(t, events)
+		assert.Equal(t, tt.method, events[0].Data.(map[string]interface{})["payment_method"])
+	}
+}
+
+// TestPaymentMethodIsStored tests that a card payment is stored with method "card", and that polling the
+// status of a paid order without a method backfills it from the intent's latest charge
+func TestPaymentMethodIsStored(t *testing.T) {
+	stub := newStripeStub(t)
+	stubChargeList(stub, testCharge("ch_method_card", 1500, 59))
+
+	h := newWebhookTestHandlers()
+	router := setupTestRouter(h)
+
+	createPendingOrder(t, h, "method-card", "pi_method_card", 1500)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, newSignedWebhookRequest(t, "payment_intent.succeeded", succeededIntent("pi_method_card", 1500, 1500)))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/payments/order/method-card", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var order struct {
+		Payment struct {
+			Method string `json:"method"`
+		} `json:"payment"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &order))
+	assert.Equal(t, "card", order.Payment.Method)
+
+	// An order marked paid before methods were recorded
+	createPendingOrder(t, h, "method-backfill", "pi_method_backfill", 1500)
+	require.NoError(t, h.PaymentStore.UpdatePaymentStatus(context.Background(), "method-backfill", models.PaymentStatusSucceeded))
+	stub.On("GET", "/v1/payment_intents/*", func(req stubRequest) (int, interface{}) {
+		return http.StatusOK, map[string]interface{}{
+			"id":     "pi_method_backfill",
+			"object": "payment_intent",
+			"status": "succeeded",
+			"latest_charge": map[string]interface{}{
+				"id":     "ch_method_backfill",
+				"object": "charge",
+				"payment_method_details": map[string]interface{}{
+					"type": "card",
+					"card": map[string]interface{}{"wallet": map[string]interface{}{"type": "google_pay"}},
+				},
+			},
+		}
+	})
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/payments/status/method-backfill", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	requests := stub.Requests("GET", "/v1/payment_intents/pi_method_backfill")
+	require.Len(t, requests, 1)
+	assert.Equal(t, "latest_charge", requests[0].Form.Get("expand[0]"))
+
+	stored, err := h.PaymentStore.GetOrder(context.Background(), "method-backfill")
+	require.NoError(t, err)
+	assert.Equal(t, models.PaymentMethodGooglePay, stored.Payment.Method)
+}
+
+// TestCheckoutSessionAsyncPayments tests that delayed checkout payments settle or fail the order
+// they belong to, resolved by session ID
+func TestCheckoutSessionAsyncPayments(t *testing.T) {
+	tests := []struct {
+		eventType     string
+		orderStatus   models.OrderStatus
+		paymentStatus models.PaymentStatus
+		eventName     string
+		subject       string
+	}{
+		{"checkout.session.async_payment_succeeded", models.OrderStatusPaid, models.PaymentStatusSucceeded, "payment_succeeded", "Subject: Payment Confirmed"},
+		{"checkout.session.async_payment_failed", models.OrderStatusPending, models.PaymentStatusFailed, "payment_failed", "Subject: Payment Failed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.eventType, func(t *testing.T) {
+			smtp := newSMTPStub(t)
+
+			h := newWebhookTestHandlers()
+			h.EmailService = newTestEmailService(smtp)
+			router := setupTestRouter(h)
+
+			// The order only knows its session; the intent is created when the customer pays
+			createPendingOrder(t, h, "async-order-1", "", 2500)
+			order, err := h.PaymentStore.GetOrder(context.Background(), "async-order-1")
+			require.NoError(t, err)
+			order.Payment.StripeSessionID = "cs_async"
+			require.NoError(t, h.PaymentStore.UpdateOrder(context.Background(), order))
+
+			session := checkoutCompletedSession("cs_async", "pi_async", "async-order-1@example.com")
+			session["payment_status"] = "paid"
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, newSignedWebhookRequest(t, tt.eventType, session))
+			require.Equal(t, http.StatusOK, w.Code)
+
+			order, err = h.PaymentStore.GetOrder(context.Background(), "async-order-1")
+			require.NoError(t, err)
+			assert.Equal(t, tt.orderStatus, order.Status)
+			assert.Equal(t, tt.paymentStatus, order.Payment.Status)
+
+			events := handlerEvents(t, h, "async-order-1")
+			require.Len(t, events, 1)
+			assert.Equal(t, tt.eventName, events[0].EventType)
+			data := events[0].Data.(map[string]interface{})
+			assert.Equal(t, "cs_async", data["session_id"])
+
+			messages := smtp.Messages()
+			require.Len(t, messages, 1)
+			assert.Contains(t, messages[0], tt.subject)
+			assert.Contains(t, messages[0], "TRKasync-order-1")
+		})
+	}
+}
+
+// TestPaymentSucceededFulfillsDigitalOrder tests that a paid order of downloads is fulfilled automatically
+// and the customer gets both the payment confirmation and signed download links
+func TestPaymentSucceededFulfillsDigitalOrder(t *testing.T) {
+	stub := newStripeStub(t)
+	stubChargeList(stub, testCharge("ch_digital", 999, 59))
+	smtp := newSMTPStub(t)
+
+	h := newWebhookTestHandlers()
+	h.EmailService = newTestEmailService(smtp)
+	h.EmailService.DownloadSecret = "download-secret"
+	h.EmailService.DownloadBaseURL = "https://api.example.com/"
+	router := setupTestRouter(h)
+
+	createPendingOrder(t, h, "digital-order-1", "pi_digital", 999)
+	order, err := h.PaymentStore.GetOrder(context.Background(), "digital-order-1")
+	require.NoError(t, err)
+	order.Items = []models.OrderItem{
+		{ProductID: "guide", ProductName: "Writing Guide", FileType: "PDF", Price: 9.99, Quantity: 1, DownloadURL: "https://files.example.com/guide.pdf"},
+	}
+	require.NoError(t, h.PaymentStore.UpdateOrder(context.Background(), order))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, newSignedWebhookRequest(t, "payment_intent.succeeded", succeededIntent("pi_digital", 999, 999)))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	order, err = h.PaymentStore.GetOrder(context.Background(), "digital-order-1")
+	require.NoError(t, err)
+	assert.Equal(t, models.OrderStatusFulfilled, order.Status)
+
+	events := handlerEvents(t, h, "digital-order-1")
+	require.Len(t, events, 2)
+	assert.Equal(t, "payment_succeeded", events[0].EventType)
+	assert.Equal(t, "order_fulfilled", events[1].EventType)
+
+	// Shutdown waits for the fulfillment email sent in the background
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, h.Shutdown(ctx))
+	messages := smtp.Messages()
+	require.Len(t, messages, 2)
+	assert.Contains(t, messages[0], "Subject: Payment Confirmed")
+	assert.Contains(t, messages[1], "Subject: Your Order is Ready for Download")
+	token := emailedDownloadToken(t, emailPart(t, messages[1], "text/html"), "https://api.example.com/api/payments/download/digital-order-1/guide")
+	assert.NoError(t, services.VerifyDownloadToken("download-secret", "digital-order-1", "guide", token))
+	assert.NotContains(t, emailPart(t, messages[1], "text/html"), "files.example.com")
+}
+
+// TestPaymentSucceededLeavesPhysicalOrderPaid tests that orders without downloads wait for manual fulfillment
+func TestPaymentSucceededLeavesPhysicalOrderPaid(t *testing.T) {
+	stub := newStripeStub(t)
+	stubChargeList(stub, testCharge("ch_physical", 999, 59))
+	smtp := newSMTPStub(t)
+
+	h := newWebhookTestHandlers()
+	h.EmailService = newTestEmailService(smtp)
+	router := setupTestRouter(h)
+
+	createPendingOrder(t, h, "physical-order-1", "pi_physical", 999)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, newSignedWebhookRequest(t, "payment_intent.succeeded", succeededIntent("pi_physical", 999, 999)))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	order, err := h.PaymentStore.GetOrder(context.Background(), "physical-order-1")
+	require.NoError(t, err)
+	assert.Equal(t, models.OrderStatusPaid, order.Status)
+	assert.Len(t, smtp.Messages(), 1)
+}
+
+// refundedCharge builds a charge.refunded payload for a payment intent's charge
+func refundedCharge(id, paymentIntentID string, amount, refunded int64, refundID string) map[string]interface{} {
+	return map[string]interface{}{
+		"id":              id,
+		"object":          "charge",
+		"amount":          amount,
+		"amount_refunded": refunded,
+		"payment_intent":  paymentIntentID,
+		"refunded":        refunded >= amount,
+		"refunds": map[string]interface{}{
+			"object": "list",
+			"data": []interface{}{
+				map[string]interface{}{"id": refundID, "object": "refund", "amount": refunded},
+			},
+		},
+	}
+}
+
+// TestChargeRefundedSyncsDashboardRefunds tests that refunds made outside the API update the order
+func TestChargeRefundedSyncsDashboardRefunds(t *testing.T) {
+	h := newWebhookTestHandlers()
+	router := setupTestRouter(h)
+
+	createPendingOrder(t, h, "dash-refund-1", "pi_dash_refund", 2000)
+	require.NoError(t, h.PaymentStore.UpdatePaymentStatus(context.Background(), "dash-refund-1", models.PaymentStatusSucceeded))
+	require.NoError(t, h.PaymentStore.UpdateOrderStatus(context.Background(), "dash-refund-1", models.OrderStatusPaid))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, newSignedWebhookRequest(t, "charge.refunded", refundedCharge("ch_dash", "pi_dash_refund", 2000, 500, "re_dash_1")))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	order, err := h.PaymentStore.GetOrder(context.Background(), "dash-refund-1")
+	require.NoError(t, err)
+	assert.Equal(t, models.OrderStatusPaid, order.Status)
+	assert.Equal(t, models.PaymentStatusPartiallyRefunded, order.Payment.Status)
+	assert.Equal(t, int64(500), order.Payment.AmountRefunded)
+	assert.Equal(t, "re_dash_1", order.Payment.StripeRefundID)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newSignedWebhookRequest(t, "charge.refunded", refundedCharge("ch_dash", "pi_dash_refund", 2000, 2000, "re_dash_2")))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	order, err = h.PaymentStore.GetOrder(context.Background(), "dash-refund-1")
+	require.NoError(t, err)
+	assert.Equal(t, models.OrderStatusRefunded, order.Status)
+	assert.Equal(t, models.PaymentStatusRefunded, order.Payment.Status)
+	assert.Equal(t, int64(2000), order.Payment.AmountRefunded)
+
+	events := handlerEvents(t, h, "dash-refund-1")
+	require.Len(t, events, 2)
+	assert.Equal(t, "order_partially_refunded", events[0].EventType)
+	assert.EqualValues(t, 500, events[0].Data.(map[string]interface{})["amount"])
+	assert.Equal(t, "order_refunded", events[1].EventType)
+	assert.EqualValues(t, 1500, events[1].Data.(map[string]interface{})["amount"])
+}
+
+// TestChargeRefundedSkipsRecordedRefunds tests that the webhook for an API refund adds nothing
+func TestChargeRefundedSkipsRecordedRefunds(t *testing.T) {
+	h := newWebhookTestHandlers()
+	router := setupTestRouter(h)
+
+	createPendingOrder(t, h, "api-refund-1", "pi_api_refund", 1500)
+	require.NoError(t, h.PaymentStore.UpdatePaymentStatus(context.Background(), "api-refund-1", models.PaymentStatusSucceeded))
+	require.NoError(t, h.PaymentStore.UpdatePaymentRefund(context.Background(), "api-refund-1", "re_api", 1500))
+	require.NoError(t, h.PaymentStore.UpdatePaymentStatus(context.Background(), "api-refund-1", models.PaymentStatusRefunded))
+	require.NoError(t, h.PaymentStore.UpdateOrderStatus(context.Background(), "api-refund-1", models.OrderStatusRefunded))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, newSignedWebhookRequest(t, "charge.refunded", refundedCharge("ch_api", "pi_api_refund", 1500, 1500, "re_api")))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	events := handlerEvents(t, h, "api-refund-1")
+	assert.Empty(t, events)
+}
+
+// TestChargeDisputeClosed tests that lost disputes refund the order and won disputes leave it paid
+func TestChargeDisputeClosed(t *testing.T) {
+	h := newWebhookTestHandlers()
+	router := setupTestRouter(h)
+
+	for _, outcome := range []struct {
+		status      string
+		orderStatus models.OrderStatus
+		eventType   string
+	}{
+		{"lost", models.OrderStatusRefunded, "dispute_lost"},
+		{"won", models.OrderStatusPaid, "dispute_won"},
+	} {
+		orderID := "dispute-" + outcome.status
+		createPendingOrder(t, h, orderID, "pi_"+orderID, 1200)
+		require.NoError(t, h.PaymentStore.UpdatePaymentStatus(context.Background(), orderID, models.PaymentStatusSucceeded))
+		require.NoError(t, h.PaymentStore.UpdateOrderStatus(context.Background(), orderID, models.OrderStatusPaid))
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, newSignedWebhookRequest(t, "charge.dispute.closed", map[string]interface{}{
+			"id":             "dp_" + outcome.status,
+			"object":         "dispute",
+			"amount":         1200,
+			"charge":         "ch_" + orderID,
+			"payment_intent": "pi_" + orderID,
+			"reason":         "fraudulent",
+			"status":         outcome.status,
+		}))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		order, err := h.PaymentStore.GetOrder(context.Background(), orderID)
+		require.NoError(t, err)
+		assert.Equal(t, outcome.orderStatus, order.Status, outcome.status)
+
+		events := handlerEvents(t, h, orderID)
+		require.Len(t, events, 1, outcome.status)
+		assert.Equal(t, outcome.eventType, events[0].EventType)
+		assert.Equal(t, "dp_"+outcome.status, events[0].Data.(map[string]interface{})["dispute_id"])
+		assert.Equal(t, "ch_"+orderID, events[0].Data.(map[string]interface{})["charge_id"])
+	}
+}
+
+// TestChargeDisputeCreated tests that a new dispute is recorded, flags its order, and emails the admin,
+// and that it leaves the open disputes list once it closes
+func TestChargeDisputeCreated(t *testing.T) {
+	smtp := newSMTPStub(t)
+	h := newWebhookTestHandlers()
+	h.Config.AdminEmail = "admin@example.com"
+	h.EmailService = newTestEmailService(smtp)
+	router := setupTestRouter(h)
+
+	createPendingOrder(t, h, "dispute-new", "pi_dispute_new", 1800)
+	require.NoError(t, h.PaymentStore.UpdatePaymentStatus(context.Background(), "dispute-new", models.PaymentStatusSucceeded))
+	require.NoError(t, h.PaymentStore.UpdateOrderStatus(context.Background(), "dispute-new", models.OrderStatusPaid))
+
+	dispute := func(id, paymentIntentID, status string) map[string]interface{} {
+		return map[string]interface{}{
+			"id":             id,
+			"object":         "dispute",
+			"amount":         1800,
+			"currency":       "usd",
+			"charge":         "ch_" + id,
+			"payment_intent": paymentIntentID,
+			"reason":         "product_not_received",
+			"status":         status,
+		}
+	}
+	// A zero-decimal currency must not be shown in hundredths in the admin email
+	unmatched := dispute("dp_unmatched", "pi_unknown", "warning_needs_response")
+	unmatched["currency"] = "jpy"
+	for _, object := range []map[string]interface{}{dispute("dp_new", "pi_dispute_new", "needs_response"), unmatched} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, newSignedWebhookRequest(t, "charge.dispute.created", object))
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	order, err := h.PaymentStore.GetOrder(context.Background(), "dispute-new")
+	require.NoError(t, err)
+	assert.True(t, order.Disputed)
+	assert.Equal(t, models.OrderStatusPaid, order.Status)
+
+	events := handlerEvents(t, h, "dispute-new")
+	require.Len(t, events, 1)
+	assert.Equal(t, "dispute_created", events[0].EventType)
+	assert.Equal(t, "dp_new", events[0].Data.(map[string]interface{})["dispute_id"])
+
+	summaries, err := h.PaymentStore.GetAllOrders(context.Background(), 10, 0, models.OrderFilter{})
+	require.NoError(t, err)
+	require.Len(t, summaries, 1)
+	assert.True(t, summaries[0].Disputed)
+
+	listDisputes := func(query string) []models.Dispute {
+		t.Helper()
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/api/payments/disputes"+query, nil))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var response struct {
+			Disputes []models.Dispute `json:"disputes"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return response.Disputes
+	}
+
+	disputes := listDisputes("")
+	require.Len(t, disputes, 2)
+	byID := map[string]models.Dispute{}
+	for _, d := range disputes {
+		byID[d.ID] = d
+	}
+	assert.Equal(t, "dispute-new", byID["dp_new"].OrderID)
+	assert.Equal(t, "ch_dp_new", byID["dp_new"].ChargeID)
+	assert.Equal(t, "product_not_received", byID["dp_new"].Reason)
+	assert.Equal(t, int64(1800), byID["dp_new"].Amount)
+	assert.Empty(t, byID["dp_unmatched"].OrderID)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, newSignedWebhookRequest(t, "charge.dispute.closed", dispute("dp_new", "pi_dispute_new", "won")))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	disputes = listDisputes("")
+	require.Len(t, disputes, 1)
+	assert.Equal(t, "dp_unmatched", disputes[0].ID)
+	assert.Len(t, listDisputes("?include_closed=true"), 2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, h.Shutdown(ctx))
+
+	messages := smtp.Messages()
+	require.Len(t, messages, 2)
+	emails := map[string]string{}
+	for _, raw := range messages {
+		assert.Contains(t, raw, "To: admin@example.com")
+		assert.Contains(t, raw, "Subject: Dispute Opened")
+		html := emailPart(t, raw, "text/html")
+		if strings.Contains(raw, "dp_new") {
+			assert.Contains(t, html, "18.00 USD")
+			emails["matched"] = html
+		} else {
+			assert.Contains(t, html, "1800 JPY")
+			emails["unmatched"] = html
+		}
+	}
+	require.Len(t, emails, 2)
+	assert.Contains(t, emails["matched"], order.TrackingID)
+	assert.Contains(t, emails["unmatched"], "No order matched this payment")
+}
+
+// TestSubscriptionLifecycle tests that subscription webhooks and paid subscription invoices keep
+// a customer's subscriptions up to date, whatever order they arrive in
+func TestSubscriptionLifecycle(t *testing.T) {
+	fake := handlers.NewFakeGateway()
+	h := newWebhookTestHandlers()
+	h.Gateway = fake
+	router := setupTestRouter(h)
+
+	customer, err := fake.CreateCustomer(context.Background(), &stripe.CustomerParams{Email: stripe.String("member@Example.com")})
+	require.NoError(t, err)
+	periodEnd := time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)
+
+	deliver := func(eventType string, object map[string]interface{}) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, newSignedWebhookRequest(t, eventType, object))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	}
+	// deliverCreatedAt delivers an event Stripe created at a given time
+	deliverCreatedAt := func(eventType string, object map[string]interface{}, created time.Time) {
+		t.Helper()
+		payload, err := webhooktest.NewEvent(eventType, object)
+		require.NoError(t, err)
+		var event map[string]interface{}
+		require.NoError(t, json.Unmarshal(payload, &event))
+		event["created"] = created.Unix()
+		payload, err = json.Marshal(event)
+		require.NoError(t, err)
+
+		req := httptest.NewRequest("POST", "/api/payments/webhook", bytes.NewReader(payload))
+		req.Header.Set("Stripe-Signature", webhooktest.Sign(payload, testWebhookSecret))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	}
+	subscriptionObject := func(id, status string) map[string]interface{} {
+		return map[string]interface{}{
+			"id":       id,
+			"object":   "subscription",
+			"customer": customer.ID,
+			"status":   status,
+			"created":  periodEnd.AddDate(0, -1, 0).Unix(),
+			"items": map[string]interface{}{
+				"object": "list",
+				"data":   []map[string]interface{}{{"id": "si_" + id, "object": "subscription_item", "current_period_end": periodEnd.Unix()}},
+			},
+		}
+	}
+	type subscriptionsResponse struct {
+		Subscriptions []models.Subscription `json:"subscriptions"`
+		HasAccess     bool                  `json:"has_access"`
+	}
+	subscriptionsOf := func(email string) subscriptionsResponse {
+		t.Helper()
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/api/subscriptions/"+email, nil))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var response subscriptionsResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return response
+	}
+
+	// The first invoice is paid before Stripe reports the subscription itself
+	deliver("invoice.payment_succeeded", map[string]interface{}{
+		"id":             "in_member_1",
+		"object":         "invoice",
+		"customer":       customer.ID,
+		"customer_email": "member@example.com",
+		"amount_paid":    900,
+		"currency":       "usd",
+		"parent": map[string]interface{}{
+			"type":                 "subscription_details",
+			"subscription_details": map[string]interface{}{"subscription": "sub_member"},
+		},
+		"lines": map[string]interface{}{
+			"object": "list",
+			"data": []map[string]interface{}{{
+				"id":     "il_member_1",
+				"object": "line_item",
+				"period": map[string]interface{}{"start": periodEnd.AddDate(0, -1, 0).Unix(), "end": periodEnd.Unix()},
+			}},
+		},
+	})
+	response := subscriptionsOf("member@example.com")
+	require.Len(t, response.Subscriptions, 1)
+	assert.True(t, response.HasAccess)
+	assert.Equal(t, models.SubscriptionStatusActive, response.Subscriptions[0].Status)
+	require.NotNil(t, response.Subscriptions[0].CurrentPeriodEnd)
+	assert.True(t, response.Subscriptions[0].CurrentPeriodEnd.Equal(periodEnd))
+
+	deliver("customer.subscription.created", subscriptionObject("sub_member", "active"))
+	deliver("customer.subscription.updated", subscriptionObject("sub_member", "past_due"))
+	response = subscriptionsOf("member@example.com")
+	require.Len(t, response.Subscriptions, 1)
+	assert.False(t, response.HasAccess)
+	assert.Equal(t, models.SubscriptionStatusPastDue, response.Subscriptions[0].Status)
+	assert.Equal(t, customer.ID, response.Subscriptions[0].StripeCustomerID)
+
+	// An update Stripe created before the last one applied arrives late and is ignored
+	deliverCreatedAt("customer.subscription.updated", subscriptionObject("sub_member", "active"), time.Now().Add(-time.Hour))
+	response = subscriptionsOf("member@example.com")
+	assert.Equal(t, models.SubscriptionStatusPastDue, response.Subscriptions[0].Status)
+
+	canceled := subscriptionObject("sub_member", "canceled")
+	canceled["canceled_at"] = periodEnd.Unix()
+	deliver("customer.subscription.deleted", canceled)
+	deliver("customer.subscription.updated", subscriptionObject("sub_member", "active"))
+	response = subscriptionsOf("member@example.com")
+	require.Len(t, response.Subscriptions, 1)
+	assert.False(t, response.HasAccess)
+	assert.Equal(t, models.SubscriptionStatusCanceled, response.Subscriptions[0].Status)
+	require.NotNil(t, response.Subscriptions[0].CanceledAt)
+
+	events, err := h.PaymentStore.GetSubscriptionEvents(context.Background(), "sub_member")
+	require.NoError(t, err)
+	var eventTypes []string
+	for _, event := range events {
+		eventTypes = append(eventTypes, event.EventType)
+	}
+	assert.Equal(t, []string{"subscription_payment_succeeded", "subscription_created", "subscription_updated", "subscription_canceled"}, eventTypes)
+
+	// Without an email on the event, it comes from the Stripe customer
+	deliver("customer.subscription.created", subscriptionObject("sub_lookup", "trialing"))
+	response = subscriptionsOf("member@EXAMPLE.com")
+	require.Len(t, response.Subscriptions, 2)
+	assert.True(t, response.HasAccess)
+	assert.Equal(t, "sub_member", response.Subscriptions[0].StripeSubscriptionID)
+
+	// One-off invoices aren't subscriptions
+	deliver("invoice.payment_succeeded", map[string]interface{}{"id": "in_one_off", "object": "invoice", "customer_email": "oneoff@example.com"})
+	assert.Empty(t, subscriptionsOf("oneoff@example.com").Subscriptions)
+}